@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACCESS_LOG writes one line per request in the Apache common or combined
+// format, to stdout or to a rotated file, separately from the
+// application log.
+
+type accessLog struct {
+	combined bool
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func loadAccessLog() (*accessLog, error) {
+	target := getEnv("ACCESS_LOG", "")
+	if target == "" {
+		return nil, nil
+	}
+	l := &accessLog{}
+	switch format := getEnv("ACCESS_LOG_FORMAT", "combined"); format {
+	case "combined":
+		l.combined = true
+	case "common":
+	default:
+		return nil, fmt.Errorf("ACCESS_LOG_FORMAT must be common or combined, not %q", format)
+	}
+	if target == "stdout" {
+		l.out = os.Stdout
+		return l, nil
+	}
+	rot, err := loadRotation("ACCESS_LOG")
+	if err != nil {
+		return nil, err
+	}
+	l.out, err = openRotatingFile(target, rot)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// accessUserKey holds the name of the authenticated user, filled in by
+// authMiddleware further down the chain.
+type accessUserKey struct{}
+
+func setAccessLogUser(r *http.Request, name string) {
+	if user, ok := r.Context().Value(accessUserKey{}).(*string); ok {
+		*user = name
+	}
+}
+
+func logField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// quoteField escapes a value for a double-quoted log field.
+func quoteField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(value)
+}
+
+func (app *App) accessLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var user string
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessUserKey{}, &user)))
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		size := "-"
+		if rec.size > 0 {
+			size = strconv.FormatInt(rec.size, 10)
+		}
+		line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+			app.clientIP(r), logField(user), start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method, quoteField(r.RequestURI), r.Proto, status, size)
+		if app.accessLog.combined {
+			line += fmt.Sprintf(" \"%s\" \"%s\"", quoteField(r.Referer()), quoteField(r.UserAgent()))
+		}
+
+		app.accessLog.mu.Lock()
+		defer app.accessLog.mu.Unlock()
+		if _, err := io.WriteString(app.accessLog.out, line+"\n"); err != nil {
+			errorf("Failed to write access log: %v", err)
+		}
+	})
+}
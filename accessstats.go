@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Access statistics are kept next to the data they describe, one entry per
+// key under the system prefix, so they survive restarts without an extra store.
+const accessStatsNamespace = "stats:"
+
+type KeyAccessStats struct {
+	Key        string    `json:"key"`
+	Reads      int64     `json:"reads"`
+	Writes     int64     `json:"writes"`
+	LastRead   time.Time `json:"last_read"`
+	LastWrite  time.Time `json:"last_write"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+// Sampled accesses are counted in memory and written out every
+// accessStatsFlushInterval, so reads do not pay for a write transaction.
+// Counts not yet written are lost if the process is killed.
+const (
+	accessStatsFlushInterval = 10 * time.Second
+	// accessStatsFlushBatch keys are written per transaction.
+	accessStatsFlushBatch = 1000
+)
+
+type accessCounter struct {
+	reads, writes       int64
+	lastRead, lastWrite time.Time
+}
+
+type pendingAccesses struct {
+	mu   sync.Mutex
+	keys map[string]*accessCounter
+}
+
+// recordAccess bumps the read or write counter for key. Only a sample of
+// accesses is recorded when ACCESS_STATS_SAMPLE_RATE is below 1, so counters
+// are relative rather than exact.
+func (app *App) recordAccess(key string, write bool) {
+	if app.accessStatsRate <= 0 || rand.Float64() >= app.accessStatsRate {
+		return
+	}
+
+	now := time.Now()
+	pending := &app.pendingAccesses
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	if pending.keys == nil {
+		pending.keys = make(map[string]*accessCounter)
+	}
+	c := pending.keys[key]
+	if c == nil {
+		c = &accessCounter{}
+		pending.keys[key] = c
+	}
+	if write {
+		c.writes++
+		c.lastWrite = now
+	} else {
+		c.reads++
+		c.lastRead = now
+	}
+}
+
+func (app *App) runAccessStatsFlusher() {
+	ticker := time.NewTicker(accessStatsFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		app.flushAccessStats()
+	}
+}
+
+// flushAccessStats adds the counts recorded since the last flush to the
+// stored statistics.
+func (app *App) flushAccessStats() {
+	pending := &app.pendingAccesses
+	pending.mu.Lock()
+	counters := pending.keys
+	pending.keys = nil
+	pending.mu.Unlock()
+
+	keys := make([]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	for start := 0; start < len(keys); start += accessStatsFlushBatch {
+		batch := keys[start:min(start+accessStatsFlushBatch, len(keys))]
+		err := app.update(func(txn *badger.Txn) error {
+			for _, key := range batch {
+				if err := app.addAccessStats(txn, key, counters[key]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			errorf("Failed to record access stats: %v", err)
+			return
+		}
+	}
+}
+
+func (app *App) addAccessStats(txn *badger.Txn, key string, c *accessCounter) error {
+	statsKey := app.systemKey(accessStatsNamespace + key)
+	stats := KeyAccessStats{Key: key}
+	item, err := txn.Get(statsKey)
+	if err == nil {
+		err = item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &stats)
+		})
+	}
+	if err != nil && err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	stats.Reads += c.reads
+	stats.Writes += c.writes
+	if c.reads > 0 {
+		stats.LastRead = c.lastRead
+	}
+	if c.writes > 0 {
+		stats.LastWrite = c.lastWrite
+	}
+	stats.LastAccess = stats.LastRead
+	if stats.LastWrite.After(stats.LastAccess) {
+		stats.LastAccess = stats.LastWrite
+	}
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	return txn.Set(statsKey, data)
+}
+
+// forgetAccess drops the statistics of a deleted key.
+func (app *App) forgetAccess(key string) {
+	if app.accessStatsRate <= 0 {
+		return
+	}
+	app.pendingAccesses.mu.Lock()
+	delete(app.pendingAccesses.keys, key)
+	app.pendingAccesses.mu.Unlock()
+	err := app.update(func(txn *badger.Txn) error {
+		return txn.Delete(app.systemKey(accessStatsNamespace + key))
+	})
+	if err != nil {
+		errorf("Failed to delete access stats for %q: %v", key, err)
+	}
+}
+
+// loadAccessStats returns the statistics of every key, with keys that were
+// never sampled reported with zero counters. Pending counts are flushed first.
+func (app *App) loadAccessStats() ([]KeyAccessStats, error) {
+	app.flushAccessStats()
+	recorded := make(map[string]KeyAccessStats)
+	all := make([]KeyAccessStats, 0)
+
+	err := app.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = app.systemKey(accessStatsNamespace)
+		it := txn.NewIterator(opts)
+		for it.Rewind(); it.Valid(); it.Next() {
+			var stats KeyAccessStats
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &stats)
+			})
+			if err != nil {
+				it.Close()
+				return err
+			}
+			recorded[stats.Key] = stats
+		}
+		it.Close()
+
+		opts = badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it = txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			if app.isSystemKey(key) {
+				continue
+			}
+			stats, ok := recorded[string(key)]
+			if !ok {
+				stats = KeyAccessStats{Key: string(key)}
+			}
+			all = append(all, stats)
+		}
+		return nil
+	})
+	return all, err
+}
+
+// accessReportHandler serves the hot-key (most accessed) and cold-key (least
+// recently accessed) reports.
+func (app *App) accessReportHandler(w http.ResponseWriter, r *http.Request) {
+	if app.accessStatsRate <= 0 {
+		http.Error(w, "Access statistics are disabled (set ACCESS_STATS=true)", http.StatusNotFound)
+		return
+	}
+
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
+			limit = parsed
+		}
+	}
+
+	all, err := app.loadAccessStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.URL.Query().Get("order") {
+	case "", "hot":
+		sort.SliceStable(all, func(i, j int) bool {
+			return all[i].Reads+all[i].Writes > all[j].Reads+all[j].Writes
+		})
+	case "cold":
+		sort.SliceStable(all, func(i, j int) bool {
+			return all[i].LastAccess.Before(all[j].LastAccess)
+		})
+	default:
+		http.Error(w, "Parameter 'order' must be 'hot' or 'cold'", http.StatusBadRequest)
+		return
+	}
+
+	if len(all) > limit {
+		all = all[:limit]
+	}
+	writeJSON(w, all)
+}
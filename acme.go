@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// loadAutocert configures automatic certificates from Let's Encrypt (or
+// another ACME directory) for ACME_DOMAINS. Certificates are cached under
+// the data directory so restarts don't hit the CA's rate limits.
+func loadAutocert(dbPath string) *autocert.Manager {
+	domains := parseList(getEnv("ACME_DOMAINS", ""))
+	if len(domains) == 0 {
+		return nil
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(getEnv("ACME_CACHE_DIR", filepath.Join(dbPath, "acme"))),
+		Email:      getEnv("ACME_EMAIL", ""),
+	}
+	if url := getEnv("ACME_DIRECTORY_URL", ""); url != "" {
+		m.Client = &acme.Client{DirectoryURL: url}
+	}
+	return m
+}
+
+// serveTLS serves the UI over HTTPS with ACME certificates. The plain HTTP
+// listener answers HTTP-01 challenges and redirects everything else to HTTPS.
+func serveTLS(handler http.Handler, m *autocert.Manager) error {
+	httpAddr := getEnv("ACME_HTTP_ADDR", ":80")
+	httpsAddr := getEnv("ACME_HTTPS_ADDR", ":443")
+
+	go func() {
+		log.Fatal(http.ListenAndServe(httpAddr, m.HTTPHandler(nil)))
+	}()
+
+	tlsConfig := m.TLSConfig()
+	tlsConfig.MinVersion = tls.VersionTLS12
+	server := &http.Server{
+		Addr:      httpsAddr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	if err := configureHTTP2(server); err != nil {
+		return err
+	}
+	go shutdownOnSignal(server)
+	fmt.Printf("Server starting on https://%s (HTTP on %s)\n", httpsAddr, httpAddr)
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// GET /api/admin/activity summarizes what happened recently for an operations
+// dashboard: writes and deletes per prefix, the last deletions, the sessions
+// and tokens that can access the server, running jobs, and when the last
+// backup and value log GC ran. Recent writes come from the event bus, which
+// keeps the last events in memory, so they start over after a restart.
+
+// activityEvents is the number of recent events kept.
+const activityEvents = 1000
+
+// activityLog is a ring of the most recent key events.
+type activityLog struct {
+	mu     sync.Mutex
+	events []Event
+	next   int
+}
+
+func newActivityLog() *activityLog {
+	return &activityLog{events: make([]Event, 0, activityEvents)}
+}
+
+func (l *activityLog) record(evt Event) {
+	if evt.Type != EventSet && evt.Type != EventDelete && evt.Type != EventExpired {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) < activityEvents {
+		l.events = append(l.events, evt)
+		return
+	}
+	l.events[l.next] = evt
+	l.next = (l.next + 1) % activityEvents
+}
+
+// since returns the events recorded after t, newest first.
+func (l *activityLog) since(t time.Time) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := make([]Event, 0, len(l.events))
+	for i := len(l.events) - 1; i >= 0; i-- {
+		evt := l.events[(l.next+i)%len(l.events)]
+		if !evt.Time.After(t) {
+			break
+		}
+		events = append(events, evt)
+	}
+	return events
+}
+
+type PrefixActivity struct {
+	Prefix string `json:"prefix"`
+	// Store names the STORES entry, empty for the live database.
+	Store     string    `json:"store,omitempty"`
+	Writes    int       `json:"writes"`
+	Deletes   int       `json:"deletes"`
+	LastEvent time.Time `json:"last_event"`
+}
+
+type SessionActivity struct {
+	User    string    `json:"user"`
+	Role    string    `json:"role"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+type TokenActivity struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type Activity struct {
+	Since    time.Time        `json:"since"`
+	Prefixes []PrefixActivity `json:"prefixes"`
+	// Deletions are the last deletions and expiries, newest first.
+	Deletions  []Event           `json:"deletions"`
+	Sessions   []SessionActivity `json:"sessions"`
+	Tokens     []TokenActivity   `json:"tokens"`
+	Jobs       []*Job            `json:"jobs"`
+	LastBackup *time.Time        `json:"last_backup"`
+	LastGC     *time.Time        `json:"last_gc"`
+}
+
+// maxActivityDeletions caps the deletions reported.
+const maxActivityDeletions = 20
+
+// activityPrefix groups key by its first segment, as the web UI does.
+func activityPrefix(key string) string {
+	if i := strings.IndexAny(key, prefixSeparators); i >= 0 {
+		return key[:i+1]
+	}
+	return ""
+}
+
+func (app *App) activityHandler(w http.ResponseWriter, r *http.Request) {
+	window := time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		var err error
+		if window, err = time.ParseDuration(v); err != nil || window <= 0 {
+			http.Error(w, "Invalid 'window', expected a duration such as 1h", http.StatusBadRequest)
+			return
+		}
+	}
+
+	a := Activity{
+		Since:     time.Now().Add(-window).UTC(),
+		Prefixes:  make([]PrefixActivity, 0),
+		Deletions: make([]Event, 0),
+		Sessions:  make([]SessionActivity, 0),
+		Tokens:    make([]TokenActivity, 0),
+		Jobs:      make([]*Job, 0),
+	}
+
+	groups := make(map[[2]string]*PrefixActivity)
+	for _, evt := range app.events.activity.since(a.Since) {
+		g := groups[[2]string{evt.Store, activityPrefix(evt.Key)}]
+		if g == nil {
+			g = &PrefixActivity{Prefix: activityPrefix(evt.Key), Store: evt.Store, LastEvent: evt.Time}
+			groups[[2]string{g.Store, g.Prefix}] = g
+		}
+		if evt.Type == EventSet {
+			g.Writes++
+			continue
+		}
+		g.Deletes++
+		if len(a.Deletions) < maxActivityDeletions {
+			a.Deletions = append(a.Deletions, evt)
+		}
+	}
+	for _, g := range groups {
+		a.Prefixes = append(a.Prefixes, *g)
+	}
+	sort.Slice(a.Prefixes, func(i, j int) bool {
+		pi, pj := a.Prefixes[i], a.Prefixes[j]
+		if pi.Writes+pi.Deletes != pj.Writes+pj.Deletes {
+			return pi.Writes+pi.Deletes > pj.Writes+pj.Deletes
+		}
+		return pi.Store+pi.Prefix < pj.Store+pj.Prefix
+	})
+	if len(a.Prefixes) > maxSamplePrefixes {
+		a.Prefixes = a.Prefixes[:maxSamplePrefixes]
+	}
+
+	now := time.Now()
+	app.sessions.mu.Lock()
+	for _, sess := range app.sessions.sessions {
+		if now.Before(sess.Expires) {
+			a.Sessions = append(a.Sessions, SessionActivity{User: sess.User, Role: sess.Role, Created: sess.Created, Expires: sess.Expires})
+		}
+	}
+	app.sessions.mu.Unlock()
+	sort.Slice(a.Sessions, func(i, j int) bool { return a.Sessions[i].Created.After(a.Sessions[j].Created) })
+
+	app.credentials.mu.RLock()
+	for _, cred := range app.credentials.tokens {
+		a.Tokens = append(a.Tokens, TokenActivity{Name: cred.secret, Role: cred.role})
+	}
+	app.credentials.mu.RUnlock()
+	sort.Slice(a.Tokens, func(i, j int) bool { return a.Tokens[i].Name < a.Tokens[j].Name })
+
+	if err := app.loadJobActivity(&a); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if app.backups != nil {
+		backups, err := app.scheduledBackups()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(backups) > 0 {
+			a.LastBackup = &backups[len(backups)-1].CreatedAt
+		}
+	}
+	writeJSON(w, a)
+}
+
+// loadJobActivity finds the running jobs and the last value log GC, which
+// runs as part of discarding old versions.
+func (app *App) loadJobActivity(a *Activity) error {
+	app.jobs.mu.Lock()
+	running := len(app.jobs.running)
+	app.jobs.mu.Unlock()
+
+	return app.view(func(txn *badger.Txn) error {
+		prefix := app.systemKey(jobsNamespace)
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(append(prefix, 0xff)); it.Valid(); it.Next() {
+			if a.LastGC != nil && len(a.Jobs) == running {
+				break
+			}
+			var job Job
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &job)
+			})
+			if err != nil {
+				return err
+			}
+			if job.Status == JobRunning && len(a.Jobs) < running {
+				job.Result = nil
+				app.withProgress(&job)
+				a.Jobs = append(a.Jobs, &job)
+			}
+			if job.Type == jobDiscardVersions && job.Status == JobSucceeded && a.LastGC == nil {
+				a.LastGC = job.FinishedAt
+			}
+		}
+		return nil
+	})
+}
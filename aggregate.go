@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/pb"
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+// Aggregations compute counts, sums, averages, minimums and maximums over
+// the JSON values under a prefix, grouped by a field, for lightweight
+// analytics without exporting the data to another system:
+//
+//	GET /api/aggregate?prefix=order:&group_by=$.status&agg=count,sum:$.total
+//
+// The prefix is read with Badger's Stream framework, which splits it into
+// key ranges scanned by several goroutines; each goroutine aggregates the
+// keys it reads on its own and the totals are merged at the end.
+
+// aggregateFuncs are the aggregate functions; all but count take a field.
+var aggregateFuncs = map[string]bool{"count": true, "sum": true, "avg": true, "min": true, "max": true}
+
+type aggregateSpec struct {
+	name string // as requested, e.g. sum:$.total
+	fn   string
+	path []interface{}
+}
+
+// parseAggregates parses the comma-separated agg= list, count by default.
+func parseAggregates(raw string) ([]aggregateSpec, error) {
+	if raw == "" {
+		raw = "count"
+	}
+	var specs []aggregateSpec
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		fn, field, hasField := strings.Cut(name, ":")
+		if !aggregateFuncs[fn] {
+			return nil, fmt.Errorf("unknown aggregate %q, expected count, sum, avg, min or max", fn)
+		}
+		spec := aggregateSpec{name: name, fn: fn}
+		if fn == "count" {
+			if hasField {
+				return nil, fmt.Errorf("count takes no field")
+			}
+			specs = append(specs, spec)
+			continue
+		}
+		path, err := parseFieldPath(field)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if path == nil {
+			return nil, fmt.Errorf("%s needs a field, e.g. %s:$.total", fn, fn)
+		}
+		spec.path = path
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// fieldTotals accumulates the numbers found in one field.
+type fieldTotals struct {
+	n             int64
+	sum, min, max float64
+}
+
+func (t *fieldTotals) add(v float64) {
+	if t.n == 0 || v < t.min {
+		t.min = v
+	}
+	if t.n == 0 || v > t.max {
+		t.max = v
+	}
+	t.n++
+	t.sum += v
+}
+
+func (t *fieldTotals) merge(o fieldTotals) {
+	if o.n == 0 {
+		return
+	}
+	if t.n == 0 {
+		*t = o
+		return
+	}
+	t.n += o.n
+	t.sum += o.sum
+	t.min = min(t.min, o.min)
+	t.max = max(t.max, o.max)
+}
+
+type groupTotals struct {
+	group  interface{}
+	count  int64
+	fields []fieldTotals // by spec
+}
+
+// aggregation accumulates the groups of one goroutine.
+type aggregation struct {
+	specs   []aggregateSpec
+	groupBy []interface{}
+	groups  map[string]*groupTotals
+	scanned int64
+	notJSON int64
+}
+
+func newAggregation(specs []aggregateSpec, groupBy []interface{}) *aggregation {
+	return &aggregation{specs: specs, groupBy: groupBy, groups: make(map[string]*groupTotals)}
+}
+
+// add counts a JSON document in its group.
+func (a *aggregation) add(doc interface{}) {
+	var group interface{}
+	if a.groupBy != nil {
+		group = lookupJSONPath(doc, a.groupBy)
+	}
+	id, _ := json.Marshal(group)
+	g := a.groups[string(id)]
+	if g == nil {
+		g = &groupTotals{group: group, fields: make([]fieldTotals, len(a.specs))}
+		a.groups[string(id)] = g
+	}
+	g.count++
+	for i, spec := range a.specs {
+		if spec.path == nil {
+			continue
+		}
+		if v, ok := lookupJSONPath(doc, spec.path).(float64); ok {
+			g.fields[i].add(v)
+		}
+	}
+}
+
+func (a *aggregation) merge(o *aggregation) {
+	a.scanned += o.scanned
+	a.notJSON += o.notJSON
+	for id, og := range o.groups {
+		g := a.groups[id]
+		if g == nil {
+			a.groups[id] = og
+			continue
+		}
+		g.count += og.count
+		for i := range g.fields {
+			g.fields[i].merge(og.fields[i])
+		}
+	}
+}
+
+// result returns the groups as objects with the group value and one member
+// per aggregate, the largest groups first. Aggregates of fields without
+// numbers are null, except sums.
+func (a *aggregation) result(limit int) []map[string]interface{} {
+	groups := make([]*groupTotals, 0, len(a.groups))
+	for _, g := range a.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].count != groups[j].count {
+			return groups[i].count > groups[j].count
+		}
+		return fmt.Sprint(groups[i].group) < fmt.Sprint(groups[j].group)
+	})
+	if len(groups) > limit {
+		groups = groups[:limit]
+	}
+	out := make([]map[string]interface{}, 0, len(groups))
+	for _, g := range groups {
+		row := map[string]interface{}{"group": g.group}
+		for i, spec := range a.specs {
+			t := g.fields[i]
+			var v interface{}
+			switch spec.fn {
+			case "count":
+				v = g.count
+			case "sum":
+				v = t.sum
+			case "avg":
+				if t.n > 0 {
+					v = t.sum / float64(t.n)
+				}
+			case "min":
+				if t.n > 0 {
+					v = t.min
+				}
+			case "max":
+				if t.n > 0 {
+					v = t.max
+				}
+			}
+			row[spec.name] = v
+		}
+		out = append(out, row)
+	}
+	return out
+}
+
+type AggregateResult struct {
+	Prefix  string `json:"prefix"`
+	GroupBy string `json:"group_by,omitempty"`
+	// Scanned counts the keys aggregated, NotJSON those left out because
+	// their value is not JSON.
+	Scanned int64 `json:"scanned"`
+	NotJSON int64 `json:"not_json"`
+	// TotalGroups is the number of groups before limit= was applied.
+	TotalGroups int                      `json:"total_groups"`
+	Groups      []map[string]interface{} `json:"groups"`
+}
+
+// aggregateHandler aggregates the JSON values under prefix=, grouped by the
+// group_by= field (all in one group without it). The keys can be narrowed
+// down with q=, regex= and filter= as for list and search. Archived keys,
+// system keys and keys redacted for the caller are left out, and values are
+// read through the read hooks. Up to limit= groups are returned, 100 by
+// default.
+func (app *App) aggregateHandler(w http.ResponseWriter, r *http.Request) {
+	specs, err := parseAggregates(r.URL.Query().Get("agg"))
+	if err != nil {
+		http.Error(w, "Invalid 'agg': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	groupBy, err := parseFieldPath(r.URL.Query().Get("group_by"))
+	if err != nil {
+		http.Error(w, "Invalid 'group_by': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	query, ok := parseKeyQuery(w, r)
+	if !ok {
+		return
+	}
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Parameter 'limit' must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	prefix := r.URL.Query().Get("prefix")
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	var mu sync.Mutex
+	var readErr error
+	fail := func(err error) {
+		mu.Lock()
+		if readErr == nil {
+			readErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+
+	stream := app.newStream()
+	stream.LogPrefix = "Aggregate"
+	stream.Prefix = []byte(prefix)
+	partials := make([]*aggregation, stream.NumGo)
+	for i := range partials {
+		partials[i] = newAggregation(specs, groupBy)
+	}
+	stream.UseKeyToListWithThreadId = true
+	stream.KeyToListWithThreadId = func(key []byte, itr *badger.Iterator, threadId int) (*pb.KVList, error) {
+		item := itr.Item()
+		if item.IsDeletedOrExpired() || app.isSystemKey(key) || item.UserMeta()&archivedMeta != 0 {
+			return nil, nil
+		}
+		k := string(key)
+		if !query.matchKey(k) || app.shouldRedact(r, k) {
+			return nil, nil
+		}
+		a := partials[threadId]
+		err := item.Value(func(val []byte) error {
+			val, err := app.scriptRead(k, val)
+			if err != nil {
+				return err
+			}
+			if !query.matchValue(k, val) {
+				return nil
+			}
+			var doc interface{}
+			if json.Unmarshal(val, &doc) != nil {
+				a.notJSON++
+				return nil
+			}
+			a.scanned++
+			a.add(doc)
+			return nil
+		})
+		if err != nil {
+			fail(fmt.Errorf("%s: %w", k, err))
+		}
+		return nil, nil
+	}
+	stream.FinishThread = func(int) (*pb.KVList, error) { return &pb.KVList{}, nil }
+	stream.Send = func(*z.Buffer) error { return nil }
+
+	err = stream.Orchestrate(ctx)
+	if readErr != nil {
+		err = readErr
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	total := newAggregation(specs, groupBy)
+	for _, a := range partials {
+		total.merge(a)
+	}
+	result := AggregateResult{
+		Prefix:      prefix,
+		Scanned:     total.scanned,
+		NotJSON:     total.notJSON,
+		TotalGroups: len(total.groups),
+		Groups:      total.result(limit),
+	}
+	if groupBy != nil {
+		result.GroupBy = r.URL.Query().Get("group_by")
+	}
+	writeJSON(w, result)
+}
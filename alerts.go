@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/gorilla/mux"
+)
+
+// Alert rules turn the statistics into monitoring: admins define them under
+// /api/admin/alerts and every ALERT_INTERVAL each rule is evaluated to a
+// value compared with its threshold. When a rule starts or stops firing an
+// alert.firing or alert.resolved event is published, which reaches the
+// webhooks like any other event. Rules are stored under the system prefix;
+// their state is kept in memory, so a rule still firing after a restart fires
+// again.
+const alertsNamespace = "alerts:"
+
+// Alert rule types.
+const (
+	AlertKeyCount   = "key_count"   // keys under prefix above threshold
+	AlertSizeGrowth = "size_growth" // database growth in bytes within window above threshold
+	AlertKeyMissing = "key_missing" // key does not exist
+	AlertValueMatch = "value_match" // keys under prefix matching filter above threshold
+	AlertBackupAge  = "backup_age"  // last scheduled backup older than max_age
+)
+
+// Events published when a rule changes state.
+const (
+	EventAlertFiring   = "alert.firing"
+	EventAlertResolved = "alert.resolved"
+)
+
+// maxGrowthWindow is how long database sizes are remembered for size_growth
+// rules.
+const maxGrowthWindow = 24 * time.Hour
+
+type AlertRule struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Type        string    `json:"type"`
+	Prefix      string    `json:"prefix,omitempty"`
+	Key         string    `json:"key,omitempty"`
+	Filter      string    `json:"filter,omitempty"`
+	Threshold   float64   `json:"threshold,omitempty"`
+	Window      string    `json:"window,omitempty"`
+	MaxAge      string    `json:"max_age,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// AlertStatus is the outcome of the last evaluation of a rule.
+type AlertStatus struct {
+	Firing      bool       `json:"firing"`
+	Since       *time.Time `json:"since,omitempty"`
+	Value       float64    `json:"value"`
+	Message     string     `json:"message,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	EvaluatedAt time.Time  `json:"evaluated_at"`
+}
+
+type AlertRuleStatus struct {
+	AlertRule
+	Status *AlertStatus `json:"status"`
+}
+
+// compiledAlert is a rule ready to be evaluated.
+type compiledAlert struct {
+	*AlertRule
+	filter *filterExpr
+	window time.Duration
+	maxAge time.Duration
+}
+
+func (a *AlertRule) compile() (*compiledAlert, error) {
+	ca := &compiledAlert{AlertRule: a}
+	var err error
+	switch a.Type {
+	case AlertKeyCount:
+	case AlertSizeGrowth:
+		ca.window = time.Hour
+		if a.Window != "" {
+			if ca.window, err = time.ParseDuration(a.Window); err != nil || ca.window <= 0 || ca.window > maxGrowthWindow {
+				return nil, fmt.Errorf("window must be a duration of at most %s", maxGrowthWindow)
+			}
+		}
+	case AlertKeyMissing:
+		if a.Key == "" {
+			return nil, errors.New("key is required")
+		}
+	case AlertValueMatch:
+		if a.Filter == "" {
+			return nil, errors.New("filter is required")
+		}
+		if ca.filter, err = parseFilter(a.Filter); err != nil {
+			return nil, errors.New("filter: " + err.Error())
+		}
+	case AlertBackupAge:
+		if ca.maxAge, err = time.ParseDuration(a.MaxAge); err != nil || ca.maxAge <= 0 {
+			return nil, errors.New("max_age must be a positive duration")
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %q, expected %s, %s, %s, %s or %s",
+			a.Type, AlertKeyCount, AlertSizeGrowth, AlertKeyMissing, AlertValueMatch, AlertBackupAge)
+	}
+	return ca, nil
+}
+
+type sizeSample struct {
+	time time.Time
+	size int64
+}
+
+// alertManager evaluates the rules in the background and remembers their
+// state and the database sizes seen.
+type alertManager struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	states  map[string]*AlertStatus
+	samples []sizeSample
+}
+
+func loadAlertManager() (*alertManager, error) {
+	interval, err := time.ParseDuration(getEnv("ALERT_INTERVAL", "1m"))
+	if err != nil || interval < 0 {
+		return nil, fmt.Errorf("invalid ALERT_INTERVAL")
+	}
+	if interval == 0 {
+		return nil, nil
+	}
+	return &alertManager{interval: interval, states: make(map[string]*AlertStatus)}, nil
+}
+
+func (m *alertManager) status(name string) *AlertStatus {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.states[name]; s != nil {
+		status := *s
+		return &status
+	}
+	return nil
+}
+
+func (app *App) loadAlertRules(txn *badger.Txn) ([]AlertRule, error) {
+	rules := make([]AlertRule, 0)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = app.systemKey(alertsNamespace)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		var rule AlertRule
+		err := it.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &rule)
+		})
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (app *App) loadAlertRule(txn *badger.Txn, name string) (*AlertRule, error) {
+	item, err := txn.Get(app.systemKey(alertsNamespace + name))
+	if err != nil {
+		return nil, err
+	}
+	var rule AlertRule
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &rule)
+	})
+	return &rule, err
+}
+
+// runAlerts evaluates the rules every ALERT_INTERVAL.
+func (app *App) runAlerts() {
+	for range time.Tick(app.alerts.interval) {
+		app.sampleSize()
+		var rules []AlertRule
+		err := app.view(func(txn *badger.Txn) error {
+			var err error
+			rules, err = app.loadAlertRules(txn)
+			return err
+		})
+		if err != nil {
+			errorf("Failed to load alert rules: %v", err)
+			continue
+		}
+		seen := make(map[string]bool, len(rules))
+		for i := range rules {
+			seen[rules[i].Name] = true
+			app.evaluateAlert(&rules[i])
+		}
+		app.alerts.mu.Lock()
+		for name := range app.alerts.states {
+			if !seen[name] {
+				delete(app.alerts.states, name)
+			}
+		}
+		app.alerts.mu.Unlock()
+	}
+}
+
+// sampleSize remembers the current database size for size_growth rules.
+func (app *App) sampleSize() {
+	lsm, vlog := app.db.Size()
+	now := time.Now()
+	m := app.alerts
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = append(m.samples, sizeSample{time: now, size: lsm + vlog})
+	for len(m.samples) > 1 && now.Sub(m.samples[0].time) > maxGrowthWindow {
+		m.samples = m.samples[1:]
+	}
+}
+
+// evaluateAlert evaluates rule and publishes an event when it starts or stops
+// firing. Rules that fail to evaluate keep their state.
+func (app *App) evaluateAlert(rule *AlertRule) {
+	now := time.Now().UTC()
+	status := AlertStatus{EvaluatedAt: now}
+	ca, err := rule.compile()
+	if err == nil {
+		status.Firing, status.Value, status.Message, err = app.checkAlert(ca)
+	}
+
+	m := app.alerts
+	m.mu.Lock()
+	prev := m.states[rule.Name]
+	if err != nil {
+		status.Error = err.Error()
+		if prev != nil {
+			status.Firing, status.Since, status.Value, status.Message = prev.Firing, prev.Since, prev.Value, prev.Message
+		}
+		m.states[rule.Name] = &status
+		m.mu.Unlock()
+		warnf("Failed to evaluate alert %q: %v", rule.Name, err)
+		return
+	}
+	wasFiring := prev != nil && prev.Firing
+	if status.Firing {
+		status.Since = &now
+		if wasFiring {
+			status.Since = prev.Since
+		}
+	}
+	m.states[rule.Name] = &status
+	m.mu.Unlock()
+
+	switch {
+	case status.Firing && !wasFiring:
+		app.events.publish(Event{Type: EventAlertFiring, Detail: rule.Name + ": " + status.Message})
+	case !status.Firing && wasFiring:
+		app.events.publish(Event{Type: EventAlertResolved, Detail: rule.Name + ": " + status.Message})
+	}
+}
+
+// checkAlert evaluates a rule to whether it fires, its value and a message
+// describing it.
+func (app *App) checkAlert(ca *compiledAlert) (bool, float64, string, error) {
+	switch ca.Type {
+	case AlertKeyCount, AlertValueMatch:
+		n, err := app.countAlertKeys(ca)
+		if err != nil {
+			return false, 0, "", err
+		}
+		what := "keys"
+		if ca.filter != nil {
+			what = "keys matching " + ca.Filter
+		}
+		return float64(n) > ca.Threshold, float64(n), fmt.Sprintf("%d %s under %q, threshold %g", n, what, ca.Prefix, ca.Threshold), nil
+
+	case AlertSizeGrowth:
+		app.alerts.mu.Lock()
+		samples := app.alerts.samples
+		from, to := samples[0], samples[len(samples)-1]
+		for _, s := range samples {
+			if to.time.Sub(s.time) <= ca.window {
+				from = s
+				break
+			}
+		}
+		app.alerts.mu.Unlock()
+		growth := float64(to.size - from.size)
+		return growth > ca.Threshold, growth, fmt.Sprintf("grew by %s in %s, threshold %s",
+			formatBytes(to.size-from.size), to.time.Sub(from.time).Round(time.Second), formatBytes(int64(ca.Threshold))), nil
+
+	case AlertKeyMissing:
+		err := app.view(func(txn *badger.Txn) error {
+			_, err := txn.Get([]byte(ca.Key))
+			return err
+		})
+		if err == badger.ErrKeyNotFound {
+			return true, 1, fmt.Sprintf("key %q is missing", ca.Key), nil
+		}
+		if err != nil {
+			return false, 0, "", err
+		}
+		return false, 0, fmt.Sprintf("key %q exists", ca.Key), nil
+
+	case AlertBackupAge:
+		if app.backups == nil {
+			return false, 0, "", errors.New("scheduled backups are not configured, see BACKUP_DIR")
+		}
+		backups, err := app.scheduledBackups()
+		if err != nil {
+			return false, 0, "", err
+		}
+		if len(backups) == 0 {
+			return true, 0, "no backup has been taken", nil
+		}
+		age := time.Since(backups[len(backups)-1].CreatedAt)
+		return age > ca.maxAge, age.Seconds(), fmt.Sprintf("last backup is %s old, maximum %s", age.Round(time.Second), ca.maxAge), nil
+	}
+	return false, 0, "", fmt.Errorf("unknown type %q", ca.Type)
+}
+
+// countAlertKeys counts the user keys under the rule's prefix, only those
+// matching its filter if it has one.
+func (app *App) countAlertKeys(ca *compiledAlert) (int64, error) {
+	var n int64
+	err := app.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = ca.filter != nil
+		opts.Prefix = []byte(ca.Prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if app.isSystemKey(item.Key()) {
+				continue
+			}
+			if ca.filter != nil {
+				matched := false
+				err := item.Value(func(val []byte) error {
+					matched = ca.filter.match(string(item.Key()), val)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				if !matched {
+					continue
+				}
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (app *App) listAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	var rules []AlertRule
+	err := app.view(func(txn *badger.Txn) error {
+		var err error
+		rules, err = app.loadAlertRules(txn)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	result := make([]AlertRuleStatus, 0, len(rules))
+	for _, rule := range rules {
+		result = append(result, AlertRuleStatus{AlertRule: rule, Status: app.alerts.status(rule.Name)})
+	}
+	writeJSON(w, result)
+}
+
+func (app *App) getAlertHandler(w http.ResponseWriter, r *http.Request) {
+	var rule *AlertRule
+	err := app.view(func(txn *badger.Txn) error {
+		var err error
+		rule, err = app.loadAlertRule(txn, mux.Vars(r)["name"])
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		http.Error(w, "Alert rule not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, AlertRuleStatus{AlertRule: *rule, Status: app.alerts.status(rule.Name)})
+}
+
+// putAlertHandler creates or replaces a rule; it is evaluated from the next
+// interval on.
+func (app *App) putAlertHandler(w http.ResponseWriter, r *http.Request) {
+	var rule AlertRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.Name = mux.Vars(r)["name"]
+	if strings.ContainsAny(rule.Name, ":/") {
+		http.Error(w, "Alert rule name must not contain ':' or '/'", http.StatusBadRequest)
+		return
+	}
+	if _, err := rule.compile(); err != nil {
+		http.Error(w, "Invalid alert rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rule.Type == AlertBackupAge && app.backups == nil {
+		http.Error(w, "Invalid alert rule: scheduled backups are not configured, see BACKUP_DIR", http.StatusBadRequest)
+		return
+	}
+
+	created := false
+	err := app.update(func(txn *badger.Txn) error {
+		rule.UpdatedAt = time.Now()
+		rule.CreatedAt = rule.UpdatedAt
+		old, err := app.loadAlertRule(txn, rule.Name)
+		switch {
+		case err == badger.ErrKeyNotFound:
+			created = true
+		case err != nil:
+			return err
+		default:
+			rule.CreatedAt = old.CreatedAt
+		}
+		data, err := json.Marshal(rule)
+		if err != nil {
+			return err
+		}
+		return txn.Set(app.systemKey(alertsNamespace+rule.Name), data)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	_ = json.NewEncoder(w).Encode(rule)
+}
+
+func (app *App) deleteAlertHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	err := app.update(func(txn *badger.Txn) error {
+		if _, err := app.loadAlertRule(txn, name); err != nil {
+			return err
+		}
+		return txn.Delete(app.systemKey(alertsNamespace + name))
+	})
+	if err == badger.ErrKeyNotFound {
+		http.Error(w, "Alert rule not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// archivedMeta marks entries whose value has been moved to object storage.
+// The entry value is then an archiveStub instead of the user data.
+const archivedMeta byte = 0x01
+
+type archiveStub struct {
+	Object    string    `json:"object"`
+	Size      int       `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Archived  time.Time `json:"archived_at"`
+	ExpiresAt uint64    `json:"expires_at,omitempty"`
+}
+
+// archiver moves the values of cold keys to S3. A key is cold when its last
+// recorded access (see accessstats.go) is older than coldAfter.
+type archiver struct {
+	s3        *s3Client
+	prefix    string
+	coldAfter time.Duration
+	minSize   int
+	interval  time.Duration
+}
+
+type ArchiveResult struct {
+	Scanned  int      `json:"scanned"`
+	Archived int      `json:"archived"`
+	Bytes    int64    `json:"bytes"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+func loadArchiver() (*archiver, error) {
+	bucket := getEnv("ARCHIVE_S3_BUCKET", "")
+	if bucket == "" {
+		return nil, nil
+	}
+
+	coldAfter, err := time.ParseDuration(getEnv("ARCHIVE_COLD_AFTER", "720h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ARCHIVE_COLD_AFTER: %w", err)
+	}
+	interval, err := time.ParseDuration(getEnv("ARCHIVE_INTERVAL", "1h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ARCHIVE_INTERVAL: %w", err)
+	}
+	minSize, err := strconv.Atoi(getEnv("ARCHIVE_MIN_SIZE", "1024"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ARCHIVE_MIN_SIZE: %w", err)
+	}
+
+	return &archiver{
+		s3: &s3Client{
+			bucket:       bucket,
+			region:       getEnv("ARCHIVE_S3_REGION", getEnv("AWS_REGION", "us-east-1")),
+			endpoint:     getEnv("ARCHIVE_S3_ENDPOINT", ""),
+			accessKey:    getEnv("AWS_ACCESS_KEY_ID", ""),
+			secretKey:    getEnv("AWS_SECRET_ACCESS_KEY", ""),
+			sessionToken: getEnv("AWS_SESSION_TOKEN", ""),
+			httpClient:   &http.Client{Timeout: 5 * time.Minute},
+		},
+		prefix:    getEnv("ARCHIVE_S3_PREFIX", "badger-archive/"),
+		coldAfter: coldAfter,
+		minSize:   minSize,
+		interval:  interval,
+	}, nil
+}
+
+func (app *App) runArchiver() {
+	ticker := time.NewTicker(app.archiver.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		result, err := app.archiveColdKeys()
+		if err != nil {
+			errorf("Archiver run failed: %v", err)
+			continue
+		}
+		if result.Archived > 0 || len(result.Errors) > 0 {
+			infof("Archiver moved %d keys (%d bytes) to S3, %d errors",
+				result.Archived, result.Bytes, len(result.Errors))
+		}
+	}
+}
+
+// archiveColdKeys runs one pass of the archival policy.
+func (app *App) archiveColdKeys() (ArchiveResult, error) {
+	var result ArchiveResult
+
+	all, err := app.loadAccessStats()
+	if err != nil {
+		return result, err
+	}
+
+	cutoff := time.Now().Add(-app.archiver.coldAfter)
+	for _, stats := range all {
+		// Keys that were never sampled have no age information; leave them.
+		if stats.LastAccess.IsZero() || stats.LastAccess.After(cutoff) {
+			continue
+		}
+		result.Scanned++
+
+		n, err := app.archiveKey(stats.Key)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", stats.Key, err))
+			continue
+		}
+		if n > 0 {
+			result.Archived++
+			result.Bytes += int64(n)
+		}
+	}
+	return result, nil
+}
+
+// archiveKey uploads the value of key and replaces it with a stub. It returns
+// the number of bytes archived, or 0 if the key was skipped.
+func (app *App) archiveKey(key string) (int, error) {
+	var (
+		value     []byte
+		version   uint64
+		expiresAt uint64
+	)
+	err := app.view(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		if item.UserMeta()&archivedMeta != 0 || item.ValueSize() < int64(app.archiver.minSize) {
+			return nil
+		}
+		version = item.Version()
+		expiresAt = item.ExpiresAt()
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	if err == badger.ErrKeyNotFound || value == nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	object := fmt.Sprintf("%s%s/%d", app.archiver.prefix,
+		base64.RawURLEncoding.EncodeToString([]byte(key)), version)
+	if err := app.archiver.s3.PutObject(object, value); err != nil {
+		return 0, err
+	}
+
+	sum := sha256.Sum256(value)
+	stub, err := json.Marshal(archiveStub{
+		Object:    object,
+		Size:      len(value),
+		SHA256:    hex.EncodeToString(sum[:]),
+		Archived:  time.Now(),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	err = app.update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		// The key was rewritten while uploading; keep the newer value local.
+		if item.Version() != version {
+			return errArchiveRace
+		}
+		e := badger.NewEntry([]byte(key), stub).WithMeta(archivedMeta)
+		if expiresAt > 0 {
+			e.ExpiresAt = expiresAt
+		}
+		return txn.SetEntry(e)
+	})
+	if err == errArchiveRace || err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(value), nil
+}
+
+var errArchiveRace = errors.New("key changed during archival")
+
+// fetchArchived reads the value a stub refers to from S3 and verifies it.
+func (app *App) fetchArchived(stubData []byte) ([]byte, *archiveStub, error) {
+	if app.archiver == nil {
+		return nil, nil, errors.New("value is archived but archival storage is not configured")
+	}
+
+	var stub archiveStub
+	if err := json.Unmarshal(stubData, &stub); err != nil {
+		return nil, nil, fmt.Errorf("invalid archive stub: %w", err)
+	}
+	value, err := app.archiver.s3.GetObject(stub.Object)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(value)
+	if hex.EncodeToString(sum[:]) != stub.SHA256 {
+		return nil, nil, fmt.Errorf("archived object %s failed checksum verification", stub.Object)
+	}
+	return value, &stub, nil
+}
+
+// rehydrate fetches the archived value of the latest version of key and
+// stores it back in Badger. If the key was rewritten or deleted since version
+// was read, the S3 copy is stale: rehydrate returns errArchiveRace and
+// callers read the key again.
+func (app *App) rehydrate(key string, stubData []byte, version uint64) ([]byte, error) {
+	value, stub, err := app.fetchArchived(stubData)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return errArchiveRace
+		}
+		if err != nil {
+			return err
+		}
+		if item.Version() != version {
+			return errArchiveRace
+		}
+		e := badger.NewEntry([]byte(key), value)
+		if stub.ExpiresAt > 0 {
+			e.ExpiresAt = stub.ExpiresAt
+		}
+		return txn.SetEntry(e)
+	})
+	if err == errArchiveRace {
+		return nil, err
+	}
+	if err != nil {
+		errorf("Failed to store rehydrated value for %q: %v", key, err)
+	}
+	return value, nil
+}
+
+func (app *App) archiveHandler(w http.ResponseWriter, r *http.Request) {
+	if app.archiver == nil {
+		http.Error(w, "Archival is not configured (set ARCHIVE_S3_BUCKET)", http.StatusNotFound)
+		return
+	}
+	result, err := app.archiveColdKeys()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, result)
+}
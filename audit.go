@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Audit entries are stored under the system prefix, ordered by time. They
+// record who did what and never contain values, so redacted secrets cannot
+// leak through the log.
+const auditNamespace = "audit:"
+
+// Audit actions.
+const (
+	AuditLogin       = "login"
+	AuditLogout      = "logout"
+	AuditAuthFailure = "auth.failure"
+	AuditAuthLocked  = "auth.locked"
+)
+
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Actor  string    `json:"actor,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+var auditSeq atomic.Uint32
+
+// audit records an entry for the request. Failures are logged and never
+// fail the request itself.
+func (app *App) audit(r *http.Request, entry AuditEntry) {
+	entry.Time = time.Now().UTC()
+	if entry.Actor == "" {
+		if p := currentPrincipal(r); p != nil {
+			entry.Actor = p.Name
+		}
+	}
+	if ip := app.clientIP(r); ip != nil {
+		entry.IP = ip.String()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		errorf("Failed to encode audit entry: %v", err)
+		return
+	}
+	// Zero-padded nanoseconds keep keys in time order; the sequence number
+	// separates entries written in the same nanosecond.
+	key := app.systemKey(fmt.Sprintf("%s%020d-%05d", auditNamespace, entry.Time.UnixNano(), auditSeq.Add(1)%100000))
+	e := badger.NewEntry(key, data)
+	if app.auditRetention > 0 {
+		e = e.WithTTL(app.auditRetention)
+	}
+	if err := app.update(func(txn *badger.Txn) error { return txn.SetEntry(e) }); err != nil {
+		errorf("Failed to write audit entry: %v", err)
+	}
+}
+
+// auditHandler returns the newest entries first, optionally filtered by
+// action.
+func (app *App) auditHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
+			limit = parsed
+		}
+	}
+	action := r.URL.Query().Get("action")
+
+	entries := make([]AuditEntry, 0)
+	err := app.view(func(txn *badger.Txn) error {
+		prefix := app.systemKey(auditNamespace)
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(append(prefix, 0xff)); it.Valid() && len(entries) < limit; it.Next() {
+			var entry AuditEntry
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &entry)
+			})
+			if err != nil {
+				return err
+			}
+			if action == "" || entry.Action == action {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
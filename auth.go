@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Roles, from least to most privileged.
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+// Permissions checked by the auth middleware.
+const (
+	permRead = iota
+	permWrite
+	permAdmin
+)
+
+var roleLevels = map[string]int{
+	RoleViewer: permRead,
+	RoleEditor: permWrite,
+	RoleAdmin:  permAdmin,
+}
+
+func roleAllows(role string, perm int) bool {
+	level, ok := roleLevels[role]
+	return ok && level >= perm
+}
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Method string `json:"method"` // session, token, basic or hmac
+}
+
+type credential struct {
+	secret string
+	role   string
+}
+
+// credentials holds the users (password login) and API tokens configured
+// through AUTH_USERS and AUTH_TOKENS, both lists of name:secret:role.
+type credentials struct {
+	mu     sync.RWMutex
+	users  map[string]credential // by user name
+	tokens map[string]credential // by token, secret holds the token name
+}
+
+func parseCredentials(users, tokens string) (*credentials, error) {
+	c := &credentials{
+		users:  make(map[string]credential),
+		tokens: make(map[string]credential),
+	}
+	for _, entry := range parseList(users) {
+		name, cred, err := parseCredential(entry)
+		if err != nil {
+			return nil, fmt.Errorf("AUTH_USERS: %w", err)
+		}
+		c.users[name] = cred
+	}
+	for _, entry := range parseList(tokens) {
+		name, cred, err := parseCredential(entry)
+		if err != nil {
+			return nil, fmt.Errorf("AUTH_TOKENS: %w", err)
+		}
+		c.tokens[cred.secret] = credential{secret: name, role: cred.role}
+	}
+	return c, nil
+}
+
+func parseCredential(entry string) (string, credential, error) {
+	parts := strings.SplitN(entry, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return "", credential{}, fmt.Errorf("entry %q must be name:secret:role", parts[0])
+	}
+	if _, ok := roleLevels[parts[2]]; !ok {
+		return "", credential{}, fmt.Errorf("unknown role %q for %s", parts[2], parts[0])
+	}
+	return parts[0], credential{secret: parts[1], role: parts[2]}, nil
+}
+
+// replace swaps in the users and tokens of src.
+func (c *credentials) replace(src *credentials) {
+	c.mu.Lock()
+	c.users, c.tokens = src.users, src.tokens
+	c.mu.Unlock()
+}
+
+func (c *credentials) enabled() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.users) > 0 || len(c.tokens) > 0
+}
+
+func (c *credentials) checkPassword(name, password string) (*principal, bool) {
+	c.mu.RLock()
+	cred, ok := c.users[name]
+	c.mu.RUnlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(cred.secret), []byte(password)) != 1 {
+		return nil, false
+	}
+	return &principal{Name: name, Role: cred.role}, true
+}
+
+func (c *credentials) checkToken(token string) (*principal, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for candidate, cred := range c.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			return &principal{Name: cred.secret, Role: cred.role, Method: "token"}, true
+		}
+	}
+	return nil, false
+}
+
+type principalKey struct{}
+
+func currentPrincipal(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey{}).(*principal)
+	return p
+}
+
+// authenticate resolves the caller from a request signature, a bearer token,
+// basic credentials or the session cookie, in that order.
+func (app *App) authenticate(r *http.Request) *principal {
+	if app.hmac != nil && strings.HasPrefix(r.Header.Get("Authorization"), hmacAuthScheme) {
+		return app.hmac.authenticate(r)
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		p, _ := app.credentials.checkToken(strings.TrimPrefix(auth, "Bearer "))
+		return p
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		p, ok := app.checkPassword(name, password)
+		if !ok {
+			return nil
+		}
+		p.Method = "basic"
+		return p
+	}
+	if s := app.sessions.fromRequest(r); s != nil {
+		return &principal{Name: s.User, Role: s.Role, Method: "session"}
+	}
+	return nil
+}
+
+// requiredPermission maps a request to the permission it needs: reads are
+// open to viewers, writes to editors, and admin routes or system keys to
+// admins.
+func requiredPermission(r *http.Request) int {
+	switch {
+	case r.URL.Path == "/logout":
+		return permRead
+	case strings.HasPrefix(r.URL.Path, "/api/admin/"), includeSystem(r):
+		return permAdmin
+	case isSafeMethod(r.Method):
+		return permRead
+	default:
+		return permWrite
+	}
+}
+
+func isPublicPath(path string) bool {
+	return path == "/login" || strings.HasPrefix(path, "/auth/") || strings.HasPrefix(path, "/static/")
+}
+
+func (app *App) authEnabled() bool {
+	return app.credentials.enabled() || app.storedUsers.Load() || app.hmac != nil || app.oidc != nil || app.ldap != nil
+}
+
+func (app *App) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.authEnabled() || isPublicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Explicit credentials can be guessed, so they are throttled; session
+		// IDs are random and simply fail.
+		user, _, _ := r.BasicAuth()
+		scheme, _, hasCredentials := strings.Cut(r.Header.Get("Authorization"), " ")
+		if hasCredentials && app.throttled(w, r, user) {
+			return
+		}
+
+		p := app.authenticate(r)
+		if p == nil && hasCredentials {
+			app.authFailed(r, strings.ToLower(scheme), user)
+		} else if p != nil && p.Method == "basic" {
+			app.authSucceeded(user)
+		}
+		if p == nil {
+			// Browsers go to the login page; API clients get a 401 without a
+			// Basic challenge so XHR calls never pop up a credentials dialog.
+			if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, app.url("/login?next=")+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="badger-web-ui"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		setAccessLogUser(r, p.Name)
+
+		if !app.checkCSRF(r, p) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		if !roleAllows(p.Role, requiredPermission(r)) {
+			http.Error(w, "Forbidden for role "+p.Role, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// ExportRecord is one line of an NDJSON export. Values are base64 encoded so
+// binary data survives; archived keys keep their archive stub as value.
+type ExportRecord struct {
+	Key       string `json:"key"`
+	Value     []byte `json:"value"`
+	ExpiresAt uint64 `json:"expires_at,omitempty"`
+	Archived  bool   `json:"archived,omitempty"`
+	Version   uint64 `json:"version"`
+}
+
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+	// Invalid counts records refused by the write rules; the first
+	// maxImportRejections are listed in Rejected.
+	Invalid  int                `json:"invalid"`
+	Rejected []*ValidationError `json:"rejected,omitempty"`
+}
+
+const maxImportRejections = 100
+
+func downloadName(kind, ext string, encrypted bool) string {
+	name := fmt.Sprintf("badger-%s-%s.%s", kind, time.Now().UTC().Format("20060102-150405.000"), ext)
+	if encrypted {
+		name += ".enc"
+	}
+	return name
+}
+
+// backupHandler streams a native Badger backup, including system keys.
+// since=N returns only versions newer than N for incremental backups.
+func (app *App) backupHandler(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, "Parameter 'since' must be a version number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	encrypted := app.exportCipher != nil && r.URL.Query().Get("encrypt") != "false"
+	name := downloadName("backup", "bak", encrypted)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	announceManifest(w, name)
+	m, err := app.writeBackup(w, name, since, encrypted)
+	if err != nil {
+		errorf("Backup failed: %v", err)
+		return
+	}
+	app.publishManifest(w, m)
+}
+
+// writeBackup writes a native backup of the entries at or above since to w,
+// encrypted if asked, and returns its manifest.
+func (app *App) writeBackup(w io.Writer, name string, since uint64, encrypted bool) (Manifest, error) {
+	hw := newHashingWriter(w)
+	out, err := app.encryptingWriter(hw, encrypted)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	// The plaintext stream is parsed alongside to count entries and versions.
+	pr, pw := io.Pipe()
+	scanned := make(chan contentStats, 1)
+	go func() {
+		stats, err := scanBackup(pr)
+		pr.CloseWithError(err)
+		scanned <- stats
+	}()
+
+	_, err = app.backup(io.MultiWriter(out, pw), since)
+	pw.CloseWithError(err)
+	stats := <-scanned
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		return Manifest{}, err
+	}
+	return Manifest{
+		Name:       name,
+		Kind:       manifestBackup,
+		Entries:    stats.entries,
+		Size:       hw.size,
+		SHA256:     hw.sum(),
+		MinVersion: stats.minVersion,
+		MaxVersion: stats.maxVersion,
+		Encrypted:  encrypted,
+		CreatedAt:  time.Now().UTC(),
+	}, nil
+}
+
+// restoreHandler loads a native Badger backup on top of the current data.
+func (app *App) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	in, err := app.verifiedUpload(r, manifestBackup)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer in.Close()
+	if err := app.restore(in); err != nil {
+		http.Error(w, "Restore failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *App) restore(in io.Reader) error {
+	if err := app.db.Load(in, 256); err != nil {
+		return err
+	}
+	if app.managed {
+		app.observeTs(app.db.MaxVersion())
+	}
+	if err := app.refreshStoredUsers(); err != nil {
+		errorf("Failed to refresh stored users: %v", err)
+	}
+	return nil
+}
+
+// exportHandler streams the keys as NDJSON, or as CSV with format=csv,
+// optionally limited to a prefix, the keys matched by q=, regex= and filter=
+// (see query.go) and the first limit= of them. System keys are only included
+// with include_system=true. mask= applies a masking profile to the values,
+// see masking.go, and every= or sample= export a sample of the keys, see
+// exportsample.go.
+func (app *App) exportHandler(w http.ResponseWriter, r *http.Request) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(r.URL.Query().Get("prefix"))
+	opts, ok := app.iteratorOptions(w, r, opts)
+	if !ok {
+		return
+	}
+	query, ok := parseKeyQuery(w, r)
+	if !ok {
+		return
+	}
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Parameter 'limit' must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	masker, ok := app.requestMasker(w, r)
+	if !ok {
+		return
+	}
+	sampler, ok := parseExportSample(w, r)
+	if !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = "ndjson"
+	case "ndjson", "csv":
+	default:
+		http.Error(w, "Parameter 'format' must be ndjson or csv", http.StatusBadRequest)
+		return
+	}
+
+	encrypted := app.exportCipher != nil && r.URL.Query().Get("encrypt") != "false"
+	name := downloadName("export", format, encrypted)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+	}
+	if encrypted {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	announceManifest(w, name)
+	hw := newHashingWriter(w)
+	out, err := app.encryptingWriter(hw, encrypted)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var stats contentStats
+	bw := bufio.NewWriter(out)
+	ew := newExportWriter(bw, format)
+	showSystem := includeSystem(r)
+	err = app.view(func(txn *badger.Txn) error {
+		ctx, cancel := operations.interruptible(r.Context(), txn)
+		defer cancel()
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid() && (limit == 0 || stats.entries < int64(limit)); it.Next() {
+			if err := checkOperation(ctx); err != nil {
+				return err
+			}
+			item := it.Item()
+			if !showSystem && app.isSystemKey(item.Key()) {
+				continue
+			}
+			if !query.matchKey(string(item.Key())) {
+				continue
+			}
+			archived := item.UserMeta()&archivedMeta != 0
+			if archived && query.filter != nil {
+				continue
+			}
+			// Without a filter, keys are sampled before their value is read.
+			if sampler != nil && query.filter == nil && !sampler.keep(item.Key()) {
+				continue
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if !query.matchValue(string(item.Key()), value) {
+				continue
+			}
+			if sampler != nil && query.filter != nil && !sampler.keep(item.Key()) {
+				continue
+			}
+			if masker != nil && !archived {
+				value = masker.mask(string(item.Key()), value)
+			}
+			err = ew.write(ExportRecord{
+				Key:       string(item.Key()),
+				Value:     value,
+				ExpiresAt: item.ExpiresAt(),
+				Archived:  archived,
+				Version:   item.Version(),
+			})
+			if err != nil {
+				return err
+			}
+			stats.add(item.Version())
+		}
+		return nil
+	})
+	if err == nil {
+		err = ew.flush()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		errorf("Export failed: %v", err)
+		return
+	}
+	app.publishManifest(w, Manifest{
+		Name:       name,
+		Kind:       manifestExport,
+		Entries:    stats.entries,
+		Size:       hw.size,
+		SHA256:     hw.sum(),
+		MinVersion: stats.minVersion,
+		MaxVersion: stats.maxVersion,
+		Encrypted:  encrypted,
+		CreatedAt:  time.Now().UTC(),
+	})
+}
+
+// exportWriter writes export records as NDJSON lines or as CSV rows of key,
+// value (as text), expires_at, archived and version, after a header row.
+type exportWriter struct {
+	enc *json.Encoder
+	csv *csv.Writer
+}
+
+func newExportWriter(w io.Writer, format string) *exportWriter {
+	if format == "csv" {
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"key", "value", "expires_at", "archived", "version"})
+		return &exportWriter{csv: cw}
+	}
+	return &exportWriter{enc: json.NewEncoder(w)}
+}
+
+func (ew *exportWriter) write(rec ExportRecord) error {
+	if ew.csv == nil {
+		return ew.enc.Encode(rec)
+	}
+	expiresAt := ""
+	if rec.ExpiresAt > 0 {
+		expiresAt = strconv.FormatUint(rec.ExpiresAt, 10)
+	}
+	return ew.csv.Write([]string{rec.Key, string(rec.Value), expiresAt, strconv.FormatBool(rec.Archived), strconv.FormatUint(rec.Version, 10)})
+}
+
+func (ew *exportWriter) flush() error {
+	if ew.csv == nil {
+		return nil
+	}
+	ew.csv.Flush()
+	return ew.csv.Error()
+}
+
+// importHandler writes the records of an NDJSON export. Expired records are
+// skipped, as are system keys unless include_system=true.
+func (app *App) importHandler(w http.ResponseWriter, r *http.Request) {
+	in, err := app.verifiedUpload(r, manifestExport)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer in.Close()
+
+	result, err := app.importRecords(in, includeSystem(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Import failed after %d records: %v", result.Imported, err), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, result)
+}
+
+func (app *App) importRecords(in io.Reader, withSystem bool) (ImportResult, error) {
+	var result ImportResult
+	dec := json.NewDecoder(in)
+	txn := app.newTransaction()
+	defer func() { app.discard(txn) }()
+
+	// The writes of the pending transaction are held in memory until it
+	// commits, see memguard.go.
+	mem := app.reserveMemory()
+	defer mem.release()
+	now := uint64(time.Now().Unix())
+	pending := 0
+	flush := func() error {
+		if err := app.commit(txn, 0); err != nil {
+			return err
+		}
+		result.Imported += pending
+		pending = 0
+		mem.release()
+		txn = app.newTransaction()
+		return nil
+	}
+	for {
+		var rec ExportRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return result, err
+		}
+		if rec.Key == "" || (!withSystem && app.isSystemKey([]byte(rec.Key))) || (rec.ExpiresAt != 0 && rec.ExpiresAt <= now) {
+			result.Skipped++
+			continue
+		}
+		if !app.isSystemKey([]byte(rec.Key)) {
+			if e := app.writeRules.validate(rec.Key, rec.Value); e != nil {
+				result.Invalid++
+				if len(result.Rejected) < maxImportRejections {
+					result.Rejected = append(result.Rejected, e)
+				}
+				continue
+			}
+		}
+
+		size := int64(len(rec.Key) + len(rec.Value))
+		err := mem.grow(size)
+		if err == errMemoryLimit && pending > 0 {
+			// Commit early to free the memory held by the pending writes.
+			if err := flush(); err != nil {
+				return result, err
+			}
+			err = mem.grow(size)
+		}
+		if err != nil {
+			app.memory.rejected.Add(1)
+			return result, err
+		}
+
+		e := badger.NewEntry([]byte(rec.Key), rec.Value)
+		e.ExpiresAt = rec.ExpiresAt
+		if rec.Archived {
+			e = e.WithMeta(archivedMeta)
+		}
+		err = app.setEntry(txn, e)
+		if err == badger.ErrTxnTooBig {
+			if err := flush(); err != nil {
+				return result, err
+			}
+			err = app.setEntry(txn, e)
+		}
+		if err != nil {
+			return result, err
+		}
+		pending++
+	}
+	if err := app.commit(txn, 0); err != nil {
+		return result, err
+	}
+	result.Imported += pending
+	return result, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With BACKUP_DIR set, a full backup is written there every BACKUP_INTERVAL,
+// next to its manifest as <name>.json, and all but the last BACKUP_KEEP are
+// removed. The manifests record the journal position, so a point-in-time
+// restore can continue from the backup with the journal, see restoreto.go.
+
+// Events published after each scheduled backup.
+const (
+	EventBackupSucceeded = "backup.succeeded"
+	EventBackupFailed    = "backup.failed"
+)
+
+type backupSchedule struct {
+	dir      string
+	interval time.Duration
+	keep     int
+}
+
+func loadBackupSchedule() (*backupSchedule, error) {
+	dir := getEnv("BACKUP_DIR", "")
+	if dir == "" {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(getEnv("BACKUP_INTERVAL", "24h"))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid BACKUP_INTERVAL")
+	}
+	keep, err := strconv.Atoi(getEnv("BACKUP_KEEP", "7"))
+	if err != nil || keep < 1 {
+		return nil, fmt.Errorf("BACKUP_KEEP must be a positive number")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &backupSchedule{dir: dir, interval: interval, keep: keep}, nil
+}
+
+// runBackupSchedule takes a backup whenever the last one is older than
+// BACKUP_INTERVAL, right away if there is none.
+func (app *App) runBackupSchedule() {
+	for {
+		backups, err := app.scheduledBackups()
+		if err != nil {
+			errorf("Failed to list backups: %v", err)
+		}
+		wait := app.backups.interval
+		if err == nil && len(backups) == 0 {
+			wait = 0
+		} else if err == nil {
+			wait = time.Until(backups[len(backups)-1].CreatedAt.Add(app.backups.interval))
+		}
+		time.Sleep(wait)
+
+		m, err := app.scheduledBackup()
+		if err != nil {
+			errorf("Scheduled backup failed: %v", err)
+			app.events.publish(Event{Type: EventBackupFailed, Detail: err.Error()})
+			time.Sleep(time.Minute)
+			continue
+		}
+		infof("Scheduled backup %s written, %d entries", m.Name, m.Entries)
+		app.events.publish(Event{Type: EventBackupSucceeded, Detail: fmt.Sprintf("%s, %d entries", m.Name, m.Entries)})
+		if err := app.pruneBackups(); err != nil {
+			errorf("Failed to remove old backups: %v", err)
+		}
+	}
+}
+
+// scheduledBackup writes a full backup into BACKUP_DIR. The file only
+// appears under its name once complete.
+func (app *App) scheduledBackup() (Manifest, error) {
+	// Entries journaled after this point may or may not be in the backup;
+	// replaying them again is harmless since they are idempotent writes.
+	seq := app.journal.lastSeq()
+	encrypted := app.exportCipher != nil
+	name := downloadName("backup", "bak", encrypted)
+	path := filepath.Join(app.backups.dir, name)
+
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer os.Remove(f.Name())
+	m, err := app.writeBackup(f, name, 0, encrypted)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Manifest{}, err
+	}
+	m.JournalSeq = seq
+
+	data, err := app.storeManifest(m)
+	if err != nil {
+		return Manifest{}, err
+	}
+	if err := os.WriteFile(path+".json", data, 0o600); err != nil {
+		return Manifest{}, err
+	}
+	return m, os.Rename(f.Name(), path)
+}
+
+// scheduledBackups lists the complete backups in BACKUP_DIR, oldest first.
+func (app *App) scheduledBackups() ([]Manifest, error) {
+	paths, err := filepath.Glob(filepath.Join(app.backups.dir, "badger-backup-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]Manifest, 0, len(paths))
+	for _, path := range paths {
+		if _, err := os.Stat(strings.TrimSuffix(path, ".json")); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var m Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		backups = append(backups, m)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.Before(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+func (app *App) pruneBackups() error {
+	backups, err := app.scheduledBackups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > app.backups.keep {
+		path := filepath.Join(app.backups.dir, backups[0].Name)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if err := os.Remove(path + ".json"); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// BASE_PATH mounts the application under a sub-path, for reverse proxies that
+// forward e.g. /badger/... without stripping the prefix. Routes are matched
+// without the prefix; it is added back to every URL handed to the browser:
+// redirects, Location headers, cookies and template links.
+
+func loadBasePath() (string, error) {
+	base := strings.TrimSuffix(getEnv("BASE_PATH", ""), "/")
+	if base != "" && (!strings.HasPrefix(base, "/") || strings.ContainsAny(base, "?#\"'<> ")) {
+		return "", fmt.Errorf("BASE_PATH must be a path starting with /, like /badger")
+	}
+	return base, nil
+}
+
+// url returns the external URL of an application path.
+func (app *App) url(path string) string {
+	return app.basePath + path
+}
+
+// mountBasePath serves h under base, redirecting the bare prefix to base/.
+func mountBasePath(base string, h http.Handler) http.Handler {
+	if base == "" {
+		return h
+	}
+	stripped := http.StripPrefix(base, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == base {
+			http.Redirect(w, r, base+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, base+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
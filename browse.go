@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// The index page is rendered with the data it first shows, so the browser
+// works without JavaScript: statistics, the keys one level below the prefix
+// in ?prefix= (or those matching ?q=) with links to the next level, and the
+// most recently written keys. HTMX then refreshes parts of the page through
+// the JSON API as before.
+
+// browsePageSize is the number of keys rendered on the index page.
+const browsePageSize = 100
+
+// recentKeysShown is the number of recently written keys listed.
+const recentKeysShown = 10
+
+// templateFuncs are available to all page templates.
+var templateFuncs = template.FuncMap{
+	"formatBytes": formatBytes,
+	"formatTime": func(t time.Time) string {
+		return t.Local().Format("2006-01-02 15:04:05")
+	},
+	// keyPath escapes a key as one segment of an API path.
+	"keyPath": url.PathEscape,
+	// plural picks the message for n items; catalogs translate both.
+	"plural": func(n int, one, other string) string {
+		if n == 1 {
+			return one
+		}
+		return other
+	},
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d Bytes", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %s", float64(n)/float64(div), []string{"KB", "MB", "GB", "TB"}[exp])
+}
+
+// PrefixLink is a prefix to navigate to, with the number of keys under it.
+type PrefixLink struct {
+	Prefix string
+	Label  string
+	Keys   int64
+}
+
+// browseData is the server-rendered part of the index page.
+type browseData struct {
+	Stats  Stats
+	Prefix string
+	Query  string
+	// Parents lead from the whole keyspace down to Prefix.
+	Parents  []PrefixLink
+	Prefixes []PrefixLink
+	Keys     []KeyValue
+	// More is set when there were more keys than browsePageSize.
+	More   bool
+	Recent []KeyInfo
+}
+
+// breadcrumbs splits prefix at the separators into its ancestors, starting
+// with the whole keyspace.
+func breadcrumbs(prefix string) []PrefixLink {
+	links := []PrefixLink{{Label: "All keys"}}
+	for start := 0; start < len(prefix); {
+		end := len(prefix)
+		if i := strings.IndexAny(prefix[start:], prefixSeparators); i >= 0 {
+			end = start + i + 1
+		}
+		links = append(links, PrefixLink{Prefix: prefix[:end], Label: prefix[start:end]})
+		start = end
+	}
+	return links
+}
+
+// loadBrowseData scans the keyspace once without reading values, counting
+// keys for the statistics and grouping those under the prefix, and then
+// reads the values of the keys shown.
+func (app *App) loadBrowseData(r *http.Request) (browseData, error) {
+	data := browseData{
+		Prefix: r.URL.Query().Get("prefix"),
+		Query:  r.URL.Query().Get("q"),
+		Stats:  Stats{Truncated: app.truncated},
+	}
+	data.Parents = breadcrumbs(data.Prefix)
+	query := strings.ToLower(data.Query)
+	groups := make(map[string]int64)
+	var keys [][]byte
+
+	err := app.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.Key()
+			if app.isSystemKey(key) {
+				continue
+			}
+			data.Stats.NumKeys++
+			if !strings.HasPrefix(string(key), data.Prefix) {
+				continue
+			}
+			if query != "" && !strings.Contains(strings.ToLower(string(key)), query) {
+				continue
+			}
+			data.Recent = addRecent(data.Recent, item)
+
+			// Searches list the matching keys directly, browsing groups
+			// them by the next segment.
+			rest := string(key[len(data.Prefix):])
+			if i := strings.IndexAny(rest, prefixSeparators); query == "" && i >= 0 && i < len(rest)-1 {
+				groups[data.Prefix+rest[:i+1]]++
+				continue
+			}
+			if len(keys) == browsePageSize {
+				data.More = true
+				continue
+			}
+			keys = append(keys, item.KeyCopy(nil))
+		}
+
+		for _, key := range keys {
+			item, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+			kv, err := app.browseKey(txn, item)
+			if err != nil {
+				return err
+			}
+			app.redact(r, &kv)
+			data.Keys = append(data.Keys, kv)
+		}
+		return nil
+	})
+	if err != nil {
+		return data, err
+	}
+
+	for prefix, count := range groups {
+		data.Prefixes = append(data.Prefixes, PrefixLink{Prefix: prefix, Label: prefix[len(data.Prefix):], Keys: count})
+	}
+	sort.Slice(data.Prefixes, func(i, j int) bool { return data.Prefixes[i].Prefix < data.Prefixes[j].Prefix })
+	app.storageStats(&data.Stats)
+	return data, nil
+}
+
+// browseKey reads an entry as listed by GET /api/keys.
+func (app *App) browseKey(txn *badger.Txn, item *badger.Item) (KeyValue, error) {
+	key := string(item.Key())
+	kv := KeyValue{Key: key, CreatedAt: time.Unix(int64(item.Version()), 0), Version: item.Version()}
+	if item.UserMeta()&archivedMeta != 0 {
+		kv.Archived = true
+		return kv, nil
+	}
+	meta, err := app.loadFileMeta(txn, item.Key())
+	if err != nil {
+		return kv, err
+	}
+	kv.File = meta
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return kv, err
+	}
+	value, err = app.scriptRead(key, value)
+	kv.Value = string(value)
+	return kv, err
+}
+
+// addRecent keeps the recentKeysShown keys with the newest versions, newest
+// first.
+func addRecent(recent []KeyInfo, item *badger.Item) []KeyInfo {
+	if len(recent) == recentKeysShown && item.Version() <= recent[len(recent)-1].Version {
+		return recent
+	}
+	i := sort.Search(len(recent), func(i int) bool { return recent[i].Version < item.Version() })
+	if len(recent) < recentKeysShown {
+		recent = append(recent, KeyInfo{})
+	}
+	copy(recent[i+1:], recent[i:])
+	recent[i] = keyInfo(item)
+	return recent
+}
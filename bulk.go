@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// POST /api/keys/bulk applies one action to a list of keys, as selected in
+// the web UI, and reports the outcome per key. delete and set-ttl run in a
+// single transaction: a conflict or storage error fails all keys, while keys
+// that are missing or may not be written are reported and skipped. export
+// returns the keys' values instead of writing anything.
+
+const maxBulkKeys = 1000
+
+// Bulk actions.
+const (
+	BulkDelete = "delete"
+	BulkSetTTL = "set-ttl"
+	BulkExport = "export"
+)
+
+// Bulk result statuses.
+const (
+	BulkOK        = "ok"
+	BulkNotFound  = "not_found"
+	BulkForbidden = "forbidden"
+	BulkFailed    = "failed"
+)
+
+type BulkRequest struct {
+	Action string   `json:"action"`
+	Keys   []string `json:"keys"`
+	// TTL is the expiry set by set-ttl as a duration such as "30m"; empty or
+	// "0" removes it.
+	TTL string `json:"ttl"`
+}
+
+type BulkResult struct {
+	Key       string     `json:"key"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	Value     *string    `json:"value,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Version   uint64     `json:"version,omitempty"`
+	Redacted  bool       `json:"redacted,omitempty"`
+}
+
+type BulkResponse struct {
+	Action    string       `json:"action"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Results   []BulkResult `json:"results"`
+}
+
+func (app *App) bulkKeysHandler(w http.ResponseWriter, r *http.Request) {
+	var req BulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Keys) == 0 || len(req.Keys) > maxBulkKeys {
+		http.Error(w, "Between 1 and "+strconv.Itoa(maxBulkKeys)+" keys must be given", http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	switch req.Action {
+	case BulkDelete, BulkExport:
+	case BulkSetTTL:
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl < 0 {
+				http.Error(w, "Invalid 'ttl', expected a duration such as 30m", http.StatusBadRequest)
+				return
+			}
+		}
+	default:
+		http.Error(w, "Unknown action "+strconv.Quote(req.Action)+", expected delete, set-ttl or export", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]BulkResult, len(req.Keys))
+	for i, key := range req.Keys {
+		results[i] = BulkResult{Key: key, Status: BulkOK}
+	}
+
+	var err error
+	switch req.Action {
+	case BulkExport:
+		err = app.bulkExport(r, results)
+	case BulkDelete:
+		err = app.bulkDelete(results)
+	case BulkSetTTL:
+		err = app.bulkSetTTL(results, ttl)
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	resp := BulkResponse{Action: req.Action, Results: results}
+	for _, result := range results {
+		if result.Status == BulkOK {
+			resp.Succeeded++
+		} else {
+			resp.Failed++
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// writable marks empty keys as missing and system keys as forbidden, and
+// reports whether result can be written.
+func (app *App) writable(result *BulkResult) bool {
+	if result.Key == "" {
+		result.Status = BulkNotFound
+		return false
+	}
+	if app.isSystemKey([]byte(result.Key)) {
+		result.Status, result.Error = BulkForbidden, "Keys under the system prefix "+app.systemPrefix+" are reserved"
+		return false
+	}
+	return true
+}
+
+func (app *App) bulkExport(r *http.Request, results []BulkResult) error {
+	for i := range results {
+		result := &results[i]
+		if result.Key == "" || app.isSystemKey([]byte(result.Key)) && !includeSystem(r) {
+			result.Status = BulkNotFound
+			continue
+		}
+		value, version, err := app.lookupKey(result.Key, 0)
+		if err == badger.ErrKeyNotFound {
+			result.Status = BulkNotFound
+			continue
+		}
+		if err != nil {
+			result.Status, result.Error = BulkFailed, err.Error()
+			continue
+		}
+		kv := KeyValue{Key: result.Key, Value: string(value)}
+		app.redact(r, &kv)
+		result.Value, result.Version, result.Redacted = &kv.Value, version, kv.Redacted
+		app.recordAccess(result.Key, false)
+	}
+	return nil
+}
+
+func (app *App) bulkDelete(results []BulkResult) error {
+	if app.proxy != nil {
+		for i := range results {
+			result := &results[i]
+			if !app.writable(result) {
+				continue
+			}
+			if err := app.proxy.remove(result.Key); err != nil {
+				result.Status, result.Error = BulkFailed, err.Error()
+			}
+		}
+	}
+
+	err := app.update(func(txn *badger.Txn) error {
+		for i := range results {
+			result := &results[i]
+			if result.Status != BulkOK || !app.writable(result) {
+				continue
+			}
+			if _, err := txn.Get([]byte(result.Key)); err == badger.ErrKeyNotFound {
+				result.Status = BulkNotFound
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := app.deleteEntry(txn, []byte(result.Key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if result.Status == BulkOK {
+			app.forgetAccess(result.Key)
+			app.events.publish(Event{Type: EventDelete, Key: result.Key})
+		}
+	}
+	return nil
+}
+
+func (app *App) bulkSetTTL(results []BulkResult, ttl time.Duration) error {
+	err := app.update(func(txn *badger.Txn) error {
+		for i := range results {
+			result := &results[i]
+			if !app.writable(result) {
+				continue
+			}
+			expiresAt, err := app.rewriteTTL(txn, []byte(result.Key), ttl)
+			if err == badger.ErrKeyNotFound {
+				result.Status = BulkNotFound
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			result.ExpiresAt = expiryTime(expiresAt)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if result.Status == BulkOK {
+			app.events.publish(Event{Type: EventSet, Key: result.Key})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/ristretto/v2"
+)
+
+// Badger caches decompressed blocks and, when IndexCacheSize is set, table
+// indexes and bloom filters. Their sizes are fixed when the database is
+// opened, since Badger does not expose the caches for resizing; hit ratios at
+// /api/stats/cache show whether BADGER_BLOCK_CACHE_SIZE or
+// BADGER_INDEX_CACHE_SIZE deserve a change at the next restart.
+
+// loadCacheSizes applies BADGER_BLOCK_CACHE_SIZE and BADGER_INDEX_CACHE_SIZE.
+func loadCacheSizes(opts *badger.Options) error {
+	for _, setting := range []struct {
+		name string
+		size *int64
+	}{
+		{"BADGER_BLOCK_CACHE_SIZE", &opts.BlockCacheSize},
+		{"BADGER_INDEX_CACHE_SIZE", &opts.IndexCacheSize},
+	} {
+		value := getEnv(setting.name, "")
+		if value == "" {
+			continue
+		}
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("%s must be a number of bytes", setting.name)
+		}
+		*setting.size = size
+	}
+	return nil
+}
+
+type CacheMetrics struct {
+	// MaxSize is the configured size in bytes.
+	MaxSize      int64   `json:"max_size"`
+	Hits         uint64  `json:"hits"`
+	Misses       uint64  `json:"misses"`
+	HitRatio     float64 `json:"hit_ratio"`
+	KeysAdded    uint64  `json:"keys_added"`
+	KeysUpdated  uint64  `json:"keys_updated"`
+	KeysEvicted  uint64  `json:"keys_evicted"`
+	CostAdded    uint64  `json:"cost_added"`
+	CostEvicted  uint64  `json:"cost_evicted"`
+	SetsDropped  uint64  `json:"sets_dropped"`
+	SetsRejected uint64  `json:"sets_rejected"`
+}
+
+// CacheStats holds the block and index cache metrics, and those of the read
+// cache in front of Badger, see readcache.go; a cache that is disabled is
+// omitted.
+type CacheStats struct {
+	Block *CacheMetrics     `json:"block,omitempty"`
+	Index *CacheMetrics     `json:"index,omitempty"`
+	Read  *ReadCacheMetrics `json:"read,omitempty"`
+}
+
+func cacheMetrics(m *ristretto.Metrics, maxSize int64) *CacheMetrics {
+	if m == nil {
+		return nil
+	}
+	return &CacheMetrics{
+		MaxSize:      maxSize,
+		Hits:         m.Hits(),
+		Misses:       m.Misses(),
+		HitRatio:     m.Ratio(),
+		KeysAdded:    m.KeysAdded(),
+		KeysUpdated:  m.KeysUpdated(),
+		KeysEvicted:  m.KeysEvicted(),
+		CostAdded:    m.CostAdded(),
+		CostEvicted:  m.CostEvicted(),
+		SetsDropped:  m.SetsDropped(),
+		SetsRejected: m.SetsRejected(),
+	}
+}
+
+func (app *App) cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	opts := app.db.Opts()
+	writeJSON(w, CacheStats{
+		Block: cacheMetrics(app.db.BlockCacheMetrics(), opts.BlockCacheSize),
+		Index: cacheMetrics(app.db.IndexCacheMetrics(), opts.IndexCacheSize),
+		Read:  app.readCache.metrics(),
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/options"
+	"github.com/dgraph-io/badger/v4/pb"
+	"github.com/dgraph-io/ristretto/v2/z"
+)
+
+// A clone streams the live database into a new directory through a
+// StreamWriter, which writes fully compacted tables: the usual way to shrink
+// a Badger store after deletes, or to change its compression or encryption.
+// Options not given are taken from the live database.
+
+const jobClone = "clone"
+
+type cloneParams struct {
+	Dir      string `json:"dir"`
+	ValueDir string `json:"value_dir,omitempty"`
+	// Compression is none, snappy or zstd.
+	Compression string `json:"compression,omitempty"`
+	ZSTDLevel   int    `json:"zstd_level,omitempty"`
+	// EncryptionKeyFile encrypts the clone with a new key; Decrypt writes it
+	// unencrypted.
+	EncryptionKeyFile string `json:"encryption_key_file,omitempty"`
+	Decrypt           bool   `json:"decrypt,omitempty"`
+}
+
+type CloneResult struct {
+	Dir        string `json:"dir"`
+	ValueDir   string `json:"value_dir"`
+	Keys       int64  `json:"keys"`
+	SourceSize int64  `json:"source_size"`
+	Size       int64  `json:"size"`
+	// Delta is Size minus SourceSize, negative when the clone is smaller.
+	Delta int64 `json:"delta"`
+}
+
+func parseCompression(name string) (options.CompressionType, error) {
+	switch name {
+	case "none":
+		return options.None, nil
+	case "snappy":
+		return options.Snappy, nil
+	case "zstd":
+		return options.ZSTD, nil
+	}
+	return 0, fmt.Errorf("compression must be none, snappy or zstd, not %q", name)
+}
+
+// readEncryptionKey reads a Badger encryption key file, see parseKey.
+func readEncryptionKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseKey(data)
+}
+
+// setEncryptionKey encrypts opts with key; Badger needs an index cache for
+// encrypted tables.
+func setEncryptionKey(opts *badger.Options, key []byte) {
+	opts.EncryptionKey = key
+	if len(key) > 0 && opts.IndexCacheSize == 0 {
+		opts.IndexCacheSize = 100 << 20
+	}
+}
+
+// cloneOptions derives the options of the clone from the live database.
+func (app *App) cloneOptions(params cloneParams) (badger.Options, error) {
+	opts := app.db.Opts()
+	opts.Dir = params.Dir
+	opts.ValueDir = params.ValueDir
+	if opts.ValueDir == "" {
+		opts.ValueDir = params.Dir
+	}
+	opts.ReadOnly = false
+	if params.Compression != "" {
+		c, err := parseCompression(params.Compression)
+		if err != nil {
+			return opts, err
+		}
+		opts.Compression = c
+	}
+	if params.ZSTDLevel != 0 {
+		opts.ZSTDCompressionLevel = params.ZSTDLevel
+	}
+	switch {
+	case params.Decrypt && params.EncryptionKeyFile != "":
+		return opts, errors.New("set only one of encryption_key_file and decrypt")
+	case params.Decrypt:
+		setEncryptionKey(&opts, nil)
+	case params.EncryptionKeyFile != "":
+		key, err := readEncryptionKey(params.EncryptionKeyFile)
+		if err != nil {
+			return opts, fmt.Errorf("encryption_key_file: %w", err)
+		}
+		setEncryptionKey(&opts, key)
+	}
+	return opts, nil
+}
+
+func emptyDir(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	return os.IsNotExist(err) || err == nil && len(entries) == 0
+}
+
+// cloneHandler starts a job cloning the live database into a new directory.
+func (app *App) cloneHandler(w http.ResponseWriter, r *http.Request) {
+	var params cloneParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Dir == "" {
+		http.Error(w, "dir is required", http.StatusBadRequest)
+		return
+	}
+	opts, err := app.cloneOptions(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !emptyDir(opts.Dir) || !emptyDir(opts.ValueDir) {
+		http.Error(w, "The clone directories must be empty or missing", http.StatusConflict)
+		return
+	}
+	// The key file path is recorded with the job, never the key.
+	job, err := app.startJob(r, jobClone, params, func(job *runningJob) (interface{}, error) {
+		return app.clone(job, opts)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJobCreated(w, job)
+}
+
+func (app *App) clone(job *runningJob, opts badger.Options) (CloneResult, error) {
+	live := app.db.Opts()
+	result := CloneResult{Dir: opts.Dir, ValueDir: opts.ValueDir}
+	for _, dir := range []string{opts.Dir, opts.ValueDir} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return result, err
+		}
+	}
+	dst, err := openDatabaseDir(opts, app.managed, true)
+	if err != nil {
+		return result, err
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			dst.Close()
+		}
+	}()
+
+	sw := dst.NewStreamWriter()
+	if err := sw.Prepare(); err != nil {
+		return result, err
+	}
+	stream := app.newStream()
+	stream.LogPrefix = "Clone"
+	stream.KeyToList = func(key []byte, itr *badger.Iterator) (*pb.KVList, error) {
+		list, err := stream.ToList(key, itr)
+		if err == nil && len(list.Kv) > 0 {
+			job.advance(1)
+		}
+		return list, err
+	}
+	stream.Send = func(buf *z.Buffer) error {
+		return sw.Write(buf)
+	}
+	if err := stream.Orchestrate(job.ctx); err != nil {
+		if job.checkCanceled() != nil {
+			return result, errJobCanceled
+		}
+		return result, err
+	}
+	if err := sw.Flush(); err != nil {
+		return result, err
+	}
+	closed = true
+	if err := dst.Close(); err != nil {
+		return result, err
+	}
+
+	result.Keys = job.progress.Load()
+	if result.SourceSize, err = dirsSize(live.Dir, live.ValueDir); err != nil {
+		return result, err
+	}
+	if result.Size, err = dirsSize(opts.Dir, opts.ValueDir); err != nil {
+		return result, err
+	}
+	result.Delta = result.Size - result.SourceSize
+	infof("Cloned the database into %s, %d bytes (%+d)", opts.Dir, result.Size, result.Delta)
+	return result, nil
+}
+
+// dirsSize adds up the disk usage of the files in the LSM and value log
+// directories, counting a shared directory once.
+func dirsSize(dir, valueDir string) (int64, error) {
+	var size int64
+	for i, d := range []string{dir, valueDir} {
+		if i == 1 && valueDir == dir {
+			break
+		}
+		err := filepath.WalkDir(d, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += diskUsage(info)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Compaction activity is sampled every compactionSampleInterval and kept for
+// maxCompactionWindow, so operators can correlate latency spikes with
+// compaction storms at /api/stats/compactions. Bytes written come from
+// Badger's expvar metrics, which are process-wide and also count the other
+// databases the server opens, such as clones. Compactions, L0 stalls and
+// value log rewrites are only reported in Badger's log messages, so they are
+// counted from those messages, whether or not BADGER_LOG writes them.
+
+const (
+	compactionSampleInterval = 10 * time.Second
+	maxCompactionWindow      = time.Hour
+)
+
+// badgerActivity counts the events observed in Badger's log messages.
+var badgerActivity struct {
+	compactions  atomic.Int64
+	stalls       atomic.Int64
+	stallTime    atomic.Int64 // nanoseconds
+	vlogRewrites atomic.Int64
+	vlogMoved    atomic.Int64
+}
+
+// observeBadgerLog counts the messages Badger logs when it finishes a
+// compaction, releases a stalled L0 and rewrites a value log file.
+func observeBadgerLog(format string, args []interface{}) {
+	switch format {
+	case "[Compactor: %d] Compaction for level: %d DONE":
+		badgerActivity.compactions.Add(1)
+	case "L0 was stalled for %s\n":
+		badgerActivity.stalls.Add(1)
+		if d, ok := args[0].(time.Duration); ok {
+			badgerActivity.stallTime.Add(int64(d))
+		}
+	case "Rewriting fid: %d":
+		badgerActivity.vlogRewrites.Add(1)
+	case "Total entries: %d. Moved: %d":
+		if moved, ok := args[1].(int); ok {
+			badgerActivity.vlogMoved.Add(int64(moved))
+		}
+	}
+}
+
+type CompactionCounters struct {
+	Compactions int64 `json:"compactions"`
+	// CompactionBytes is written by compactions into each level (l1, l2,
+	// ...), L0Bytes by memtable flushes into level 0.
+	CompactionBytes map[string]int64 `json:"compaction_bytes"`
+	L0Bytes         int64            `json:"l0_bytes"`
+	// UserBytes is written by transactions, VlogBytes to the value log.
+	UserBytes int64 `json:"user_bytes"`
+	VlogBytes int64 `json:"vlog_bytes"`
+	// Stalls counts the times writes waited for L0 to be compacted.
+	Stalls       int64 `json:"stalls"`
+	StallMillis  int64 `json:"stall_ms"`
+	VlogRewrites int64 `json:"vlog_rewrites"`
+	VlogMoved    int64 `json:"vlog_entries_moved"`
+}
+
+func expvarInt(name string) int64 {
+	if v, ok := expvar.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func currentCompactionCounters() CompactionCounters {
+	c := CompactionCounters{
+		Compactions:     badgerActivity.compactions.Load(),
+		CompactionBytes: make(map[string]int64),
+		L0Bytes:         expvarInt("badger_write_bytes_l0"),
+		UserBytes:       expvarInt("badger_write_bytes_user"),
+		VlogBytes:       expvarInt("badger_write_bytes_vlog"),
+		Stalls:          badgerActivity.stalls.Load(),
+		StallMillis:     time.Duration(badgerActivity.stallTime.Load()).Milliseconds(),
+		VlogRewrites:    badgerActivity.vlogRewrites.Load(),
+		VlogMoved:       badgerActivity.vlogMoved.Load(),
+	}
+	if m, ok := expvar.Get("badger_write_bytes_compaction").(*expvar.Map); ok {
+		m.Do(func(kv expvar.KeyValue) {
+			if v, ok := kv.Value.(*expvar.Int); ok {
+				c.CompactionBytes[kv.Key] = v.Value()
+			}
+		})
+	}
+	return c
+}
+
+// add adds d to c, or subtracts it when sign is -1.
+func (c *CompactionCounters) add(d CompactionCounters, sign int64) {
+	c.Compactions += sign * d.Compactions
+	c.L0Bytes += sign * d.L0Bytes
+	c.UserBytes += sign * d.UserBytes
+	c.VlogBytes += sign * d.VlogBytes
+	c.Stalls += sign * d.Stalls
+	c.StallMillis += sign * d.StallMillis
+	c.VlogRewrites += sign * d.VlogRewrites
+	c.VlogMoved += sign * d.VlogMoved
+	for level, n := range d.CompactionBytes {
+		c.CompactionBytes[level] += sign * n
+	}
+}
+
+func (c CompactionCounters) writtenBytes() int64 {
+	total := c.L0Bytes
+	for _, n := range c.CompactionBytes {
+		total += n
+	}
+	return total
+}
+
+// CompactionSample is the activity during one interval ending at Time.
+type CompactionSample struct {
+	Time time.Time `json:"time"`
+	CompactionCounters
+}
+
+type compactionMonitor struct {
+	mu      sync.Mutex
+	last    CompactionCounters
+	samples []CompactionSample
+}
+
+func newCompactionMonitor() *compactionMonitor {
+	return &compactionMonitor{last: currentCompactionCounters()}
+}
+
+func (m *compactionMonitor) run() {
+	for now := range time.Tick(compactionSampleInterval) {
+		current := currentCompactionCounters()
+		m.mu.Lock()
+		sample := CompactionSample{Time: now.UTC(), CompactionCounters: CompactionCounters{CompactionBytes: make(map[string]int64)}}
+		sample.add(current, 1)
+		sample.add(m.last, -1)
+		m.last = current
+		m.samples = append(m.samples, sample)
+		for len(m.samples) > 0 && now.Sub(m.samples[0].Time) > maxCompactionWindow {
+			m.samples = m.samples[1:]
+		}
+		m.mu.Unlock()
+	}
+}
+
+type LevelStats struct {
+	Level      int   `json:"level"`
+	Tables     int   `json:"tables"`
+	Size       int64 `json:"size"`
+	TargetSize int64 `json:"target_size"`
+	// Score above 1 makes the level a candidate for compaction.
+	Score         float64 `json:"score"`
+	StaleDataSize int64   `json:"stale_data_size"`
+}
+
+type CompactionStats struct {
+	MetricsEnabled bool `json:"metrics_enabled"`
+	// Totals are counted since the server started, WindowTotals within the
+	// window.
+	Totals       CompactionCounters `json:"totals"`
+	Window       string             `json:"window"`
+	WindowTotals CompactionCounters `json:"window_totals"`
+	// WriteAmplification is the bytes written to tables within the window
+	// per byte written by transactions, 0 when nothing was written.
+	WriteAmplification float64 `json:"write_amplification"`
+	// RunningTables is the number of tables being compacted right now.
+	RunningTables int64              `json:"running_tables"`
+	Levels        []LevelStats       `json:"levels"`
+	Samples       []CompactionSample `json:"samples"`
+}
+
+// compactionStatsHandler reports the compaction activity within window=
+// (1h by default, at most 1h) with a sample per interval.
+func (app *App) compactionStatsHandler(w http.ResponseWriter, r *http.Request) {
+	window := maxCompactionWindow
+	if v := r.URL.Query().Get("window"); v != "" {
+		var err error
+		if window, err = time.ParseDuration(v); err != nil || window <= 0 || window > maxCompactionWindow {
+			http.Error(w, "Invalid 'window', expected a duration up to 1h", http.StatusBadRequest)
+			return
+		}
+	}
+	stats := CompactionStats{
+		MetricsEnabled: app.db.Opts().MetricsEnabled,
+		Totals:         currentCompactionCounters(),
+		Window:         window.String(),
+		WindowTotals:   CompactionCounters{CompactionBytes: make(map[string]int64)},
+		RunningTables:  expvarInt("badger_compaction_current_num_lsm"),
+		Levels:         make([]LevelStats, 0),
+		Samples:        make([]CompactionSample, 0),
+	}
+	since := time.Now().Add(-window)
+	m := app.compactions
+	m.mu.Lock()
+	for _, sample := range m.samples {
+		if sample.Time.After(since) {
+			stats.Samples = append(stats.Samples, sample)
+			stats.WindowTotals.add(sample.CompactionCounters, 1)
+		}
+	}
+	m.mu.Unlock()
+	if stats.WindowTotals.UserBytes > 0 {
+		stats.WriteAmplification = float64(stats.WindowTotals.writtenBytes()) / float64(stats.WindowTotals.UserBytes)
+	}
+	for _, level := range app.db.Levels() {
+		stats.Levels = append(stats.Levels, LevelStats{
+			Level:         level.Level,
+			Tables:        level.NumTables,
+			Size:          level.Size,
+			TargetSize:    level.TargetSize,
+			Score:         level.Score,
+			StaleDataSize: level.StaleDatSize,
+		})
+	}
+	writeJSON(w, stats)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// CONFIG_FILE names a file of KEY=VALUE lines read at startup as if they were
+// environment variables; variables set in the real environment win. The file
+// is read again on SIGHUP or POST /api/admin/reload, and the settings below
+// take effect without a restart. Other changes are reported and wait for the
+// next restart.
+var reloadableSettings = map[string]bool{
+	"AUTH_USERS":                  true,
+	"AUTH_TOKENS":                 true,
+	"AUTH_THROTTLE_FREE_ATTEMPTS": true,
+	"AUTH_THROTTLE_BASE_DELAY":    true,
+	"AUTH_LOCKOUT_MAX":            true,
+	"WEBHOOK_URLS":                true,
+	"LOG_LEVEL":                   true,
+	"BADGER_LOG":                  true,
+}
+
+var errNoConfigFile = errors.New("no CONFIG_FILE configured")
+
+// configFile tracks the values the config file placed in the environment.
+type configFile struct {
+	path string
+	env  map[string]bool // set in the real environment, never overridden
+
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func loadConfigFile() (*configFile, error) {
+	c := &configFile{
+		path:   os.Getenv("CONFIG_FILE"),
+		env:    make(map[string]bool),
+		values: make(map[string]string),
+	}
+	for _, kv := range os.Environ() {
+		if name, _, ok := strings.Cut(kv, "="); ok {
+			c.env[name] = true
+		}
+	}
+	if c.path == "" {
+		return c, nil
+	}
+	if _, _, err := c.apply(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseConfigFile reads KEY=VALUE lines; blank lines and lines starting with
+// # are ignored and values may be wrapped in single or double quotes.
+func parseConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[name] = value
+	}
+	return values, scanner.Err()
+}
+
+// apply reads the file and updates the environment, returning the names whose
+// value changed and a function that restores the previous values.
+func (c *configFile) apply() ([]string, func(), error) {
+	values, err := parseConfigFile(c.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for name := range values {
+		if c.env[name] {
+			delete(values, name)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous := c.values
+	changed := make([]string, 0)
+	for name, value := range values {
+		if old, ok := previous[name]; !ok || old != value {
+			changed = append(changed, name)
+		}
+		os.Setenv(name, value)
+	}
+	for name := range previous {
+		if _, ok := values[name]; !ok {
+			changed = append(changed, name)
+			os.Unsetenv(name)
+		}
+	}
+	sort.Strings(changed)
+	c.values = values
+
+	revert := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for name := range values {
+			os.Unsetenv(name)
+		}
+		for name, value := range previous {
+			os.Setenv(name, value)
+		}
+		c.values = previous
+	}
+	return changed, revert, nil
+}
+
+// ReloadResult lists the settings that changed in the config file.
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// reloadConfig re-reads CONFIG_FILE and applies the reloadable settings. If
+// any of them is invalid nothing is applied.
+func (app *App) reloadConfig() (*ReloadResult, error) {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
+	if app.config.path == "" {
+		return nil, errNoConfigFile
+	}
+	sdNotify("RELOADING=1")
+	defer sdNotify("READY=1")
+	changed, revert, err := app.config.apply()
+	if err != nil {
+		return nil, err
+	}
+	creds, err := parseCredentials(getEnv("AUTH_USERS", ""), getEnv("AUTH_TOKENS", ""))
+	if err != nil {
+		revert()
+		return nil, err
+	}
+	throttle, err := parseAuthThrottle()
+	if err != nil {
+		revert()
+		return nil, err
+	}
+	if _, err := parseLogLevel(getEnv("LOG_LEVEL", "info")); err != nil {
+		revert()
+		return nil, fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+
+	app.credentials.replace(creds)
+	if app.throttle != nil && throttle != nil {
+		app.throttle.configure(throttle)
+	}
+	app.events.setWebhooks(parseList(getEnv("WEBHOOK_URLS", "")))
+	loadLogLevel()
+
+	result := &ReloadResult{Applied: make([]string, 0), RestartRequired: make([]string, 0)}
+	for _, name := range changed {
+		if reloadableSettings[name] {
+			result.Applied = append(result.Applied, name)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, name)
+		}
+	}
+	return result, nil
+}
+
+// reloadOnHangup reloads the config file whenever the process gets SIGHUP.
+func (app *App) reloadOnHangup() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			result, err := app.reloadConfig()
+			if err != nil {
+				errorf("Failed to reload configuration: %v", err)
+				continue
+			}
+			logReload(result)
+		}
+	}()
+}
+
+func logReload(result *ReloadResult) {
+	infof("Configuration reloaded, applied: %s", strings.Join(result.Applied, ", "))
+	if len(result.RestartRequired) > 0 {
+		warnf("Configuration changes waiting for a restart: %s", strings.Join(result.RestartRequired, ", "))
+	}
+}
+
+func (app *App) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := app.reloadConfig()
+	if err == errNoConfigFile {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to reload configuration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	logReload(result)
+	writeJSON(w, result)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const jobCopy = "copy"
+
+// Conflict policies for keys that already exist in the destination.
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictFail      = "fail"
+)
+
+type copyParams struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Prefix   string `json:"prefix,omitempty"`
+	Conflict string `json:"conflict"`
+}
+
+type CopyResult struct {
+	Copied  int64 `json:"copied"`
+	Skipped int64 `json:"skipped"`
+}
+
+// sourceItem is what copyKeys reads of a key. The items of Badger v2 and v3
+// implement it as well, which is how migrations reuse copyKeys.
+type sourceItem interface {
+	Key() []byte
+	KeyCopy(dst []byte) []byte
+	ValueCopy(dst []byte) ([]byte, error)
+	UserMeta() byte
+	ExpiresAt() uint64
+}
+
+// eachItem calls fn for the keys to copy, in order.
+type eachItem func(fn func(item sourceItem) error) error
+
+// copyHandler starts a job copying the keys under a prefix from one
+// configured database to another, values, TTLs and archival state included.
+func (app *App) copyHandler(w http.ResponseWriter, r *http.Request) {
+	var params copyParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Conflict == "" {
+		params.Conflict = ConflictSkip
+	}
+	switch {
+	case !app.knownDatabase(params.From):
+		http.Error(w, "Unknown database "+params.From, http.StatusBadRequest)
+		return
+	case !app.knownDatabase(params.To):
+		http.Error(w, "Unknown database "+params.To, http.StatusBadRequest)
+		return
+	case params.From == params.To:
+		http.Error(w, "Source and destination must differ", http.StatusBadRequest)
+		return
+	case params.Conflict != ConflictSkip && params.Conflict != ConflictOverwrite && params.Conflict != ConflictFail:
+		http.Error(w, "Conflict must be 'skip', 'overwrite' or 'fail'", http.StatusBadRequest)
+		return
+	}
+	withSystem := includeSystem(r)
+
+	job, err := app.startJob(r, jobCopy, params, func(job *runningJob) (interface{}, error) {
+		src, closeSrc, err := app.openDatabase(params.From, true)
+		if err != nil {
+			return nil, err
+		}
+		defer closeSrc()
+		dst, closeDst, err := app.openDatabase(params.To, false)
+		if err != nil {
+			return nil, err
+		}
+		defer closeDst()
+		result, err := app.copyKeys(job, app.itemsOf(job, src, params.Prefix, withSystem), dst, params.To, params.Conflict)
+		if dst == app.db && withSystem {
+			if err := app.refreshStoredUsers(); err != nil {
+				errorf("Failed to refresh stored users: %v", err)
+			}
+		}
+		return result, err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJobCreated(w, job)
+}
+
+// itemsOf iterates the keys of src under prefix, system keys only with
+// withSystem.
+func (app *App) itemsOf(job *runningJob, src *badger.DB, prefix string, withSystem bool) eachItem {
+	// The live database is read through app.view so its transaction is
+	// tracked, and the job canceled with it.
+	view := src.View
+	if src == app.db {
+		view = app.view
+	}
+	return func(fn func(item sourceItem) error) error {
+		return view(func(txn *badger.Txn) error {
+			job.holds(txn)
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = []byte(prefix)
+			it := txn.NewIterator(opts)
+			defer it.Close()
+
+			for it.Rewind(); it.Valid(); it.Next() {
+				if err := app.visitItem(job, it.Item(), withSystem, fn); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// visitItem calls fn for item unless it is a system key to leave out, after
+// checking that the job goes on.
+func (app *App) visitItem(job *runningJob, item sourceItem, withSystem bool, fn func(item sourceItem) error) error {
+	if err := job.checkCanceled(); err != nil {
+		return err
+	}
+	if !withSystem && app.isSystemKey(item.Key()) {
+		return nil
+	}
+	return fn(item)
+}
+
+// copyKeys streams the keys from each into dst, named to, in batches. With
+// the fail policy, conflicts are looked for before anything is written.
+func (app *App) copyKeys(job *runningJob, each eachItem, dst *badger.DB, to, conflict string) (CopyResult, error) {
+	var result CopyResult
+	// Writes to the live database go through setEntry so file metadata and
+	// the expiry index stay consistent, and through app.commit for managed
+	// mode.
+	set := func(txn *badger.Txn, e *badger.Entry) error { return txn.SetEntry(e) }
+	begin := func() *badger.Txn { return dst.NewTransaction(true) }
+	commit := func(txn *badger.Txn) error { return txn.Commit() }
+	if dst == app.db {
+		set = app.setEntry
+		begin = app.newTransaction
+		commit = func(txn *badger.Txn) error { return app.commit(txn, 0) }
+	}
+
+	if conflict == ConflictFail {
+		err := dst.View(func(dtxn *badger.Txn) error {
+			return each(func(item sourceItem) error {
+				if _, err := dtxn.Get(item.Key()); err != badger.ErrKeyNotFound {
+					if err == nil {
+						return fmt.Errorf("key %q already exists in %s", item.Key(), to)
+					}
+					return err
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	txn := begin()
+	defer func() { txn.Discard() }()
+	var pending int64
+	err := each(func(item sourceItem) error {
+		job.advance(1)
+		if conflict != ConflictOverwrite {
+			if _, err := txn.Get(item.Key()); err == nil {
+				result.Skipped++
+				return nil
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+		}
+
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		e := badger.NewEntry(item.KeyCopy(nil), value).WithMeta(item.UserMeta())
+		e.ExpiresAt = item.ExpiresAt()
+		err = set(txn, e)
+		if err == badger.ErrTxnTooBig {
+			if err := commit(txn); err != nil {
+				return err
+			}
+			result.Copied += pending
+			pending = 0
+			txn = begin()
+			err = set(txn, e)
+		}
+		if err != nil {
+			return err
+		}
+		pending++
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	if err := commit(txn); err != nil {
+		return result, err
+	}
+	result.Copied += pending
+	return result, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Besides the live database, DATABASES can name other database directories
+// for jobs such as keyspace diffs and copies. They are opened only for the
+// duration of a job, so they may be used by other processes in between.
+
+// mainDatabase names the live database.
+const mainDatabase = "main"
+
+// loadDatabases parses DATABASES, a list of name=path entries.
+func loadDatabases() (map[string]string, error) {
+	dbs := make(map[string]string)
+	for _, entry := range parseList(getEnv("DATABASES", "")) {
+		name, path, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("DATABASES entry %q must be name=path", entry)
+		}
+		if name == mainDatabase {
+			return nil, errors.New("DATABASES: the name main is reserved for the live database")
+		}
+		dbs[name] = path
+	}
+	return dbs, nil
+}
+
+func (app *App) knownDatabase(name string) bool {
+	_, ok := app.databases[name]
+	return ok || name == mainDatabase
+}
+
+// openDatabase opens a configured database, or returns the live one for
+// "main". The returned function releases it.
+func (app *App) openDatabase(name string, readOnly bool) (*badger.DB, func(), error) {
+	if name == mainDatabase {
+		return app.db, func() {}, nil
+	}
+	path, ok := app.databases[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown database %s", name)
+	}
+	db, err := badger.Open(badger.DefaultOptions(path).WithReadOnly(readOnly).WithLogger(nil))
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening %s: %w", name, err)
+	}
+	return db, func() { db.Close() }, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dgraph-io/badger/v4/y"
+)
+
+// GET /api/admin/info reports what `badger info` prints for a directory: the
+// MANIFEST, the levels and their tables with key ranges, the value log files,
+// and problems spotted in them. Per-table details are included with
+// show_tables=true since large stores have thousands of tables.
+
+type DBInfo struct {
+	Dir        string      `json:"dir"`
+	ValueDir   string      `json:"value_dir"`
+	Manifest   DBFile      `json:"manifest"`
+	Levels     []LevelInfo `json:"levels"`
+	Tables     []TableInfo `json:"tables,omitempty"`
+	ValueLog   []DBFile    `json:"value_log"`
+	LSMSize    int64       `json:"lsm_size"`
+	VlogSize   int64       `json:"vlog_size"`
+	MaxVersion uint64      `json:"max_version"`
+	Issues     []string    `json:"issues"`
+}
+
+type DBFile struct {
+	Name string `json:"name"`
+	// Size is the space used on disk; Badger preallocates the active value
+	// log as a sparse file.
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+type LevelInfo struct {
+	Level       int     `json:"level"`
+	Tables      int     `json:"tables"`
+	Size        int64   `json:"size"`
+	TargetSize  int64   `json:"target_size"`
+	BaseLevel   bool    `json:"base_level,omitempty"`
+	Score       float64 `json:"score"`
+	StaleSize   int64   `json:"stale_size"`
+	KeyCount    int64   `json:"key_count"`
+	SmallestKey string  `json:"smallest_key,omitempty"`
+	BiggestKey  string  `json:"biggest_key,omitempty"`
+}
+
+type TableInfo struct {
+	ID               uint64 `json:"id"`
+	Level            int    `json:"level"`
+	SmallestKey      string `json:"smallest_key"`
+	BiggestKey       string `json:"biggest_key"`
+	KeyCount         uint32 `json:"key_count"`
+	Size             uint32 `json:"size"`
+	UncompressedSize uint32 `json:"uncompressed_size"`
+	StaleSize        uint32 `json:"stale_size"`
+	IndexSize        int    `json:"index_size"`
+	BloomFilterSize  int    `json:"bloom_filter_size"`
+	MaxVersion       uint64 `json:"max_version"`
+}
+
+func statFile(path string) (DBFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return DBFile{}, err
+	}
+	return DBFile{Name: filepath.Base(path), Size: diskUsage(info), Modified: info.ModTime().UTC()}, nil
+}
+
+// tableFileName is the name Badger gives the file of table id.
+func tableFileName(id uint64) string {
+	return fmt.Sprintf("%06d.sst", id)
+}
+
+func (app *App) dbInfo(showTables bool) (DBInfo, error) {
+	opts := app.db.Opts()
+	info := DBInfo{Dir: opts.Dir, ValueDir: opts.ValueDir, Issues: make([]string, 0)}
+	info.LSMSize, info.VlogSize = app.db.Size()
+	info.MaxVersion = app.db.MaxVersion()
+
+	var err error
+	if info.Manifest, err = statFile(filepath.Join(opts.Dir, "MANIFEST")); err != nil {
+		return info, err
+	}
+
+	levels := app.db.Levels()
+	tables := app.db.Tables()
+	for _, l := range levels {
+		info.Levels = append(info.Levels, LevelInfo{
+			Level:      l.Level,
+			Tables:     l.NumTables,
+			Size:       l.Size,
+			TargetSize: l.TargetSize,
+			BaseLevel:  l.IsBaseLevel,
+			Score:      l.Score,
+			StaleSize:  l.StaleDatSize,
+		})
+	}
+	inManifest := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		inManifest[tableFileName(t.ID)] = true
+		smallest, biggest := string(y.ParseKey(t.Left)), string(y.ParseKey(t.Right))
+		if t.Level < len(info.Levels) {
+			l := &info.Levels[t.Level]
+			l.KeyCount += int64(t.KeyCount)
+			if l.SmallestKey == "" || smallest < l.SmallestKey {
+				l.SmallestKey = smallest
+			}
+			if biggest > l.BiggestKey {
+				l.BiggestKey = biggest
+			}
+		}
+		if showTables {
+			info.Tables = append(info.Tables, TableInfo{
+				ID:               t.ID,
+				Level:            t.Level,
+				SmallestKey:      smallest,
+				BiggestKey:       biggest,
+				KeyCount:         t.KeyCount,
+				Size:             t.OnDiskSize,
+				UncompressedSize: t.UncompressedSize,
+				StaleSize:        t.StaleDataSize,
+				IndexSize:        t.IndexSz,
+				BloomFilterSize:  t.BloomFilterSize,
+				MaxVersion:       t.MaxVersion,
+			})
+		}
+	}
+
+	vlogs, err := filepath.Glob(filepath.Join(opts.ValueDir, "*.vlog"))
+	if err != nil {
+		return info, err
+	}
+	for _, path := range vlogs {
+		f, err := statFile(path)
+		if err != nil {
+			return info, err
+		}
+		info.ValueLog = append(info.ValueLog, f)
+	}
+
+	// Problems `badger info` reports, plus signs of compaction falling
+	// behind.
+	ssts, err := filepath.Glob(filepath.Join(opts.Dir, "*.sst"))
+	if err != nil {
+		return info, err
+	}
+	onDisk := make(map[string]bool, len(ssts))
+	for _, path := range ssts {
+		name := filepath.Base(path)
+		onDisk[name] = true
+		if !inManifest[name] {
+			info.Issues = append(info.Issues, "table file "+name+" is not referenced by the MANIFEST")
+		}
+	}
+	for _, t := range tables {
+		if name := tableFileName(t.ID); !onDisk[name] {
+			info.Issues = append(info.Issues, "table file "+name+" referenced by the MANIFEST is missing")
+		}
+	}
+	if len(levels) > 0 {
+		switch l0 := levels[0].NumTables; {
+		case l0 >= opts.NumLevelZeroTablesStall:
+			info.Issues = append(info.Issues, fmt.Sprintf("level 0 has %d tables, writes are stalled until compaction catches up", l0))
+		case l0 > opts.NumLevelZeroTables:
+			info.Issues = append(info.Issues, fmt.Sprintf("level 0 has %d tables, compaction is falling behind", l0))
+		}
+	}
+	for _, l := range info.Levels {
+		if l.Level > 0 && l.TargetSize > 0 && l.Size > 2*l.TargetSize {
+			info.Issues = append(info.Issues, fmt.Sprintf("level %d holds %d bytes, more than twice its target of %d", l.Level, l.Size, l.TargetSize))
+		}
+		if l.Size > 0 && l.StaleSize*2 > l.Size {
+			info.Issues = append(info.Issues, fmt.Sprintf("level %d is more than half stale data", l.Level))
+		}
+	}
+	return info, nil
+}
+
+func (app *App) dbInfoHandler(w http.ResponseWriter, r *http.Request) {
+	info, err := app.dbInfo(r.URL.Query().Get("show_tables") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, info)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// With DEBUG_HEADERS=true, list, search and get responses report the cost of
+// their read transaction, so client developers can see what their queries
+// cost without access to the server logs:
+//
+//	X-Scan-Keys: 1200       keys the iterator went through
+//	X-Scan-Bytes: 381024    their estimated key and value sizes
+//	X-Txn-Duration: 4.2ms   time spent in the read transaction
+
+// scanCost counts what one request read. A nil scanCost, as returned when
+// the headers are off, records nothing.
+type scanCost struct {
+	keys  int64
+	bytes int64
+	txn   time.Duration
+}
+
+func (app *App) newScanCost() *scanCost {
+	if !app.debugHeaders {
+		return nil
+	}
+	return &scanCost{}
+}
+
+// add counts an item without reading its value.
+func (c *scanCost) add(item *badger.Item) {
+	if c != nil {
+		c.keys++
+		c.bytes += item.EstimatedSize()
+	}
+}
+
+// addValue counts a key looked up with its value.
+func (c *scanCost) addValue(key string, value []byte) {
+	if c != nil {
+		c.keys++
+		c.bytes += int64(len(key) + len(value))
+	}
+}
+
+// since adds the time elapsed since start to the transaction time.
+func (c *scanCost) since(start time.Time) {
+	if c != nil {
+		c.txn += time.Since(start)
+	}
+}
+
+// writeHeaders sets the headers; it must be called before the response is
+// written.
+func (c *scanCost) writeHeaders(w http.ResponseWriter) {
+	if c == nil {
+		return
+	}
+	w.Header().Set("X-Scan-Keys", strconv.FormatInt(c.keys, 10))
+	w.Header().Set("X-Scan-Bytes", strconv.FormatInt(c.bytes, 10))
+	w.Header().Set("X-Txn-Duration", c.txn.String())
+}
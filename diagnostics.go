@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// POST /api/admin/diagnostics collects what a bug report needs into one zip
+// file: goroutine, heap and CPU profiles, the database layout and options,
+// the slow requests, the open transactions, and the build and version.
+// Profiles are in pprof format, for `go tool pprof`. Nothing in it holds keys'
+// values or the server's configuration secrets, but key names appear in the
+// table ranges.
+
+const (
+	defaultProfileDuration = 5 * time.Second
+	maxProfileDuration     = time.Minute
+)
+
+type BuildInfo struct {
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	CPUs      int    `json:"cpus"`
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	// Revision and RevisionTime come from version control, when the binary
+	// was built from a checkout.
+	Revision     string            `json:"revision,omitempty"`
+	RevisionTime string            `json:"revision_time,omitempty"`
+	Modified     bool              `json:"modified,omitempty"`
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// buildInfo describes the running binary from the information Go embeds in
+// it.
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		GoVersion:    runtime.Version(),
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		CPUs:         runtime.NumCPU(),
+		Dependencies: make(map[string]string),
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.Module, info.Version = bi.Main.Path, bi.Main.Version
+	for _, dep := range bi.Deps {
+		info.Dependencies[dep.Path] = dep.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Revision = s.Value
+		case "vcs.time":
+			info.RevisionTime = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+// diagnosticsHandler profiles the CPU for seconds= (5 by default, at most 60)
+// and answers the bundle. Parts that cannot be collected are listed in
+// errors.txt instead of failing the download.
+func (app *App) diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	duration := defaultProfileDuration
+	if v := r.URL.Query().Get("seconds"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxProfileDuration {
+			http.Error(w, "Parameter 'seconds' must be a number of seconds up to 60", http.StatusBadRequest)
+			return
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+
+	var failures []string
+	fail := func(part string, err error) {
+		failures = append(failures, fmt.Sprintf("%s: %v", part, err))
+	}
+
+	// The CPU profile comes first: the response cannot start before it is
+	// done.
+	var cpu bytes.Buffer
+	if duration > 0 {
+		if err := pprof.StartCPUProfile(&cpu); err != nil {
+			fail("cpu.pprof", err)
+		} else {
+			select {
+			case <-time.After(duration):
+			case <-r.Context().Done():
+			}
+			pprof.StopCPUProfile()
+		}
+	}
+
+	now := time.Now().UTC()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="diagnostics-%s.zip"`, now.Format("20060102-150405")))
+	zw := zip.NewWriter(w)
+	add := func(name string, write func(io.Writer) error) {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+		if err == nil {
+			err = write(f)
+		}
+		if err != nil {
+			fail(name, err)
+		}
+	}
+	addJSON := func(name string, v interface{}) {
+		add(name, func(f io.Writer) error {
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			return enc.Encode(v)
+		})
+	}
+
+	if cpu.Len() > 0 {
+		add("cpu.pprof", func(f io.Writer) error {
+			_, err := cpu.WriteTo(f)
+			return err
+		})
+	}
+	add("goroutines.txt", func(f io.Writer) error {
+		return pprof.Lookup("goroutine").WriteTo(f, 2)
+	})
+	add("heap.pprof", func(f io.Writer) error {
+		runtime.GC()
+		return pprof.Lookup("heap").WriteTo(f, 0)
+	})
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	addJSON("memstats.json", mem)
+	addJSON("build.json", buildInfo())
+	addJSON("version.json", app.versionInfo())
+
+	if info, err := app.dbInfo(true); err != nil {
+		fail("db.json", err)
+	} else {
+		addJSON("db.json", info)
+	}
+	addJSON("options.json", app.dbOptions())
+	addJSON("slowlog.json", app.slowLog.list())
+	addJSON("active-operations.json", operations.list())
+
+	if len(failures) > 0 {
+		add("errors.txt", func(f io.Writer) error {
+			_, err := io.WriteString(f, strings.Join(failures, "\n")+"\n")
+			return err
+		})
+	}
+	if err := zw.Close(); err != nil {
+		errorf("Failed to write the diagnostics bundle: %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// diffContext is the number of unchanged lines around each hunk.
+const diffContext = 3
+
+// maxDiffCells bounds the line-matching table so diffing two huge values
+// cannot exhaust memory.
+const maxDiffCells = 16 << 20
+
+// DiffChange is one difference in a JSON structural diff. Path is a JSON
+// Pointer (RFC 6901) to the changed element.
+type DiffChange struct {
+	Op   string      `json:"op"` // added, removed or changed
+	Path string      `json:"path"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+type JSONDiff struct {
+	Key     string       `json:"key"`
+	From    uint64       `json:"from"`
+	To      uint64       `json:"to"`
+	Changes []DiffChange `json:"changes"`
+}
+
+// diffHandler compares two stored versions of a key. JSON values get a
+// structural diff, other text a unified diff.
+func (app *App) diffHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := routeKey(w, r)
+	if !ok {
+		return
+	}
+
+	if app.isSystemKey([]byte(key)) && !includeSystem(r) {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	if app.shouldRedact(r, key) {
+		http.Error(w, "Value is redacted", http.StatusForbidden)
+		return
+	}
+
+	from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	if err != nil {
+		http.Error(w, "from must be a version number", http.StatusBadRequest)
+		return
+	}
+	to, err := strconv.ParseUint(r.URL.Query().Get("to"), 10, 64)
+	if err != nil {
+		http.Error(w, "to must be a version number", http.StatusBadRequest)
+		return
+	}
+
+	a, err := app.valueAt(key, from)
+	if err != nil {
+		writeVersionError(w, from, err)
+		return
+	}
+	b, err := app.valueAt(key, to)
+	if err != nil {
+		writeVersionError(w, to, err)
+		return
+	}
+
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) == nil && json.Unmarshal(b, &bv) == nil {
+		changes := make([]DiffChange, 0)
+		diffJSON("", av, bv, &changes)
+		writeJSON(w, JSONDiff{Key: key, From: from, To: to, Changes: changes})
+		return
+	}
+
+	if !utf8.Valid(a) || !utf8.Valid(b) {
+		http.Error(w, "Binary values cannot be diffed", http.StatusUnprocessableEntity)
+		return
+	}
+	diff, ok := unifiedDiff(
+		fmt.Sprintf("%s@%d", key, from), fmt.Sprintf("%s@%d", key, to),
+		splitLines(string(a)), splitLines(string(b)))
+	if !ok {
+		http.Error(w, "Values are too large to diff", http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	_, _ = w.Write([]byte(diff))
+}
+
+func writeVersionError(w http.ResponseWriter, version uint64, err error) {
+	if err == errVersionNotFound {
+		http.Error(w, fmt.Sprintf("Version %d not found", version), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// diffJSON appends the differences between a and b, both decoded with
+// encoding/json, to changes.
+func diffJSON(path string, a, b interface{}, changes *[]DiffChange) {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := path + "/" + escapePointer(k)
+			x, inA := av[k]
+			y, inB := bv[k]
+			switch {
+			case !inB:
+				*changes = append(*changes, DiffChange{Op: "removed", Path: p, From: x})
+			case !inA:
+				*changes = append(*changes, DiffChange{Op: "added", Path: p, To: y})
+			default:
+				diffJSON(p, x, y, changes)
+			}
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			p := path + "/" + strconv.Itoa(i)
+			switch {
+			case i >= len(bv):
+				*changes = append(*changes, DiffChange{Op: "removed", Path: p, From: av[i]})
+			case i >= len(av):
+				*changes = append(*changes, DiffChange{Op: "added", Path: p, To: bv[i]})
+			default:
+				diffJSON(p, av[i], bv[i], changes)
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, DiffChange{Op: "changed", Path: path, From: a, To: b})
+	}
+}
+
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// splitLines splits s into lines, keeping the line terminators so a missing
+// final newline shows up in the diff.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffOp is one line of an edit script: ' ' kept, '-' removed, '+' added.
+type diffOp struct {
+	kind byte
+	line string
+	a, b int // line numbers in a and b before this op
+}
+
+// unifiedDiff renders the differences between a and b in unified format. It
+// reports false if the inputs are too large to compare.
+func unifiedDiff(nameA, nameB string, a, b []string) (string, bool) {
+	// Common prefix and suffix never need the matching table.
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+	if (len(ma)+1)*(len(mb)+1) > maxDiffCells {
+		return "", false
+	}
+
+	// Longest common subsequence of the differing middle.
+	lcs := make([][]int32, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for i := 0; i < pre; i++ {
+		ops = append(ops, diffOp{' ', a[i], i, i})
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			ops = append(ops, diffOp{' ', ma[i], pre + i, pre + j})
+			i++
+			j++
+		case i < len(ma) && (j == len(mb) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', ma[i], pre + i, pre + j})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', mb[j], pre + i, pre + j})
+			j++
+		}
+	}
+	for k := 0; k < suf; k++ {
+		ops = append(ops, diffOp{' ', a[len(a)-suf+k], len(a) - suf + k, len(b) - suf + k})
+	}
+
+	var sb strings.Builder
+	for start := 0; start < len(ops); {
+		// Find the next change and extend the hunk while changes are close.
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		end := start
+		for k := start; k < len(ops); k++ {
+			if ops[k].kind != ' ' {
+				end = k + 1
+			} else if k-end >= 2*diffContext {
+				break
+			}
+		}
+		lo := start - diffContext
+		if lo < 0 {
+			lo = 0
+		}
+		hi := end + diffContext
+		if hi > len(ops) {
+			hi = len(ops)
+		}
+
+		countA, countB := 0, 0
+		for _, op := range ops[lo:hi] {
+			if op.kind != '+' {
+				countA++
+			}
+			if op.kind != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(ops[lo].a, countA), hunkRange(ops[lo].b, countB))
+		for _, op := range ops[lo:hi] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = hi
+	}
+	return sb.String(), true
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
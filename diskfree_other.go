@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+)
+
+func diskFree(path string) (int64, error) {
+	return 0, errors.New("free space monitoring is not supported on this platform")
+}
+
+func diskUsage(info fs.FileInfo) int64 {
+	return info.Size()
+}
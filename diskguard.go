@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Badger can corrupt itself when the disk fills up mid-write. With
+// DISK_MIN_FREE set, the free space of the volumes holding the LSM tree and
+// the value log is checked periodically; below the threshold API writes are
+// rejected with 507 until space is back above it by a margin of 10%.
+
+// Event types published when writes are blocked and allowed again.
+const (
+	EventDiskLow = "disk.low"
+	EventDiskOK  = "disk.ok"
+)
+
+type diskGuard struct {
+	minFree  int64
+	interval time.Duration
+
+	free atomic.Int64
+	low  atomic.Bool
+}
+
+func loadDiskGuard() (*diskGuard, error) {
+	minFree, err := strconv.ParseInt(getEnv("DISK_MIN_FREE", "0"), 10, 64)
+	if err != nil || minFree < 0 {
+		return nil, fmt.Errorf("DISK_MIN_FREE must be a number of bytes")
+	}
+	if minFree == 0 {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(getEnv("DISK_CHECK_INTERVAL", "10s"))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid DISK_CHECK_INTERVAL")
+	}
+	return &diskGuard{minFree: minFree, interval: interval}, nil
+}
+
+// checkDisk measures the free space and switches write protection on or off.
+func (app *App) checkDisk() error {
+	opts := app.db.Opts()
+	free, err := diskFree(opts.Dir)
+	if err != nil {
+		return err
+	}
+	if opts.ValueDir != opts.Dir {
+		vlogFree, err := diskFree(opts.ValueDir)
+		if err != nil {
+			return err
+		}
+		free = min(free, vlogFree)
+	}
+
+	g := app.diskGuard
+	g.free.Store(free)
+	switch {
+	case free < g.minFree && !g.low.Load():
+		g.low.Store(true)
+		errorf("Free disk space down to %d bytes, rejecting writes", free)
+		app.events.publish(Event{Type: EventDiskLow, Detail: fmt.Sprintf("%d bytes free", free)})
+	case free >= g.minFree+g.minFree/10 && g.low.Load():
+		g.low.Store(false)
+		infof("Free disk space back to %d bytes, accepting writes", free)
+		app.events.publish(Event{Type: EventDiskOK, Detail: fmt.Sprintf("%d bytes free", free)})
+	}
+	return nil
+}
+
+func (app *App) runDiskGuard() {
+	ticker := time.NewTicker(app.diskGuard.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := app.checkDisk(); err != nil {
+			errorf("Disk space check failed: %v", err)
+		}
+	}
+}
+
+// diskGuardMiddleware rejects API writes while free space is low. Deletes
+// and the version discard job stay allowed so space can be reclaimed.
+func (app *App) diskGuardMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.diskGuard != nil && app.diskGuard.low.Load() && strings.HasPrefix(r.URL.Path, "/api/") &&
+			r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodDelete &&
+			r.URL.Path != "/api/admin/versions/discard" && !readOnlyRequest(r) {
+			http.Error(w, "Not enough free disk space, writes are disabled", http.StatusInsufficientStorage)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// A duplicates job hashes values and groups the keys holding identical
+// content, with the space that storing each value once would save. With
+// sample below 1 only that fraction of the values is hashed: a quick way to
+// tell whether a full run is worth it, though duplicates are then only found
+// among the hashed values.
+
+const jobDuplicates = "duplicates"
+
+// maxGroupKeys caps the keys listed per group; all are counted.
+const maxGroupKeys = 20
+
+type duplicatesParams struct {
+	Prefix  string  `json:"prefix,omitempty"`
+	Sample  float64 `json:"sample"`
+	MinSize int64   `json:"min_size"`
+	Limit   int     `json:"limit"`
+}
+
+type DuplicateGroup struct {
+	SHA256 string   `json:"sha256"`
+	Size   int64    `json:"size"`
+	Count  int64    `json:"count"`
+	Keys   []string `json:"keys"`
+	// Savings is the space held by all copies but one.
+	Savings int64 `json:"savings"`
+}
+
+type DuplicatesReport struct {
+	Keys          int64            `json:"keys"`
+	Hashed        int64            `json:"hashed"`
+	HashedBytes   int64            `json:"hashed_bytes"`
+	Groups        int64            `json:"groups"`
+	DuplicateKeys int64            `json:"duplicate_keys"`
+	Savings       int64            `json:"savings"`
+	Largest       []DuplicateGroup `json:"largest"`
+	Truncated     bool             `json:"truncated,omitempty"`
+}
+
+// duplicatesHandler starts a duplicates job over the keys under prefix=,
+// hashing a sample= fraction of the values of at least min_size= bytes and
+// listing the limit= groups that would save the most.
+func (app *App) duplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	params := duplicatesParams{Prefix: q.Get("prefix"), Sample: 1, MinSize: 1, Limit: 100}
+	if s := q.Get("sample"); s != "" {
+		parsed, err := strconv.ParseFloat(s, 64)
+		if err != nil || parsed <= 0 || parsed > 1 {
+			http.Error(w, "Parameter 'sample' must be above 0 and at most 1", http.StatusBadRequest)
+			return
+		}
+		params.Sample = parsed
+	}
+	if s := q.Get("min_size"); s != "" {
+		parsed, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Parameter 'min_size' must be a number of bytes", http.StatusBadRequest)
+			return
+		}
+		params.MinSize = parsed
+	}
+	if l := q.Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed >= 0 {
+			params.Limit = parsed
+		}
+	}
+	withSystem := includeSystem(r)
+
+	job, err := app.startJob(r, jobDuplicates, params, func(job *runningJob) (interface{}, error) {
+		return app.findDuplicates(job, params, withSystem)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJobCreated(w, job)
+}
+
+// valueGroup tracks the keys seen with one value; keys is only kept up to
+// maxGroupKeys.
+type valueGroup struct {
+	size  int64
+	count int64
+	keys  []string
+}
+
+func (app *App) findDuplicates(job *runningJob, params duplicatesParams, withSystem bool) (*DuplicatesReport, error) {
+	report := &DuplicatesReport{Largest: make([]DuplicateGroup, 0)}
+	groups := make(map[[sha256.Size]byte]*valueGroup)
+	err := app.view(func(txn *badger.Txn) error {
+		job.holds(txn)
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(params.Prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := job.checkCanceled(); err != nil {
+				return err
+			}
+			item := it.Item()
+			// Archived entries hold a stub, not the value.
+			if !withSystem && app.isSystemKey(item.Key()) || item.UserMeta()&archivedMeta != 0 {
+				continue
+			}
+			report.Keys++
+			job.advance(1)
+			if item.ValueSize() < params.MinSize || params.Sample < 1 && rand.Float64() >= params.Sample {
+				continue
+			}
+			var sum [sha256.Size]byte
+			var size int64
+			err := item.Value(func(val []byte) error {
+				sum, size = sha256.Sum256(val), int64(len(val))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			report.Hashed++
+			report.HashedBytes += size
+
+			g := groups[sum]
+			if g == nil {
+				g = &valueGroup{size: size}
+				groups[sum] = g
+			}
+			g.count++
+			if len(g.keys) < maxGroupKeys {
+				g.keys = append(g.keys, string(item.Key()))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for sum, g := range groups {
+		if g.count < 2 {
+			continue
+		}
+		savings := (g.count - 1) * g.size
+		report.Groups++
+		report.DuplicateKeys += g.count
+		report.Savings += savings
+		report.Largest = append(report.Largest, DuplicateGroup{
+			SHA256:  hex.EncodeToString(sum[:]),
+			Size:    g.size,
+			Count:   g.count,
+			Keys:    g.keys,
+			Savings: savings,
+		})
+	}
+	sort.Slice(report.Largest, func(i, j int) bool {
+		if report.Largest[i].Savings != report.Largest[j].Savings {
+			return report.Largest[i].Savings > report.Largest[j].Savings
+		}
+		return report.Largest[i].SHA256 < report.Largest[j].SHA256
+	})
+	if len(report.Largest) > params.Limit {
+		report.Largest = report.Largest[:params.Limit]
+		report.Truncated = true
+	}
+	return report, nil
+}
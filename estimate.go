@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/dgraph-io/badger/v4/y"
+)
+
+// GET /api/stats/estimate?prefix= sizes a prefix from the table key ranges
+// alone, without reading any data. Tables whose whole range is under the
+// prefix are counted in full, like db.EstimateSize; tables that only overlap
+// it may hold some of its keys, so they only raise the upper bounds. Entries
+// still in the memtables and values kept in the value log are not included.
+
+type SizeEstimate struct {
+	Prefix string `json:"prefix"`
+	// Size, UncompressedSize and Keys add up the tables entirely under the
+	// prefix. Keys counts every version and deletion marker.
+	Size             int64 `json:"size"`
+	UncompressedSize int64 `json:"uncompressed_size"`
+	Keys             int64 `json:"keys"`
+	Tables           int   `json:"tables"`
+	// MaxSize and MaxKeys also include the tables partly under the prefix.
+	MaxSize       int64 `json:"max_size"`
+	MaxKeys       int64 `json:"max_keys"`
+	PartialTables int   `json:"partial_tables"`
+}
+
+func (app *App) estimateSize(prefix []byte) SizeEstimate {
+	estimate := SizeEstimate{Prefix: string(prefix)}
+	for _, t := range app.db.Tables() {
+		left, right := y.ParseKey(t.Left), y.ParseKey(t.Right)
+		inside := bytes.HasPrefix(left, prefix) && bytes.HasPrefix(right, prefix)
+		// A table overlaps the prefix when either end is under it or the
+		// prefix falls between its ends.
+		overlaps := inside || bytes.HasPrefix(left, prefix) || bytes.HasPrefix(right, prefix) ||
+			bytes.Compare(left, prefix) < 0 && bytes.Compare(right, prefix) > 0
+		if !overlaps {
+			continue
+		}
+		estimate.MaxSize += int64(t.OnDiskSize)
+		estimate.MaxKeys += int64(t.KeyCount)
+		if !inside {
+			estimate.PartialTables++
+			continue
+		}
+		estimate.Tables++
+		estimate.Size += int64(t.OnDiskSize)
+		estimate.UncompressedSize += int64(t.UncompressedSize)
+		estimate.Keys += int64(t.KeyCount)
+	}
+	return estimate
+}
+
+func (app *App) estimateHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, app.estimateSize([]byte(r.URL.Query().Get("prefix"))))
+}
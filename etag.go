@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// collectionTag builds the ETag of a list response from the keys and versions
+// it covers, as they are scanned. Any write or delete in the range changes a
+// version or the set of keys, so the tag changes with the data without
+// hashing the values.
+type collectionTag struct {
+	h   hash.Hash64
+	buf [8]byte
+}
+
+// newCollectionTag starts a tag for r. The query string, the HTML fragment
+// format and whether the caller sees redacted values are part of it, as they
+// change the response.
+func (app *App) newCollectionTag(r *http.Request) *collectionTag {
+	t := &collectionTag{h: fnv.New64a()}
+	t.h.Write([]byte(r.URL.RawQuery))
+	if wantsFragment(r) {
+		t.h.Write([]byte{0, 'h'})
+	}
+	if app.redactor != nil {
+		revealed := byte(0)
+		if p := currentPrincipal(r); p != nil && roleAllows(p.Role, app.redactor.revealPerm) {
+			revealed = 1
+		}
+		t.h.Write([]byte{0, revealed})
+	}
+	return t
+}
+
+func (t *collectionTag) add(key []byte, version uint64) {
+	binary.BigEndian.PutUint64(t.buf[:], uint64(len(key)))
+	t.h.Write(t.buf[:])
+	t.h.Write(key)
+	binary.BigEndian.PutUint64(t.buf[:], version)
+	t.h.Write(t.buf[:])
+}
+
+func (t *collectionTag) String() string {
+	return `"c` + strconv.FormatUint(t.h.Sum64(), 36) + `"`
+}
+
+// notModified sets the ETag header and answers 304 when the request's
+// If-None-Match already names it, reporting whether it did.
+func (t *collectionTag) notModified(w http.ResponseWriter, r *http.Request) bool {
+	etag := t.String()
+	w.Header().Set("ETag", etag)
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types published on the event bus.
+const (
+	EventSet     = "set"
+	EventDelete  = "delete"
+	EventExpired = "expired"
+)
+
+type Event struct {
+	Type   string `json:"type"`
+	Key    string `json:"key,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	// Store names the STORES entry written to, empty for the live database.
+	Store string    `json:"store,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// eventBus queues events and delivers them to the configured webhooks in the
+// background so publishers never block on slow receivers.
+type eventBus struct {
+	queue  chan Event
+	client *http.Client
+
+	mu       sync.RWMutex
+	webhooks []string
+
+	// activity keeps the last key events for GET /api/admin/activity.
+	activity *activityLog
+	// notifier forwards events to the notification channels, see notify.go.
+	notifier *notifier
+}
+
+func newEventBus(webhooks []string) *eventBus {
+	bus := &eventBus{
+		queue:    make(chan Event, 1024),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		webhooks: webhooks,
+		activity: newActivityLog(),
+	}
+	go bus.run()
+	return bus
+}
+
+// parseList splits a comma-separated setting, dropping empty items.
+func parseList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (b *eventBus) setWebhooks(webhooks []string) {
+	b.mu.Lock()
+	b.webhooks = webhooks
+	b.mu.Unlock()
+}
+
+// publish queues evt for the webhooks. A nil bus, as used while replaying
+// the journal into a restored copy, drops events.
+func (b *eventBus) publish(evt Event) {
+	if b == nil {
+		return
+	}
+	if evt.Time.IsZero() {
+		evt.Time = time.Now()
+	}
+	select {
+	case b.queue <- evt:
+	default:
+		warnf("Event queue full, dropping %s event for %q", evt.Type, evt.Key)
+	}
+}
+
+// setNotifier routes events to the notification channels.
+func (b *eventBus) setNotifier(n *notifier) {
+	b.mu.Lock()
+	b.notifier = n
+	b.mu.Unlock()
+}
+
+func (b *eventBus) run() {
+	for evt := range b.queue {
+		b.activity.record(evt)
+
+		b.mu.RLock()
+		webhooks, notifier := b.webhooks, b.notifier
+		b.mu.RUnlock()
+		notifier.notify(evt)
+
+		if len(webhooks) == 0 {
+			continue
+		}
+		body, err := json.Marshal(evt)
+		if err != nil {
+			errorf("Failed to encode %s event: %v", evt.Type, err)
+			continue
+		}
+		for _, url := range webhooks {
+			b.deliver(url, body)
+		}
+	}
+}
+
+// deliver posts an event to one webhook, retrying a few times with backoff.
+func (b *eventBus) deliver(url string, body []byte) {
+	backoff := time.Second
+	for attempt := 1; attempt <= 3; attempt++ {
+		resp, err := b.client.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				debugf("Webhook %s accepted the event (attempt %d)", url, attempt)
+				return
+			}
+			warnf("Webhook %s answered %s (attempt %d)", url, resp.Status, attempt)
+		} else {
+			warnf("Webhook %s failed (attempt %d): %v", url, attempt, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// POST /api/keys/exists answers which of a list of keys exist, all in one
+// read transaction. Lookups only touch the LSM tree: txn.Get never reads
+// values from the value log.
+
+const maxExistsKeys = 1000
+
+func (app *App) keysExistHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Keys) > maxExistsKeys {
+		http.Error(w, "At most "+strconv.Itoa(maxExistsKeys)+" keys can be checked at once", http.StatusBadRequest)
+		return
+	}
+	readTs, ok := app.timestampParam(w, r, "read_ts")
+	if !ok {
+		return
+	}
+	showSystem := includeSystem(r)
+
+	exists := make(map[string]bool, len(req.Keys))
+	err := app.viewAt(readTs, func(txn *badger.Txn) error {
+		for _, key := range req.Keys {
+			if key == "" || !showSystem && app.isSystemKey([]byte(key)) {
+				exists[key] = false
+				continue
+			}
+			_, err := txn.Get([]byte(key))
+			if err != nil && err != badger.ErrKeyNotFound {
+				return err
+			}
+			exists[key] = err == nil
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// In proxy mode, keys missing locally may exist upstream; they are
+	// checked there without being cached.
+	if app.proxy != nil {
+		for key, found := range exists {
+			if found || key == "" || app.isSystemKey([]byte(key)) {
+				continue
+			}
+			if _, exists[key], err = app.proxy.fetch(key); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+		}
+	}
+	writeJSON(w, exists)
+}
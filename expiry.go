@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Badger drops expired keys silently. To notice expirations, every key written
+// with a TTL is tracked under the system prefix with its expiry time, and a
+// sweeper periodically checks the tracked keys whose time has passed.
+const expiryNamespace = "ttl:"
+
+// setEntry writes e and keeps the expiry index in sync with its TTL. File
+// metadata no longer applies to the new value and is dropped.
+func (app *App) setEntry(txn *badger.Txn, e *badger.Entry) error {
+	if err := txn.SetEntry(e); err != nil {
+		return err
+	}
+	if err := app.clearFileMeta(txn, e.Key); err != nil {
+		return err
+	}
+	return app.setEntryIndex(txn, e.Key, e.ExpiresAt)
+}
+
+func (app *App) setEntryIndex(txn *badger.Txn, key []byte, expiresAt uint64) error {
+	trackKey := app.systemKey(expiryNamespace + string(key))
+	if expiresAt == 0 {
+		return txn.Delete(trackKey)
+	}
+	return txn.Set(trackKey, expiryIndexValue(expiresAt))
+}
+
+// expiryIndexValue encodes the expiry time kept in the expiry index.
+func expiryIndexValue(expiresAt uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, expiresAt)
+	return buf
+}
+
+// deleteEntry removes key together with its expiry tracking and file
+// metadata.
+func (app *App) deleteEntry(txn *badger.Txn, key []byte) error {
+	if err := txn.Delete(key); err != nil {
+		return err
+	}
+	if err := app.clearFileMeta(txn, key); err != nil {
+		return err
+	}
+	return txn.Delete(app.systemKey(expiryNamespace + string(key)))
+}
+
+func (app *App) runExpirySweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		expired, err := app.sweepExpired()
+		if err != nil {
+			errorf("Expiry sweep failed: %v", err)
+			continue
+		}
+		for _, key := range expired {
+			app.events.publish(Event{Type: EventExpired, Key: key})
+		}
+	}
+}
+
+// sweepExpired returns the tracked keys that have expired since the last
+// sweep and stops tracking them.
+func (app *App) sweepExpired() ([]string, error) {
+	expired := make([]string, 0)
+	now := uint64(time.Now().Unix())
+	prefix := app.systemKey(expiryNamespace)
+
+	err := app.update(func(txn *badger.Txn) error {
+		due, err := dueExpiries(txn, prefix, now)
+		if err != nil {
+			return err
+		}
+
+		for key, expiresAt := range due {
+			trackKey := append(append([]byte{}, prefix...), key...)
+			item, err := txn.Get([]byte(key))
+			switch {
+			case err == badger.ErrKeyNotFound:
+				expired = append(expired, key)
+				if err = app.clearFileMeta(txn, []byte(key)); err == nil {
+					err = txn.Delete(trackKey)
+				}
+			case err != nil:
+				return err
+			case item.ExpiresAt() == expiresAt:
+				// Not expired yet by Badger's clock; check again next sweep.
+			default:
+				// Rewritten without going through setEntry, resync the index.
+				err = app.setEntryIndex(txn, []byte(key), item.ExpiresAt())
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+// dueExpiries lists the tracked keys whose expiry time is not after now.
+func dueExpiries(txn *badger.Txn, prefix []byte, now uint64) (map[string]uint64, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	due := make(map[string]uint64)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(val) == 8 {
+			if expiresAt := binary.BigEndian.Uint64(val); expiresAt <= now {
+				due[strings.TrimPrefix(string(item.Key()), string(prefix))] = expiresAt
+			}
+		}
+	}
+	return due, nil
+}
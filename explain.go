@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// With explain=true, list and search describe how they would read the keys
+// instead of returning them, to help users understand why a query is slow
+// and how to restructure their keys. Badger keys are sorted and are their
+// own only index: a prefix is found with a seek, anything else scans every
+// key, and conditions on values read each value in the range.
+
+type QueryCondition struct {
+	Param string `json:"param"`
+	// On is what the condition is evaluated on: key or value.
+	On string `json:"on"`
+}
+
+type QueryPlan struct {
+	Endpoint string `json:"endpoint"`
+	// AccessPath is prefix_seek when prefix= narrows the range, full_scan
+	// otherwise.
+	AccessPath string `json:"access_path"`
+	Prefix     string `json:"prefix"`
+	// Index is always none: there are no secondary indexes.
+	Index      string           `json:"index"`
+	Conditions []QueryCondition `json:"conditions"`
+	// ReadsValues is set when values are read, for the response or for a
+	// filter; values in the value log then cost a random read each.
+	ReadsValues bool `json:"reads_values"`
+	// Limit is where the iteration stops, 0 when it goes through the whole
+	// range.
+	Limit int `json:"limit"`
+	// EstimatedKeys and EstimatedSize come from the tables entirely in the
+	// range, MaxEstimatedKeys also counts the tables partly in it, see
+	// /api/stats/estimate. They count every version, not recent writes.
+	EstimatedKeys    int64    `json:"estimated_keys"`
+	MaxEstimatedKeys int64    `json:"max_estimated_keys"`
+	EstimatedSize    int64    `json:"estimated_size"`
+	Hints            []string `json:"hints"`
+}
+
+// readsValues reports whether a list or search response includes values.
+func readsValues(keysOnly bool, fields fieldSet) bool {
+	if fields != nil {
+		return fields["value"]
+	}
+	return !keysOnly
+}
+
+// explainQuery describes the plan of a list or search with the given
+// iterator options, query conditions and limit (0 for none).
+func (app *App) explainQuery(endpoint string, opts badger.IteratorOptions, query keyQuery, limit int, readsValues bool) QueryPlan {
+	plan := QueryPlan{
+		Endpoint:    endpoint,
+		AccessPath:  "full_scan",
+		Prefix:      string(opts.Prefix),
+		Index:       "none",
+		Conditions:  make([]QueryCondition, 0),
+		ReadsValues: readsValues || query.filter != nil,
+		Limit:       limit,
+		Hints:       make([]string, 0),
+	}
+	if len(opts.Prefix) > 0 {
+		plan.AccessPath = "prefix_seek"
+	}
+	if query.substring != "" {
+		plan.Conditions = append(plan.Conditions, QueryCondition{Param: "q", On: "key"})
+	}
+	if query.pattern != nil {
+		plan.Conditions = append(plan.Conditions, QueryCondition{Param: "regex", On: "key"})
+	}
+	if query.filter != nil {
+		plan.Conditions = append(plan.Conditions, QueryCondition{Param: "filter", On: "value"})
+	}
+	estimate := app.estimateSize(opts.Prefix)
+	plan.EstimatedKeys, plan.MaxEstimatedKeys, plan.EstimatedSize = estimate.Keys, estimate.MaxKeys, estimate.Size
+
+	if plan.AccessPath == "full_scan" && len(plan.Conditions) > 0 {
+		hint := "Every key is scanned because conditions on keys cannot use a seek; pass the part of the key they share as prefix= to scan only that range"
+		if query.pattern != nil && strings.HasPrefix(query.pattern.String(), "^") {
+			if literal, _ := query.pattern.LiteralPrefix(); literal != "" {
+				hint = fmt.Sprintf("The regex starts with %q: pass prefix=%s to seek to it instead of scanning every key", literal, literal)
+			}
+		}
+		plan.Hints = append(plan.Hints, hint)
+	}
+	if query.filter != nil {
+		plan.Hints = append(plan.Hints, "The filter reads the value of every key in the range that passes the key conditions; narrow the range with prefix=, q= or regex= first, or move the fields you filter on into the key")
+	}
+	if limit > 0 && len(plan.Conditions) > 0 {
+		plan.Hints = append(plan.Hints, fmt.Sprintf("The iteration stops after %d matching keys, so rare matches scan more of the range than common ones", limit))
+	}
+	if readsValues {
+		plan.Hints = append(plan.Hints, "Values are read for the response; keys_only=true or fields= without value list keys without reading values")
+	}
+	return plan
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted backups and exports are a header followed by AES-256-GCM sealed
+// chunks. Each chunk nonce is the random prefix from the header, a counter and
+// a final-chunk flag, so reordered, dropped or truncated chunks fail to open.
+//
+//	header: magic(8) | kdf(1) | salt(16) | nonce prefix(7)
+//	chunk:  length(4, big-endian) | ciphertext
+const (
+	encMagic     = "BWUIENC1"
+	encChunkSize = 64 << 10
+	encHeaderLen = len(encMagic) + 1 + 16 + 7
+
+	kdfKeyFile = 0
+	kdfScrypt  = 1
+)
+
+var errNoExportKey = errors.New("the file is encrypted, configure BACKUP_PASSPHRASE or BACKUP_KEY_FILE to read it")
+
+// exportCipher holds either a passphrase, stretched with scrypt and a random
+// salt per file, or a 32-byte key read from a key file.
+type exportCipher struct {
+	passphrase []byte
+	key        []byte
+}
+
+func loadExportCipher() (*exportCipher, error) {
+	passphrase := getEnv("BACKUP_PASSPHRASE", "")
+	keyFile := getEnv("BACKUP_KEY_FILE", "")
+	switch {
+	case passphrase != "" && keyFile != "":
+		return nil, errors.New("set only one of BACKUP_PASSPHRASE and BACKUP_KEY_FILE")
+	case passphrase != "":
+		return &exportCipher{passphrase: []byte(passphrase)}, nil
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("BACKUP_KEY_FILE: %w", err)
+		}
+		return &exportCipher{key: key}, nil
+	}
+	return nil, nil
+}
+
+// parseKey accepts 32 raw bytes, or 32 bytes encoded as hex or base64.
+func parseKey(data []byte) ([]byte, error) {
+	if len(data) == 32 {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("key must be 32 bytes, raw or hex/base64 encoded")
+}
+
+func (c *exportCipher) aead(kdf byte, salt []byte) (cipher.AEAD, error) {
+	key := c.key
+	switch kdf {
+	case kdfScrypt:
+		if c.passphrase == nil {
+			return nil, errors.New("the file is encrypted with a passphrase, set BACKUP_PASSPHRASE")
+		}
+		var err error
+		if key, err = scrypt.Key(c.passphrase, salt, 1<<15, 8, 1, 32); err != nil {
+			return nil, err
+		}
+	case kdfKeyFile:
+		if key == nil {
+			return nil, errors.New("the file is encrypted with a key file, set BACKUP_KEY_FILE")
+		}
+	default:
+		return nil, fmt.Errorf("unknown key derivation %d", kdf)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+// encryptWriter returns a writer that encrypts into w. Close must be called
+// to write the final chunk; without it the output is rejected as truncated.
+func (c *exportCipher) encryptWriter(w io.Writer) (io.WriteCloser, error) {
+	header := make([]byte, encHeaderLen)
+	copy(header, encMagic)
+	kdf := byte(kdfKeyFile)
+	if c.passphrase != nil {
+		kdf = kdfScrypt
+	}
+	header[len(encMagic)] = kdf
+	if _, err := rand.Read(header[len(encMagic)+1:]); err != nil {
+		return nil, err
+	}
+	salt := header[len(encMagic)+1 : len(encMagic)+17]
+	aead, err := c.aead(kdf, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, header: header, prefix: header[len(encMagic)+17:]}, nil
+}
+
+func chunkNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[7:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func (e *encryptWriter) seal(final bool) error {
+	if e.counter == ^uint32(0) {
+		return errors.New("encrypted stream too long")
+	}
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.counter, final), e.buf, e.header)
+	e.counter++
+	e.buf = e.buf[:0]
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := e.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := min(encChunkSize-len(e.buf), len(p))
+		e.buf = append(e.buf, p[:take]...)
+		p = p[take:]
+		if len(e.buf) == encChunkSize {
+			if err := e.seal(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+type decryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		var length [4]byte
+		if _, err := io.ReadFull(d.r, length[:]); err != nil {
+			return 0, errors.New("encrypted file is truncated")
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size > encChunkSize+uint32(d.aead.Overhead()) {
+			return 0, errors.New("encrypted file is corrupt")
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(d.r, sealed); err != nil {
+			return 0, errors.New("encrypted file is truncated")
+		}
+		// A chunk opens either as a regular or as the final chunk.
+		plain, err := d.aead.Open(nil, chunkNonce(d.prefix, d.counter, false), sealed, d.header)
+		if err != nil {
+			if plain, err = d.aead.Open(nil, chunkNonce(d.prefix, d.counter, true), sealed, d.header); err != nil {
+				return 0, errors.New("decryption failed: wrong key or corrupt file")
+			}
+			d.done = true
+		}
+		d.counter++
+		d.buf = plain
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// decryptingReader returns r unchanged when it is not encrypted, and a
+// decrypting reader otherwise.
+func (app *App) decryptingReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(encMagic))
+	if err != nil || !bytes.Equal(magic, []byte(encMagic)) {
+		return br, nil
+	}
+	if app.exportCipher == nil {
+		return nil, errNoExportKey
+	}
+	header := make([]byte, encHeaderLen)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	aead, err := app.exportCipher.aead(header[len(encMagic)], header[len(encMagic)+1:len(encMagic)+17])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: br, aead: aead, header: header, prefix: header[len(encMagic)+17:]}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// encryptingWriter encrypts downloads when a backup key is configured, unless
+// the request opts out with encrypt=false.
+func (app *App) encryptingWriter(w io.Writer, encrypt bool) (io.WriteCloser, error) {
+	if app.exportCipher == nil || !encrypt {
+		return nopWriteCloser{w}, nil
+	}
+	return app.exportCipher.encryptWriter(w)
+}
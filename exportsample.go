@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+)
+
+// Sampled exports produce small, representative fixture files from large
+// namespaces: every=N keeps every Nth matching key, sample=0.01 a random
+// hundredth of them. Random samples are drawn by hashing each key with the
+// seed, so the same seed selects the same keys again, also after unrelated
+// keys were added or removed.
+
+type exportSampler struct {
+	every     int64
+	threshold uint64 // keys hashing below it are kept
+	seed      int64
+	seen      int64
+}
+
+// parseExportSample reads every= or sample= and seed=, answering 400 and
+// reporting false when they are invalid. It returns nil for full exports.
+// The seed of a random sample is sent in X-Sample-Seed, so a sample without
+// seed= can be repeated.
+func parseExportSample(w http.ResponseWriter, r *http.Request) (*exportSampler, bool) {
+	q := r.URL.Query()
+	every, sample := q.Get("every"), q.Get("sample")
+	switch {
+	case every != "" && sample != "":
+		http.Error(w, "Parameters 'every' and 'sample' are mutually exclusive", http.StatusBadRequest)
+		return nil, false
+	case every != "":
+		n, err := strconv.ParseInt(every, 10, 64)
+		if err != nil || n < 1 {
+			http.Error(w, "Parameter 'every' must be a positive number", http.StatusBadRequest)
+			return nil, false
+		}
+		return &exportSampler{every: n}, true
+	case sample != "":
+		fraction, err := strconv.ParseFloat(sample, 64)
+		if err != nil || fraction <= 0 || fraction > 1 {
+			http.Error(w, "Parameter 'sample' must be above 0 and at most 1", http.StatusBadRequest)
+			return nil, false
+		}
+		s := &exportSampler{threshold: math.MaxUint64, seed: rand.Int63()}
+		if fraction < 1 {
+			s.threshold = uint64(fraction * math.MaxUint64)
+		}
+		if v := q.Get("seed"); v != "" {
+			if s.seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+				http.Error(w, "Parameter 'seed' must be a number", http.StatusBadRequest)
+				return nil, false
+			}
+		}
+		w.Header().Set("X-Sample-Seed", strconv.FormatInt(s.seed, 10))
+		return s, true
+	}
+	return nil, true
+}
+
+// keep reports whether key is part of the sample; it is called for each
+// matching key in order.
+func (s *exportSampler) keep(key []byte) bool {
+	if s.every > 0 {
+		s.seen++
+		return (s.seen-1)%s.every == 0
+	}
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(s.seed))
+	h.Write(buf[:])
+	h.Write(key)
+	return mix64(h.Sum64()) <= s.threshold
+}
+
+// mix64 spreads the bits of an FNV hash, whose high bits barely change
+// between keys that differ only at the end (the splitmix64 finalizer).
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Filter expressions select keys by their key, value and JSON content:
+//
+//	json.status == "failed" && json.retries > 3
+//	key startswith "order:" && !(json.customer.vip == true)
+//
+// Operands are key, value (the value as text), size (its length in bytes),
+// json followed by a path such as json.items[0].sku, and string, number,
+// true, false and null literals. Operators are == != < <= > >=, contains,
+// startswith, matches (a regular expression literal), && || ! and
+// parentheses. Values that are not JSON, and paths that lead nowhere, are
+// null. Comparisons between different types are false.
+
+// filterExpr is a compiled filter expression.
+type filterExpr struct {
+	source string
+	root   exprNode
+}
+
+// exprEnv is the key an expression is evaluated against; the value is
+// decoded as JSON at most once.
+type exprEnv struct {
+	key     string
+	value   []byte
+	decoded bool
+	doc     interface{}
+}
+
+func (env *exprEnv) json() interface{} {
+	if !env.decoded {
+		env.decoded = true
+		if json.Unmarshal(env.value, &env.doc) != nil {
+			env.doc = nil
+		}
+	}
+	return env.doc
+}
+
+type exprNode interface {
+	eval(env *exprEnv) interface{}
+}
+
+// match reports whether key and value satisfy the expression.
+func (f *filterExpr) match(key string, value []byte) bool {
+	return truthy(f.root.eval(&exprEnv{key: key, value: value}))
+}
+
+func (f *filterExpr) String() string { return f.source }
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	default:
+		return true
+	}
+}
+
+type literalNode struct{ value interface{} }
+
+func (n literalNode) eval(*exprEnv) interface{} { return n.value }
+
+// pathNode reads key, value, size or a path into the JSON value.
+type pathNode struct {
+	root string
+	path []interface{} // string field names and int indexes
+}
+
+func (n pathNode) eval(env *exprEnv) interface{} {
+	switch n.root {
+	case "key":
+		return env.key
+	case "value":
+		return string(env.value)
+	case "size":
+		return float64(len(env.value))
+	}
+	return lookupJSONPath(env.json(), n.path)
+}
+
+// lookupJSONPath follows path, of string field names and int indexes, into
+// doc; nil if it leads nowhere.
+func lookupJSONPath(doc interface{}, path []interface{}) interface{} {
+	for _, step := range path {
+		switch step := step.(type) {
+		case string:
+			object, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			doc = object[step]
+		case int:
+			array, ok := doc.([]interface{})
+			if !ok || step < 0 || step >= len(array) {
+				return nil
+			}
+			doc = array[step]
+		}
+	}
+	return doc
+}
+
+type notNode struct{ x exprNode }
+
+func (n notNode) eval(env *exprEnv) interface{} { return !truthy(n.x.eval(env)) }
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+	re          *regexp.Regexp
+}
+
+func (n binaryNode) eval(env *exprEnv) interface{} {
+	switch n.op {
+	case "&&":
+		return truthy(n.left.eval(env)) && truthy(n.right.eval(env))
+	case "||":
+		return truthy(n.left.eval(env)) || truthy(n.right.eval(env))
+	}
+
+	l := n.left.eval(env)
+	if n.op == "matches" {
+		s, ok := l.(string)
+		return ok && n.re.MatchString(s)
+	}
+	r := n.right.eval(env)
+	switch n.op {
+	case "==":
+		return equalValues(l, r)
+	case "!=":
+		return !equalValues(l, r)
+	case "contains":
+		switch l := l.(type) {
+		case string:
+			s, ok := r.(string)
+			return ok && strings.Contains(l, s)
+		case []interface{}:
+			for _, item := range l {
+				if equalValues(item, r) {
+					return true
+				}
+			}
+		}
+		return false
+	case "startswith":
+		ls, lok := l.(string)
+		rs, rok := r.(string)
+		return lok && rok && strings.HasPrefix(ls, rs)
+	}
+
+	var c int
+	switch l := l.(type) {
+	case float64:
+		r, ok := r.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case l < r:
+			c = -1
+		case l > r:
+			c = 1
+		}
+	case string:
+		r, ok := r.(string)
+		if !ok {
+			return false
+		}
+		c = strings.Compare(l, r)
+	default:
+		return false
+	}
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+func equalValues(a, b interface{}) bool {
+	switch a := a.(type) {
+	case nil, bool, float64, string:
+		return a == b
+	}
+	// Objects and arrays compare by their JSON encoding.
+	aj, err1 := json.Marshal(a)
+	bj, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && string(aj) == string(bj)
+}
+
+// parseFilter compiles a filter expression.
+func parseFilter(source string) (*filterExpr, error) {
+	tokens, err := tokenizeExpr(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+	}
+	return &filterExpr{source: source, root: root}, nil
+}
+
+// filterCacheSize bounds the filters kept by cachedFilter.
+const filterCacheSize = 256
+
+// filterCache holds the filters compiled for request parameters, so clients
+// polling the same query do not have it parsed on every request. Compiled
+// filters are immutable and shared between requests; the cache is emptied
+// when full.
+var filterCache = struct {
+	sync.Mutex
+	filters map[string]*filterExpr
+}{filters: make(map[string]*filterExpr)}
+
+// cachedFilter is parseFilter through filterCache.
+func cachedFilter(source string) (*filterExpr, error) {
+	filterCache.Lock()
+	f := filterCache.filters[source]
+	filterCache.Unlock()
+	if f != nil {
+		return f, nil
+	}
+	f, err := parseFilter(source)
+	if err != nil {
+		return nil, err
+	}
+	filterCache.Lock()
+	if len(filterCache.filters) >= filterCacheSize {
+		filterCache.filters = make(map[string]*filterExpr)
+	}
+	filterCache.filters[source] = f
+	filterCache.Unlock()
+	return f, nil
+}
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", ".", "[", "]"}
+
+func tokenizeExpr(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(s) && s[j] != c {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			text := s[i+1 : j]
+			if c == '"' {
+				unquoted, err := strconv.Unquote(s[i : j+1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid string at offset %d", i)
+				}
+				text = unquoted
+			} else {
+				text = strings.ReplaceAll(text, `\'`, `'`)
+			}
+			tokens = append(tokens, exprToken{tokString, text, i})
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			j := i + 1
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == 'e' || s[j] == 'E') {
+				j++
+			}
+			tokens = append(tokens, exprToken{tokNumber, s[i:j], i})
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z' || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, exprToken{tokIdent, s[i:j], i})
+			i = j
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(s[i:], op) {
+					tokens = append(tokens, exprToken{tokOp, op, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+		}
+	}
+	return append(tokens, exprToken{kind: tokEOF, text: "end of expression", pos: len(s)}), nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken { return p.tokens[p.pos] }
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) accept(kind int, text string) bool {
+	if t := p.peek(); t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept(tokOp, "||") {
+		var right exprNode
+		if right, err = p.parseAnd(); err == nil {
+			left = binaryNode{op: "||", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.accept(tokOp, "&&") {
+		var right exprNode
+		if right, err = p.parseUnary(); err == nil {
+			left = binaryNode{op: "&&", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.accept(tokOp, "!") {
+		x, err := p.parseUnary()
+		return notNode{x}, err
+	}
+	return p.parseComparison()
+}
+
+var comparisonOps = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"contains": true, "startswith": true, "matches": true,
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if (t.kind != tokOp && t.kind != tokIdent) || !comparisonOps[t.text] {
+		return left, nil
+	}
+	p.next()
+	if t.text == "matches" {
+		pattern := p.next()
+		if pattern.kind != tokString {
+			return nil, fmt.Errorf("matches at offset %d needs a string pattern", t.pos)
+		}
+		re, err := regexp.Compile(pattern.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern at offset %d: %w", pattern.pos, err)
+		}
+		return binaryNode{op: t.text, left: left, re: re}, nil
+	}
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	return binaryNode{op: t.text, left: left, right: right}, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return literalNode{t.text}, nil
+	case tokNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", t.text, t.pos)
+		}
+		return literalNode{n}, nil
+	case tokOp:
+		if t.text == "(" {
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.accept(tokOp, ")") {
+				t := p.peek()
+				return nil, fmt.Errorf("expected ) at offset %d", t.pos)
+			}
+			return x, nil
+		}
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		case "null":
+			return literalNode{nil}, nil
+		case "key", "value", "size":
+			return pathNode{root: t.text}, nil
+		case "json":
+			path, err := p.parsePath()
+			return pathNode{root: t.text, path: path}, err
+		}
+		return nil, fmt.Errorf("unknown name %q at offset %d, expected key, value, size or json", t.text, t.pos)
+	}
+	return nil, fmt.Errorf("unexpected %s at offset %d", t.text, t.pos)
+}
+
+// parsePath reads .field, ["field"] and [index] steps.
+func (p *exprParser) parsePath() ([]interface{}, error) {
+	var path []interface{}
+	for {
+		switch {
+		case p.accept(tokOp, "."):
+			t := p.next()
+			if t.kind != tokIdent {
+				return nil, fmt.Errorf("expected a field name at offset %d", t.pos)
+			}
+			path = append(path, t.text)
+		case p.accept(tokOp, "["):
+			t := p.next()
+			switch t.kind {
+			case tokString:
+				path = append(path, t.text)
+			case tokNumber:
+				index, err := strconv.Atoi(t.text)
+				if err != nil {
+					return nil, fmt.Errorf("invalid index %q at offset %d", t.text, t.pos)
+				}
+				path = append(path, index)
+			default:
+				return nil, fmt.Errorf("expected an index at offset %d", t.pos)
+			}
+			if !p.accept(tokOp, "]") {
+				return nil, fmt.Errorf("expected ] at offset %d", p.peek().pos)
+			}
+		default:
+			return path, nil
+		}
+	}
+}
+
+// parseJSONPath parses a dotted path such as address.city or items[0].sku,
+// as used in projections.
+func parseJSONPath(s string) ([]interface{}, error) {
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: append([]exprToken{{kind: tokOp, text: "."}}, tokens...)}
+	path, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF || len(path) == 0 {
+		return nil, fmt.Errorf("invalid path %q", s)
+	}
+	return path, nil
+}
+
+// parseFieldPath parses a field path that may start with the $ root, as in
+// $.customer.email; $ alone, or an empty path, is the whole value (nil).
+func parseFieldPath(s string) ([]interface{}, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "$"), ".")
+	if s == "" {
+		return nil, nil
+	}
+	return parseJSONPath(s)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// GET /api/config tells the web UI and API clients what this server allows,
+// so they can hide what would fail instead of finding out from a 403: the
+// authentication methods and the caller's permissions, read-only and
+// maintenance modes, the other databases and stores, and the features
+// switched off with DISABLED_FEATURES. The index page embeds the same
+// document.
+
+// Features that DISABLED_FEATURES can switch off, typically the risky ones in
+// production.
+const (
+	FeatureDelete = "delete" // deleting keys, also in stores
+	FeatureBulk   = "bulk"   // POST /api/keys/bulk
+	FeatureUpload = "upload" // storing uploaded files as values
+	FeatureImport = "import" // imports, restores and chunked uploads
+	FeatureExport = "export" // exports and backups
+)
+
+var allFeatures = []string{FeatureDelete, FeatureBulk, FeatureUpload, FeatureImport, FeatureExport}
+
+// loadDisabledFeatures parses DISABLED_FEATURES.
+func loadDisabledFeatures() (map[string]bool, error) {
+	disabled := make(map[string]bool)
+	for _, name := range parseList(getEnv("DISABLED_FEATURES", "")) {
+		known := false
+		for _, f := range allFeatures {
+			known = known || f == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown feature %q, expected one of %s", name, strings.Join(allFeatures, ", "))
+		}
+		disabled[name] = true
+	}
+	return disabled, nil
+}
+
+// requestFeature names the feature r uses, "" when it is not switchable.
+func requestFeature(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case path == "/api/keys/bulk":
+		return FeatureBulk
+	case r.Method == http.MethodDelete && (strings.HasPrefix(path, "/api/keys/") || strings.HasPrefix(path, "/api/stores/")):
+		return FeatureDelete
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/api/keys/") && strings.HasSuffix(path, "/file"):
+		return FeatureUpload
+	case path == "/api/admin/import", path == "/api/admin/restore", path == "/api/admin/restore-to", path == "/api/admin/migrate",
+		strings.HasPrefix(path, "/api/admin/uploads"):
+		return FeatureImport
+	case path == "/api/admin/export", path == "/api/admin/backup":
+		return FeatureExport
+	}
+	return ""
+}
+
+// featuresMiddleware rejects requests to disabled features.
+func (app *App) featuresMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f := requestFeature(r); f != "" && app.disabledFeatures[f] {
+			http.Error(w, "The "+f+" feature is disabled on this server", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type AuthConfig struct {
+	Enabled bool `json:"enabled"`
+	// Methods are the ways to sign in: password (AUTH_USERS or stored
+	// users), token, hmac, oidc and ldap.
+	Methods []string   `json:"methods"`
+	User    *principal `json:"user,omitempty"`
+}
+
+// Permissions are what the caller may do right now, taking read-only and
+// maintenance modes into account.
+type Permissions struct {
+	Read  bool `json:"read"`
+	Write bool `json:"write"`
+	Admin bool `json:"admin"`
+}
+
+type UIConfig struct {
+	BasePath    string          `json:"base_path"`
+	Auth        AuthConfig      `json:"auth"`
+	Permissions Permissions     `json:"permissions"`
+	ReadOnly    bool            `json:"read_only"`
+	Maintenance bool            `json:"maintenance"`
+	Managed     bool            `json:"managed"`
+	Databases   []string        `json:"databases"`
+	Stores      []string        `json:"stores"`
+	Features    map[string]bool `json:"features"`
+}
+
+// uiConfig describes the server as seen by the caller of r.
+func (app *App) uiConfig(r *http.Request) UIConfig {
+	c := UIConfig{
+		BasePath:    app.basePath,
+		Auth:        AuthConfig{Enabled: app.authEnabled(), Methods: make([]string, 0), User: currentPrincipal(r)},
+		ReadOnly:    app.readOnly(),
+		Maintenance: app.maintenance.get().Enabled,
+		Managed:     app.managed,
+		Databases:   make([]string, 0, len(app.databases)),
+		Stores:      make([]string, 0, len(app.stores)),
+		Features:    make(map[string]bool, len(allFeatures)),
+	}
+
+	app.credentials.mu.RLock()
+	if len(app.credentials.users) > 0 || app.storedUsers.Load() {
+		c.Auth.Methods = append(c.Auth.Methods, "password")
+	}
+	if len(app.credentials.tokens) > 0 {
+		c.Auth.Methods = append(c.Auth.Methods, "token")
+	}
+	app.credentials.mu.RUnlock()
+	if app.hmac != nil {
+		c.Auth.Methods = append(c.Auth.Methods, "hmac")
+	}
+	if app.oidc != nil {
+		c.Auth.Methods = append(c.Auth.Methods, "oidc")
+	}
+	if app.ldap != nil {
+		c.Auth.Methods = append(c.Auth.Methods, "ldap")
+	}
+
+	allows := func(perm int) bool {
+		return !c.Auth.Enabled || c.Auth.User != nil && roleAllows(c.Auth.User.Role, perm)
+	}
+	c.Permissions = Permissions{
+		Read:  allows(permRead),
+		Write: allows(permWrite) && !c.ReadOnly && !c.Maintenance,
+		Admin: allows(permAdmin),
+	}
+
+	for name := range app.databases {
+		c.Databases = append(c.Databases, name)
+	}
+	sort.Strings(c.Databases)
+	for name := range app.stores {
+		c.Stores = append(c.Stores, name)
+	}
+	sort.Strings(c.Stores)
+	for _, f := range allFeatures {
+		c.Features[f] = !app.disabledFeatures[f]
+	}
+	return c
+}
+
+// CanDelete and CanUpload tell the templates which controls to show.
+func (c UIConfig) CanDelete() bool { return c.Permissions.Write && c.Features[FeatureDelete] }
+func (c UIConfig) CanUpload() bool { return c.Permissions.Write && c.Features[FeatureUpload] }
+
+func (app *App) configHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, app.uiConfig(r))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// fields=key,size,ttl on list, search and get returns only the named
+// attributes of each key. Values are only read when "value" is among them,
+// so table views that show metadata never touch the value log.
+
+// Fields that can be selected.
+var selectableFields = map[string]bool{
+	"key":        true,
+	"value":      true,
+	"size":       true,
+	"version":    true,
+	"created_at": true,
+	"expires_at": true,
+	"ttl":        true,
+	"archived":   true,
+	"redacted":   true,
+	"file":       true,
+}
+
+type fieldSet map[string]bool
+
+// parseFields reads the fields parameter, nil when absent. It answers 400
+// and reports false for unknown fields.
+func parseFields(w http.ResponseWriter, r *http.Request) (fieldSet, bool) {
+	value := r.URL.Query().Get("fields")
+	if value == "" {
+		return nil, true
+	}
+	fields := make(fieldSet)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if !selectableFields[name] {
+			http.Error(w, "Unknown field "+name+" in 'fields'", http.StatusBadRequest)
+			return nil, false
+		}
+		fields[name] = true
+	}
+	return fields, true
+}
+
+// fieldSource describes a key for selectFields; value and file are only
+// called when selected.
+type fieldSource struct {
+	key       string
+	version   uint64
+	size      int64
+	expiresAt uint64
+	archived  bool
+	value     func() ([]byte, error)
+	file      func() (*FileMeta, error)
+}
+
+// itemFields describes item; archived values are left out, as in listings.
+func (app *App) itemFields(txn *badger.Txn, item *badger.Item) fieldSource {
+	return fieldSource{
+		key:       string(item.Key()),
+		version:   item.Version(),
+		size:      item.ValueSize(),
+		expiresAt: item.ExpiresAt(),
+		archived:  item.UserMeta()&archivedMeta != 0,
+		value: func() ([]byte, error) {
+			if item.UserMeta()&archivedMeta != 0 {
+				return nil, nil
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return nil, err
+			}
+			return app.scriptRead(string(item.Key()), value)
+		},
+		file: func() (*FileMeta, error) {
+			return app.loadFileMeta(txn, item.Key())
+		},
+	}
+}
+
+// selectFields builds the record of src holding the selected fields, masking
+// the value for callers who may not see it. ttl is the number of seconds
+// left, null for keys that do not expire.
+func (app *App) selectFields(r *http.Request, fields fieldSet, src fieldSource) (map[string]interface{}, error) {
+	record := make(map[string]interface{}, len(fields))
+	redacted := app.shouldRedact(r, src.key)
+	for name := range fields {
+		switch name {
+		case "key":
+			record[name] = src.key
+		case "value":
+			if redacted {
+				record[name] = redactedValue
+				continue
+			}
+			value, err := src.value()
+			if err != nil {
+				return nil, err
+			}
+			record[name] = string(value)
+		case "size":
+			record[name] = src.size
+		case "version":
+			record[name] = src.version
+		case "created_at":
+			record[name] = time.Unix(int64(src.version), 0)
+		case "expires_at":
+			record[name] = nil
+			if src.expiresAt > 0 {
+				record[name] = time.Unix(int64(src.expiresAt), 0).UTC()
+			}
+		case "ttl":
+			record[name] = nil
+			if src.expiresAt > 0 {
+				record[name] = max(int64(src.expiresAt)-time.Now().Unix(), 0)
+			}
+		case "archived":
+			record[name] = src.archived
+		case "redacted":
+			record[name] = redacted
+		case "file":
+			meta, err := src.file()
+			if err != nil {
+				return nil, err
+			}
+			record[name] = meta
+		}
+	}
+	return record, nil
+}
+
+// keyFields selects the fields of key as of readTs, rehydrating an archived
+// value if selected and falling back to the upstream in proxy mode. It
+// returns badger.ErrKeyNotFound for unknown keys.
+func (app *App) keyFields(r *http.Request, key string, readTs uint64, fields fieldSet) (map[string]interface{}, error) {
+	var record map[string]interface{}
+	err := app.viewAt(readTs, func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		src := app.itemFields(txn, item)
+		if src.archived {
+			src.value = func() ([]byte, error) {
+				stub, err := item.ValueCopy(nil)
+				if err != nil {
+					return nil, err
+				}
+				if readTs != 0 {
+					value, _, err := app.fetchArchived(stub)
+					if err != nil {
+						return nil, err
+					}
+					return app.scriptRead(key, value)
+				}
+				value, err := app.rehydrate(key, stub, src.version)
+				if err == errArchiveRace {
+					// Rewritten since: its current value, hooks applied.
+					value, _, err = app.lookupKey(key, 0)
+					return value, err
+				}
+				if err != nil {
+					return nil, err
+				}
+				return app.scriptRead(key, value)
+			}
+		}
+		record, err = app.selectFields(r, fields, src)
+		return err
+	})
+	if err != badger.ErrKeyNotFound || app.proxy == nil {
+		return record, err
+	}
+
+	value, version, err := app.lookupKey(key, readTs)
+	if err != nil {
+		return nil, err
+	}
+	return app.selectFields(r, fields, fieldSource{
+		key:     key,
+		version: version,
+		size:    int64(len(value)),
+		value:   func() ([]byte, error) { return value, nil },
+		file:    func() (*FileMeta, error) { return app.fileMeta(key), nil },
+	})
+}
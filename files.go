@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Values uploaded as files keep their file name and content type under the
+// system prefix. Any other write to the key drops the metadata again.
+const fileMetaNamespace = "files:"
+
+type FileMeta struct {
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+func (app *App) loadFileMeta(txn *badger.Txn, key []byte) (*FileMeta, error) {
+	item, err := txn.Get(app.systemKey(fileMetaNamespace + string(key)))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var meta FileMeta
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &meta)
+	})
+	return &meta, err
+}
+
+func (app *App) setFileMeta(txn *badger.Txn, key []byte, meta *FileMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return txn.Set(app.systemKey(fileMetaNamespace+string(key)), data)
+}
+
+// clearFileMeta removes the metadata of key, if any, without writing a
+// tombstone for the common case of plain values.
+func (app *App) clearFileMeta(txn *badger.Txn, key []byte) error {
+	metaKey := app.systemKey(fileMetaNamespace + string(key))
+	if _, err := txn.Get(metaKey); err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return txn.Delete(metaKey)
+}
+
+// fileMeta returns the metadata of key, or nil for plain values.
+func (app *App) fileMeta(key string) *FileMeta {
+	if meta, ok := app.readCache.fileMeta(key); ok {
+		return meta
+	}
+	var meta *FileMeta
+	_ = app.view(func(txn *badger.Txn) error {
+		var err error
+		meta, err = app.loadFileMeta(txn, []byte(key))
+		return err
+	})
+	return meta
+}
+
+// uploadFileHandler stores the "file" part of a multipart/form-data request
+// as the value of key, along with its file name and content type.
+func (app *App) uploadFileHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := routeKey(w, r)
+	if !ok {
+		return
+	}
+
+	if app.rejectSystemWrite(w, key) {
+		return
+	}
+	commitTs, ok := app.timestampParam(w, r, "commit_ts")
+	if !ok {
+		return
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart/form-data body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			http.Error(w, "Form field 'file' is required", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Invalid multipart body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, app.maxValueSize+1))
+		if err != nil {
+			http.Error(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if int64(len(value)) > app.maxValueSize {
+			http.Error(w, fmt.Sprintf("File exceeds the maximum size of %d bytes", app.maxValueSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if app.rejectInvalidWrite(w, key, value) {
+			return
+		}
+
+		contentType := part.Header.Get("Content-Type")
+		if contentType == "" || contentType == "application/octet-stream" {
+			contentType = http.DetectContentType(value)
+		}
+		meta := &FileMeta{
+			Filename:    part.FileName(),
+			ContentType: contentType,
+			Size:        int64(len(value)),
+			UploadedAt:  time.Now().UTC(),
+		}
+		info, err := app.storeValue(key, value, meta, commitTs)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeTxnHeaders(w, info)
+		writeJSON(w, KeyValue{Key: key, CreatedAt: meta.UploadedAt, Version: info.CommitTs, File: meta})
+		return
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// A fix job applies a find-and-replace to the values under a prefix, so mass
+// data fixes do not need a one-off program: a regular expression replacement
+// on the value text, and setting or deleting fields of JSON values. Keys can
+// be narrowed down with a filter expression (see expr.go). Values are
+// rewritten in batches of transactions as large as Badger allows, keeping
+// their TTL; each key is read again in the transaction that rewrites it, so
+// concurrent writes are not lost. With dry_run nothing is written and the
+// result shows what would change.
+
+const jobFix = "fix"
+
+// fixSamples is the number of changes shown in the result.
+const fixSamples = 10
+
+type FixReplace struct {
+	Pattern string `json:"pattern"`
+	// With may refer to groups of the pattern as $1 or ${name}.
+	With string `json:"with"`
+}
+
+type fixParams struct {
+	Prefix  string                     `json:"prefix"`
+	Filter  string                     `json:"filter,omitempty"`
+	Replace *FixReplace                `json:"replace,omitempty"`
+	Set     map[string]json.RawMessage `json:"set,omitempty"`
+	Delete  []string                   `json:"delete,omitempty"`
+	DryRun  bool                       `json:"dry_run,omitempty"`
+}
+
+type FixSample struct {
+	Key    string `json:"key"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+type FixResult struct {
+	DryRun  bool  `json:"dry_run"`
+	Scanned int64 `json:"scanned"`
+	Matched int64 `json:"matched"`
+	Changed int64 `json:"changed"`
+	// Skipped counts matching keys that could not be fixed: files, archived
+	// values, and values that are not JSON when fields are set or deleted.
+	Skipped int64       `json:"skipped"`
+	Samples []FixSample `json:"samples"`
+}
+
+type fixSetField struct {
+	path  []interface{}
+	value interface{}
+}
+
+// fixer is a compiled fix.
+type fixer struct {
+	filter  *filterExpr
+	pattern *regexp.Regexp
+	with    []byte
+	set     []fixSetField
+	delete  [][]interface{}
+}
+
+var errNotJSON = errors.New("value is not JSON")
+
+func (p *fixParams) compile() (*fixer, error) {
+	f := &fixer{}
+	if p.Replace == nil && len(p.Set) == 0 && len(p.Delete) == 0 {
+		return nil, errors.New("at least one of replace, set and delete is required")
+	}
+	var err error
+	if p.Filter != "" {
+		if f.filter, err = parseFilter(p.Filter); err != nil {
+			return nil, errors.New("filter: " + err.Error())
+		}
+	}
+	if p.Replace != nil {
+		if f.pattern, err = regexp.Compile(p.Replace.Pattern); err != nil {
+			return nil, errors.New("replace: " + err.Error())
+		}
+		f.with = []byte(p.Replace.With)
+	}
+	fields := make([]string, 0, len(p.Set))
+	for field := range p.Set {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		path, err := parseJSONPath(field)
+		if err != nil {
+			return nil, errors.New("set: " + err.Error())
+		}
+		var value interface{}
+		if err := json.Unmarshal(p.Set[field], &value); err != nil {
+			return nil, fmt.Errorf("set: %s: %v", field, err)
+		}
+		f.set = append(f.set, fixSetField{path: path, value: value})
+	}
+	for _, field := range p.Delete {
+		path, err := parseJSONPath(field)
+		if err != nil {
+			return nil, errors.New("delete: " + err.Error())
+		}
+		f.delete = append(f.delete, path)
+	}
+	return f, nil
+}
+
+// apply returns the fixed value, which is value itself when nothing changed.
+func (f *fixer) apply(value []byte) ([]byte, error) {
+	fixed := value
+	if f.pattern != nil {
+		fixed = f.pattern.ReplaceAll(fixed, f.with)
+	}
+	if len(f.set) == 0 && len(f.delete) == 0 {
+		return fixed, nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(fixed, &doc); err != nil {
+		return nil, errNotJSON
+	}
+	var err error
+	for _, s := range f.set {
+		if doc, err = setJSONPath(doc, s.path, s.value); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range f.delete {
+		doc = deleteJSONPath(doc, path)
+	}
+	return json.Marshal(doc)
+}
+
+// setJSONPath sets the value at path in doc, creating the objects on the way,
+// and returns doc. Array indexes must exist.
+func setJSONPath(doc interface{}, path []interface{}, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	switch step := path[0].(type) {
+	case string:
+		object, ok := doc.(map[string]interface{})
+		if !ok {
+			if doc != nil {
+				return nil, fmt.Errorf("cannot set field %q of a %T", step, doc)
+			}
+			object = make(map[string]interface{})
+		}
+		child, err := setJSONPath(object[step], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		object[step] = child
+		return object, nil
+	case int:
+		array, ok := doc.([]interface{})
+		if !ok || step < 0 || step >= len(array) {
+			return nil, fmt.Errorf("index %d does not exist", step)
+		}
+		child, err := setJSONPath(array[step], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		array[step] = child
+		return array, nil
+	}
+	return doc, nil
+}
+
+// deleteJSONPath removes the field or array element at path from doc and
+// returns doc; paths that lead nowhere are ignored.
+func deleteJSONPath(doc interface{}, path []interface{}) interface{} {
+	parent := lookupJSONPath(doc, path[:len(path)-1])
+	switch step := path[len(path)-1].(type) {
+	case string:
+		if object, ok := parent.(map[string]interface{}); ok {
+			delete(object, step)
+		}
+	case int:
+		if array, ok := parent.([]interface{}); ok && step >= 0 && step < len(array) {
+			array = append(array[:step], array[step+1:]...)
+			if len(path) == 1 {
+				return array
+			}
+			doc, _ = setJSONPath(doc, path[:len(path)-1], array)
+		}
+	}
+	return doc
+}
+
+// fixHandler starts a fix job.
+func (app *App) fixHandler(w http.ResponseWriter, r *http.Request) {
+	var params fixParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if app.rejectSystemWrite(w, params.Prefix) {
+		return
+	}
+	f, err := params.compile()
+	if err != nil {
+		http.Error(w, "Invalid fix: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Samples of redacted keys are left out of the result.
+	redacted := func(key string) bool { return app.shouldRedact(r, key) }
+
+	job, err := app.startJob(r, jobFix, params, func(job *runningJob) (interface{}, error) {
+		return app.fixKeys(job, f, params, redacted)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJobCreated(w, job)
+}
+
+func (app *App) fixKeys(job *runningJob, f *fixer, params fixParams, redacted func(string) bool) (FixResult, error) {
+	result := FixResult{DryRun: params.DryRun, Samples: make([]FixSample, 0)}
+	var keys [][]byte
+	err := app.view(func(txn *badger.Txn) error {
+		job.holds(txn)
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(params.Prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := job.checkCanceled(); err != nil {
+				return err
+			}
+			if !app.isSystemKey(it.Item().Key()) {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	txn := app.newTransaction()
+	defer func() { app.discard(txn) }()
+	var batch [][]byte // the keys fixed in txn
+	var pending []string
+	fixOne := func(key []byte) (keyFix, error) {
+		fix, err := app.fixKey(txn, f, key)
+		if err != nil {
+			return fix, err
+		}
+		batch = append(batch, key)
+		if fix.outcome == fixChanged && !params.DryRun {
+			pending = append(pending, string(key))
+		}
+		return fix, nil
+	}
+	// A fix that does not fit in txn may have queued some of its writes.
+	// restart discards them with txn and fixes the keys of the batch again in
+	// a new transaction, so that a fix is never committed half-way, and never
+	// applied twice to a value.
+	restart := func() error {
+		keys := batch
+		app.discard(txn)
+		txn = app.newTransaction()
+		batch, pending = nil, pending[:0]
+		for _, key := range keys {
+			if _, err := fixOne(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	flush := func() error {
+		if params.DryRun {
+			app.discard(txn)
+		} else if err := app.commit(txn, 0); err != nil {
+			return err
+		}
+		for _, key := range pending {
+			app.events.publish(Event{Type: EventSet, Key: key})
+		}
+		result.Changed += int64(len(pending))
+		batch, pending = nil, pending[:0]
+		txn = app.newTransaction()
+		return nil
+	}
+	for _, key := range keys {
+		if err := job.checkCanceled(); err != nil {
+			return result, err
+		}
+		job.advance(1)
+		fix, err := fixOne(key)
+		if err == badger.ErrTxnTooBig {
+			if err = restart(); err == nil {
+				if err = flush(); err == nil {
+					fix, err = fixOne(key)
+				}
+			}
+		}
+		if err != nil {
+			return result, fmt.Errorf("after fixing %d keys: %w", result.Changed, err)
+		}
+		if fix.outcome != fixMissing {
+			result.Scanned++
+		}
+		if fix.outcome >= fixSkipped {
+			result.Matched++
+		}
+		switch fix.outcome {
+		case fixSkipped:
+			result.Skipped++
+		case fixChanged:
+			if params.DryRun {
+				result.Changed++
+			}
+			if len(result.Samples) < fixSamples && !redacted(string(key)) {
+				result.Samples = append(result.Samples, FixSample{Key: string(key), Before: string(fix.before), After: string(fix.after)})
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return result, fmt.Errorf("after fixing %d keys: %w", result.Changed, err)
+	}
+	return result, nil
+}
+
+// Outcomes of fixing a key, from least to most progress.
+const (
+	fixMissing   = iota // deleted since the keys were listed
+	fixUnmatched        // not matched by the filter
+	fixSkipped          // a file, archived, or not JSON
+	fixUnchanged
+	fixChanged
+)
+
+type keyFix struct {
+	outcome       int
+	before, after []byte
+}
+
+// fixKey rewrites key in txn if the fix changes its value.
+func (app *App) fixKey(txn *badger.Txn, f *fixer, key []byte) (keyFix, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return keyFix{outcome: fixMissing}, nil
+	}
+	if err != nil {
+		return keyFix{}, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return keyFix{}, err
+	}
+	if f.filter != nil && !f.filter.match(string(key), value) {
+		return keyFix{outcome: fixUnmatched}, nil
+	}
+	if item.UserMeta()&archivedMeta != 0 {
+		return keyFix{outcome: fixSkipped}, nil
+	}
+	if meta, err := app.loadFileMeta(txn, key); err != nil || meta != nil {
+		return keyFix{outcome: fixSkipped}, err
+	}
+
+	fixed, err := f.apply(value)
+	if err == errNotJSON {
+		return keyFix{outcome: fixSkipped}, nil
+	}
+	if err != nil {
+		return keyFix{}, fmt.Errorf("%s: %w", key, err)
+	}
+	if string(fixed) == string(value) {
+		return keyFix{outcome: fixUnchanged}, nil
+	}
+	if verr := app.writeRules.validate(string(key), fixed); verr != nil {
+		return keyFix{}, verr
+	}
+	e := badger.NewEntry(key, fixed).WithMeta(item.UserMeta())
+	e.ExpiresAt = item.ExpiresAt()
+	if err := app.setEntry(txn, e); err != nil {
+		return keyFix{}, err
+	}
+	return keyFix{outcome: fixChanged, before: value, after: fixed}, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// fromTrustedProxy reports whether the connection comes from one of the
+// TRUSTED_PROXIES, whose X-Forwarded-* headers are then honoured.
+func (app *App) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && containsIP(app.trustedProxies, ip)
+}
+
+// forwardedProtoMiddleware records the scheme a trusted proxy received the
+// request with in r.URL.Scheme, so cookies are marked Secure behind a proxy
+// that terminates TLS.
+func (app *App) forwardedProtoMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto := r.Header.Get("X-Forwarded-Proto")
+		if proto != "" && app.fromTrustedProxy(r) {
+			// Proxies chained behind each other may append their own.
+			proto, _, _ = strings.Cut(proto, ",")
+			if proto = strings.ToLower(strings.TrimSpace(proto)); proto == "https" || proto == "http" {
+				r = r.Clone(r.Context())
+				r.URL.Scheme = proto
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
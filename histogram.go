@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math/bits"
+	"net/http"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// GET /api/stats/histogram?prefix= buckets the key and value sizes of a
+// prefix by powers of two, to help choose Badger's ValueThreshold and the
+// compression of a clone. It walks the keys without reading values, using the
+// sizes Badger keeps next to each key, and counts how many values the
+// current threshold keeps in the LSM tree and how many go to the value log.
+
+// SizeBucket counts the sizes from Min to Max bytes.
+type SizeBucket struct {
+	Min   int64 `json:"min"`
+	Max   int64 `json:"max"`
+	Count int64 `json:"count"`
+}
+
+type SizeHistogram struct {
+	// Total is the sum of the sizes in bytes.
+	Total   int64        `json:"total"`
+	Buckets []SizeBucket `json:"buckets"`
+	counts  [65]int64
+}
+
+// add counts size in the bucket of sizes with the same bit length: 0, 1,
+// 2-3, 4-7 and so on.
+func (h *SizeHistogram) add(size int64) {
+	h.Total += size
+	h.counts[bits.Len64(uint64(size))]++
+}
+
+// finish fills in the buckets from the smallest to the largest size seen,
+// empty ones included.
+func (h *SizeHistogram) finish() {
+	h.Buckets = make([]SizeBucket, 0)
+	first, last := -1, -1
+	for i, count := range h.counts {
+		if count > 0 {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	for i := first; first >= 0 && i <= last; i++ {
+		b := SizeBucket{Count: h.counts[i]}
+		if i > 0 {
+			b.Min, b.Max = 1<<(i-1), 1<<i-1
+		}
+		h.Buckets = append(h.Buckets, b)
+	}
+}
+
+type SizeHistograms struct {
+	Prefix  string        `json:"prefix"`
+	Keys    int64         `json:"keys"`
+	KeySize SizeHistogram `json:"key_size"`
+	// Archived values are counted with the size of their stub, as stored.
+	ValueSize SizeHistogram `json:"value_size"`
+	// ValueThreshold is Badger's current threshold: smaller values are
+	// stored in the LSM tree with their key, the others in the value log.
+	ValueThreshold int64 `json:"value_threshold"`
+	InLSM          int64 `json:"in_lsm"`
+	InValueLog     int64 `json:"in_value_log"`
+	// CompressionRatio is the uncompressed size of the tables entirely under
+	// the prefix divided by their size on disk, see /api/stats/estimate; 0
+	// when there are none yet.
+	CompressionRatio float64 `json:"compression_ratio"`
+}
+
+func (app *App) sizeHistograms(prefix []byte, showSystem bool) (SizeHistograms, error) {
+	h := SizeHistograms{Prefix: string(prefix), ValueThreshold: app.db.Opts().ValueThreshold}
+	err := app.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if !showSystem && app.isSystemKey(item.Key()) {
+				continue
+			}
+			h.Keys++
+			size := item.ValueSize()
+			h.KeySize.add(int64(len(item.Key())))
+			h.ValueSize.add(size)
+			if size < h.ValueThreshold {
+				h.InLSM++
+			} else {
+				h.InValueLog++
+			}
+		}
+		return nil
+	})
+	h.KeySize.finish()
+	h.ValueSize.finish()
+	if estimate := app.estimateSize(prefix); estimate.Size > 0 {
+		h.CompressionRatio = float64(estimate.UncompressedSize) / float64(estimate.Size)
+	}
+	return h, err
+}
+
+func (app *App) histogramHandler(w http.ResponseWriter, r *http.Request) {
+	h, err := app.sizeHistograms([]byte(r.URL.Query().Get("prefix")), includeSystem(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, h)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTP/2 is negotiated through ALPN on TLS listeners. With H2C=true the
+// plaintext listener also accepts HTTP/2 without TLS (prior knowledge or
+// Upgrade: h2c), for proxies and clients that speak h2c to the backend.
+
+func loadH2C(handler http.Handler) http.Handler {
+	if getEnv("H2C", "false") != "true" {
+		return handler
+	}
+	return h2c.NewHandler(handler, &http2.Server{})
+}
+
+// configureHTTP2 enables HTTP/2 on a TLS server.
+func configureHTTP2(server *http.Server) error {
+	return http2.ConfigureServer(server, &http2.Server{})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Messages are written in English in the code and templates. A catalog per
+// language in LOCALES_DIR (locales/<lang>.json, a JSON object from English
+// message to translation) translates them for clients whose Accept-Language
+// prefers that language: the pages through the t template function, and the
+// plain text errors of the API by localizeMiddleware. Messages missing from
+// a catalog stay in English.
+
+type catalogs map[string]map[string]string
+
+// loadCatalogs reads the catalogs in dir, nil when there is none.
+func loadCatalogs(dir string) (catalogs, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	c := make(catalogs)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, &os.PathError{Op: "parse", Path: file, Err: err}
+		}
+		lang := strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))
+		c[lang] = messages
+	}
+	return c, nil
+}
+
+// language picks the catalog for an Accept-Language header: the tags in
+// order of quality, each tried as is and then as its base language. It
+// returns "" for English, the source language, or when nothing matches.
+func (c catalogs) language(header string) string {
+	type tag struct {
+		name string
+		q    float64
+	}
+	var tags []tag
+	for _, part := range strings.Split(header, ",") {
+		name, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q <= 0 {
+				continue
+			}
+		}
+		tags = append(tags, tag{strings.ToLower(name), q})
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	for _, t := range tags {
+		base, _, _ := strings.Cut(t.name, "-")
+		if base == "en" {
+			return ""
+		}
+		for _, name := range []string{t.name, base} {
+			if _, ok := c[name]; ok {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// translate returns the translation of message in lang. Messages with a
+// detail after ": " not found as a whole are translated up to the colon.
+func (c catalogs) translate(lang, message string) string {
+	messages := c[lang]
+	if messages == nil {
+		return message
+	}
+	if t, ok := messages[message]; ok {
+		return t
+	}
+	if head, detail, ok := strings.Cut(message, ": "); ok {
+		if t, ok := messages[head]; ok {
+			return t + ": " + detail
+		}
+	}
+	return message
+}
+
+// requestLanguage is the catalog language for r, "" for English.
+func (app *App) requestLanguage(r *http.Request) string {
+	if app.i18n == nil {
+		return ""
+	}
+	return app.i18n.language(r.Header.Get("Accept-Language"))
+}
+
+// localizeMiddleware translates the plain text error responses of the API.
+func (app *App) localizeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.i18n == nil || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Language")
+		lang := app.requestLanguage(r)
+		if lang == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		lw := &localizedWriter{ResponseWriter: w, app: app, lang: lang}
+		next.ServeHTTP(lw, r)
+		lw.finish()
+	})
+}
+
+// localizedWriter holds back plain text error responses to translate them
+// once complete and passes anything else through.
+type localizedWriter struct {
+	http.ResponseWriter
+	app       *App
+	lang      string
+	status    int
+	buffering bool
+	body      bytes.Buffer
+}
+
+func (lw *localizedWriter) WriteHeader(status int) {
+	if lw.status != 0 {
+		return
+	}
+	lw.status = status
+	mediaType, _, _ := mime.ParseMediaType(lw.Header().Get("Content-Type"))
+	lw.buffering = status >= 400 && mediaType == "text/plain"
+	if !lw.buffering {
+		lw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (lw *localizedWriter) Write(b []byte) (int, error) {
+	lw.WriteHeader(http.StatusOK)
+	if lw.buffering {
+		return lw.body.Write(b)
+	}
+	return lw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (lw *localizedWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+func (lw *localizedWriter) finish() {
+	if !lw.buffering {
+		return
+	}
+	message := strings.TrimSuffix(lw.body.String(), "\n")
+	lw.Header().Del("Content-Length")
+	lw.Header().Set("Content-Language", lw.lang)
+	lw.ResponseWriter.WriteHeader(lw.status)
+	_, _ = lw.ResponseWriter.Write([]byte(lw.app.i18n.translate(lw.lang, message) + "\n"))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// An integrity job checks references between prefixes for applications that
+// use Badger as their primary store: for each key under a check's prefix,
+// the field of its JSON value (a string, a number, or an array of them)
+// names a key that must exist under the target prefix, e.g. the user_id of
+// every order: value must have a user: key. All checks read the same
+// snapshot, and the result lists the dangling references.
+
+const jobIntegrity = "integrity"
+
+// IntegrityCheck is one reference to verify: the keys under Prefix whose
+// Field, prefixed with Target, must exist.
+type IntegrityCheck struct {
+	Prefix string `json:"prefix"`
+	Field  string `json:"field"`
+	Target string `json:"target"`
+	// Filter limits the check to the keys matching a filter expression.
+	Filter string `json:"filter,omitempty"`
+	// Required counts keys without the field as dangling.
+	Required bool `json:"required,omitempty"`
+}
+
+type integrityParams struct {
+	Checks []IntegrityCheck `json:"checks"`
+	Limit  int              `json:"limit"`
+}
+
+type DanglingReference struct {
+	Key string `json:"key"`
+	// Missing is the key that does not exist, empty when the field is
+	// missing from a required reference.
+	Missing string `json:"missing"`
+}
+
+type IntegrityCheckResult struct {
+	IntegrityCheck
+	Checked    int64 `json:"checked"`
+	References int64 `json:"references"`
+	// NotJSON counts values that are not JSON and could not be checked.
+	NotJSON       int64               `json:"not_json"`
+	DanglingCount int64               `json:"dangling_count"`
+	Dangling      []DanglingReference `json:"dangling"`
+}
+
+type IntegrityResult struct {
+	Checks []IntegrityCheckResult `json:"checks"`
+	// OK is set when no check found a dangling reference.
+	OK bool `json:"ok"`
+}
+
+type compiledCheck struct {
+	IntegrityCheck
+	path   []interface{}
+	filter *filterExpr
+}
+
+func (p *integrityParams) compile() ([]compiledCheck, error) {
+	if len(p.Checks) == 0 {
+		return nil, errors.New("at least one check is required")
+	}
+	if p.Limit <= 0 {
+		p.Limit = 100
+	}
+	checks := make([]compiledCheck, 0, len(p.Checks))
+	for i, check := range p.Checks {
+		cc := compiledCheck{IntegrityCheck: check}
+		var err error
+		if cc.path, err = parseFieldPath(check.Field); err != nil {
+			return nil, fmt.Errorf("check %d: field: %v", i+1, err)
+		}
+		if cc.path == nil {
+			return nil, fmt.Errorf("check %d: a field is required", i+1)
+		}
+		if check.Filter != "" {
+			if cc.filter, err = parseFilter(check.Filter); err != nil {
+				return nil, fmt.Errorf("check %d: filter: %v", i+1, err)
+			}
+		}
+		checks = append(checks, cc)
+	}
+	return checks, nil
+}
+
+// referencedKeys returns the keys a field value refers to.
+func referencedKeys(target string, v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{target + v}
+	case float64:
+		return []string{target + strconv.FormatFloat(v, 'f', -1, 64)}
+	case []interface{}:
+		var keys []string
+		for _, item := range v {
+			keys = append(keys, referencedKeys(target, item)...)
+		}
+		return keys
+	}
+	return nil
+}
+
+// integrityHandler starts an integrity job over the checks in the body,
+// listing up to limit dangling references per check (100 by default).
+func (app *App) integrityHandler(w http.ResponseWriter, r *http.Request) {
+	var params integrityParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	checks, err := params.compile()
+	if err != nil {
+		http.Error(w, "Invalid integrity check: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := app.startJob(r, jobIntegrity, params, func(job *runningJob) (interface{}, error) {
+		result := IntegrityResult{OK: true}
+		err := app.view(func(txn *badger.Txn) error {
+			job.holds(txn)
+			for _, check := range checks {
+				cr, err := app.checkReferences(job, txn, check, params.Limit)
+				if err != nil {
+					return err
+				}
+				result.OK = result.OK && cr.DanglingCount == 0
+				result.Checks = append(result.Checks, cr)
+			}
+			return nil
+		})
+		return result, err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJobCreated(w, job)
+}
+
+func (app *App) checkReferences(job *runningJob, txn *badger.Txn, check compiledCheck, limit int) (IntegrityCheckResult, error) {
+	cr := IntegrityCheckResult{IntegrityCheck: check.IntegrityCheck, Dangling: make([]DanglingReference, 0)}
+	dangling := func(key, missing string) {
+		cr.DanglingCount++
+		if len(cr.Dangling) < limit {
+			cr.Dangling = append(cr.Dangling, DanglingReference{Key: key, Missing: missing})
+		}
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(check.Prefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		if err := job.checkCanceled(); err != nil {
+			return cr, err
+		}
+		item := it.Item()
+		key := string(item.Key())
+		if app.isSystemKey(item.Key()) || item.UserMeta()&archivedMeta != 0 {
+			continue
+		}
+		job.advance(1)
+		var doc interface{}
+		var matched, isJSON bool
+		err := item.Value(func(val []byte) error {
+			matched = check.filter == nil || check.filter.match(key, val)
+			isJSON = json.Unmarshal(val, &doc) == nil
+			return nil
+		})
+		if err != nil {
+			return cr, err
+		}
+		if !matched {
+			continue
+		}
+		cr.Checked++
+		if !isJSON {
+			cr.NotJSON++
+			continue
+		}
+		refs := referencedKeys(check.Target, lookupJSONPath(doc, check.path))
+		if len(refs) == 0 && check.Required {
+			dangling(key, "")
+		}
+		for _, ref := range refs {
+			cr.References++
+			if _, err := txn.Get([]byte(ref)); err == badger.ErrKeyNotFound {
+				dangling(key, ref)
+			} else if err != nil {
+				return cr, err
+			}
+		}
+	}
+	return cr, nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/gorilla/mux"
+)
+
+// Jobs are long-running admin tasks executed in the background. Their state
+// is stored under the system prefix so finished results survive restarts;
+// progress of running jobs is kept in memory and stored when they finish.
+const jobsNamespace = "jobs:"
+
+// Job states.
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// Events published when a job finishes.
+const (
+	EventJobSucceeded = "job.succeeded"
+	EventJobFailed    = "job.failed"
+	EventJobCanceled  = "job.canceled"
+)
+
+type Job struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Status     string          `json:"status"`
+	Params     json.RawMessage `json:"params,omitempty"`
+	Progress   int64           `json:"progress"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	CreatedBy  string          `json:"created_by,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// runningJob is handed to the job function to report progress and observe
+// cancellation.
+type runningJob struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	progress atomic.Int64
+}
+
+func (j *runningJob) advance(n int64) { j.progress.Add(n) }
+
+var errJobCanceled = errors.New("job canceled")
+
+// checkCanceled returns errJobCanceled once the job has been canceled; job
+// functions call it between units of work.
+func (j *runningJob) checkCanceled() error {
+	if j.ctx.Err() != nil {
+		return errJobCanceled
+	}
+	return nil
+}
+
+// holds makes txn, a transaction of the live database the job iterates in,
+// cancelable: canceling the operation through the watchdog or the API
+// cancels the job, which stops at its next checkCanceled.
+func (j *runningJob) holds(txn *badger.Txn) {
+	operations.setCancelable(txn, j.cancel)
+}
+
+type jobFunc func(job *runningJob) (interface{}, error)
+
+type jobManager struct {
+	retention time.Duration
+
+	mu      sync.Mutex
+	running map[string]*runningJob
+}
+
+var jobSeq atomic.Uint32
+
+func loadJobManager() (*jobManager, error) {
+	retention, err := time.ParseDuration(getEnv("JOB_RETENTION", "168h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JOB_RETENTION: %w", err)
+	}
+	return &jobManager{retention: retention, running: make(map[string]*runningJob)}, nil
+}
+
+func (app *App) storeJob(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	e := badger.NewEntry(app.systemKey(jobsNamespace+job.ID), data)
+	if app.jobs.retention > 0 {
+		e = e.WithTTL(app.jobs.retention)
+	}
+	return app.update(func(txn *badger.Txn) error { return txn.SetEntry(e) })
+}
+
+func (app *App) loadJob(txn *badger.Txn, id string) (*Job, error) {
+	item, err := txn.Get(app.systemKey(jobsNamespace + id))
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &job)
+	})
+	return &job, err
+}
+
+// startJob records a new job and runs fn in the background. params are
+// stored with the job for reference.
+func (app *App) startJob(r *http.Request, typ string, params interface{}, fn jobFunc) (*Job, error) {
+	now := time.Now().UTC()
+	// Zero-padded hex nanoseconds keep job keys in creation order.
+	job := &Job{
+		ID:        fmt.Sprintf("%016x%04x", now.UnixNano(), jobSeq.Add(1)%0x10000),
+		Type:      typ,
+		Status:    JobRunning,
+		CreatedAt: now,
+	}
+	if p := currentPrincipal(r); p != nil {
+		job.CreatedBy = p.Name
+	}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		job.Params = data
+	}
+	if err := app.storeJob(job); err != nil {
+		return nil, err
+	}
+
+	rj := &runningJob{}
+	rj.ctx, rj.cancel = context.WithCancel(context.Background())
+	app.jobs.mu.Lock()
+	app.jobs.running[job.ID] = rj
+	app.jobs.mu.Unlock()
+
+	go app.runJob(job, rj, fn)
+	return job, nil
+}
+
+func (app *App) runJob(job *Job, rj *runningJob, fn jobFunc) {
+	result, err := callJob(fn, rj)
+
+	finished := time.Now().UTC()
+	job.FinishedAt = &finished
+	job.Progress = rj.progress.Load()
+	switch {
+	case errors.Is(err, errJobCanceled):
+		job.Status = JobCanceled
+	case err != nil:
+		job.Status = JobFailed
+		job.Error = err.Error()
+	default:
+		job.Status = JobSucceeded
+	}
+	if result != nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			job.Status, job.Error = JobFailed, "encoding result: "+err.Error()
+		} else {
+			job.Result = data
+		}
+	}
+	if err := app.storeJob(job); err != nil {
+		errorf("Failed to store job %s: %v", job.ID, err)
+	}
+	detail := fmt.Sprintf("%s job %s", job.Type, job.ID)
+	if job.Error != "" {
+		detail += ": " + job.Error
+	}
+	// EventJobSucceeded, EventJobFailed or EventJobCanceled
+	app.events.publish(Event{Type: "job." + job.Status, Detail: detail})
+
+	app.jobs.mu.Lock()
+	delete(app.jobs.running, job.ID)
+	app.jobs.mu.Unlock()
+	rj.cancel()
+}
+
+// withProgress fills in the live progress of a running job.
+func (app *App) withProgress(job *Job) {
+	app.jobs.mu.Lock()
+	rj := app.jobs.running[job.ID]
+	app.jobs.mu.Unlock()
+	if rj != nil {
+		job.Progress = rj.progress.Load()
+	}
+}
+
+// failInterruptedJobs marks jobs left running by a previous process as
+// failed; their goroutines are gone.
+func (app *App) failInterruptedJobs() error {
+	var interrupted []*Job
+	err := app.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = app.systemKey(jobsNamespace)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var job Job
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &job)
+			})
+			if err != nil {
+				return err
+			}
+			if job.Status == JobRunning {
+				interrupted = append(interrupted, &job)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, job := range interrupted {
+		job.Status, job.Error = JobFailed, "interrupted by a restart"
+		if err := app.storeJob(job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listJobsHandler returns the newest jobs first, optionally filtered by type
+// and status. Results are left out; fetch a single job to get its result.
+func (app *App) listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
+			limit = parsed
+		}
+	}
+	typ, status := r.URL.Query().Get("type"), r.URL.Query().Get("status")
+
+	jobs := make([]*Job, 0)
+	err := app.view(func(txn *badger.Txn) error {
+		ctx, cancel := operations.interruptible(r.Context(), txn)
+		defer cancel()
+		prefix := app.systemKey(jobsNamespace)
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(append(prefix, 0xff)); it.Valid() && len(jobs) < limit; it.Next() {
+			if err := checkOperation(ctx); err != nil {
+				return err
+			}
+			var job Job
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &job)
+			})
+			if err != nil {
+				return err
+			}
+			if (typ == "" || job.Type == typ) && (status == "" || job.Status == status) {
+				job.Result = nil
+				jobs = append(jobs, &job)
+			}
+		}
+		return nil
+	})
+	if err == errOperationCanceled {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, job := range jobs {
+		app.withProgress(job)
+	}
+	writeJSON(w, jobs)
+}
+
+func (app *App) getJobHandler(w http.ResponseWriter, r *http.Request) {
+	var job *Job
+	err := app.view(func(txn *badger.Txn) error {
+		var err error
+		job, err = app.loadJob(txn, mux.Vars(r)["id"])
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.withProgress(job)
+	writeJSON(w, job)
+}
+
+// cancelJobHandler asks a running job to stop. The job records itself as
+// canceled at its next cancellation check.
+func (app *App) cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	app.jobs.mu.Lock()
+	rj := app.jobs.running[mux.Vars(r)["id"]]
+	app.jobs.mu.Unlock()
+	if rj == nil {
+		http.Error(w, "Job is not running", http.StatusConflict)
+		return
+	}
+	rj.cancel()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// writeJobCreated answers a request that started a job.
+func (app *App) writeJobCreated(w http.ResponseWriter, job *Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", app.url("/api/admin/jobs/"+job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JOURNAL_FILE appends every successful write to the data API, with its
+// body, to a file of JSON lines. Replaying the file against another instance
+// with "badger-web-ui replay" repeats the writes in order, independently of
+// Badger's backup format. Admin endpoints are not journaled.
+
+// JournalEntry is one line of the journal.
+type JournalEntry struct {
+	Seq         uint64    `json:"seq"`
+	Time        time.Time `json:"time"`
+	RequestID   string    `json:"request_id,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+}
+
+type journal struct {
+	path string
+	sync bool
+
+	mu  sync.Mutex
+	f   *os.File
+	seq uint64
+}
+
+func loadJournal() (*journal, error) {
+	path := getEnv("JOURNAL_FILE", "")
+	if path == "" {
+		return nil, nil
+	}
+	j := &journal{path: path, sync: getEnv("JOURNAL_SYNC", "false") == "true"}
+	// Continue the sequence of an existing journal, dropping a partial last
+	// line so new entries start on a line of their own.
+	end, err := readJournal(path, func(e JournalEntry) error {
+		j.seq = e.Seq
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	j.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.f.Truncate(end); err != nil {
+		j.f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *journal) append(e JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e.Seq = j.seq + 1
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if j.sync {
+		if err := j.f.Sync(); err != nil {
+			return err
+		}
+	}
+	j.seq = e.Seq
+	return nil
+}
+
+// lastSeq returns the sequence number of the last entry written, 0 without a
+// journal.
+func (j *journal) lastSeq() uint64 {
+	if j == nil {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.seq
+}
+
+// readJournal calls fn for each entry of the journal at path, in order, and
+// returns the offset just past the last complete entry.
+func readJournal(path string, fn func(JournalEntry) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var end int64
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial last line left by a crash was never acknowledged
+			// to the client and is skipped.
+			return end, nil
+		}
+		if err != nil {
+			return end, err
+		}
+		var e JournalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return end, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		if err := fn(e); err != nil {
+			return end, err
+		}
+		end += int64(len(line))
+	}
+}
+
+// journalMiddleware records writes to the data API of the live database once
+// the handler has accepted them.
+func (app *App) journalMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.journal == nil || isSafeMethod(r.Method) || readOnlyRequest(r) ||
+			!strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/api/admin/") ||
+			strings.HasPrefix(r.URL.Path, "/api/stores/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var body bytes.Buffer
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, &body), r.Body}
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status < 200 || rec.status > 299 {
+			return
+		}
+
+		e := JournalEntry{
+			Time:        time.Now().UTC(),
+			RequestID:   requestID(r),
+			Method:      r.Method,
+			Path:        r.URL.RequestURI(),
+			ContentType: r.Header.Get("Content-Type"),
+			Body:        body.Bytes(),
+		}
+		if p := currentPrincipal(r); p != nil {
+			e.User = p.Name
+		}
+		if err := app.journal.append(e); err != nil {
+			errorf("Failed to journal %s %s: %v", r.Method, e.Path, err)
+		}
+	})
+}
+
+// replayJournal sends the entries of a journal to the instance at target,
+// stopping at the first request it rejects. A bearer token for an editor or
+// admin can be given in REPLAY_TOKEN.
+func replayJournal(path, target string) error {
+	target = strings.TrimSuffix(target, "/")
+	token := os.Getenv("REPLAY_TOKEN")
+	client := &http.Client{Timeout: time.Minute}
+	count := 0
+	_, err := readJournal(path, func(e JournalEntry) error {
+		req, err := http.NewRequest(e.Method, target+e.Path, bytes.NewReader(e.Body))
+		if err != nil {
+			return err
+		}
+		if e.ContentType != "" {
+			req.Header.Set("Content-Type", e.ContentType)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", e.Seq, err)
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("entry %d: %s %s: %s: %s", e.Seq, e.Method, e.Path, resp.Status, strings.TrimSpace(string(msg)))
+		}
+		count++
+		return nil
+	})
+	fmt.Printf("Replayed %d requests\n", count)
+	return err
+}
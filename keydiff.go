@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// A keyspace diff compares the live database against a baseline: an uploaded
+// backup or export, or another database listed in DATABASES. Keys only in the live database are "added", keys only
+// in the baseline "removed".
+
+const jobKeyspaceDiff = "keyspace-diff"
+
+// Key changes reported by a keyspace diff.
+const (
+	KeyAdded   = "added"
+	KeyRemoved = "removed"
+	KeyChanged = "changed"
+)
+
+type KeyChange struct {
+	Key    string `json:"key"`
+	Change string `json:"change"`
+}
+
+type KeyspaceDiff struct {
+	Added     int64       `json:"added"`
+	Removed   int64       `json:"removed"`
+	Changed   int64       `json:"changed"`
+	Unchanged int64       `json:"unchanged"`
+	Keys      []KeyChange `json:"keys"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+type keyspaceDiffParams struct {
+	Source string `json:"source"` // database name, upload ID or "body"
+	Kind   string `json:"kind,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Limit  int    `json:"limit"`
+}
+
+// keyspaceDiffHandler starts a keyspace diff job. The baseline is the
+// database named by db=, the chunked upload named by upload=, or otherwise
+// the request body; kind= tells a backup from an export.
+func (app *App) keyspaceDiffHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	params := keyspaceDiffParams{Prefix: q.Get("prefix"), Limit: 1000}
+	if l := q.Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed >= 0 {
+			params.Limit = parsed
+		}
+	}
+	withSystem := includeSystem(r)
+
+	var (
+		openBaseline func() (*badger.DB, func(), error)
+		upload       *spooledUpload
+	)
+	switch {
+	case q.Get("db") != "":
+		params.Source = q.Get("db")
+		if params.Source == mainDatabase || !app.knownDatabase(params.Source) {
+			http.Error(w, "Unknown database "+params.Source, http.StatusBadRequest)
+			return
+		}
+		openBaseline = func() (*badger.DB, func(), error) {
+			return app.openDatabase(params.Source, true)
+		}
+	default:
+		var err error
+		upload, params.Kind, params.Source, err = app.diffUpload(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		openBaseline = func() (*badger.DB, func(), error) {
+			return app.loadScratchDB(upload, params.Kind)
+		}
+	}
+
+	job, err := app.startJob(r, jobKeyspaceDiff, params, func(job *runningJob) (interface{}, error) {
+		if upload != nil {
+			defer upload.Close()
+		}
+		baseline, closeBaseline, err := openBaseline()
+		if err != nil {
+			return nil, err
+		}
+		defer closeBaseline()
+		return app.compareKeyspaces(job, baseline, []byte(params.Prefix), withSystem, params.Limit)
+	})
+	if err != nil {
+		if upload != nil {
+			upload.Close()
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJobCreated(w, job)
+}
+
+// diffUpload takes the baseline file from a chunked upload session or the
+// request body and verifies it against the manifest, if any. The job runs
+// after the request ends, so the body is always spooled to disk.
+func (app *App) diffUpload(r *http.Request) (*spooledUpload, string, string, error) {
+	m, err := app.requestManifest(r)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if id := r.URL.Query().Get("upload"); id != "" {
+		u := app.uploads.get(id)
+		if u == nil {
+			return nil, "", "", errors.New("upload not found")
+		}
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		file, err := os.Open(u.path)
+		if err != nil {
+			return nil, "", "", err
+		}
+		// The open file outlives the session's removal.
+		app.uploads.remove(u)
+		upload, err := app.verifiedFile(file, m, u.Kind)
+		return upload, u.Kind, "upload", err
+	}
+
+	kind := r.URL.Query().Get("kind")
+	if kind == "" {
+		kind = manifestBackup
+	}
+	if kind != manifestBackup && kind != manifestExport {
+		return nil, "", "", errors.New("kind must be 'backup' or 'export'")
+	}
+	file, err := os.CreateTemp(app.uploads.dir, "diff-*")
+	if err != nil {
+		return nil, "", "", err
+	}
+	if _, err := io.Copy(file, r.Body); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, "", "", err
+	}
+	upload, err := app.verifiedFile(file, m, kind)
+	return upload, kind, "body", err
+}
+
+// loadScratchDB loads a backup or export into a temporary database so it can
+// be iterated in key order. The returned function closes and removes it.
+func (app *App) loadScratchDB(in io.Reader, kind string) (*badger.DB, func(), error) {
+	dir, err := os.MkdirTemp(app.uploads.dir, "scratch-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+
+	if kind == manifestBackup {
+		err = db.Load(in, 256)
+	} else {
+		err = loadExportInto(db, in)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("loading %s: %w", kind, err)
+	}
+	return db, cleanup, nil
+}
+
+func loadExportInto(db *badger.DB, in io.Reader) error {
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	dec := json.NewDecoder(in)
+	for {
+		var rec ExportRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		e := badger.NewEntry([]byte(rec.Key), rec.Value)
+		e.ExpiresAt = rec.ExpiresAt
+		if rec.Archived {
+			e = e.WithMeta(archivedMeta)
+		}
+		if err := wb.SetEntry(e); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// compareKeyspaces walks the live database and the baseline side by side in
+// key order. Up to limit changed keys are listed; all are counted.
+func (app *App) compareKeyspaces(job *runningJob, baseline *badger.DB, prefix []byte, withSystem bool, limit int) (*KeyspaceDiff, error) {
+	diff := &KeyspaceDiff{Keys: make([]KeyChange, 0)}
+	report := func(key []byte, change string) {
+		if len(diff.Keys) < limit {
+			diff.Keys = append(diff.Keys, KeyChange{Key: string(key), Change: change})
+		} else {
+			diff.Truncated = true
+		}
+	}
+
+	err := app.view(func(liveTxn *badger.Txn) error {
+		job.holds(liveTxn)
+		return baseline.View(func(baseTxn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			opts.Prefix = prefix
+			live := liveTxn.NewIterator(opts)
+			defer live.Close()
+			base := baseTxn.NewIterator(opts)
+			defer base.Close()
+
+			// skip advances past system keys unless they are compared.
+			skip := func(it *badger.Iterator) {
+				for !withSystem && it.Valid() && app.isSystemKey(it.Item().Key()) {
+					it.Next()
+				}
+			}
+			live.Rewind()
+			base.Rewind()
+			for {
+				skip(live)
+				skip(base)
+				if !live.Valid() && !base.Valid() {
+					return nil
+				}
+				if err := job.checkCanceled(); err != nil {
+					return err
+				}
+				job.advance(1)
+
+				cmp := 0
+				switch {
+				case !base.Valid():
+					cmp = -1
+				case !live.Valid():
+					cmp = 1
+				default:
+					cmp = bytes.Compare(live.Item().Key(), base.Item().Key())
+				}
+
+				switch {
+				case cmp < 0:
+					diff.Added++
+					report(live.Item().Key(), KeyAdded)
+					live.Next()
+				case cmp > 0:
+					diff.Removed++
+					report(base.Item().Key(), KeyRemoved)
+					base.Next()
+				default:
+					same, err := sameValue(live.Item(), base.Item())
+					if err != nil {
+						return err
+					}
+					if same {
+						diff.Unchanged++
+					} else {
+						diff.Changed++
+						report(live.Item().Key(), KeyChanged)
+					}
+					live.Next()
+					base.Next()
+				}
+			}
+		})
+	})
+	return diff, err
+}
+
+// sameValue compares two items' values and metadata. Archived values compare
+// by their stub, so a key archived on one side only shows up as changed.
+func sameValue(a, b *badger.Item) (bool, error) {
+	if a.ValueSize() != b.ValueSize() || a.UserMeta() != b.UserMeta() || a.ExpiresAt() != b.ExpiresAt() {
+		return false, nil
+	}
+	av, err := a.ValueCopy(nil)
+	if err != nil {
+		return false, err
+	}
+	var same bool
+	err = b.Value(func(bv []byte) error {
+		same = bytes.Equal(av, bv)
+		return nil
+	})
+	return same, err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Keys are addressed by the {key} path segment, which cannot hold a "/" and
+// is awkward for "%" or bytes that are not UTF-8. With key_encoding=base64url
+// the segment is the base64url encoding of the key bytes (RFC 4648, section
+// 5), padding optional, so any Badger key can be addressed.
+
+const keyEncodingBase64URL = "base64url"
+
+// routeKey returns the key addressed by the request. It answers 400 and
+// reports false for an unknown key_encoding or a segment that does not
+// decode.
+func routeKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := mux.Vars(r)["key"]
+	switch encoding := r.URL.Query().Get("key_encoding"); encoding {
+	case "":
+		return key, true
+	case keyEncodingBase64URL:
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+		if err != nil || len(decoded) == 0 {
+			http.Error(w, "Key is not valid base64url", http.StatusBadRequest)
+			return "", false
+		}
+		return string(decoded), true
+	default:
+		http.Error(w, "Unknown key_encoding "+encoding+", expected base64url", http.StatusBadRequest)
+		return "", false
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// keys_only=true makes list and search skip the values: the iterator does not
+// prefetch them and only the key's metadata is returned, which keeps browsing
+// fast when values are large.
+
+// KeyInfo describes a key without its value.
+type KeyInfo struct {
+	Key string `json:"key"`
+	// Size is Badger's estimate of the value size in bytes.
+	Size      int64      `json:"size"`
+	Version   uint64     `json:"version"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Archived  bool       `json:"archived,omitempty"`
+}
+
+func keyInfo(item *badger.Item) KeyInfo {
+	info := KeyInfo{
+		Key:      string(item.Key()),
+		Size:     item.ValueSize(),
+		Version:  item.Version(),
+		Archived: item.UserMeta()&archivedMeta != 0,
+	}
+	if expires := item.ExpiresAt(); expires > 0 {
+		t := time.Unix(int64(expires), 0).UTC()
+		info.ExpiresAt = &t
+	}
+	return info
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapProvider authenticates users against LDAP or Active Directory: it binds
+// with a service account, looks the user up, then binds as the user to check
+// the password. Roles are mapped from group DNs.
+type ldapProvider struct {
+	url                string
+	bindDN             string
+	bindPassword       string
+	userBase           string
+	userFilter         string // %s is replaced by the escaped user name
+	groupBase          string
+	groupFilter        string // %s is replaced by the escaped user DN
+	groupAttribute     string
+	roleMapping        map[string]string // lower-cased group DN -> role
+	defaultRole        string
+	startTLS           bool
+	insecureSkipVerify bool
+}
+
+func loadLDAPProvider() (*ldapProvider, error) {
+	url := getEnv("LDAP_URL", "")
+	if url == "" {
+		return nil, nil
+	}
+	p := &ldapProvider{
+		url:                url,
+		bindDN:             getEnv("LDAP_BIND_DN", ""),
+		bindPassword:       getEnv("LDAP_BIND_PASSWORD", ""),
+		userBase:           getEnv("LDAP_USER_BASE", ""),
+		userFilter:         getEnv("LDAP_USER_FILTER", "(&(objectClass=person)(uid=%s))"),
+		groupBase:          getEnv("LDAP_GROUP_BASE", ""),
+		groupFilter:        getEnv("LDAP_GROUP_FILTER", ""),
+		groupAttribute:     getEnv("LDAP_GROUP_ATTRIBUTE", "memberOf"),
+		roleMapping:        make(map[string]string),
+		defaultRole:        getEnv("LDAP_DEFAULT_ROLE", ""),
+		startTLS:           getEnv("LDAP_START_TLS", "false") == "true",
+		insecureSkipVerify: getEnv("LDAP_INSECURE_SKIP_VERIFY", "false") == "true",
+	}
+	if p.userBase == "" {
+		return nil, errors.New("LDAP_USER_BASE is required with LDAP_URL")
+	}
+	if p.groupFilter != "" && p.groupBase == "" {
+		return nil, errors.New("LDAP_GROUP_BASE is required with LDAP_GROUP_FILTER")
+	}
+	if p.defaultRole != "" {
+		if _, ok := roleLevels[p.defaultRole]; !ok {
+			return nil, fmt.Errorf("unknown LDAP_DEFAULT_ROLE %q", p.defaultRole)
+		}
+	}
+	// Group DNs contain commas, so mapping entries are separated by semicolons
+	// and the role follows the last '='.
+	for _, entry := range strings.Split(getEnv("LDAP_ROLE_MAPPING", ""), ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("LDAP_ROLE_MAPPING entry %q must be groupDN=role", entry)
+		}
+		role := entry[i+1:]
+		if _, ok := roleLevels[role]; !ok {
+			return nil, fmt.Errorf("unknown role %q in LDAP_ROLE_MAPPING", role)
+		}
+		p.roleMapping[strings.ToLower(entry[:i])] = role
+	}
+	return p, nil
+}
+
+func (p *ldapProvider) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: p.insecureSkipVerify}
+	conn, err := ldap.DialURL(p.url,
+		ldap.DialWithTLSConfig(tlsConfig),
+		ldap.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(10 * time.Second)
+	if p.startTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// authenticate returns the principal for valid credentials, or nil when the
+// user is unknown, the password is wrong or no role applies.
+func (p *ldapProvider) authenticate(name, password string) (*principal, error) {
+	// An empty password would be an unauthenticated bind, which most
+	// directories accept; never treat it as a successful login.
+	if name == "" || password == "" {
+		return nil, nil
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if p.bindDN != "" {
+		if err := conn.Bind(p.bindDN, p.bindPassword); err != nil {
+			return nil, fmt.Errorf("service bind: %w", err)
+		}
+	}
+
+	attributes := []string{"dn"}
+	if p.groupFilter == "" {
+		attributes = append(attributes, p.groupAttribute)
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		p.userBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(p.userFilter, ldap.EscapeFilter(name)), attributes, nil))
+	if err != nil {
+		return nil, fmt.Errorf("user search: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, nil
+	}
+	user := result.Entries[0]
+
+	if err := conn.Bind(user.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("user bind: %w", err)
+	}
+
+	groups := user.GetAttributeValues(p.groupAttribute)
+	if p.groupFilter != "" {
+		// Search groups with the service account, not the user's rights.
+		if p.bindDN != "" {
+			if err := conn.Bind(p.bindDN, p.bindPassword); err != nil {
+				return nil, fmt.Errorf("service bind: %w", err)
+			}
+		}
+		result, err := conn.Search(ldap.NewSearchRequest(
+			p.groupBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			fmt.Sprintf(p.groupFilter, ldap.EscapeFilter(user.DN)), []string{"dn"}, nil))
+		if err != nil {
+			return nil, fmt.Errorf("group search: %w", err)
+		}
+		groups = groups[:0]
+		for _, entry := range result.Entries {
+			groups = append(groups, entry.DN)
+		}
+	}
+
+	role := p.defaultRole
+	for _, group := range groups {
+		if mapped, ok := p.roleMapping[strings.ToLower(group)]; ok && (role == "" || roleLevels[mapped] > roleLevels[role]) {
+			role = mapped
+		}
+	}
+	if role == "" {
+		return nil, nil
+	}
+	return &principal{Name: name, Role: role}, nil
+}
+
+// checkPassword validates a user name and password against the environment
+// users first, then the users stored in the database and finally LDAP, if
+// configured.
+func (app *App) checkPassword(name, password string) (*principal, bool) {
+	if p, ok := app.credentials.checkPassword(name, password); ok {
+		return p, true
+	}
+	if p, ok := app.checkStoredPassword(name, password); ok {
+		return p, true
+	}
+	if app.ldap == nil {
+		return nil, false
+	}
+	p, err := app.ldap.authenticate(name, password)
+	if err != nil {
+		warnf("LDAP authentication for %q failed: %v", name, err)
+		return nil, false
+	}
+	return p, p != nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A burst of expensive requests makes them all slow: each scan competes for
+// the disk and holds its results in memory. MAX_IN_FLIGHT_REQUESTS caps the
+// API requests served at once and MAX_CONCURRENT_SCANS the scans and exports
+// among them. Requests over a limit wait in a queue of REQUEST_QUEUE_SIZE for
+// up to REQUEST_QUEUE_TIMEOUT, then are rejected with 503 and Retry-After.
+
+// limiter is a semaphore with a bounded queue.
+type limiter struct {
+	max     int
+	slots   chan struct{}
+	maxWait int64
+	wait    time.Duration
+
+	queued   atomic.Int64
+	rejected atomic.Int64
+}
+
+func newLimiter(max int, maxWait int64, wait time.Duration) *limiter {
+	if max == 0 {
+		return nil
+	}
+	return &limiter{max: max, slots: make(chan struct{}, max), maxWait: maxWait, wait: wait}
+}
+
+// acquire takes a slot, waiting in the queue when none is free. It returns
+// false when the queue is full, the wait times out or the request is gone.
+func (l *limiter) acquire(r *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.queued.Add(1) > l.maxWait {
+		l.queued.Add(-1)
+		l.rejected.Add(1)
+		return false
+	}
+	defer l.queued.Add(-1)
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	l.rejected.Add(1)
+	return false
+}
+
+func (l *limiter) release() {
+	<-l.slots
+}
+
+type LimiterStats struct {
+	Max      int   `json:"max"`
+	Running  int   `json:"running"`
+	Queued   int64 `json:"queued"`
+	Rejected int64 `json:"rejected"`
+}
+
+func (l *limiter) stats() *LimiterStats {
+	if l == nil {
+		return nil
+	}
+	return &LimiterStats{Max: l.max, Running: len(l.slots), Queued: l.queued.Load(), Rejected: l.rejected.Load()}
+}
+
+type requestLimits struct {
+	inFlight *limiter
+	scans    *limiter
+}
+
+func loadRequestLimits() (*requestLimits, error) {
+	maxInFlight, err := strconv.Atoi(getEnv("MAX_IN_FLIGHT_REQUESTS", "0"))
+	if err != nil || maxInFlight < 0 {
+		return nil, fmt.Errorf("MAX_IN_FLIGHT_REQUESTS must be a number")
+	}
+	maxScans, err := strconv.Atoi(getEnv("MAX_CONCURRENT_SCANS", "0"))
+	if err != nil || maxScans < 0 {
+		return nil, fmt.Errorf("MAX_CONCURRENT_SCANS must be a number")
+	}
+	if maxInFlight == 0 && maxScans == 0 {
+		return nil, nil
+	}
+	queueSize, err := strconv.ParseInt(getEnv("REQUEST_QUEUE_SIZE", "100"), 10, 64)
+	if err != nil || queueSize < 0 {
+		return nil, fmt.Errorf("REQUEST_QUEUE_SIZE must be a number")
+	}
+	wait, err := time.ParseDuration(getEnv("REQUEST_QUEUE_TIMEOUT", "10s"))
+	if err != nil || wait < 0 {
+		return nil, fmt.Errorf("invalid REQUEST_QUEUE_TIMEOUT")
+	}
+	return &requestLimits{
+		inFlight: newLimiter(maxInFlight, queueSize, wait),
+		scans:    newLimiter(maxScans, queueSize, wait),
+	}, nil
+}
+
+// scanRequest reports the requests that read a whole range of keys, or the
+// whole database, in one go.
+func scanRequest(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/api/search", "/api/aggregate", "/api/stats/histogram", "/api/stats/sample",
+		"/api/admin/export", "/api/admin/backup":
+		return true
+	case "/api/keys":
+		return r.Method == http.MethodGet && r.URL.Query().Get("filter") != ""
+	}
+	return false
+}
+
+// limitExempt reports the requests served whatever the load, so operators
+// can still see what the server is busy with.
+func limitExempt(r *http.Request) bool {
+	return !strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/api/config" || r.URL.Path == "/api/version" ||
+		r.URL.Path == "/api/stats/limits" ||
+		strings.HasPrefix(r.URL.Path, "/api/admin/active-operations")
+}
+
+func rejectBusy(w http.ResponseWriter, msg string) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
+
+// limitsMiddleware queues API requests over the limits. Scans take their
+// scan slot first, so that waiting for one does not hold a request slot.
+func (app *App) limitsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limits := app.limits
+		if limits == nil || limitExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if limits.scans != nil && scanRequest(r) {
+			if !limits.scans.acquire(r) {
+				rejectBusy(w, "Too many scans running, try again later")
+				return
+			}
+			defer limits.scans.release()
+		}
+		if limits.inFlight != nil {
+			if !limits.inFlight.acquire(r) {
+				rejectBusy(w, "Too many requests in flight, try again later")
+				return
+			}
+			defer limits.inFlight.release()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type LimitsStats struct {
+	// Requests, Scans and Memory are null when their limit is off; Memory
+	// is the budget of MEMORY_LIMIT, see memguard.go.
+	Requests *LimiterStats `json:"requests"`
+	Scans    *LimiterStats `json:"scans"`
+	Memory   *MemoryStats  `json:"memory"`
+}
+
+func (app *App) limitsStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := LimitsStats{Memory: app.memory.stats()}
+	if app.limits != nil {
+		stats.Requests = app.limits.inFlight.stats()
+		stats.Scans = app.limits.scans.stats()
+	}
+	writeJSON(w, stats)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Log messages are filtered by LOG_LEVEL, which can be changed at runtime
+// through /api/admin/loglevel or a config reload. Badger's own messages go
+// through the same filter and are only written while BADGER_LOG is on.
+var (
+	logLevel   slog.LevelVar
+	badgerLogs atomic.Bool
+)
+
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q, use debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+func logLevelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
+
+// loadLogLevel applies LOG_LEVEL and BADGER_LOG.
+func loadLogLevel() error {
+	level, err := parseLogLevel(getEnv("LOG_LEVEL", "info"))
+	if err != nil {
+		return fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+	logLevel.Set(level)
+	badgerLogs.Store(getEnv("BADGER_LOG", "false") == "true")
+	return nil
+}
+
+// loadLogFile sends the log to LOG_FILE, rotated per LOG_MAX_SIZE_MB,
+// LOG_MAX_AGE, LOG_MAX_BACKUPS and LOG_COMPRESS, instead of stderr.
+func loadLogFile() error {
+	path := getEnv("LOG_FILE", "")
+	if path == "" {
+		return nil
+	}
+	rot, err := loadRotation("LOG")
+	if err != nil {
+		return err
+	}
+	f, err := openRotatingFile(path, rot)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	return nil
+}
+
+func logAt(level slog.Level, format string, args ...interface{}) {
+	if level < logLevel.Level() {
+		return
+	}
+	log.Printf(level.String()+" "+format, args...)
+}
+
+func debugf(format string, args ...interface{}) { logAt(slog.LevelDebug, format, args...) }
+func infof(format string, args ...interface{})  { logAt(slog.LevelInfo, format, args...) }
+func warnf(format string, args ...interface{})  { logAt(slog.LevelWarn, format, args...) }
+func errorf(format string, args ...interface{}) { logAt(slog.LevelError, format, args...) }
+
+// badgerLogger implements badger.Logger on top of the level filter.
+type badgerLogger struct{}
+
+func (badgerLogger) logf(level slog.Level, format string, args ...interface{}) {
+	observeBadgerLog(format, args)
+	if badgerLogs.Load() {
+		logAt(level, "badger: "+strings.TrimSuffix(format, "\n"), args...)
+	}
+}
+
+func (l badgerLogger) Errorf(format string, args ...interface{}) {
+	l.logf(slog.LevelError, format, args...)
+}
+
+func (l badgerLogger) Warningf(format string, args ...interface{}) {
+	l.logf(slog.LevelWarn, format, args...)
+}
+
+func (l badgerLogger) Infof(format string, args ...interface{}) {
+	l.logf(slog.LevelInfo, format, args...)
+}
+
+func (l badgerLogger) Debugf(format string, args ...interface{}) {
+	l.logf(slog.LevelDebug, format, args...)
+}
+
+// LogSettings is the body of the log level endpoints.
+type LogSettings struct {
+	Level  string `json:"level"`
+	Badger bool   `json:"badger"`
+}
+
+func currentLogSettings() LogSettings {
+	return LogSettings{Level: logLevelName(logLevel.Level()), Badger: badgerLogs.Load()}
+}
+
+func (app *App) logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, currentLogSettings())
+}
+
+// updateLogLevelHandler changes the log level and turns Badger's logging on
+// or off until the next restart or reload.
+func (app *App) updateLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Level  *string `json:"level"`
+		Badger *bool   `json:"badger"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Level != nil {
+		level, err := parseLogLevel(*req.Level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logLevel.Set(level)
+	}
+	if req.Badger != nil {
+		badgerLogs.Store(*req.Badger)
+	}
+	settings := currentLogSettings()
+	log.Printf("Log level set to %s, Badger logging %t", settings.Level, settings.Badger)
+	writeJSON(w, settings)
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
@@ -18,17 +25,128 @@ import (
 type App struct {
 	db        *badger.DB
 	templates *template.Template
+	// i18n translates pages and API errors, see i18n.go.
+	i18n catalogs
+
+	// systemPrefix namespaces internal keys, see system.go.
+	systemPrefix string
+
+	// basePath is the sub-path the application is mounted under, see
+	// basepath.go.
+	basePath string
+
+	// accessStatsRate is the fraction of key accesses recorded in the
+	// per-key statistics; 0 disables them.
+	accessStatsRate float64
+	pendingAccesses pendingAccesses
+	archiver        *archiver
+	proxy           *upstreamProxy
+	events          *eventBus
+	credentials     *credentials
+	sessions        *sessionStore
+	oidc            *oidcProvider
+	ldap            *ldapProvider
+	hmac            *hmacAuth
+	ipFilter        *ipFilter
+	trustedProxies  []*net.IPNet
+	redactor        *redactor
+	securityHeaders map[string]string
+	throttle        *authThrottle
+	auditRetention  time.Duration
+	exportCipher    *exportCipher
+	uploads         *uploadStore
+	scans           *scanStore
+	maxValueSize    int64
+	writeRules      writeRules
+	maxPrefetchSize int
+	jobs            *jobManager
+	diskGuard       *diskGuard
+	limits          *requestLimits
+	writes          *writePool
+	readCache       *readCache
+	memory          *memoryGuard
+	slowLog         *slowLog
+	alerts          *alertManager
+	compactions     *compactionMonitor
+	notifier        *notifier
+	accessLog       *accessLog
+	maintenance     maintenanceMode
+	journal         *journal
+	backups         *backupSchedule
+	scripts         *scriptHooks
+
+	// config holds the values read from CONFIG_FILE; reloadMu serializes
+	// reloads, see config.go.
+	config   *configFile
+	reloadMu sync.Mutex
+
+	// databases maps names to other database directories, see databases.go.
+	databases map[string]string
+	// stores are the other key-value directories opened for the stores
+	// API, see store.go.
+	stores map[string]*namedStore
+
+	// manifestRequired rejects restores and imports without a manifest.
+	manifestRequired bool
+
+	// managed is set for databases opened with managed transactions; clock
+	// is then the last commit timestamp handed out, see managed.go.
+	managed bool
+	clock   atomic.Uint64
+
+	// truncated is set when the database was opened after an unclean
+	// shutdown and Badger truncated its write-ahead logs, see truncate.go.
+	truncated bool
+
+	// conflicts counts transactions that failed with ErrConflict.
+	conflicts atomic.Int64
+
+	// storedUsers is set once any user exists under the system prefix, which
+	// turns authentication on even without environment credentials.
+	storedUsers atomic.Bool
+
+	// disabledFeatures are the features switched off with
+	// DISABLED_FEATURES, see features.go.
+	disabledFeatures map[string]bool
+
+	// debugHeaders adds the cost of reads to their responses, see
+	// debugheaders.go.
+	debugHeaders bool
+
+	// rawStreamTimeout bounds the writing of a raw value from within its
+	// read transaction, see streamRawValue.
+	rawStreamTimeout time.Duration
 }
 
 type KeyValue struct {
 	Key       string    `json:"key"`
 	Value     string    `json:"value"`
 	CreatedAt time.Time `json:"created_at"`
+	Version   uint64    `json:"version,omitempty"`
+	Archived  bool      `json:"archived,omitempty"`
+	Redacted  bool      `json:"redacted,omitempty"`
+	File      *FileMeta `json:"file,omitempty"`
 }
 
 type Stats struct {
-	NumKeys      int64 `json:"num_keys"`
-	DatabaseSize int64 `json:"database_size"`
+	NumKeys      int64  `json:"num_keys"`
+	DatabaseSize int64  `json:"database_size"`
+	Dir          string `json:"dir"`
+	ValueDir     string `json:"value_dir"`
+	LSMSize      int64  `json:"lsm_size"`
+	VlogSize     int64  `json:"vlog_size"`
+	Truncated    bool   `json:"truncated,omitempty"`
+	DiskFree     int64  `json:"disk_free,omitempty"`
+	DiskLow      bool   `json:"disk_low,omitempty"`
+}
+
+// readOnlyRequest reports API requests that only read although their method
+// is not GET: the scan API, which creates and deletes sessions, and existence
+// checks, which take a list of keys in the body. Read-only mode, the disk
+// guard and the journal let them through.
+func readOnlyRequest(r *http.Request) bool {
+	return r.URL.Path == "/api/scan" || strings.HasPrefix(r.URL.Path, "/api/scan/") ||
+		r.URL.Path == "/api/keys/exists"
 }
 
 func getEnv(key, defaultValue string) string {
@@ -39,61 +157,513 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
-func main() {
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// serve runs the server until it is shut down, see service.go.
+func serve() {
+	config, err := loadConfigFile()
+	if err != nil {
+		log.Fatal("Failed to read CONFIG_FILE:", err)
+	}
+	if err := loadLogLevel(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadLogFile(); err != nil {
+		log.Fatal("Failed to open LOG_FILE:", err)
+	}
+
 	dbPath := getEnv("BADGER_DB_PATH", "./badger-data")
 	opts := badger.DefaultOptions(dbPath)
-	if getEnv("BADGER_LOG", "false") != "true" {
-		opts.Logger = nil // Disable logging for cleaner output
+	opts.ValueDir = getEnv("BADGER_VALUE_DIR", dbPath)
+	opts.Logger = badgerLogger{}
+	versionsToKeep, err := loadVersionsToKeep()
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.NumVersionsToKeep = versionsToKeep
+	opts.DetectConflicts = getEnv("DETECT_CONFLICTS", "true") == "true"
+	if err := loadCacheSizes(&opts); err != nil {
+		log.Fatal(err)
+	}
+	if keyFile := getEnv("BADGER_ENCRYPTION_KEY_FILE", ""); keyFile != "" {
+		key, err := readEncryptionKey(keyFile)
+		if err != nil {
+			log.Fatal("BADGER_ENCRYPTION_KEY_FILE:", err)
+		}
+		setEncryptionKey(&opts, key)
 	}
 
-	db, err := badger.Open(opts)
+	managed := getEnv("MANAGED_TXNS", "false") == "true"
+	truncate := loadTruncate()
+	leftoverWAL := walFiles(dbPath)
+	db, err := openDatabaseDir(opts, managed, truncate)
 	if err != nil {
-		log.Fatal("Failed to open database:", err)
+		db = recoverDatabase(opts, managed, truncate, err)
 	}
 	defer db.Close()
 
+	i18n, err := loadCatalogs(getEnv("LOCALES_DIR", "locales"))
+	if err != nil {
+		log.Fatal("Failed to load message catalogs:", err)
+	}
+
 	// Parse templates
-	templates, err := template.ParseGlob("templates/*.html")
+	templates, err := template.New("").Funcs(templateFuncs).Funcs(template.FuncMap{"t": i18n.translate}).ParseGlob("templates/*.html")
 	if err != nil {
 		log.Fatal("Failed to parse templates:", err)
 	}
 
 	app := &App{
-		db:        db,
-		templates: templates,
+		db:           db,
+		templates:    templates,
+		i18n:         i18n,
+		systemPrefix: getEnv("SYSTEM_PREFIX", "_sys:"),
+		events:       newEventBus(parseList(getEnv("WEBHOOK_URLS", ""))),
+		managed:      managed,
+		config:       config,
+		truncated:    len(leftoverWAL) > 0 && !db.Opts().ReadOnly,
+	}
+	app.clock.Store(db.MaxVersion())
+
+	app.readCache, err = loadReadCache()
+	if err != nil {
+		log.Fatal("Failed to configure the read cache:", err)
+	}
+	if app.readCache != nil {
+		// Values are only cached once the subscription is live.
+		go app.subscribeReadCache()
+	}
+
+	app.maxValueSize, err = loadMaxValueSize(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.rawStreamTimeout, err = time.ParseDuration(getEnv("RAW_STREAM_TIMEOUT", "5m"))
+	if err != nil || app.rawStreamTimeout <= 0 {
+		log.Fatal("Invalid RAW_STREAM_TIMEOUT")
+	}
+	app.writeRules, err = loadWriteRules(app.maxValueSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.maxPrefetchSize, err = loadMaxPrefetchSize()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.credentials, err = parseCredentials(getEnv("AUTH_USERS", ""), getEnv("AUTH_TOKENS", ""))
+	if err != nil {
+		log.Fatal("Invalid credentials:", err)
+	}
+	sessionTTL, err := time.ParseDuration(getEnv("SESSION_TTL", "12h"))
+	if err != nil {
+		log.Fatal("Invalid SESSION_TTL:", err)
+	}
+	app.oidc, err = loadOIDCProvider()
+	if err != nil {
+		log.Fatal("Failed to configure OIDC:", err)
+	}
+	app.ldap, err = loadLDAPProvider()
+	if err != nil {
+		log.Fatal("Failed to configure LDAP:", err)
+	}
+	app.hmac, err = loadHMACAuth()
+	if err != nil {
+		log.Fatal("Failed to configure HMAC clients:", err)
+	}
+	app.throttle, err = loadAuthThrottle()
+	if err != nil {
+		log.Fatal("Failed to configure login throttling:", err)
+	}
+	app.auditRetention, err = time.ParseDuration(getEnv("AUDIT_RETENTION", "2160h"))
+	if err != nil {
+		log.Fatal("Invalid AUDIT_RETENTION:", err)
+	}
+	app.basePath, err = loadBasePath()
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.sessions = newSessionStore(sessionTTL, getEnv("SESSION_COOKIE_SECURE", "false") == "true", app.url("/"))
+	if err := app.refreshStoredUsers(); err != nil {
+		log.Fatal("Failed to load users:", err)
+	}
+
+	sweepInterval, err := time.ParseDuration(getEnv("EXPIRY_SWEEP_INTERVAL", "30s"))
+	if err != nil {
+		log.Fatal("Invalid EXPIRY_SWEEP_INTERVAL:", err)
+	}
+	if !app.readOnly() {
+		go app.runExpirySweeper(sweepInterval)
+	}
+
+	if getEnv("ACCESS_STATS", "false") == "true" {
+		rate, err := strconv.ParseFloat(getEnv("ACCESS_STATS_SAMPLE_RATE", "1"), 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			log.Fatal("ACCESS_STATS_SAMPLE_RATE must be a number in (0, 1]")
+		}
+		app.accessStatsRate = rate
+		go app.runAccessStatsFlusher()
+		defer app.flushAccessStats()
+	}
+
+	app.archiver, err = loadArchiver()
+	if err != nil {
+		log.Fatal("Failed to configure archival:", err)
+	}
+	if app.archiver != nil {
+		if app.accessStatsRate == 0 {
+			log.Fatal("Archival relies on access statistics, set ACCESS_STATS=true")
+		}
+		if !app.readOnly() {
+			go app.runArchiver()
+		}
+	}
+
+	app.exportCipher, err = loadExportCipher()
+	if err != nil {
+		log.Fatal("Failed to configure backup encryption:", err)
+	}
+
+	app.manifestRequired = getEnv("MANIFEST_REQUIRED", "false") == "true"
+	app.debugHeaders = getEnv("DEBUG_HEADERS", "false") == "true"
+	if err := loadOperationTimeout(); err != nil {
+		log.Fatal("Failed to configure the operation watchdog:", err)
+	}
+	app.writes, err = loadWritePool()
+	if err != nil {
+		log.Fatal("Failed to configure write batching:", err)
+	}
+	if app.writes != nil {
+		app.runWriteWorkers()
+	}
+	app.backups, err = loadBackupSchedule()
+	if err != nil {
+		log.Fatal("Failed to configure scheduled backups:", err)
+	}
+	if app.backups != nil && !app.readOnly() {
+		go app.runBackupSchedule()
+	}
+	app.notifier, err = loadNotifier()
+	if err != nil {
+		log.Fatal("Failed to configure notifications:", err)
+	}
+	app.events.setNotifier(app.notifier)
+	app.compactions = newCompactionMonitor()
+	go app.compactions.run()
+	app.alerts, err = loadAlertManager()
+	if err != nil {
+		log.Fatal("Failed to configure alerts:", err)
+	}
+	if app.alerts != nil {
+		go app.runAlerts()
+	}
+	app.uploads, err = loadUploadStore()
+	if err != nil {
+		log.Fatal("Failed to configure uploads:", err)
+	}
+	app.scans, err = loadScanStore()
+	if err != nil {
+		log.Fatal("Failed to configure scan sessions:", err)
+	}
+	defer app.scans.closeAll()
+
+	app.jobs, err = loadJobManager()
+	if err != nil {
+		log.Fatal("Failed to configure jobs:", err)
+	}
+	if !app.readOnly() {
+		if err := app.failInterruptedJobs(); err != nil {
+			log.Fatal("Failed to load jobs:", err)
+		}
+	}
+	if err := app.restoreDiscardTs(); err != nil {
+		log.Fatal("Failed to load discard timestamp:", err)
+	}
+	app.databases, err = loadDatabases()
+	if err != nil {
+		log.Fatal("Failed to configure databases:", err)
+	}
+	app.disabledFeatures, err = loadDisabledFeatures()
+	if err != nil {
+		log.Fatal("Failed to configure features:", err)
+	}
+	app.stores, err = app.loadStores()
+	if err != nil {
+		log.Fatal("Failed to open stores:", err)
+	}
+	defer closeStores(app.stores)
+
+	app.proxy, err = loadUpstreamProxy()
+	if err != nil {
+		log.Fatal("Failed to configure proxy mode:", err)
+	}
+
+	app.redactor, err = loadRedactor()
+	if err != nil {
+		log.Fatal("Failed to configure redaction:", err)
+	}
+
+	app.scripts, err = loadScriptHooks()
+	if err != nil {
+		log.Fatal("Failed to load script hooks:", err)
+	}
+
+	app.trustedProxies, err = parseCIDRs("TRUSTED_PROXIES")
+	if err != nil {
+		log.Fatal("Failed to configure trusted proxies:", err)
+	}
+	app.ipFilter, err = loadIPFilter()
+	if err != nil {
+		log.Fatal("Failed to configure IP filter:", err)
+	}
+
+	app.diskGuard, err = loadDiskGuard()
+	if err != nil {
+		log.Fatal("Failed to configure disk monitoring:", err)
+	}
+	if app.diskGuard != nil && !app.readOnly() {
+		if err := app.checkDisk(); err != nil {
+			log.Fatal("Failed to check disk space:", err)
+		}
+		go app.runDiskGuard()
+	}
+
+	app.limits, err = loadRequestLimits()
+	if err != nil {
+		log.Fatal("Failed to configure request limits:", err)
+	}
+
+	app.slowLog, err = loadSlowLog()
+	if err != nil {
+		log.Fatal("Failed to configure the slow request log:", err)
+	}
+	app.memory, err = loadMemoryGuard()
+	if err != nil {
+		log.Fatal("Failed to configure the memory limit:", err)
+	}
+
+	app.accessLog, err = loadAccessLog()
+	if err != nil {
+		log.Fatal("Failed to configure access log:", err)
+	}
+
+	app.journal, err = loadJournal()
+	if err != nil {
+		log.Fatal("Failed to open journal:", err)
+	}
+
+	app.securityHeaders = loadSecurityHeaders()
+	app.reloadOnHangup()
+
+	if warmup := loadWarmup(); warmup != nil {
+		if warmup.wait {
+			app.warm(warmup)
+		} else {
+			go app.warm(warmup)
+		}
 	}
 
 	// Setup routes
 	r := mux.NewRouter()
+	r.Use(app.requestIDMiddleware)
+	r.Use(app.recoverMiddleware)
+	r.Use(app.slowLogMiddleware)
+	r.Use(app.localizeMiddleware)
+	r.Use(app.forwardedProtoMiddleware)
+	r.Use(app.authMiddleware)
+	r.Use(app.limitsMiddleware)
+	r.Use(app.maintenanceMiddleware)
+	r.Use(app.readOnlyMiddleware)
+	r.Use(app.featuresMiddleware)
+	r.Use(app.diskGuardMiddleware)
+	r.Use(app.journalMiddleware)
+	r.Use(app.negotiateMiddleware)
 
 	// Static files
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
 
 	// Main page
 	r.HandleFunc("/", app.indexHandler).Methods("GET")
+	r.HandleFunc("/login", app.loginPageHandler).Methods("GET")
+	r.HandleFunc("/login", app.loginHandler).Methods("POST")
+	r.HandleFunc("/logout", app.logoutHandler).Methods("POST")
+	if app.oidc != nil {
+		r.HandleFunc("/auth/oidc/login", app.oidcLoginHandler).Methods("GET")
+		r.HandleFunc("/auth/oidc/callback", app.oidcCallbackHandler).Methods("GET")
+	}
 
 	// API routes
-	r.HandleFunc("/api/keys", app.listKeysHandler).Methods("GET")
-	r.HandleFunc("/api/keys", app.createKeyHandler).Methods("POST")
-	r.HandleFunc("/api/keys/{key}", app.getKeyHandler).Methods("GET")
-	r.HandleFunc("/api/keys/{key}", app.updateKeyHandler).Methods("PUT")
-	r.HandleFunc("/api/keys/{key}", app.deleteKeyHandler).Methods("DELETE")
+	app.keyRoutes(r)
+	app.storeRoutes(r)
+	r.HandleFunc("/api/scan", app.createScanHandler).Methods("POST")
+	r.HandleFunc("/api/scan/{id}/next", app.scanNextHandler).Methods("GET")
+	r.HandleFunc("/api/scan/{id}", app.deleteScanHandler).Methods("DELETE")
 	r.HandleFunc("/api/stats", app.statsHandler).Methods("GET")
+	r.HandleFunc("/api/config", app.configHandler).Methods("GET")
+	r.HandleFunc("/api/version", app.versionHandler).Methods("GET")
+	r.HandleFunc("/api/stats/access", app.accessReportHandler).Methods("GET")
+	r.HandleFunc("/api/stats/cache", app.cacheStatsHandler).Methods("GET")
+	r.HandleFunc("/api/stats/compactions", app.compactionStatsHandler).Methods("GET")
+	r.HandleFunc("/api/stats/estimate", app.estimateHandler).Methods("GET")
+	r.HandleFunc("/api/stats/histogram", app.histogramHandler).Methods("GET")
+	r.HandleFunc("/api/stats/limits", app.limitsStatsHandler).Methods("GET")
+	r.HandleFunc("/api/stats/sample", app.sampleHandler).Methods("GET")
+	r.HandleFunc("/api/admin/archive", app.archiveHandler).Methods("POST")
+	r.HandleFunc("/api/admin/audit", app.auditHandler).Methods("GET")
+	r.HandleFunc("/api/admin/backup", app.backupHandler).Methods("GET")
+	r.HandleFunc("/api/admin/clone", app.cloneHandler).Methods("POST")
+	r.HandleFunc("/api/admin/copy", app.copyHandler).Methods("POST")
+	r.HandleFunc("/api/admin/migrate", app.migrateHandler).Methods("POST")
+	r.HandleFunc("/api/admin/diagnostics", app.diagnosticsHandler).Methods("POST")
+	r.HandleFunc("/api/admin/info", app.dbInfoHandler).Methods("GET")
+	r.HandleFunc("/api/admin/jobs", app.listJobsHandler).Methods("GET")
+	r.HandleFunc("/api/admin/activity", app.activityHandler).Methods("GET")
+	r.HandleFunc("/api/admin/active-operations", app.activeOperationsHandler).Methods("GET")
+	r.HandleFunc("/api/admin/active-operations/{id}", app.cancelOperationHandler).Methods("DELETE")
+	r.HandleFunc("/api/admin/jobs/duplicates", app.duplicatesHandler).Methods("POST")
+	r.HandleFunc("/api/admin/jobs/fix", app.fixHandler).Methods("POST")
+	r.HandleFunc("/api/admin/jobs/rekey", app.rekeyHandler).Methods("POST")
+	r.HandleFunc("/api/admin/jobs/integrity", app.integrityHandler).Methods("POST")
+	r.HandleFunc("/api/admin/jobs/keyspace-diff", app.keyspaceDiffHandler).Methods("POST")
+	r.HandleFunc("/api/admin/jobs/stale-space", app.staleSpaceHandler).Methods("POST")
+	r.HandleFunc("/api/admin/jobs/{id}", app.getJobHandler).Methods("GET")
+	r.HandleFunc("/api/admin/jobs/{id}/cancel", app.cancelJobHandler).Methods("POST")
+	r.HandleFunc("/api/admin/loglevel", app.logLevelHandler).Methods("GET")
+	r.HandleFunc("/api/admin/loglevel", app.updateLogLevelHandler).Methods("PUT")
+	r.HandleFunc("/api/admin/options", app.optionsHandler).Methods("GET")
+	r.HandleFunc("/api/admin/slowlog", app.slowLogHandler).Methods("GET")
+	r.HandleFunc("/api/admin/reload", app.reloadHandler).Methods("POST")
+	r.HandleFunc("/api/admin/restore", app.restoreHandler).Methods("POST")
+	r.HandleFunc("/api/admin/restore-to", app.restoreToHandler).Methods("POST")
+	r.HandleFunc("/api/admin/export", app.exportHandler).Methods("GET")
+	r.HandleFunc("/api/admin/masking", app.listMaskingHandler).Methods("GET")
+	r.HandleFunc("/api/admin/masking/{name}", app.putMaskingHandler).Methods("PUT")
+	r.HandleFunc("/api/admin/masking/{name}", app.deleteMaskingHandler).Methods("DELETE")
+	r.HandleFunc("/api/admin/import", app.importHandler).Methods("POST")
+	r.HandleFunc("/api/admin/maintenance", app.maintenanceHandler).Methods("GET")
+	r.HandleFunc("/api/admin/maintenance", app.updateMaintenanceHandler).Methods("POST")
+	r.HandleFunc("/api/admin/manifests/{name}", app.manifestHandler).Methods("GET")
+	r.HandleFunc("/api/admin/views/{name}", app.putViewHandler).Methods("PUT")
+	r.HandleFunc("/api/admin/views/{name}", app.deleteViewHandler).Methods("DELETE")
+	r.HandleFunc("/api/admin/alerts", app.listAlertsHandler).Methods("GET")
+	r.HandleFunc("/api/admin/alerts/{name}", app.getAlertHandler).Methods("GET")
+	r.HandleFunc("/api/admin/alerts/{name}", app.putAlertHandler).Methods("PUT")
+	r.HandleFunc("/api/admin/alerts/{name}", app.deleteAlertHandler).Methods("DELETE")
+	r.HandleFunc("/api/admin/notify/{channel}/test", app.testNotifyHandler).Methods("POST")
+	r.HandleFunc("/api/admin/versions", app.versionSettingsHandler).Methods("GET")
+	r.HandleFunc("/api/admin/versions", app.updateVersionSettingsHandler).Methods("PUT")
+	r.HandleFunc("/api/admin/versions/discard", app.discardVersionsHandler).Methods("POST")
+	r.HandleFunc("/api/admin/transactions", app.txnStatsHandler).Methods("GET")
+	r.HandleFunc("/api/admin/uploads", app.createUploadHandler).Methods("POST")
+	r.HandleFunc("/api/admin/uploads/{id}", app.uploadStatusHandler).Methods("GET")
+	r.HandleFunc("/api/admin/uploads/{id}", app.appendUploadHandler).Methods("PUT")
+	r.HandleFunc("/api/admin/uploads/{id}", app.deleteUploadHandler).Methods("DELETE")
+	r.HandleFunc("/api/admin/uploads/{id}/commit", app.commitUploadHandler).Methods("POST")
+	r.HandleFunc("/api/admin/users", app.listUsersHandler).Methods("GET")
+	r.HandleFunc("/api/admin/users", app.createUserHandler).Methods("POST")
+	r.HandleFunc("/api/admin/users/{name}", app.getUserHandler).Methods("GET")
+	r.HandleFunc("/api/admin/users/{name}", app.updateUserHandler).Methods("PUT")
+	r.HandleFunc("/api/admin/users/{name}", app.deleteUserHandler).Methods("DELETE")
+	r.HandleFunc("/api/admin/users/{name}/password", app.resetPasswordHandler).Methods("POST")
+	r.HandleFunc("/api/aggregate", app.aggregateHandler).Methods("GET")
 	r.HandleFunc("/api/search", app.searchKeysHandler).Methods("GET")
+	r.HandleFunc("/api/views", app.listViewsHandler).Methods("GET")
+	r.HandleFunc("/api/views/{name}", app.viewItemsHandler).Methods("GET")
+
+	handler := mountBasePath(app.basePath, r)
+	handler = app.multiplexProtocols(handler)
+	// Around the router rather than through r.Use, which only runs for
+	// matched routes, so that 404 and 405 responses are filtered and carry
+	// the security headers as well.
+	handler = app.ipFilterMiddleware(handler)
+	handler = app.securityHeadersMiddleware(handler)
+	if app.accessLog != nil {
+		handler = app.accessLogHandler(handler)
+	}
+
+	if m := loadAutocert(dbPath); m != nil {
+		app.notifyReady()
+		if err := serveTLS(handler, m); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	port := getEnv("PORT", "8080")
-	fmt.Printf("Server starting on http://localhost:%s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	server := &http.Server{Addr: ":" + port, Handler: loadH2C(handler)}
+	listener, err := systemdListener()
+	if err != nil {
+		log.Fatal("Failed to use the socket passed by systemd:", err)
+	}
+	if listener != nil {
+		fmt.Printf("Server starting on %s (socket activated)\n", listener.Addr())
+	} else {
+		if listener, err = net.Listen("tcp", server.Addr); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Server starting on http://localhost:%s\n", port)
+	}
+	go shutdownOnSignal(server)
+	app.notifyReady()
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// shutdownOnSignal stops server on SIGINT, SIGTERM or a service manager stop
+// request, letting serve return and close the database cleanly.
+func shutdownOnSignal(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-signals:
+	case <-shutdownRequests:
+	}
+	sdNotify("STOPPING=1")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to stop server: %v", err)
+	}
+}
+
+type indexPage struct {
+	BasePath  string
+	Lang      string
+	User      *principal
+	CSRFToken string
+	Config    UIConfig
+	browseData
 }
 
 func (app *App) indexHandler(w http.ResponseWriter, r *http.Request) {
-	err := app.templates.ExecuteTemplate(w, "index.html", nil)
+	page := indexPage{BasePath: app.basePath, Lang: app.requestLanguage(r), User: currentPrincipal(r), Config: app.uiConfig(r)}
+	if sess := app.sessions.fromRequest(r); sess != nil {
+		page.CSRFToken = sess.CSRFToken
+	}
+	data, err := app.loadBrowseData(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.browseData = data
+
+	err = app.templates.ExecuteTemplate(w, "index.html", page)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
 func (app *App) listKeysHandler(w http.ResponseWriter, r *http.Request) {
+	readTs, ok := app.timestampParam(w, r, "read_ts")
+	if !ok {
+		return
+	}
 	limit := 1000
 	if l := r.URL.Query().Get("limit"); l != "" {
 		if parsed, err := strconv.Atoi(l); err == nil {
@@ -101,23 +671,117 @@ func (app *App) listKeysHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchSize = 10
+	opts.Prefix = []byte(r.URL.Query().Get("prefix"))
+	opts, ok = app.iteratorOptions(w, r, opts)
+	if !ok {
+		return
+	}
+	fields, ok := parseFields(w, r)
+	if !ok {
+		return
+	}
+	query, ok := parseKeyQuery(w, r)
+	if !ok {
+		return
+	}
+	keysOnly := r.URL.Query().Get("keys_only") == "true"
+	if query.filter == nil && (keysOnly || fields != nil && !fields["value"]) {
+		opts.PrefetchValues = false
+	}
+	if r.URL.Query().Get("explain") == "true" {
+		writeJSON(w, app.explainQuery("list", opts, query, limit, readsValues(keysOnly, fields)))
+		return
+	}
+
 	keys := make([]KeyValue, 0)
-	err := app.db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 10
+	infos := make([]KeyInfo, 0)
+	records := make([]map[string]interface{}, 0)
+	tag := app.newCollectionTag(r)
+	cost := app.newScanCost()
+	mem := app.reserveMemory()
+	defer mem.release()
+	start := time.Now()
+	scan := func(txn *badger.Txn) error {
+		ctx, cancel := operations.interruptible(r.Context(), txn)
+		defer cancel()
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
+		showSystem := includeSystem(r)
 		count := 0
 		for it.Rewind(); it.Valid() && count < limit; it.Next() {
+			if err := checkOperation(ctx); err != nil {
+				return err
+			}
 			item := it.Item()
+			cost.add(item)
+			if !showSystem && app.isSystemKey(item.Key()) {
+				continue
+			}
+			if !query.matchKey(string(item.Key())) {
+				continue
+			}
+			matched, err := app.matchItem(r, query, item)
+			if err != nil {
+				return err
+			}
+			if !matched {
+				continue
+			}
+			tag.add(item.Key(), item.Version())
+			if fields != nil {
+				if err := mem.growKeyValue(item); err != nil {
+					return err
+				}
+				record, err := app.selectFields(r, fields, app.itemFields(txn, item))
+				if err != nil {
+					return err
+				}
+				records = append(records, record)
+				count++
+				continue
+			}
+			if keysOnly {
+				if err := mem.growKeyInfo(item); err != nil {
+					return err
+				}
+				infos = append(infos, keyInfo(item))
+				count++
+				continue
+			}
 			key := string(item.Key())
+			if err := mem.growKeyValue(item); err != nil {
+				return err
+			}
+
+			if item.UserMeta()&archivedMeta != 0 {
+				keys = append(keys, KeyValue{
+					Key:       key,
+					CreatedAt: time.Unix(int64(item.Version()), 0),
+					Version:   item.Version(),
+					Archived:  true,
+				})
+				count++
+				continue
+			}
 
-			err := item.Value(func(val []byte) error {
+			meta, err := app.loadFileMeta(txn, item.Key())
+			if err != nil {
+				return err
+			}
+			err = item.Value(func(val []byte) error {
+				val, err := app.scriptRead(key, val)
+				if err != nil {
+					return err
+				}
 				keys = append(keys, KeyValue{
 					Key:       key,
 					Value:     string(val),
 					CreatedAt: time.Unix(int64(item.Version()), 0),
+					Version:   item.Version(),
+					File:      meta,
 				})
 				return nil
 			})
@@ -127,12 +791,55 @@ func (app *App) listKeysHandler(w http.ResponseWriter, r *http.Request) {
 			count++
 		}
 		return nil
-	})
+	}
+	err := app.viewAt(readTs, scan)
+	if err == errMemoryLimit && fields == nil && !keysOnly && !wantsFragment(r) {
+		// Too many values to hold: list the keys only.
+		mem.release()
+		keys = make([]KeyValue, 0)
+		keysOnly = true
+		if query.filter == nil {
+			opts.PrefetchValues = false
+		}
+		tag = app.newCollectionTag(r)
+		if err = app.viewAt(readTs, scan); err == nil {
+			app.memory.degrade(w)
+		}
+	}
+	cost.since(start)
+	cost.writeHeaders(w)
 
+	if err == errMemoryLimit {
+		app.memory.reject(w)
+		return
+	}
+	if err == errOperationCanceled {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if tag.notModified(w, r) {
+		return
+	}
+
+	if fields != nil {
+		writeJSON(w, records)
+		return
+	}
+	if keysOnly {
+		writeJSON(w, infos)
+		return
+	}
+	for i := range keys {
+		app.redact(r, &keys[i])
+	}
+	if wantsFragment(r) {
+		app.writeKeyRows(w, r, keys)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(keys); err != nil {
@@ -141,6 +848,124 @@ func (app *App) listKeysHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// storeValue writes a user value, through the upstream first in proxy mode,
+// and records the write. meta is set for values uploaded as files. In
+// managed mode the value is committed at commitTs, or the next timestamp if
+// 0. It returns the timestamps of the write.
+func (app *App) storeValue(key string, value []byte, meta *FileMeta, commitTs uint64) (txnInfo, error) {
+	return app.putValue(key, value, meta, commitTs, false)
+}
+
+// errKeyExists rejects a create-if-absent write of an existing key.
+var errKeyExists = errors.New("key already exists")
+
+// createValue is storeValue for a key that must not exist yet; it returns
+// errKeyExists otherwise. The check runs in the write transaction, so with
+// conflict detection a concurrent create of the same key fails with
+// badger.ErrConflict.
+func (app *App) createValue(key string, value []byte, commitTs uint64) (txnInfo, error) {
+	return app.putValue(key, value, nil, commitTs, true)
+}
+
+func (app *App) putValue(key string, value []byte, meta *FileMeta, commitTs uint64, ifAbsent bool) (txnInfo, error) {
+	value, extra, err := app.scriptWrite(key, value)
+	if err != nil {
+		return txnInfo{}, err
+	}
+	if app.proxy != nil {
+		if ifAbsent {
+			_, found, err := app.proxy.fetch(key)
+			if err != nil {
+				return txnInfo{}, upstreamError{err}
+			}
+			if found {
+				return txnInfo{}, errKeyExists
+			}
+		}
+		if err := app.proxy.store(key, value); err != nil {
+			return txnInfo{}, upstreamError{err}
+		}
+	}
+
+	entries := []*badger.Entry{app.newEntry([]byte(key), value)}
+	for k, v := range extra {
+		entries = append(entries, app.newEntry([]byte(k), v))
+	}
+	var info txnInfo
+	if app.writes.batchable(value, meta, commitTs, ifAbsent) {
+		info, err = app.batchWrite(key, entries)
+	} else {
+		info, err = app.writeKey(key, commitTs, func(txn *badger.Txn) error {
+			if ifAbsent {
+				if _, err := txn.Get([]byte(key)); err == nil {
+					return errKeyExists
+				} else if err != badger.ErrKeyNotFound {
+					return err
+				}
+			}
+			for _, e := range entries {
+				if err := app.setEntry(txn, e); err != nil {
+					return err
+				}
+			}
+			if meta != nil {
+				return app.setFileMeta(txn, []byte(key), meta)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		return info, err
+	}
+
+	app.recordAccess(key, true)
+	app.events.publish(Event{Type: EventSet, Key: key})
+	for k := range extra {
+		app.events.publish(Event{Type: EventSet, Key: k})
+	}
+	return info, nil
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	var upstream upstreamError
+	var invalid *ValidationError
+	var rejection *scriptRejection
+	switch {
+	case errors.As(err, &invalid):
+		writeValidationError(w, invalid)
+	case errors.As(err, &rejection):
+		http.Error(w, rejection.Message, http.StatusUnprocessableEntity)
+	case errors.As(err, &upstream):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	case err == badger.ErrConflict:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err == errKeyExists:
+		http.Error(w, "Key already exists", http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// keyRoutes registers the data API for keys. It is shared with the copy
+// that replays the journal during a point-in-time restore.
+func (app *App) keyRoutes(r *mux.Router) {
+	r.HandleFunc("/api/keys", app.listKeysHandler).Methods("GET")
+	r.HandleFunc("/api/keys", app.createKeyHandler).Methods("POST")
+	r.HandleFunc("/api/keys/exists", app.keysExistHandler).Methods("POST")
+	r.HandleFunc("/api/keys/bulk", app.bulkKeysHandler).Methods("POST")
+	r.HandleFunc("/api/keys/ttl", app.setPrefixTTLHandler).Methods("PATCH")
+	r.HandleFunc("/api/keys/{key}", app.getKeyHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/api/keys/{key}/raw", app.rawValueHandler).Methods("GET")
+	r.HandleFunc("/api/keys/{key}/raw", app.putRawValueHandler).Methods("PUT")
+	r.HandleFunc("/api/keys/{key}/file", app.uploadFileHandler).Methods("POST")
+	r.HandleFunc("/api/keys/{key}/ttl", app.setTTLHandler).Methods("PATCH")
+	r.HandleFunc("/api/keys/{key}/touch", app.touchHandler).Methods("POST")
+	r.HandleFunc("/api/keys/{key}/versions", app.keyVersionsHandler).Methods("GET")
+	r.HandleFunc("/api/keys/{key}/diff", app.diffHandler).Methods("GET")
+	r.HandleFunc("/api/keys/{key}", app.updateKeyHandler).Methods("PUT")
+	r.HandleFunc("/api/keys/{key}", app.deleteKeyHandler).Methods("DELETE")
+}
+
 func (app *App) createKeyHandler(w http.ResponseWriter, r *http.Request) {
 	var kv KeyValue
 	if err := json.NewDecoder(r.Body).Decode(&kv); err != nil {
@@ -148,19 +973,28 @@ func (app *App) createKeyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if kv.Key == "" {
-		http.Error(w, "Key cannot be empty", http.StatusBadRequest)
+	if app.rejectSystemWrite(w, kv.Key) || app.rejectInvalidWrite(w, kv.Key, []byte(kv.Value)) {
+		return
+	}
+	commitTs, ok := app.timestampParam(w, r, "commit_ts")
+	if !ok {
 		return
 	}
 
-	err := app.db.Update(func(txn *badger.Txn) error {
-		return txn.Set([]byte(kv.Key), []byte(kv.Value))
-	})
-
+	// if_absent=true or If-None-Match: * only creates new keys.
+	var info txnInfo
+	var err error
+	if r.URL.Query().Get("if_absent") == "true" || r.Header.Get("If-None-Match") == "*" {
+		info, err = app.createValue(kv.Key, []byte(kv.Value), commitTs)
+	} else {
+		info, err = app.storeValue(kv.Key, []byte(kv.Value), nil, commitTs)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeStoreError(w, err)
 		return
 	}
+	kv.Version = info.CommitTs
+	writeTxnHeaders(w, info)
 
 	kv.CreatedAt = time.Now()
 	w.Header().Set("Content-Type", "application/json")
@@ -170,34 +1004,136 @@ func (app *App) createKeyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (app *App) getKeyHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+// upstreamError marks failures of the proxy upstream, reported as 502.
+type upstreamError struct{ error }
 
-	var kv KeyValue
-	err := app.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(key))
-		if err != nil {
+// lookupKey reads a user key as of readTs (0 for the latest data),
+// rehydrating archived values and falling back to the upstream in proxy
+// mode, where version is 0 for freshly fetched values, and runs the read
+// hooks on the value. It returns badger.ErrKeyNotFound for unknown keys.
+func (app *App) lookupKey(key string, readTs uint64) (value []byte, version uint64, err error) {
+	var archived bool
+	if cached := app.readCacheGet(key, readTs); cached != nil {
+		value, version, archived = cached.value, cached.version, cached.archived
+	} else {
+		seq := app.readCache.begin()
+		var meta *FileMeta
+		var expiresAt uint64
+		err = app.viewAt(readTs, func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte(key))
+			if err != nil {
+				return err
+			}
+			version, expiresAt = item.Version(), item.ExpiresAt()
+			archived = item.UserMeta()&archivedMeta != 0
+			if value, err = item.ValueCopy(nil); err != nil {
+				return err
+			}
+			if app.readCache != nil && readTs == 0 {
+				meta, err = app.loadFileMeta(txn, []byte(key))
+			}
 			return err
+		})
+		if err == nil && readTs == 0 {
+			app.readCache.put(seq, &readCacheEntry{key: key, value: value, version: version, archived: archived, meta: meta, expiresAt: expiresAt})
 		}
+	}
 
-		return item.Value(func(val []byte) error {
-			kv = KeyValue{
-				Key:       key,
-				Value:     string(val),
-				CreatedAt: time.Unix(int64(item.Version()), 0),
-			}
-			return nil
-		})
-	})
+	if err == nil && archived {
+		if readTs != 0 {
+			value, _, err = app.fetchArchived(value)
+		} else if value, err = app.rehydrate(key, value, version); err == errArchiveRace {
+			app.readCache.invalidate([]string{key})
+			return app.lookupKey(key, readTs)
+		}
+	}
 
-	if err == badger.ErrKeyNotFound {
+	if err == badger.ErrKeyNotFound && app.proxy != nil {
+		var found bool
+		value, found, err = app.readThrough(key)
+		if err != nil {
+			return nil, 0, upstreamError{err}
+		}
+		if !found {
+			err = badger.ErrKeyNotFound
+		}
+		version = 0
+	}
+	if err == nil {
+		value, err = app.scriptRead(key, value)
+	}
+	return value, version, err
+}
+
+// writeLookupError reports a lookupKey failure.
+func writeLookupError(w http.ResponseWriter, err error) {
+	var upstream upstreamError
+	switch {
+	case err == badger.ErrKeyNotFound:
+		http.Error(w, "Key not found", http.StatusNotFound)
+	case errors.As(err, &upstream):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (app *App) getKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := routeKey(w, r)
+	if !ok {
+		return
+	}
+
+	if app.isSystemKey([]byte(key)) && !includeSystem(r) {
 		http.Error(w, "Key not found", http.StatusNotFound)
 		return
 	}
 
+	readTs, ok := app.timestampParam(w, r, "read_ts")
+	if !ok {
+		return
+	}
+	fields, ok := parseFields(w, r)
+	if !ok {
+		return
+	}
+	cost := app.newScanCost()
+	start := time.Now()
+	if fields != nil {
+		record, err := app.keyFields(r, key, readTs, fields)
+		cost.since(start)
+		if err == nil {
+			cost.addValue(key, nil)
+		}
+		cost.writeHeaders(w)
+		if err != nil {
+			writeLookupError(w, err)
+			return
+		}
+		app.recordAccess(key, false)
+		writeJSON(w, record)
+		return
+	}
+
+	value, version, err := app.lookupKey(key, readTs)
+	cost.since(start)
+	if err == nil {
+		cost.addValue(key, value)
+	}
+	cost.writeHeaders(w)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeLookupError(w, err)
+		return
+	}
+	kv := KeyValue{Key: key, Value: string(value), CreatedAt: time.Now(), Version: version, File: app.fileMeta(key)}
+	if version > 0 {
+		kv.CreatedAt = time.Unix(int64(version), 0)
+	}
+
+	app.recordAccess(key, false)
+	app.redact(r, &kv)
+	if wantsFragment(r) {
+		app.writeFragment(w, "key-detail", keyDetail{KeyValue: kv, BasePath: app.basePath, Lang: app.requestLanguage(r)})
 		return
 	}
 
@@ -209,25 +1145,38 @@ func (app *App) getKeyHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *App) updateKeyHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key, ok := routeKey(w, r)
+	if !ok {
+		return
+	}
+
+	if app.rejectSystemWrite(w, key) {
+		return
+	}
+
+	commitTs, ok := app.timestampParam(w, r, "commit_ts")
+	if !ok {
+		return
+	}
 
 	var kv KeyValue
 	if err := json.NewDecoder(r.Body).Decode(&kv); err != nil {
 		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	if app.rejectInvalidWrite(w, key, []byte(kv.Value)) {
+		return
+	}
 
-	err := app.db.Update(func(txn *badger.Txn) error {
-		return txn.Set([]byte(key), []byte(kv.Value))
-	})
-
+	info, err := app.storeValue(key, []byte(kv.Value), nil, commitTs)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeStoreError(w, err)
 		return
 	}
+	writeTxnHeaders(w, info)
 
 	kv.Key = key
+	kv.Version = info.CommitTs
 	kv.CreatedAt = time.Now()
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(kv); err != nil {
@@ -237,30 +1186,71 @@ func (app *App) updateKeyHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *App) deleteKeyHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key, ok := routeKey(w, r)
+	if !ok {
+		return
+	}
+
+	if app.rejectSystemWrite(w, key) {
+		return
+	}
+	commitTs, ok := app.timestampParam(w, r, "commit_ts")
+	if !ok {
+		return
+	}
+	precondition, ok := parseDeletePrecondition(w, r)
+	if !ok {
+		return
+	}
+
+	if app.proxy != nil && precondition == nil {
+		if err := app.proxy.remove(key); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
 
-	err := app.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete([]byte(key))
+	info, err := app.writeKey(key, commitTs, func(txn *badger.Txn) error {
+		if precondition != nil {
+			// Checked against the local copy; the upstream only loses the
+			// key once the check has passed.
+			if err := precondition.check(txn, []byte(key)); err != nil {
+				return err
+			}
+			if app.proxy != nil {
+				if err := app.proxy.remove(key); err != nil {
+					return upstreamError{err}
+				}
+			}
+		}
+		return app.deleteEntry(txn, []byte(key))
 	})
 
 	if err == badger.ErrKeyNotFound {
 		http.Error(w, "Key not found", http.StatusNotFound)
 		return
 	}
+	if err == errPreconditionFailed {
+		http.Error(w, "Key has changed or does not exist", http.StatusPreconditionFailed)
+		return
+	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeStoreError(w, err)
 		return
 	}
+	writeTxnHeaders(w, info)
+
+	app.forgetAccess(key)
+	app.events.publish(Event{Type: EventDelete, Key: key})
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (app *App) statsHandler(w http.ResponseWriter, r *http.Request) {
-	var stats Stats
+	stats := Stats{Truncated: app.truncated}
 
-	err := app.db.View(func(txn *badger.Txn) error {
+	err := app.view(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
@@ -268,6 +1258,9 @@ func (app *App) statsHandler(w http.ResponseWriter, r *http.Request) {
 
 		count := int64(0)
 		for it.Rewind(); it.Valid(); it.Next() {
+			if app.isSystemKey(it.Item().Key()) {
+				continue
+			}
 			count++
 		}
 		stats.NumKeys = count
@@ -279,10 +1272,7 @@ func (app *App) statsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get database size
-	if info, err := os.Stat("./badger-data"); err == nil {
-		stats.DatabaseSize = info.Size()
-	}
+	app.storageStats(&stats)
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(stats); err != nil {
@@ -291,30 +1281,132 @@ func (app *App) statsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// storageStats fills in the sizes and free space of stats.
+func (app *App) storageStats(stats *Stats) {
+	// The LSM tree lives in Dir and the value log in ValueDir; Badger
+	// refreshes these sizes every minute.
+	opts := app.db.Opts()
+	stats.Dir, stats.ValueDir = opts.Dir, opts.ValueDir
+	stats.LSMSize, stats.VlogSize = app.db.Size()
+	stats.DatabaseSize = stats.LSMSize + stats.VlogSize
+	if app.diskGuard != nil {
+		stats.DiskFree = app.diskGuard.free.Load()
+		stats.DiskLow = app.diskGuard.low.Load()
+	}
+}
+
 func (app *App) searchKeysHandler(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	if query == "" {
+	if r.URL.Query().Get("q") == "" {
 		http.Error(w, "Query parameter 'q' is required", http.StatusBadRequest)
 		return
 	}
+	readTs, ok := app.timestampParam(w, r, "read_ts")
+	if !ok {
+		return
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchSize = 10
+	opts.Prefix = []byte(r.URL.Query().Get("prefix"))
+	opts, ok = app.iteratorOptions(w, r, opts)
+	if !ok {
+		return
+	}
+	fields, ok := parseFields(w, r)
+	if !ok {
+		return
+	}
+	query, ok := parseKeyQuery(w, r)
+	if !ok {
+		return
+	}
+	keysOnly := r.URL.Query().Get("keys_only") == "true"
+	if query.filter == nil && (keysOnly || fields != nil && !fields["value"]) {
+		opts.PrefetchValues = false
+	}
+	if r.URL.Query().Get("explain") == "true" {
+		writeJSON(w, app.explainQuery("search", opts, query, 0, readsValues(keysOnly, fields)))
+		return
+	}
 
 	keys := make([]KeyValue, 0)
-	err := app.db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 10
+	infos := make([]KeyInfo, 0)
+	records := make([]map[string]interface{}, 0)
+	cost := app.newScanCost()
+	mem := app.reserveMemory()
+	defer mem.release()
+	start := time.Now()
+	scan := func(txn *badger.Txn) error {
+		ctx, cancel := operations.interruptible(r.Context(), txn)
+		defer cancel()
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
+		showSystem := includeSystem(r)
 		for it.Rewind(); it.Valid(); it.Next() {
+			if err := checkOperation(ctx); err != nil {
+				return err
+			}
 			item := it.Item()
+			cost.add(item)
+			if !showSystem && app.isSystemKey(item.Key()) {
+				continue
+			}
 			key := string(item.Key())
+			if !query.matchKey(key) {
+				continue
+			}
+			matched, err := app.matchItem(r, query, item)
+			if err != nil {
+				return err
+			}
 
-			if strings.Contains(strings.ToLower(key), strings.ToLower(query)) {
-				err := item.Value(func(val []byte) error {
+			if matched {
+				if fields != nil {
+					if err := mem.growKeyValue(item); err != nil {
+						return err
+					}
+					record, err := app.selectFields(r, fields, app.itemFields(txn, item))
+					if err != nil {
+						return err
+					}
+					records = append(records, record)
+					continue
+				}
+				if keysOnly {
+					if err := mem.growKeyInfo(item); err != nil {
+						return err
+					}
+					infos = append(infos, keyInfo(item))
+					continue
+				}
+				if err := mem.growKeyValue(item); err != nil {
+					return err
+				}
+				if item.UserMeta()&archivedMeta != 0 {
+					keys = append(keys, KeyValue{
+						Key:       key,
+						CreatedAt: time.Unix(int64(item.Version()), 0),
+						Version:   item.Version(),
+						Archived:  true,
+					})
+					continue
+				}
+				meta, err := app.loadFileMeta(txn, item.Key())
+				if err != nil {
+					return err
+				}
+				err = item.Value(func(val []byte) error {
+					val, err := app.scriptRead(key, val)
+					if err != nil {
+						return err
+					}
 					keys = append(keys, KeyValue{
 						Key:       key,
 						Value:     string(val),
 						CreatedAt: time.Unix(int64(item.Version()), 0),
+						Version:   item.Version(),
+						File:      meta,
 					})
 					return nil
 				})
@@ -324,13 +1416,52 @@ func (app *App) searchKeysHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		return nil
-	})
+	}
+	err := app.viewAt(readTs, scan)
+	if err == errMemoryLimit && fields == nil && !keysOnly && !wantsFragment(r) {
+		// Too many values to hold: return the keys only.
+		mem.release()
+		keys = make([]KeyValue, 0)
+		keysOnly = true
+		if query.filter == nil {
+			opts.PrefetchValues = false
+		}
+		if err = app.viewAt(readTs, scan); err == nil {
+			app.memory.degrade(w)
+		}
+	}
+	cost.since(start)
+	cost.writeHeaders(w)
 
+	if err == errMemoryLimit {
+		app.memory.reject(w)
+		return
+	}
+	if err == errOperationCanceled {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if fields != nil {
+		writeJSON(w, records)
+		return
+	}
+	if keysOnly {
+		writeJSON(w, infos)
+		return
+	}
+	for i := range keys {
+		app.redact(r, &keys[i])
+	}
+	if wantsFragment(r) {
+		app.writeKeyRows(w, r, keys)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(keys); err != nil {
 		http.Error(w, "Failed to encode keys", http.StatusInternalServerError)
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In maintenance mode the data endpoints answer 503 with a Retry-After
+// header, so clients back off while an admin takes a backup, restores or
+// drops data. /api/admin/ and the pages stay available.
+
+// Event types published when maintenance mode is switched on and off.
+const (
+	EventMaintenanceOn  = "maintenance.on"
+	EventMaintenanceOff = "maintenance.off"
+)
+
+const defaultMaintenanceRetryAfter = 60
+
+// Maintenance is the body of the maintenance endpoints.
+type Maintenance struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+	// RetryAfter is the Retry-After sent to clients, in seconds.
+	RetryAfter int        `json:"retry_after,omitempty"`
+	Since      *time.Time `json:"since,omitempty"`
+}
+
+type maintenanceMode struct {
+	mu    sync.RWMutex
+	state Maintenance
+}
+
+func (m *maintenanceMode) get() Maintenance {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state
+}
+
+func (m *maintenanceMode) set(state Maintenance) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = state
+}
+
+// maintenanceMiddleware rejects requests to the data endpoints while
+// maintenance mode is on. GET /api/config stays available so clients can
+// tell.
+func (app *App) maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/api/admin/") &&
+			r.URL.Path != "/api/config" && r.URL.Path != "/api/version" {
+			if state := app.maintenance.get(); state.Enabled {
+				w.Header().Set("Retry-After", strconv.Itoa(state.RetryAfter))
+				msg := "The server is in maintenance mode"
+				if state.Reason != "" {
+					msg += ": " + state.Reason
+				}
+				http.Error(w, msg, http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *App) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, app.maintenance.get())
+}
+
+// updateMaintenanceHandler switches maintenance mode on or off until the
+// next restart.
+func (app *App) updateMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var req Maintenance
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.RetryAfter < 0 {
+		http.Error(w, "retry_after must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	current := app.maintenance.get()
+	state := Maintenance{}
+	if req.Enabled {
+		state = req
+		if state.RetryAfter == 0 {
+			state.RetryAfter = defaultMaintenanceRetryAfter
+		}
+		state.Since = current.Since
+		if !current.Enabled {
+			now := time.Now()
+			state.Since = &now
+		}
+	}
+	app.maintenance.set(state)
+
+	switch {
+	case state.Enabled && !current.Enabled:
+		warnf("Maintenance mode on: %s", state.Reason)
+		app.events.publish(Event{Type: EventMaintenanceOn, Detail: state.Reason})
+	case !state.Enabled && current.Enabled:
+		infof("Maintenance mode off")
+		app.events.publish(Event{Type: EventMaintenanceOff})
+	}
+	writeJSON(w, state)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// With MANAGED_TXNS=true the database is opened with badger.OpenManaged, as
+// done by systems that assign their own MVCC timestamps. Reads then default
+// to the latest data and writes to a commit timestamp above any seen so far;
+// read_ts and commit_ts request parameters pick explicit ones.
+//
+// All transactions on the live database go through the helpers below, which
+// pick the managed or regular Badger API and track the open transactions, see
+// operations.go. Write batches, which open their own transactions, are not
+// tracked.
+
+// view runs fn in a read-only transaction on the latest data.
+func (app *App) view(fn func(txn *badger.Txn) error) error {
+	return app.viewAt(0, fn)
+}
+
+// viewAt runs fn in a read-only transaction at readTs, or on the latest data
+// if readTs is 0.
+func (app *App) viewAt(readTs uint64, fn func(txn *badger.Txn) error) error {
+	txn := app.readTransaction(readTs)
+	defer app.discard(txn)
+	return fn(txn)
+}
+
+// readTransaction starts a read-only transaction at readTs, or on the latest
+// data if readTs is 0, for callers that keep it open across requests; discard
+// it when done.
+func (app *App) readTransaction(readTs uint64) *badger.Txn {
+	var txn *badger.Txn
+	switch {
+	case !app.managed:
+		txn = app.db.NewTransaction(false)
+	case readTs == 0:
+		txn = app.db.NewTransactionAt(math.MaxUint64, false)
+	default:
+		txn = app.db.NewTransactionAt(readTs, false)
+	}
+	operations.track(txn, "read")
+	return txn
+}
+
+// discard discards a transaction started by the helpers.
+func (app *App) discard(txn *badger.Txn) {
+	txn.Discard()
+	operations.done(txn)
+}
+
+// update runs fn in a read-write transaction and commits it.
+func (app *App) update(fn func(txn *badger.Txn) error) error {
+	return app.updateAt(0, fn)
+}
+
+// updateAt runs fn in a read-write transaction committed at commitTs, or at
+// the next timestamp if commitTs is 0.
+func (app *App) updateAt(commitTs uint64, fn func(txn *badger.Txn) error) error {
+	txn := app.newTransaction()
+	defer app.discard(txn)
+	if err := fn(txn); err != nil {
+		return err
+	}
+	return app.commit(txn, commitTs)
+}
+
+// newTransaction starts a read-write transaction for callers that commit in
+// batches; commit it with app.commit or discard it with app.discard.
+func (app *App) newTransaction() *badger.Txn {
+	var txn *badger.Txn
+	if !app.managed {
+		txn = app.db.NewTransaction(true)
+	} else {
+		txn = app.db.NewTransactionAt(math.MaxUint64, true)
+	}
+	operations.track(txn, "write")
+	return txn
+}
+
+// commit commits txn, at commitTs in managed mode (0 picks the next
+// timestamp), and counts conflicts.
+func (app *App) commit(txn *badger.Txn, commitTs uint64) error {
+	var err error
+	switch {
+	case !app.managed:
+		err = txn.Commit()
+	case commitTs == 0:
+		err = txn.CommitAt(app.clock.Add(1), nil)
+	default:
+		app.observeTs(commitTs)
+		err = txn.CommitAt(commitTs, nil)
+	}
+	operations.done(txn)
+	if err == badger.ErrConflict {
+		app.conflicts.Add(1)
+	}
+	return err
+}
+
+// newWriteBatch starts a write batch. In managed mode it commits at the next
+// timestamp, which is returned; 0 is returned otherwise.
+func (app *App) newWriteBatch() (*badger.WriteBatch, uint64) {
+	if !app.managed {
+		return app.db.NewWriteBatch(), 0
+	}
+	commitTs := app.clock.Add(1)
+	return app.db.NewWriteBatchAt(commitTs), commitTs
+}
+
+// observeTs moves the clock past ts so later default commits stay above it.
+func (app *App) observeTs(ts uint64) {
+	for {
+		current := app.clock.Load()
+		if ts <= current || app.clock.CompareAndSwap(current, ts) {
+			return
+		}
+	}
+}
+
+// newStream returns a stream over the latest data.
+func (app *App) newStream() *badger.Stream {
+	if !app.managed {
+		return app.db.NewStream()
+	}
+	return app.db.NewStreamAt(math.MaxUint64)
+}
+
+// backup writes a native backup of the entries at or above since.
+func (app *App) backup(w io.Writer, since uint64) (uint64, error) {
+	if !app.managed {
+		return app.db.Backup(w, since)
+	}
+	stream := app.newStream()
+	stream.LogPrefix = "DB.Backup"
+	stream.SinceTs = since
+	return stream.Backup(w, since)
+}
+
+// timestampParam parses the read_ts or commit_ts query parameter, 0 when
+// absent. It answers 400 and reports false if the value is invalid or the
+// database is not in managed mode.
+func (app *App) timestampParam(w http.ResponseWriter, r *http.Request, name string) (uint64, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, true
+	}
+	if !app.managed {
+		http.Error(w, name+" requires MANAGED_TXNS=true", http.StatusBadRequest)
+		return 0, false
+	}
+	ts, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || ts == 0 {
+		http.Error(w, fmt.Sprintf("%s must be a positive integer", name), http.StatusBadRequest)
+		return 0, false
+	}
+	return ts, true
+}
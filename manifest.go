@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/pb"
+	"github.com/gorilla/mux"
+	"google.golang.org/protobuf/proto"
+)
+
+// Every backup and export gets a manifest, so a truncated or corrupted file
+// is rejected before anything is applied. The manifest is sent as the
+// X-Manifest trailer and kept under the system prefix by file name.
+const manifestsNamespace = "manifests:"
+
+const (
+	manifestBackup = "backup"
+	manifestExport = "export"
+)
+
+type Manifest struct {
+	Name       string    `json:"name"`
+	Kind       string    `json:"kind"`
+	Entries    int64     `json:"entries"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"` // of the file as downloaded
+	MinVersion uint64    `json:"min_version"`
+	MaxVersion uint64    `json:"max_version"`
+	Encrypted  bool      `json:"encrypted"`
+	CreatedAt  time.Time `json:"created_at"`
+	// JournalSeq is the last journal entry written before a scheduled
+	// backup started, see restoreto.go.
+	JournalSeq uint64 `json:"journal_seq,omitempty"`
+}
+
+// contentStats counts the entries and version range of a backup or export.
+type contentStats struct {
+	entries    int64
+	minVersion uint64
+	maxVersion uint64
+}
+
+func (s *contentStats) add(version uint64) {
+	if s.entries == 0 || version < s.minVersion {
+		s.minVersion = version
+	}
+	if version > s.maxVersion {
+		s.maxVersion = version
+	}
+	s.entries++
+}
+
+// scanBackup reads the native backup format: little-endian uint64 lengths
+// each followed by a KVList.
+func scanBackup(r io.Reader) (contentStats, error) {
+	var stats contentStats
+	for {
+		var size uint64
+		if err := binary.Read(r, binary.LittleEndian, &size); err == io.EOF {
+			return stats, nil
+		} else if err != nil {
+			return stats, err
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return stats, err
+		}
+		var list pb.KVList
+		if err := proto.Unmarshal(buf, &list); err != nil {
+			return stats, err
+		}
+		for _, kv := range list.Kv {
+			stats.add(kv.Version)
+		}
+	}
+}
+
+func scanExport(r io.Reader) (contentStats, error) {
+	var stats contentStats
+	dec := json.NewDecoder(r)
+	for {
+		var rec ExportRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return stats, nil
+		} else if err != nil {
+			return stats, err
+		}
+		stats.add(rec.Version)
+	}
+}
+
+func scanContent(kind string, r io.Reader) (contentStats, error) {
+	if kind == manifestBackup {
+		return scanBackup(r)
+	}
+	return scanExport(r)
+}
+
+// hashingWriter hashes and counts the bytes written through it.
+type hashingWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	return &hashingWriter{w: w, hash: sha256.New()}
+}
+
+func (h *hashingWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+func (h *hashingWriter) sum() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
+
+// publishManifest stores the manifest and sends it as the X-Manifest trailer,
+// which must have been announced before the body was written.
+func (app *App) publishManifest(w http.ResponseWriter, m Manifest) {
+	data, err := app.storeManifest(m)
+	if err != nil {
+		errorf("Failed to store manifest %s: %v", m.Name, err)
+	}
+	if data != nil {
+		w.Header().Set("X-Manifest", string(data))
+	}
+}
+
+// storeManifest keeps the manifest under the system prefix and returns its
+// encoding.
+func (app *App) storeManifest(m Manifest) ([]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	err = app.update(func(txn *badger.Txn) error {
+		return txn.Set(app.systemKey(manifestsNamespace+m.Name), data)
+	})
+	return data, err
+}
+
+func announceManifest(w http.ResponseWriter, name string) {
+	w.Header().Set("Trailer", "X-Manifest")
+	w.Header().Set("X-Manifest-URL", "/api/admin/manifests/"+name)
+}
+
+func (app *App) loadManifest(name string) (*Manifest, error) {
+	var m Manifest
+	err := app.view(func(txn *badger.Txn) error {
+		item, err := txn.Get(app.systemKey(manifestsNamespace + name))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &m)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (app *App) manifestHandler(w http.ResponseWriter, r *http.Request) {
+	m, err := app.loadManifest(mux.Vars(r)["name"])
+	if err == badger.ErrKeyNotFound {
+		http.Error(w, "Manifest not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, m)
+}
+
+// requestManifest returns the manifest sent with an upload, either inline in
+// the X-Manifest header or by name of a stored manifest.
+func (app *App) requestManifest(r *http.Request) (*Manifest, error) {
+	if header := r.Header.Get("X-Manifest"); header != "" {
+		var m Manifest
+		if err := json.Unmarshal([]byte(header), &m); err != nil {
+			return nil, fmt.Errorf("invalid X-Manifest header: %w", err)
+		}
+		return &m, nil
+	}
+	if name := r.URL.Query().Get("manifest"); name != "" {
+		m, err := app.loadManifest(name)
+		if err == badger.ErrKeyNotFound {
+			return nil, fmt.Errorf("manifest %s not found", name)
+		}
+		return m, err
+	}
+	if app.manifestRequired {
+		return nil, errors.New("a manifest is required, send X-Manifest or manifest=<name>")
+	}
+	return nil, nil
+}
+
+// spooledUpload is an upload verified against its manifest, ready to apply.
+// Closing it removes the backing file.
+type spooledUpload struct {
+	io.Reader
+	file *os.File
+}
+
+func (s *spooledUpload) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// verifiedUpload returns the decrypted request body. With a manifest, the body
+// is first spooled to a temporary file and verified, so nothing is applied
+// from a damaged file.
+func (app *App) verifiedUpload(r *http.Request, kind string) (*spooledUpload, error) {
+	m, err := app.requestManifest(r)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		in, err := app.decryptingReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &spooledUpload{Reader: in}, nil
+	}
+
+	file, err := os.CreateTemp("", "bwui-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(file, r.Body); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return app.verifiedFile(file, m, kind)
+}
+
+// verifiedFile checks file for the size, checksum, entry count and version
+// range listed in the manifest, if any, and returns its decrypted content.
+// The file is removed when the result is closed or verification fails.
+func (app *App) verifiedFile(file *os.File, m *Manifest, kind string) (*spooledUpload, error) {
+	upload := &spooledUpload{file: file}
+	if err := app.verifyFile(file, m, kind); err != nil {
+		upload.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		upload.Close()
+		return nil, err
+	}
+	in, err := app.decryptingReader(file)
+	if err != nil {
+		upload.Close()
+		return nil, err
+	}
+	upload.Reader = in
+	return upload, nil
+}
+
+func (app *App) verifyFile(file *os.File, m *Manifest, kind string) error {
+	if m == nil {
+		return nil
+	}
+	if m.Kind != kind {
+		return fmt.Errorf("manifest is for a %s, not a %s", m.Kind, kind)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hw := newHashingWriter(io.Discard)
+	if _, err := io.Copy(hw, file); err != nil {
+		return err
+	}
+	if hw.size != m.Size || hw.sum() != m.SHA256 {
+		return fmt.Errorf("upload does not match manifest: got %d bytes with sha256 %s", hw.size, hw.sum())
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	in, err := app.decryptingReader(file)
+	if err != nil {
+		return err
+	}
+	stats, err := scanContent(kind, in)
+	if err != nil {
+		return fmt.Errorf("upload is not a valid %s: %w", kind, err)
+	}
+	if stats.entries != m.Entries || stats.minVersion != m.MinVersion || stats.maxVersion != m.MaxVersion {
+		return fmt.Errorf("upload has %d entries (versions %d-%d), manifest lists %d (versions %d-%d)",
+			stats.entries, stats.minVersion, stats.maxVersion, m.Entries, m.MinVersion, m.MaxVersion)
+	}
+	return nil
+}
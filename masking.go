@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/gorilla/mux"
+)
+
+// Masking profiles make production data safe to export to staging and test
+// environments. A profile is a list of rules, each masking one field of the
+// JSON values (or the whole value) under a prefix: replacing it with a hash,
+// truncating it or nulling it out. Admins define profiles under
+// /api/admin/masking and exports apply one with mask=<name>. Profiles are
+// stored under the system prefix.
+const maskingNamespace = "masking:"
+
+// Masking actions.
+const (
+	MaskHash     = "hash"
+	MaskTruncate = "truncate"
+	MaskNull     = "null"
+)
+
+type MaskRule struct {
+	// Prefix limits the rule to the keys under it.
+	Prefix string `json:"prefix,omitempty"`
+	// Path is a field path such as $.customer.email or items[0].name; $
+	// alone masks the whole value, also when it is not JSON.
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	// Length is how many characters truncate keeps, 1 by default.
+	Length int `json:"length,omitempty"`
+}
+
+type MaskingProfile struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Rules       []MaskRule `json:"rules"`
+	// Salt is prepended to values before hashing, so hashes cannot be looked
+	// up in a dictionary of likely values. It is never returned.
+	Salt      string    `json:"salt,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type compiledMaskRule struct {
+	MaskRule
+	path  []interface{} // nil for the whole value
+	whole bool
+}
+
+// masker is a compiled masking profile.
+type masker struct {
+	salt  string
+	rules []compiledMaskRule
+}
+
+func (p *MaskingProfile) compile() (*masker, error) {
+	if len(p.Rules) == 0 {
+		return nil, errors.New("at least one rule is required")
+	}
+	m := &masker{salt: p.Salt}
+	for i, rule := range p.Rules {
+		switch rule.Action {
+		case MaskHash, MaskNull:
+		case MaskTruncate:
+			if rule.Length < 0 {
+				return nil, fmt.Errorf("rule %d: length must not be negative", i+1)
+			}
+			if rule.Length == 0 {
+				rule.Length = 1
+			}
+		default:
+			return nil, fmt.Errorf("rule %d: action must be %s, %s or %s", i+1, MaskHash, MaskTruncate, MaskNull)
+		}
+		path, err := parseFieldPath(rule.Path)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		m.rules = append(m.rules, compiledMaskRule{MaskRule: rule, path: path, whole: path == nil})
+	}
+	return m, nil
+}
+
+// mask returns value with the rules applying to key applied. Values that
+// are not JSON are only masked by rules for the whole value.
+func (m *masker) mask(key string, value []byte) []byte {
+	var doc interface{}
+	decoded, isJSON := false, false
+	for _, rule := range m.rules {
+		if !strings.HasPrefix(key, rule.Prefix) {
+			continue
+		}
+		if rule.whole {
+			if decoded && isJSON {
+				value, _ = json.Marshal(doc)
+			}
+			masked := m.maskValue(rule, string(value))
+			if masked == nil {
+				value = nil
+			} else {
+				value = []byte(masked.(string))
+			}
+			decoded = false
+			continue
+		}
+		if !decoded {
+			decoded = true
+			isJSON = json.Unmarshal(value, &doc) == nil
+		}
+		if !isJSON || lookupJSONPath(doc, rule.path) == nil {
+			continue
+		}
+		doc, _ = setJSONPath(doc, rule.path, m.maskValue(rule, lookupJSONPath(doc, rule.path)))
+	}
+	if decoded && isJSON {
+		value, _ = json.Marshal(doc)
+	}
+	return value
+}
+
+// maskValue masks one value: hashes are hex SHA-256 of the salt and the
+// value (strings as is, others as JSON), truncate keeps the start of strings
+// and nulls other values.
+func (m *masker) maskValue(rule compiledMaskRule, v interface{}) interface{} {
+	switch rule.Action {
+	case MaskHash:
+		text, ok := v.(string)
+		if !ok {
+			data, _ := json.Marshal(v)
+			text = string(data)
+		}
+		sum := sha256.Sum256([]byte(m.salt + text))
+		return hex.EncodeToString(sum[:])
+	case MaskTruncate:
+		text, ok := v.(string)
+		if !ok {
+			return nil
+		}
+		if runes := []rune(text); len(runes) > rule.Length {
+			return string(runes[:rule.Length])
+		}
+		return text
+	}
+	return nil
+}
+
+func (app *App) loadMaskingProfile(txn *badger.Txn, name string) (*MaskingProfile, error) {
+	item, err := txn.Get(app.systemKey(maskingNamespace + name))
+	if err != nil {
+		return nil, err
+	}
+	var p MaskingProfile
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &p)
+	})
+	return &p, err
+}
+
+// requestMasker compiles the profile named by mask=, answering 400 and
+// reporting false when it does not exist. It returns nil without mask=.
+func (app *App) requestMasker(w http.ResponseWriter, r *http.Request) (*masker, bool) {
+	name := r.URL.Query().Get("mask")
+	if name == "" {
+		return nil, true
+	}
+	var p *MaskingProfile
+	err := app.view(func(txn *badger.Txn) error {
+		var err error
+		p, err = app.loadMaskingProfile(txn, name)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		http.Error(w, "Unknown masking profile "+name, http.StatusBadRequest)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	m, err := p.compile()
+	if err != nil {
+		http.Error(w, "Invalid masking profile: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return m, true
+}
+
+func (app *App) listMaskingHandler(w http.ResponseWriter, r *http.Request) {
+	profiles := make([]MaskingProfile, 0)
+	err := app.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = app.systemKey(maskingNamespace)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var p MaskingProfile
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &p)
+			})
+			if err != nil {
+				return err
+			}
+			p.Salt = ""
+			profiles = append(profiles, p)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	writeJSON(w, profiles)
+}
+
+// putMaskingHandler creates or replaces a masking profile. Without a salt,
+// the salt of the profile it replaces is kept.
+func (app *App) putMaskingHandler(w http.ResponseWriter, r *http.Request) {
+	var p MaskingProfile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.Name = mux.Vars(r)["name"]
+	if strings.ContainsAny(p.Name, ":/") {
+		http.Error(w, "Masking profile name must not contain ':' or '/'", http.StatusBadRequest)
+		return
+	}
+	if _, err := p.compile(); err != nil {
+		http.Error(w, "Invalid masking profile: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	created := false
+	err := app.update(func(txn *badger.Txn) error {
+		p.UpdatedAt = time.Now()
+		p.CreatedAt = p.UpdatedAt
+		old, err := app.loadMaskingProfile(txn, p.Name)
+		switch {
+		case err == badger.ErrKeyNotFound:
+			created = true
+		case err != nil:
+			return err
+		default:
+			p.CreatedAt = old.CreatedAt
+			if p.Salt == "" {
+				p.Salt = old.Salt
+			}
+		}
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		return txn.Set(app.systemKey(maskingNamespace+p.Name), data)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Salt = ""
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+func (app *App) deleteMaskingHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	err := app.update(func(txn *badger.Txn) error {
+		if _, err := app.loadMaskingProfile(txn, name); err != nil {
+			return err
+		}
+		return txn.Delete(app.systemKey(maskingNamespace + name))
+	})
+	if err == badger.ErrKeyNotFound {
+		http.Error(w, "Masking profile not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
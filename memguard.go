@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// With MEMORY_LIMIT set, the responses that list and search build in memory,
+// and the writes an import holds until it commits, reserve their estimated
+// size from a budget shared by all requests. A list or search of values over
+// the budget is answered with keys only instead, a JSON response marked with
+// X-Degraded: keys_only; an import commits early. Requests that still do not
+// fit are rejected with 503, so one greedy query cannot run the server out of
+// memory. The limit is soft: sizes are estimates and memory outside these
+// requests is not counted.
+
+// Overheads approximate the memory of a collected key besides its key and
+// value bytes.
+const (
+	keyValueOverhead = 128
+	keyInfoOverhead  = 96
+)
+
+var errMemoryLimit = errors.New("memory limit reached")
+
+type memoryGuard struct {
+	limit    int64
+	used     atomic.Int64
+	rejected atomic.Int64
+	degraded atomic.Int64
+}
+
+func loadMemoryGuard() (*memoryGuard, error) {
+	limit, err := strconv.ParseInt(getEnv("MEMORY_LIMIT", "0"), 10, 64)
+	if err != nil || limit < 0 {
+		return nil, fmt.Errorf("MEMORY_LIMIT must be a number of bytes")
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	return &memoryGuard{limit: limit}, nil
+}
+
+// memoryReservation is the part of the budget held by one request. A nil
+// reservation, as returned when the limit is off, always grows.
+type memoryReservation struct {
+	guard *memoryGuard
+	size  int64
+}
+
+// reserveMemory starts a reservation; release it when the response is
+// written.
+func (app *App) reserveMemory() *memoryReservation {
+	if app.memory == nil {
+		return nil
+	}
+	return &memoryReservation{guard: app.memory}
+}
+
+// grow reserves n more bytes, or returns errMemoryLimit if the budget is
+// exhausted.
+func (m *memoryReservation) grow(n int64) error {
+	if m == nil {
+		return nil
+	}
+	if m.guard.used.Add(n) > m.guard.limit {
+		m.guard.used.Add(-n)
+		return errMemoryLimit
+	}
+	m.size += n
+	return nil
+}
+
+// growKeyValue reserves a key and its value for a response. JSON responses
+// are encoded in memory before they are sent, so the value counts twice.
+func (m *memoryReservation) growKeyValue(item *badger.Item) error {
+	return m.grow(int64(len(item.Key())) + 2*item.ValueSize() + keyValueOverhead)
+}
+
+// growKeyInfo reserves a key listed without its value.
+func (m *memoryReservation) growKeyInfo(item *badger.Item) error {
+	return m.grow(2*int64(len(item.Key())) + keyInfoOverhead)
+}
+
+// release gives the reservation back to the budget.
+func (m *memoryReservation) release() {
+	if m != nil {
+		m.guard.used.Add(-m.size)
+		m.size = 0
+	}
+}
+
+// degrade counts a request answered with keys only and marks its response.
+func (g *memoryGuard) degrade(w http.ResponseWriter) {
+	g.degraded.Add(1)
+	w.Header().Set("X-Degraded", "keys_only")
+}
+
+// reject answers 503 to a request over the budget.
+func (g *memoryGuard) reject(w http.ResponseWriter) {
+	g.rejected.Add(1)
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Not enough memory for this request, narrow it down or try again later", http.StatusServiceUnavailable)
+}
+
+type MemoryStats struct {
+	Limit    int64 `json:"limit"`
+	Used     int64 `json:"used"`
+	Degraded int64 `json:"degraded"`
+	Rejected int64 `json:"rejected"`
+}
+
+func (g *memoryGuard) stats() *MemoryStats {
+	if g == nil {
+		return nil
+	}
+	return &MemoryStats{Limit: g.limit, Used: g.used.Load(), Degraded: g.degraded.Load(), Rejected: g.rejected.Load()}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	badger2 "github.com/dgraph-io/badger/v2"
+	badger3 "github.com/dgraph-io/badger/v3"
+)
+
+// A migration copies the keys of a data directory written by Badger v2 or
+// v3, which v4 cannot open, into the live database. The directory is opened
+// read-only with the Badger module of its version, so it must not be in use.
+
+const jobMigrate = "migrate"
+
+type migrateParams struct {
+	Dir      string `json:"dir"`
+	ValueDir string `json:"value_dir,omitempty"`
+	// Version is the major version of Badger that wrote Dir, 2 or 3.
+	Version  int    `json:"version"`
+	Conflict string `json:"conflict"`
+}
+
+// migrateHandler starts a job migrating an old data directory into the live
+// database.
+func (app *App) migrateHandler(w http.ResponseWriter, r *http.Request) {
+	var params migrateParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Conflict == "" {
+		params.Conflict = ConflictSkip
+	}
+	if params.ValueDir == "" {
+		params.ValueDir = params.Dir
+	}
+	switch {
+	case params.Dir == "":
+		http.Error(w, "dir is required", http.StatusBadRequest)
+		return
+	case params.Version != 2 && params.Version != 3:
+		http.Error(w, "Version must be 2 or 3", http.StatusBadRequest)
+		return
+	case params.Conflict != ConflictSkip && params.Conflict != ConflictOverwrite && params.Conflict != ConflictFail:
+		http.Error(w, "Conflict must be 'skip', 'overwrite' or 'fail'", http.StatusBadRequest)
+		return
+	}
+	for _, dir := range []string{params.Dir, params.ValueDir} {
+		if _, err := os.Stat(dir); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	withSystem := includeSystem(r)
+
+	job, err := app.startJob(r, jobMigrate, params, func(job *runningJob) (interface{}, error) {
+		each, closeSrc, err := app.legacyItems(job, params, withSystem)
+		if err != nil {
+			return nil, err
+		}
+		defer closeSrc()
+		result, err := app.copyKeys(job, each, app.db, mainDatabase, params.Conflict)
+		if withSystem {
+			if err := app.refreshStoredUsers(); err != nil {
+				errorf("Failed to refresh stored users: %v", err)
+			}
+		}
+		return result, err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJobCreated(w, job)
+}
+
+// legacyItems opens the directory of params with the Badger version that
+// wrote it and iterates its keys.
+func (app *App) legacyItems(job *runningJob, params migrateParams, withSystem bool) (eachItem, func(), error) {
+	switch params.Version {
+	case 2:
+		opts := badger2.DefaultOptions(params.Dir).WithValueDir(params.ValueDir).WithReadOnly(true).WithLogger(nil)
+		db, err := badger2.Open(opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening %s with Badger v2: %w", params.Dir, err)
+		}
+		each := func(fn func(item sourceItem) error) error {
+			return db.View(func(txn *badger2.Txn) error {
+				it := txn.NewIterator(badger2.DefaultIteratorOptions)
+				defer it.Close()
+
+				for it.Rewind(); it.Valid(); it.Next() {
+					if err := app.visitItem(job, it.Item(), withSystem, fn); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		return each, func() { db.Close() }, nil
+	case 3:
+		opts := badger3.DefaultOptions(params.Dir).WithValueDir(params.ValueDir).WithReadOnly(true).WithLogger(nil)
+		db, err := badger3.Open(opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening %s with Badger v3: %w", params.Dir, err)
+		}
+		each := func(fn func(item sourceItem) error) error {
+			return db.View(func(txn *badger3.Txn) error {
+				it := txn.NewIterator(badger3.DefaultIteratorOptions)
+				defer it.Close()
+
+				for it.Rewind(); it.Valid(); it.Next() {
+					if err := app.visitItem(job, it.Item(), withSystem, fn); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		return each, func() { db.Close() }, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported Badger version %d", params.Version)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// The web interface, the API, the metrics and gRPC share PORT, so locked-down
+// environments open a single port. Connections negotiate their protocol:
+// HTTP/2 through ALPN on TLS listeners and, with H2C=true, through the h2c
+// preface on the plain listener, which is what gRPC clients send. Requests
+// are then routed by protocol before reaching the application's router:
+//
+//   - gRPC requests (HTTP/2 with a Content-Type of application/grpc) go to
+//     grpcHandler. No gRPC service is registered yet, so they get an
+//     UNIMPLEMENTED status instead of the HTML 404 of the web router.
+//   - With METRICS=true, GET /metrics answers Badger's and the Go runtime's
+//     metrics in the Prometheus text format, to scrapers that have no UI
+//     credentials: it skips authentication but not the IP filter.
+//   - Everything else goes to the web interface and API.
+
+const metricsPath = "/metrics"
+
+// multiplexProtocols wraps the application handler with the routing above.
+func (app *App) multiplexProtocols(handler http.Handler) http.Handler {
+	var metrics http.Handler
+	if getEnv("METRICS", "false") == "true" {
+		metrics = http.HandlerFunc(metricsHandler)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case isGRPC(r):
+			grpcHandler(w, r)
+		case metrics != nil && r.URL.Path == app.basePath+metricsPath:
+			metrics.ServeHTTP(w, r)
+		default:
+			handler.ServeHTTP(w, r)
+		}
+	})
+}
+
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcHandler answers gRPC calls with status 12 (UNIMPLEMENTED) in the
+// trailers, as a gRPC server does for unknown services.
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Grpc-Status", "12")
+	w.Header().Set("Grpc-Message", "unknown service "+strings.TrimPrefix(r.URL.Path, "/"))
+}
+
+var metricNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// metricsHandler writes the integer and float expvar variables, Badger's
+// among them, as untyped metrics; expvar maps become one series per key,
+// labelled key. Go's goroutine count and heap size follow.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	expvar.Do(func(kv expvar.KeyValue) {
+		name := metricNameInvalid.ReplaceAllString(kv.Key, "_")
+		switch v := kv.Value.(type) {
+		case *expvar.Int, *expvar.Float:
+			fmt.Fprintf(w, "%s %s\n", name, v)
+		case *expvar.Map:
+			writeMetricMap(w, name, v)
+		}
+	})
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(w, "go_memstats_heap_alloc_bytes %d\n", mem.HeapAlloc)
+	fmt.Fprintf(w, "go_memstats_sys_bytes %d\n", mem.Sys)
+}
+
+func writeMetricMap(w io.Writer, name string, m *expvar.Map) {
+	m.Do(func(kv expvar.KeyValue) {
+		switch v := kv.Value.(type) {
+		case *expvar.Int, *expvar.Float:
+			fmt.Fprintf(w, "%s{key=%q} %s\n", name, kv.Key, v)
+		}
+	})
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// API responses are written as JSON; a request whose Accept header prefers
+// YAML or MessagePack gets the same document re-encoded by
+// negotiateMiddleware. Other responses (plain text errors, exports, event
+// streams) pass through untouched. Object keys keep their JSON order.
+
+const (
+	formatJSON    = "json"
+	formatYAML    = "yaml"
+	formatMsgPack = "msgpack"
+	// formatHTML selects the HTML fragments of partials.go; the middleware
+	// passes such requests through.
+	formatHTML = "html"
+)
+
+var formatTypes = map[string]string{
+	formatYAML:    "application/yaml",
+	formatMsgPack: "application/msgpack",
+}
+
+// acceptedFormats maps the media types recognized in Accept to formats.
+var acceptedFormats = map[string]string{
+	"application/json":        formatJSON,
+	"*/*":                     formatJSON,
+	"application/*":           formatJSON,
+	"application/yaml":        formatYAML,
+	"application/x-yaml":      formatYAML,
+	"text/yaml":               formatYAML,
+	"text/x-yaml":             formatYAML,
+	"application/msgpack":     formatMsgPack,
+	"application/x-msgpack":   formatMsgPack,
+	"application/vnd.msgpack": formatMsgPack,
+	"text/html":               formatHTML,
+}
+
+// responseFormat picks the format with the highest quality in the Accept
+// header, the earliest on ties, and JSON by default.
+func responseFormat(accept string) string {
+	format, best := formatJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		f, ok := acceptedFormats[mediaType]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > best {
+			format, best = f, q
+		}
+	}
+	return format
+}
+
+func (app *App) negotiateMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept")
+		format := responseFormat(r.Header.Get("Accept"))
+		if format == formatJSON || format == formatHTML {
+			next.ServeHTTP(w, r)
+			return
+		}
+		nw := &negotiatedWriter{ResponseWriter: w, format: format}
+		next.ServeHTTP(nw, r)
+		nw.finish()
+	})
+}
+
+// negotiatedWriter holds back JSON responses to re-encode them once complete
+// and passes anything else through.
+type negotiatedWriter struct {
+	http.ResponseWriter
+	format    string
+	status    int
+	buffering bool
+	body      bytes.Buffer
+}
+
+func (nw *negotiatedWriter) WriteHeader(status int) {
+	if nw.status != 0 {
+		return
+	}
+	nw.status = status
+	mediaType, _, _ := mime.ParseMediaType(nw.Header().Get("Content-Type"))
+	nw.buffering = mediaType == "application/json"
+	if !nw.buffering {
+		nw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (nw *negotiatedWriter) Write(b []byte) (int, error) {
+	nw.WriteHeader(http.StatusOK)
+	if nw.buffering {
+		return nw.body.Write(b)
+	}
+	return nw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (nw *negotiatedWriter) Unwrap() http.ResponseWriter {
+	return nw.ResponseWriter
+}
+
+// finish writes the held back JSON in the negotiated format, or as JSON if
+// it does not parse.
+func (nw *negotiatedWriter) finish() {
+	if !nw.buffering {
+		return
+	}
+	body := nw.body.Bytes()
+	if doc, err := decodeOrdered(body); err == nil {
+		var out bytes.Buffer
+		if nw.format == formatYAML {
+			writeYAML(&out, doc, 0)
+		} else {
+			writeMsgPack(&out, doc)
+		}
+		body = out.Bytes()
+		nw.Header().Set("Content-Type", formatTypes[nw.format])
+	}
+	nw.Header().Del("Content-Length")
+	nw.ResponseWriter.WriteHeader(nw.status)
+	_, _ = nw.ResponseWriter.Write(body)
+}
+
+// orderedObject is a JSON object with its keys in document order.
+type orderedObject []orderedField
+
+type orderedField struct {
+	key   string
+	value interface{}
+}
+
+// decodeOrdered parses a single JSON document into orderedObject, []interface{},
+// string, json.Number, bool and nil values.
+func decodeOrdered(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := decodeValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON document")
+	}
+	return v, nil
+}
+
+func decodeValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := make(orderedObject, 0)
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, orderedField{key.(string), value})
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		list := make([]interface{}, 0)
+		for dec.More() {
+			value, err := decodeValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err := dec.Token()
+		return list, err
+	}
+	return tok, nil
+}
+
+// plainYAML matches strings that can be written unquoted without YAML
+// reading them as another type.
+var plainYAML = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_./@+-]*( [A-Za-z0-9_./@+-]+)*$`)
+
+// yamlKeywords are read by YAML 1.1 parsers as booleans or null.
+var yamlKeywords = map[string]bool{
+	"true": true, "false": true, "yes": true, "no": true, "on": true, "off": true,
+	"y": true, "n": true, "null": true,
+}
+
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		if plainYAML.MatchString(v) && !yamlKeywords[strings.ToLower(v)] {
+			return v
+		}
+		// Go's escapes are a subset of YAML's double-quoted ones.
+		return strconv.Quote(v)
+	}
+	return "null"
+}
+
+// writeYAML writes v as a block-style YAML document at the given indent.
+func writeYAML(out *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch v := v.(type) {
+	case orderedObject:
+		if len(v) == 0 {
+			out.WriteString(pad + "{}\n")
+			return
+		}
+		for _, f := range v {
+			out.WriteString(pad + yamlScalar(f.key) + ":")
+			writeYAMLChild(out, f.value, indent+1)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			out.WriteString(pad + "[]\n")
+			return
+		}
+		for _, item := range v {
+			if !nestedYAML(item) {
+				out.WriteString(pad + "-")
+				writeYAMLChild(out, item, indent+1)
+				continue
+			}
+			// Start a nested collection on the dash line: "- key: value".
+			var child bytes.Buffer
+			writeYAML(&child, item, indent+1)
+			out.WriteString(pad + "- ")
+			out.Write(child.Bytes()[len(pad)+2:])
+		}
+	default:
+		out.WriteString(pad + yamlScalar(v) + "\n")
+	}
+}
+
+// nestedYAML reports whether v is written on lines of its own.
+func nestedYAML(v interface{}) bool {
+	switch c := v.(type) {
+	case orderedObject:
+		return len(c) > 0
+	case []interface{}:
+		return len(c) > 0
+	}
+	return false
+}
+
+// writeYAMLChild writes a value after "key:" or "-", inline when it is a
+// scalar or empty collection and on the following lines otherwise.
+func writeYAMLChild(out *bytes.Buffer, v interface{}, indent int) {
+	if nestedYAML(v) {
+		out.WriteString("\n")
+		writeYAML(out, v, indent)
+		return
+	}
+	switch c := v.(type) {
+	case orderedObject:
+		out.WriteString(" {}\n")
+	case []interface{}:
+		out.WriteString(" []\n")
+	default:
+		out.WriteString(" " + yamlScalar(c) + "\n")
+	}
+}
+
+// writeMsgPack writes v in the MessagePack format, using the smallest
+// encoding for each value.
+func writeMsgPack(out *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		out.WriteByte(0xc0)
+	case bool:
+		if v {
+			out.WriteByte(0xc3)
+		} else {
+			out.WriteByte(0xc2)
+		}
+	case json.Number:
+		writeMsgPackNumber(out, v)
+	case string:
+		writeMsgPackHeader(out, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		out.WriteString(v)
+	case []interface{}:
+		writeMsgPackHeader(out, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			writeMsgPack(out, item)
+		}
+	case orderedObject:
+		writeMsgPackHeader(out, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, f := range v {
+			writeMsgPack(out, f.key)
+			writeMsgPack(out, f.value)
+		}
+	}
+}
+
+// writeMsgPackHeader writes the type and length of a string, array or map:
+// the fix form below fixLimit, then 8 (if the type has one), 16 and 32 bit
+// lengths.
+func writeMsgPackHeader(out *bytes.Buffer, n int, fix byte, fixLimit int, code8, code16, code32 byte) {
+	switch {
+	case n < fixLimit:
+		out.WriteByte(fix | byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		out.Write([]byte{code8, byte(n)})
+	case n <= math.MaxUint16:
+		out.WriteByte(code16)
+		out.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		out.WriteByte(code32)
+		out.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+func writeMsgPackNumber(out *bytes.Buffer, n json.Number) {
+	if i, err := strconv.ParseInt(n.String(), 10, 64); err == nil {
+		switch {
+		case i >= 0 && i <= 0x7f, i < 0 && i >= -32:
+			out.WriteByte(byte(i))
+		case i >= 0:
+			writeMsgPackUint(out, uint64(i))
+		case i >= math.MinInt8:
+			out.Write([]byte{0xd0, byte(i)})
+		case i >= math.MinInt16:
+			out.WriteByte(0xd1)
+			out.Write(binary.BigEndian.AppendUint16(nil, uint16(i)))
+		case i >= math.MinInt32:
+			out.WriteByte(0xd2)
+			out.Write(binary.BigEndian.AppendUint32(nil, uint32(i)))
+		default:
+			out.WriteByte(0xd3)
+			out.Write(binary.BigEndian.AppendUint64(nil, uint64(i)))
+		}
+		return
+	}
+	if u, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+		writeMsgPackUint(out, u)
+		return
+	}
+	f, _ := n.Float64()
+	out.WriteByte(0xcb)
+	out.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+}
+
+func writeMsgPackUint(out *bytes.Buffer, u uint64) {
+	switch {
+	case u <= math.MaxUint8:
+		out.Write([]byte{0xcc, byte(u)})
+	case u <= math.MaxUint16:
+		out.WriteByte(0xcd)
+		out.Write(binary.BigEndian.AppendUint16(nil, uint16(u)))
+	case u <= math.MaxUint32:
+		out.WriteByte(0xce)
+		out.Write(binary.BigEndian.AppendUint32(nil, uint32(u)))
+	default:
+		out.WriteByte(0xcf)
+		out.Write(binary.BigEndian.AppendUint64(nil, u))
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const oidcStateCookie = "bwui_oidc_state"
+
+// oidcProvider implements the OpenID Connect authorization code flow (with
+// PKCE) against a single issuer. Discovery and keys are fetched lazily so an
+// unreachable identity provider doesn't prevent startup; local users keep
+// working as break-glass accounts.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	groupsClaim  string
+	roleMapping  map[string]string // group -> role
+	defaultRole  string
+	client       *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	pending   map[string]oidcPending // by state
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcPending struct {
+	nonce    string
+	verifier string
+	next     string
+	expires  time.Time
+}
+
+func loadOIDCProvider() (*oidcProvider, error) {
+	issuer := getEnv("OIDC_ISSUER", "")
+	if issuer == "" {
+		return nil, nil
+	}
+	p := &oidcProvider{
+		issuer:       strings.TrimRight(issuer, "/"),
+		clientID:     getEnv("OIDC_CLIENT_ID", ""),
+		clientSecret: getEnv("OIDC_CLIENT_SECRET", ""),
+		redirectURL:  getEnv("OIDC_REDIRECT_URL", ""),
+		scopes:       strings.Fields(getEnv("OIDC_SCOPES", "openid profile email")),
+		groupsClaim:  getEnv("OIDC_GROUPS_CLAIM", "groups"),
+		roleMapping:  make(map[string]string),
+		defaultRole:  getEnv("OIDC_DEFAULT_ROLE", ""),
+		client:       &http.Client{Timeout: 10 * time.Second},
+		pending:      make(map[string]oidcPending),
+	}
+	if p.clientID == "" || p.redirectURL == "" {
+		return nil, errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required with OIDC_ISSUER")
+	}
+	if p.defaultRole != "" {
+		if _, ok := roleLevels[p.defaultRole]; !ok {
+			return nil, fmt.Errorf("unknown OIDC_DEFAULT_ROLE %q", p.defaultRole)
+		}
+	}
+	for _, entry := range parseList(getEnv("OIDC_ROLE_MAPPING", "")) {
+		group, role, ok := strings.Cut(entry, "=")
+		if _, known := roleLevels[role]; !ok || !known {
+			return nil, fmt.Errorf("OIDC_ROLE_MAPPING entry %q must be group=role", entry)
+		}
+		p.roleMapping[group] = role
+	}
+	return p, nil
+}
+
+func (p *oidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := p.getJSON(p.issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer mismatch %q", d.Issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+func (p *oidcProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// key returns the signing key with the given id, refreshing the JWKS once if
+// the key is unknown (the provider may have rotated keys).
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("oidc jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("oidc: unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// verifyIDToken checks the signature and standard claims of an ID token and
+// returns its claims.
+func (p *oidcProvider) verifyIDToken(token, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("id token signature: %w", err)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch header.Alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("invalid id token signature")
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 ||
+			!ecdsa.Verify(ecKey, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("invalid id token signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported id token algorithm %q", header.Alg)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimRight(iss, "/") != p.issuer {
+		return nil, errors.New("id token issuer mismatch")
+	}
+	if !audienceContains(claims["aud"], p.clientID) {
+		return nil, errors.New("id token audience mismatch")
+	}
+	if exp, _ := claims["exp"].(float64); time.Now().After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("id token expired")
+	}
+	if n, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("malformed id token: %w", err)
+	}
+	return json.Unmarshal(data, v)
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// roleFor picks the most privileged role mapped from the user's groups.
+func (p *oidcProvider) roleFor(claims map[string]interface{}) string {
+	role := p.defaultRole
+	groups, _ := claims[p.groupsClaim].([]interface{})
+	for _, g := range groups {
+		group, _ := g.(string)
+		if mapped, ok := p.roleMapping[group]; ok && (role == "" || roleLevels[mapped] > roleLevels[role]) {
+			role = mapped
+		}
+	}
+	return role
+}
+
+func (p *oidcProvider) exchange(code, verifier string) (string, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("token endpoint: %s: %s", resp.Status, msg)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token endpoint returned no id_token")
+	}
+	return tokens.IDToken, nil
+}
+
+func (app *App) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.oidc
+	d, err := p.getDiscovery()
+	if err != nil {
+		warnf("OIDC login failed: %v", err)
+		http.Error(w, "Single sign-on is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state, nonce, verifier := randomToken(), randomToken(), randomToken()
+	now := time.Now()
+	p.mu.Lock()
+	for s, pending := range p.pending {
+		if now.After(pending.expires) {
+			delete(p.pending, s)
+		}
+	}
+	p.pending[state] = oidcPending{
+		nonce:    nonce,
+		verifier: verifier,
+		next:     safeRedirect(r.URL.Query().Get("next")),
+		expires:  now.Add(10 * time.Minute),
+	}
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {p.redirectURL},
+		"scope":                 {strings.Join(p.scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	// Bind the state to this browser so a callback can't be replayed elsewhere.
+	app.sessions.setCookie(w, r, oidcStateCookie, state, 600)
+	http.Redirect(w, r, d.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+}
+
+func (app *App) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.oidc
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		app.renderLogin(w, r, http.StatusBadRequest, "/", "Single sign-on failed: invalid state, please try again.")
+		return
+	}
+	app.sessions.setCookie(w, r, oidcStateCookie, "", -1)
+
+	p.mu.Lock()
+	pending, ok := p.pending[state]
+	delete(p.pending, state)
+	p.mu.Unlock()
+	if !ok || time.Now().After(pending.expires) {
+		app.renderLogin(w, r, http.StatusBadRequest, "/", "Single sign-on expired, please try again.")
+		return
+	}
+
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		app.renderLogin(w, r, http.StatusUnauthorized, pending.next, "Single sign-on was denied: "+errCode)
+		return
+	}
+
+	idToken, err := p.exchange(r.URL.Query().Get("code"), pending.verifier)
+	if err == nil {
+		var claims map[string]interface{}
+		if claims, err = p.verifyIDToken(idToken, pending.nonce); err == nil {
+			app.completeOIDCLogin(w, r, claims, pending.next)
+			return
+		}
+	}
+	warnf("OIDC callback failed: %v", err)
+	app.renderLogin(w, r, http.StatusUnauthorized, pending.next, "Single sign-on failed, please try again.")
+}
+
+func (app *App) completeOIDCLogin(w http.ResponseWriter, r *http.Request, claims map[string]interface{}, next string) {
+	name, _ := claims["preferred_username"].(string)
+	if name == "" {
+		name, _ = claims["email"].(string)
+	}
+	if name == "" {
+		name, _ = claims["sub"].(string)
+	}
+
+	role := app.oidc.roleFor(claims)
+	if role == "" {
+		app.renderLogin(w, r, http.StatusForbidden, next, "Your account is not allowed to use this application.")
+		return
+	}
+
+	sess := app.sessions.create(&principal{Name: name, Role: role})
+	app.audit(r, AuditEntry{Action: AuditLogin, Actor: name, Detail: "oidc"})
+	app.sessions.setCookie(w, r, sessionCookie, sess.ID, int(app.sessions.ttl.Seconds()))
+	http.Redirect(w, r, app.url(next), http.StatusSeeOther)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/gorilla/mux"
+)
+
+// Every transaction opened on the live database through the helpers in
+// managed.go is tracked until it is committed or discarded, with the function
+// that opened it, and listed at /api/admin/active-operations. An open read
+// transaction, and any iterator in it, keeps Badger from discarding the
+// versions it may still read, so a leaked one blocks garbage collection
+// indefinitely. With OPERATION_TIMEOUT set, a watchdog cancels the
+// operations open for longer. Badger transactions cannot be discarded from
+// another goroutine, so cancelable operations register how to stop them:
+// scan sessions are closed, and the list, search and export handlers and the
+// jobs iterating in a transaction stop at their next key, see interruptible
+// and runningJob.holds. The watchdog logs a warning for the others.
+
+// operationCheckInterval is how often the watchdog looks for overdue operations.
+const operationCheckInterval = 10 * time.Second
+
+// Operation is a transaction open on the live database.
+type Operation struct {
+	ID uint64 `json:"id"`
+	// Kind is read or write.
+	Kind string `json:"kind"`
+	// Caller is the function that opened the transaction, or what holds it
+	// open, such as a scan session.
+	Caller  string    `json:"caller"`
+	Started time.Time `json:"started"`
+	// Age is in seconds.
+	Age    float64 `json:"age"`
+	ReadTs uint64  `json:"read_ts"`
+	// Cancelable operations can be canceled through the API and by the
+	// watchdog.
+	Cancelable bool `json:"cancelable"`
+	Overdue    bool `json:"overdue"`
+	cancel     func()
+	warned     bool
+}
+
+type operationTracker struct {
+	// timeout is OPERATION_TIMEOUT, 0 when the watchdog is off.
+	timeout time.Duration
+
+	mu   sync.Mutex
+	next uint64
+	ops  map[*badger.Txn]*Operation
+}
+
+// operations tracks the transactions of the live database.
+var operations = &operationTracker{ops: make(map[*badger.Txn]*Operation)}
+
+// loadOperationTimeout applies OPERATION_TIMEOUT and starts the watchdog.
+func loadOperationTimeout() error {
+	value := getEnv("OPERATION_TIMEOUT", "0")
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return fmt.Errorf("invalid OPERATION_TIMEOUT %q, expected a duration such as 10m", value)
+	}
+	if timeout > 0 {
+		operations.timeout = timeout
+		go operations.watch()
+	}
+	return nil
+}
+
+// callerName returns the first function on the stack outside the
+// transaction helpers.
+func callerName() string {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasSuffix(frame.File, "/managed.go") && !strings.HasSuffix(frame.File, "/operations.go") {
+			return strings.TrimPrefix(frame.Function, "main.")
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+func (t *operationTracker) track(txn *badger.Txn, kind string) {
+	op := &Operation{Kind: kind, Caller: callerName(), Started: time.Now().UTC(), ReadTs: txn.ReadTs()}
+	t.mu.Lock()
+	t.next++
+	op.ID = t.next
+	t.ops[txn] = op
+	t.mu.Unlock()
+}
+
+// done stops tracking txn; untracked transactions are ignored.
+func (t *operationTracker) done(txn *badger.Txn) {
+	t.mu.Lock()
+	delete(t.ops, txn)
+	t.mu.Unlock()
+}
+
+// setCancel names what holds txn open and how to close it.
+func (t *operationTracker) setCancel(txn *badger.Txn, caller string, cancel func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if op := t.ops[txn]; op != nil {
+		op.Caller, op.Cancelable, op.cancel = caller, true, cancel
+	}
+}
+
+// setCancelable makes txn cancelable through cancel, keeping its caller.
+func (t *operationTracker) setCancelable(txn *badger.Txn, cancel func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if op := t.ops[txn]; op != nil {
+		op.Cancelable, op.cancel = true, cancel
+	}
+}
+
+// errOperationCanceled is returned by checkOperation once the watchdog or
+// DELETE /api/admin/active-operations/{id} canceled the operation.
+var errOperationCanceled = errors.New("operation canceled: its transaction was open for longer than OPERATION_TIMEOUT or was canceled by an administrator")
+
+// interruptible makes txn, which a handler iterates in, cancelable: the
+// returned context, derived from the request's, is canceled with the
+// operation, and the handler calls checkOperation between keys.
+func (t *operationTracker) interruptible(ctx context.Context, txn *badger.Txn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	t.setCancelable(txn, func() { cancel(errOperationCanceled) })
+	return ctx, func() { cancel(nil) }
+}
+
+// checkOperation returns errOperationCanceled once the operation of ctx, see
+// interruptible, was canceled, and the context's error once the client is
+// gone.
+func checkOperation(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return nil
+}
+
+// list returns the open operations, oldest first.
+func (t *operationTracker) list() []Operation {
+	now := time.Now()
+	t.mu.Lock()
+	ops := make([]Operation, 0, len(t.ops))
+	for _, op := range t.ops {
+		o := *op
+		o.Age = now.Sub(o.Started).Seconds()
+		o.Overdue = t.timeout > 0 && now.Sub(o.Started) > t.timeout
+		ops = append(ops, o)
+	}
+	t.mu.Unlock()
+	sort.Slice(ops, func(i, j int) bool { return ops[i].ID < ops[j].ID })
+	return ops
+}
+
+// cancel closes the operation with the given ID and reports whether it
+// exists and whether it could be canceled.
+func (t *operationTracker) cancel(id uint64) (found, canceled bool) {
+	var cancel func()
+	t.mu.Lock()
+	for _, op := range t.ops {
+		if op.ID == id {
+			found, cancel = true, op.cancel
+			break
+		}
+	}
+	t.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	return found, cancel != nil
+}
+
+// watch cancels the cancelable operations open for longer than the timeout
+// and warns once about the others.
+func (t *operationTracker) watch() {
+	for now := range time.Tick(operationCheckInterval) {
+		var cancels []func()
+		t.mu.Lock()
+		for _, op := range t.ops {
+			age := now.Sub(op.Started)
+			if age <= t.timeout || op.warned {
+				continue
+			}
+			op.warned = true
+			if op.cancel != nil {
+				warnf("Canceling %s, open for %s, longer than OPERATION_TIMEOUT", op.Caller, age.Round(time.Second))
+				cancels = append(cancels, op.cancel)
+				continue
+			}
+			warnf("A %s transaction opened by %s has been open for %s, longer than OPERATION_TIMEOUT; it cannot be interrupted", op.Kind, op.Caller, age.Round(time.Second))
+		}
+		t.mu.Unlock()
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+}
+
+type ActiveOperations struct {
+	// Timeout is OPERATION_TIMEOUT, empty when the watchdog is off.
+	Timeout    string      `json:"timeout"`
+	Operations []Operation `json:"operations"`
+}
+
+func (app *App) activeOperationsHandler(w http.ResponseWriter, r *http.Request) {
+	result := ActiveOperations{Operations: operations.list()}
+	if operations.timeout > 0 {
+		result.Timeout = operations.timeout.String()
+	}
+	writeJSON(w, result)
+}
+
+// cancelOperationHandler cancels a cancelable operation, answering 409 for
+// the others.
+func (app *App) cancelOperationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Operation not found", http.StatusNotFound)
+		return
+	}
+	found, canceled := operations.cancel(id)
+	switch {
+	case !found:
+		http.Error(w, "Operation not found", http.StatusNotFound)
+	case !canceled:
+		http.Error(w, "This transaction cannot be canceled; it ends with its request or job", http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v4/options"
+)
+
+// DBOptions is the JSON view of the badger.Options the database was opened
+// with. The encryption key itself is never included.
+type DBOptions struct {
+	Dir                           string  `json:"dir"`
+	ValueDir                      string  `json:"value_dir"`
+	InMemory                      bool    `json:"in_memory"`
+	ReadOnly                      bool    `json:"read_only"`
+	Managed                       bool    `json:"managed"`
+	SyncWrites                    bool    `json:"sync_writes"`
+	DetectConflicts               bool    `json:"detect_conflicts"`
+	NumVersionsToKeep             int     `json:"num_versions_to_keep"`
+	Compression                   string  `json:"compression"`
+	ZSTDCompressionLevel          int     `json:"zstd_compression_level"`
+	Encrypted                     bool    `json:"encrypted"`
+	EncryptionKeyRotationDuration string  `json:"encryption_key_rotation_duration"`
+	BlockCacheSize                int64   `json:"block_cache_size"`
+	IndexCacheSize                int64   `json:"index_cache_size"`
+	MemTableSize                  int64   `json:"mem_table_size"`
+	NumMemtables                  int     `json:"num_memtables"`
+	BaseTableSize                 int64   `json:"base_table_size"`
+	BaseLevelSize                 int64   `json:"base_level_size"`
+	LevelSizeMultiplier           int     `json:"level_size_multiplier"`
+	TableSizeMultiplier           int     `json:"table_size_multiplier"`
+	MaxLevels                     int     `json:"max_levels"`
+	NumLevelZeroTables            int     `json:"num_level_zero_tables"`
+	NumLevelZeroTablesStall       int     `json:"num_level_zero_tables_stall"`
+	NumCompactors                 int     `json:"num_compactors"`
+	CompactL0OnClose              bool    `json:"compact_l0_on_close"`
+	BlockSize                     int     `json:"block_size"`
+	BloomFalsePositive            float64 `json:"bloom_false_positive"`
+	ValueThreshold                int64   `json:"value_threshold"`
+	VLogPercentile                float64 `json:"vlog_percentile"`
+	ValueLogFileSize              int64   `json:"value_log_file_size"`
+	ValueLogMaxEntries            uint32  `json:"value_log_max_entries"`
+	VerifyValueChecksum           bool    `json:"verify_value_checksum"`
+	ChecksumVerificationMode      string  `json:"checksum_verification_mode"`
+	NumGoroutines                 int     `json:"num_goroutines"`
+	MetricsEnabled                bool    `json:"metrics_enabled"`
+	NamespaceOffset               int     `json:"namespace_offset"`
+}
+
+func compressionName(c options.CompressionType) string {
+	switch c {
+	case options.None:
+		return "none"
+	case options.Snappy:
+		return "snappy"
+	case options.ZSTD:
+		return "zstd"
+	}
+	return strconv.Itoa(int(c))
+}
+
+func checksumModeName(m options.ChecksumVerificationMode) string {
+	switch m {
+	case options.NoVerification:
+		return "none"
+	case options.OnTableRead:
+		return "table"
+	case options.OnBlockRead:
+		return "block"
+	case options.OnTableAndBlockRead:
+		return "table_and_block"
+	}
+	return strconv.Itoa(int(m))
+}
+
+func (app *App) dbOptions() DBOptions {
+	opts := app.db.Opts()
+	return DBOptions{
+		Dir:                           opts.Dir,
+		ValueDir:                      opts.ValueDir,
+		InMemory:                      opts.InMemory,
+		ReadOnly:                      opts.ReadOnly,
+		Managed:                       app.managed,
+		SyncWrites:                    opts.SyncWrites,
+		DetectConflicts:               opts.DetectConflicts,
+		NumVersionsToKeep:             opts.NumVersionsToKeep,
+		Compression:                   compressionName(opts.Compression),
+		ZSTDCompressionLevel:          opts.ZSTDCompressionLevel,
+		Encrypted:                     len(opts.EncryptionKey) > 0,
+		EncryptionKeyRotationDuration: opts.EncryptionKeyRotationDuration.String(),
+		BlockCacheSize:                opts.BlockCacheSize,
+		IndexCacheSize:                opts.IndexCacheSize,
+		MemTableSize:                  opts.MemTableSize,
+		NumMemtables:                  opts.NumMemtables,
+		BaseTableSize:                 opts.BaseTableSize,
+		BaseLevelSize:                 opts.BaseLevelSize,
+		LevelSizeMultiplier:           opts.LevelSizeMultiplier,
+		TableSizeMultiplier:           opts.TableSizeMultiplier,
+		MaxLevels:                     opts.MaxLevels,
+		NumLevelZeroTables:            opts.NumLevelZeroTables,
+		NumLevelZeroTablesStall:       opts.NumLevelZeroTablesStall,
+		NumCompactors:                 opts.NumCompactors,
+		CompactL0OnClose:              opts.CompactL0OnClose,
+		BlockSize:                     opts.BlockSize,
+		BloomFalsePositive:            opts.BloomFalsePositive,
+		ValueThreshold:                opts.ValueThreshold,
+		VLogPercentile:                opts.VLogPercentile,
+		ValueLogFileSize:              opts.ValueLogFileSize,
+		ValueLogMaxEntries:            opts.ValueLogMaxEntries,
+		VerifyValueChecksum:           opts.VerifyValueChecksum,
+		ChecksumVerificationMode:      checksumModeName(opts.ChecksumVerificationMode),
+		NumGoroutines:                 opts.NumGoroutines,
+		MetricsEnabled:                opts.MetricsEnabled,
+		NamespaceOffset:               opts.NamespaceOffset,
+	}
+}
+
+// optionsHandler returns the options the database was opened with, as Badger
+// resolved them.
+func (app *App) optionsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, app.dbOptions())
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// responseRecorder tracks the status and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// recoverMiddleware turns a handler panic into a logged stack trace and a
+// JSON 500 carrying the request ID. If the response had already started, the
+// connection is aborted instead so the client does not take a truncated body
+// for a complete one.
+func (app *App) recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			id := requestID(r)
+			errorf("Panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, id, v, debug.Stack())
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Internal server error", "request_id": id})
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// callJob runs a job function, reporting a panic as the job's error so it
+// fails instead of taking the process down.
+func callJob(fn jobFunc, rj *runningJob) (result interface{}, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			errorf("Panic in job: %v\n%s", v, debug.Stack())
+			result, err = nil, fmt.Errorf("internal error: %v", v)
+		}
+	}()
+	return fn(rj)
+}
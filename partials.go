@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+)
+
+// HTMX requests (HX-Request: true) that accept text/html get the key list,
+// search results and key details as HTML fragments of the index page
+// (templates/partials.html) instead of JSON, so the page is enhanced by
+// swapping in markup rendered from the same data. Other clients are not
+// affected.
+
+// wantsFragment reports whether r asks for an HTML fragment.
+func wantsFragment(r *http.Request) bool {
+	return r.Header.Get("HX-Request") == "true" && responseFormat(r.Header.Get("Accept")) == formatHTML
+}
+
+// keyRows is the data of the key-rows and search-status fragments.
+type keyRows struct {
+	BasePath string
+	Lang     string
+	Keys     []KeyValue
+	Prefix   string
+	Query    string
+	More     bool
+	// Groups is the number of prefix groups shown next to the keys.
+	Groups int
+	// OOB swaps the search status in along with the rows.
+	OOB bool
+	// CanWrite and CanDelete show the edit and delete buttons.
+	CanWrite  bool
+	CanDelete bool
+}
+
+// Rows is the key list of the index page.
+func (p indexPage) Rows() keyRows {
+	return keyRows{
+		BasePath:  p.BasePath,
+		Lang:      p.Lang,
+		Keys:      p.Keys,
+		Prefix:    p.Prefix,
+		Query:     p.Query,
+		More:      p.More,
+		Groups:    len(p.Prefixes),
+		CanWrite:  p.Config.Permissions.Write,
+		CanDelete: p.Config.CanDelete(),
+	}
+}
+
+// keyDetail is the data of the key-detail fragment.
+type keyDetail struct {
+	KeyValue
+	BasePath string
+	Lang     string
+}
+
+func (app *App) writeFragment(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := app.templates.ExecuteTemplate(w, name, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeKeyRows renders listed or searched keys, with the search status.
+func (app *App) writeKeyRows(w http.ResponseWriter, r *http.Request, keys []KeyValue) {
+	config := app.uiConfig(r)
+	app.writeFragment(w, "key-rows", keyRows{
+		BasePath:  app.basePath,
+		Lang:      app.requestLanguage(r),
+		Keys:      keys,
+		Prefix:    r.URL.Query().Get("prefix"),
+		Query:     r.URL.Query().Get("q"),
+		OOB:       true,
+		CanWrite:  config.Permissions.Write,
+		CanDelete: config.CanDelete(),
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// errPreconditionFailed rejects a conditional write whose key changed since
+// the client read it.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// deletePrecondition is what a conditional delete expects of the key: an
+// If-Match header with the versions reported as ETag (or * for any existing
+// version), and/or the SHA-256 of the value in if_sha256=.
+type deletePrecondition struct {
+	anyVersion bool
+	versions   []uint64
+	sha256     string
+}
+
+// parseDeletePrecondition reads the conditions of r, nil for none, answering
+// 400 and reporting false when they are malformed.
+func parseDeletePrecondition(w http.ResponseWriter, r *http.Request) (*deletePrecondition, bool) {
+	var p deletePrecondition
+	set := false
+	if header := r.Header.Get("If-Match"); header != "" {
+		set = true
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" {
+				p.anyVersion = true
+				continue
+			}
+			version, err := strconv.ParseUint(strings.Trim(tag, `"`), 10, 64)
+			if err != nil {
+				http.Error(w, "If-Match must list versions such as \"42\" or be *", http.StatusBadRequest)
+				return nil, false
+			}
+			p.versions = append(p.versions, version)
+		}
+	}
+	if sum := r.URL.Query().Get("if_sha256"); sum != "" {
+		if _, err := hex.DecodeString(sum); err != nil || len(sum) != 2*sha256.Size {
+			http.Error(w, "Parameter 'if_sha256' must be a hex SHA-256 digest", http.StatusBadRequest)
+			return nil, false
+		}
+		set = true
+		p.sha256 = strings.ToLower(sum)
+	}
+	if !set {
+		return nil, true
+	}
+	return &p, true
+}
+
+// check returns errPreconditionFailed unless the current version of key in
+// txn meets p. A missing key fails every precondition. Archived values are
+// compared by the digest recorded when they were archived.
+func (p *deletePrecondition) check(txn *badger.Txn, key []byte) error {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return errPreconditionFailed
+	}
+	if err != nil {
+		return err
+	}
+	if len(p.versions) > 0 && !p.anyVersion {
+		matched := false
+		for _, version := range p.versions {
+			matched = matched || version == item.Version()
+		}
+		if !matched {
+			return errPreconditionFailed
+		}
+	}
+	if p.sha256 == "" {
+		return nil
+	}
+	var digest string
+	err = item.Value(func(val []byte) error {
+		if item.UserMeta()&archivedMeta != 0 {
+			var stub archiveStub
+			if err := json.Unmarshal(val, &stub); err != nil {
+				return err
+			}
+			digest = stub.SHA256
+			return nil
+		}
+		sum := sha256.Sum256(val)
+		digest = hex.EncodeToString(sum[:])
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if digest != p.sha256 {
+		return errPreconditionFailed
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// List, search and export iterate with value prefetching, which pays off when
+// every value is read. The prefetch_values and prefetch_size request
+// parameters tune this per scan, with prefetch_size capped by
+// MAX_PREFETCH_SIZE so a request cannot pin large amounts of memory.
+
+func loadMaxPrefetchSize() (int, error) {
+	size, err := strconv.Atoi(getEnv("MAX_PREFETCH_SIZE", "1000"))
+	if err != nil || size < 1 {
+		return 0, errors.New("MAX_PREFETCH_SIZE must be a positive number")
+	}
+	return size, nil
+}
+
+// iteratorOptions applies the prefetch parameters of r to opts. It answers
+// 400 and reports false if they are invalid.
+func (app *App) iteratorOptions(w http.ResponseWriter, r *http.Request, opts badger.IteratorOptions) (badger.IteratorOptions, bool) {
+	query := r.URL.Query()
+	if value := query.Get("prefetch_values"); value != "" {
+		prefetch, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "Parameter 'prefetch_values' must be true or false", http.StatusBadRequest)
+			return opts, false
+		}
+		opts.PrefetchValues = prefetch
+	}
+	if value := query.Get("prefetch_size"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 || size > app.maxPrefetchSize {
+			http.Error(w, fmt.Sprintf("Parameter 'prefetch_size' must be between 1 and %d", app.maxPrefetchSize), http.StatusBadRequest)
+			return opts, false
+		}
+		opts.PrefetchSize = size
+	}
+	return opts, true
+}
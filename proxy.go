@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// upstreamProxy turns the service into a read-through/write-through cache in
+// front of an HTTP key-value API. The upstream is expected to serve raw values
+// at {base}/{key}: GET returns the value (404 when missing), PUT stores the
+// request body and DELETE removes the key.
+type upstreamProxy struct {
+	baseURL string
+	ttl     time.Duration
+	client  *http.Client
+}
+
+func loadUpstreamProxy() (*upstreamProxy, error) {
+	base := getEnv("PROXY_UPSTREAM_URL", "")
+	if base == "" {
+		return nil, nil
+	}
+	if _, err := url.Parse(base); err != nil {
+		return nil, fmt.Errorf("invalid PROXY_UPSTREAM_URL: %w", err)
+	}
+	ttl, err := time.ParseDuration(getEnv("PROXY_CACHE_TTL", "5m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY_CACHE_TTL: %w", err)
+	}
+	timeout, err := time.ParseDuration(getEnv("PROXY_TIMEOUT", "10s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY_TIMEOUT: %w", err)
+	}
+	return &upstreamProxy{
+		baseURL: strings.TrimRight(base, "/"),
+		ttl:     ttl,
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (p *upstreamProxy) keyURL(key string) string {
+	return p.baseURL + "/" + url.PathEscape(key)
+}
+
+// fetch returns the upstream value of key, or found=false if the upstream
+// does not have it.
+func (p *upstreamProxy) fetch(key string) (value []byte, found bool, err error) {
+	resp, err := p.client.Get(p.keyURL(key))
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		value, err = io.ReadAll(resp.Body)
+		return value, err == nil, err
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("upstream GET %s: %s", key, resp.Status)
+	}
+}
+
+func (p *upstreamProxy) store(key string, value []byte) error {
+	req, err := http.NewRequest(http.MethodPut, p.keyURL(key), bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return p.do(req)
+}
+
+func (p *upstreamProxy) remove(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, p.keyURL(key), nil)
+	if err != nil {
+		return err
+	}
+	return p.do(req)
+}
+
+func (p *upstreamProxy) do(req *http.Request) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	// A missing key is not an error when deleting through the proxy.
+	if resp.StatusCode/100 == 2 || (req.Method == http.MethodDelete && resp.StatusCode == http.StatusNotFound) {
+		return nil
+	}
+	return fmt.Errorf("upstream %s %s: %s", req.Method, req.URL.Path, resp.Status)
+}
+
+// newEntry builds the entry for a user write, applying the cache TTL when
+// running as a proxy so the local copy never outlives its freshness window.
+func (app *App) newEntry(key, value []byte) *badger.Entry {
+	e := badger.NewEntry(key, value)
+	if app.proxy != nil && app.proxy.ttl > 0 {
+		e = e.WithTTL(app.proxy.ttl)
+	}
+	return e
+}
+
+// readThrough fetches a missing key from the upstream and caches it locally.
+func (app *App) readThrough(key string) ([]byte, bool, error) {
+	value, found, err := app.proxy.fetch(key)
+	if err != nil || !found {
+		return nil, found, err
+	}
+
+	err = app.update(func(txn *badger.Txn) error {
+		return app.setEntry(txn, app.newEntry([]byte(key), value))
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
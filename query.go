@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// keyQuery selects keys by the q= (case-insensitive key substring, as for
+// search), regex= (regular expression on the key) and filter= (expression
+// on key and value, see expr.go) parameters.
+type keyQuery struct {
+	substring string
+	pattern   *regexp.Regexp
+	filter    *filterExpr
+}
+
+// parseKeyQuery reads the query parameters, answering 400 and reporting false
+// when one is invalid.
+func parseKeyQuery(w http.ResponseWriter, r *http.Request) (keyQuery, bool) {
+	q := keyQuery{substring: strings.ToLower(r.URL.Query().Get("q"))}
+	if expr := r.URL.Query().Get("regex"); expr != "" {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			http.Error(w, "Invalid 'regex': "+err.Error(), http.StatusBadRequest)
+			return q, false
+		}
+		q.pattern = pattern
+	}
+	if expr := r.URL.Query().Get("filter"); expr != "" {
+		filter, err := cachedFilter(expr)
+		if err != nil {
+			http.Error(w, "Invalid 'filter': "+err.Error(), http.StatusBadRequest)
+			return q, false
+		}
+		q.filter = filter
+	}
+	return q, true
+}
+
+// matchKey applies the conditions on the key alone.
+func (q keyQuery) matchKey(key string) bool {
+	if q.substring != "" && !strings.Contains(strings.ToLower(key), q.substring) {
+		return false
+	}
+	return q.pattern == nil || q.pattern.MatchString(key)
+}
+
+// matchValue applies the filter, which is the only condition that needs the
+// value.
+func (q keyQuery) matchValue(key string, value []byte) bool {
+	return q.filter == nil || q.filter.match(key, value)
+}
+
+// matchItem applies the filter of a list or search to item, evaluating it
+// against the value as the caller would read it. Archived keys and keys
+// redacted for the caller never match, so a filter cannot probe hidden
+// values.
+func (app *App) matchItem(r *http.Request, q keyQuery, item *badger.Item) (bool, error) {
+	if q.filter == nil {
+		return true, nil
+	}
+	key := string(item.Key())
+	if item.UserMeta()&archivedMeta != 0 || app.shouldRedact(r, key) {
+		return false, nil
+	}
+	var matched bool
+	err := item.Value(func(val []byte) error {
+		val, err := app.scriptRead(key, val)
+		if err != nil {
+			return err
+		}
+		matched = q.filter.match(key, val)
+		return nil
+	})
+	return matched, err
+}
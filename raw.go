@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// rawValueHandler serves a value as bytes. http.ServeContent handles Range
+// and If-Range, so large values can be fetched partially or resumed; the
+// version-based ETag keeps a resumed download from mixing two values.
+//
+// Values are written straight from Badger's buffer, which for values in the
+// value log maps the file, without copying them, see streamRawValue.
+// Archived values, values fetched from the proxy upstream and values changed
+// by read hooks are looked up in memory instead.
+func (app *App) rawValueHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := routeKey(w, r)
+	if !ok {
+		return
+	}
+
+	if app.isSystemKey([]byte(key)) && !includeSystem(r) {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	if app.shouldRedact(r, key) {
+		http.Error(w, "Value is redacted", http.StatusForbidden)
+		return
+	}
+
+	readTs, ok := app.timestampParam(w, r, "read_ts")
+	if !ok {
+		return
+	}
+
+	if !app.scripts.hasHooks(hookRead, key) {
+		if cached := app.readCacheGet(key, readTs); cached != nil && !cached.archived {
+			app.recordAccess(key, false)
+			serveRaw(w, r, cached.value, cached.version, cached.meta)
+			return
+		}
+		err := app.streamRawValue(w, r, key, readTs)
+		if err == nil {
+			app.recordAccess(key, false)
+			return
+		}
+		if err != errNotStreamable {
+			writeLookupError(w, err)
+			return
+		}
+	}
+
+	value, version, err := app.lookupKey(key, readTs)
+	if err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	app.recordAccess(key, false)
+	serveRaw(w, r, value, version, app.fileMeta(key))
+}
+
+// errNotStreamable makes rawValueHandler look the value up with lookupKey.
+var errNotStreamable = errors.New("value cannot be streamed")
+
+// streamRawValue serves the value of key from within the read transaction.
+// Small values are cached on the way, see readcache.go.
+//
+// The open transaction keeps Badger from discarding the memtables and value
+// log files it reads, so a slow client must not hold it open for long: the
+// response gets a write deadline of RAW_STREAM_TIMEOUT, after which the
+// download fails and the transaction closes. Where no deadline can be set,
+// the value is copied and written after the transaction is closed.
+func (app *App) streamRawValue(w http.ResponseWriter, r *http.Request, key string, readTs uint64) error {
+	seq := app.readCache.begin()
+	var serveCopy func()
+	err := app.viewAt(readTs, func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound && app.proxy != nil || err == nil && item.UserMeta()&archivedMeta != 0 {
+			return errNotStreamable
+		}
+		if err != nil {
+			return err
+		}
+		meta, err := app.loadFileMeta(txn, item.Key())
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if readTs == 0 && app.readCache.fits(len(key)+len(val)) {
+				app.readCache.put(seq, &readCacheEntry{key: key, value: bytes.Clone(val), version: item.Version(), meta: meta, expiresAt: item.ExpiresAt()})
+			}
+			rc := http.NewResponseController(w)
+			if err := rc.SetWriteDeadline(time.Now().Add(app.rawStreamTimeout)); err != nil {
+				value, version := bytes.Clone(val), item.Version()
+				serveCopy = func() { serveRaw(w, r, value, version, meta) }
+				return nil
+			}
+			defer rc.SetWriteDeadline(time.Time{})
+			serveRaw(w, r, val, item.Version(), meta)
+			return nil
+		})
+	})
+	if err == nil && serveCopy != nil {
+		serveCopy()
+	}
+	return err
+}
+
+// serveRaw writes value with the headers of the raw endpoint.
+func serveRaw(w http.ResponseWriter, r *http.Request, value []byte, version uint64, meta *FileMeta) {
+	if version > 0 {
+		w.Header().Set("ETag", `"`+strconv.FormatUint(version, 10)+`"`)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if meta != nil {
+		// Always an attachment: serving uploaded HTML inline from this origin
+		// would run it with the user's session.
+		w.Header().Set("Content-Type", meta.ContentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": meta.Filename}))
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(value))
+}
+
+// putRawValueHandler stores the request body verbatim as the value, whatever
+// its content type. Bodies above the maximum value size are rejected with 413
+// before they are read into memory.
+func (app *App) putRawValueHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := routeKey(w, r)
+	if !ok {
+		return
+	}
+
+	if app.rejectSystemWrite(w, key) {
+		return
+	}
+	commitTs, ok := app.timestampParam(w, r, "commit_ts")
+	if !ok {
+		return
+	}
+	if r.ContentLength > app.maxValueSize {
+		http.Error(w, fmt.Sprintf("Value exceeds the maximum size of %d bytes", app.maxValueSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, app.maxValueSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Value exceeds the maximum size of %d bytes", app.maxValueSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if app.rejectInvalidWrite(w, key, value) {
+		return
+	}
+
+	info, err := app.storeValue(key, value, nil, commitTs)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeTxnHeaders(w, info)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadMaxValueSize reads MAX_VALUE_SIZE, which must stay below the value log
+// file size since Badger cannot store larger values.
+func loadMaxValueSize(opts badger.Options) (int64, error) {
+	size, err := strconv.ParseInt(getEnv("MAX_VALUE_SIZE", "268435456"), 10, 64)
+	if err != nil || size <= 0 {
+		return 0, errors.New("MAX_VALUE_SIZE must be a positive number of bytes")
+	}
+	if size >= opts.ValueLogFileSize {
+		return 0, fmt.Errorf("MAX_VALUE_SIZE must be below the value log file size (%d bytes)", opts.ValueLogFileSize)
+	}
+	return size, nil
+}
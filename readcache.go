@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/pb"
+)
+
+// With READ_CACHE_SIZE set, the latest values read by key are kept in
+// memory, so dashboards polling the same few keys do not go through the LSM
+// tree on every request. Entries are dropped when Badger publishes a write
+// of their key, which happens right after the write commits: a read racing
+// with a write may still see the previous value for that moment. Badger
+// publishes nothing when a TTL runs out, so entries keep the expiry of their
+// value and are dropped once it has passed. Reads at a read_ts bypass the
+// cache.
+
+// readCacheEntryOverhead approximates the memory of an entry besides its key
+// and value.
+const readCacheEntryOverhead = 128
+
+type readCacheEntry struct {
+	key      string
+	value    []byte
+	version  uint64
+	archived bool
+	meta     *FileMeta
+	// expiresAt is the Unix time the value expires at, 0 if it does not.
+	expiresAt uint64
+}
+
+func (e *readCacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.value) + readCacheEntryOverhead)
+}
+
+func (e *readCacheEntry) expired() bool {
+	return e.expiresAt != 0 && e.expiresAt <= uint64(time.Now().Unix())
+}
+
+// readCache is an LRU cache of values bounded by their total size.
+type readCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List // most recently used first
+	// seq counts the invalidations; a value read before one is not cached,
+	// since it may be older than the write that caused it.
+	seq uint64
+	// live is set once the subscription that invalidates entries is known to
+	// be registered; nothing is cached before.
+	live bool
+
+	hits, misses, evictions, invalidations int64
+}
+
+func loadReadCache() (*readCache, error) {
+	size, err := strconv.ParseInt(getEnv("READ_CACHE_SIZE", "0"), 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("READ_CACHE_SIZE must be a number of bytes")
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	return &readCache{maxSize: size, entries: make(map[string]*list.Element), lru: list.New()}, nil
+}
+
+// get returns the cached entry of key, nil if there is none. Its value must
+// not be modified.
+func (c *readCache) get(key string) *readCacheEntry {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if ok && elem.Value.(*readCacheEntry).expired() {
+		c.remove(elem)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*readCacheEntry)
+}
+
+// fileMeta returns the file metadata of a cached key, without counting a hit
+// or a miss since the value was just looked up.
+func (c *readCache) fileMeta(key string) (*FileMeta, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok || elem.Value.(*readCacheEntry).expired() {
+		return nil, false
+	}
+	return elem.Value.(*readCacheEntry).meta, true
+}
+
+// begin returns the invalidation count to pass to put once the value is read.
+func (c *readCache) begin() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seq
+}
+
+// fits reports whether an entry of size bytes besides the overhead would be
+// cached: values larger than a sixteenth of the cache are not.
+func (c *readCache) fits(size int) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int64(size+readCacheEntryOverhead) <= c.maxSize/16
+}
+
+// put caches e unless an invalidation happened since begin returned seq, it
+// does not fit, or the cache is not live yet.
+func (c *readCache) put(seq uint64, e *readCacheEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.live || seq != c.seq || e.size() > c.maxSize/16 {
+		return
+	}
+	if elem, ok := c.entries[e.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size()
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *readCache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*readCacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+}
+
+func (c *readCache) invalidate(keys []string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	for _, key := range keys {
+		if elem, ok := c.entries[key]; ok {
+			c.remove(elem)
+			c.invalidations++
+		}
+	}
+}
+
+// readCacheProbeKey is written under the system prefix until the read
+// cache subscription reports it, which confirms the subscription is live.
+const readCacheProbeKey = "readcache"
+
+// subscribeReadCache drops the entries of the keys written, including those
+// whose file metadata changed, until the database is closed. A write made
+// before the subscription is registered would go unnoticed, so the cache
+// stays unused until the subscription sees a probe write, or from the start
+// when the database is read-only. Should the subscription fail, the cache is
+// emptied and stays unused.
+func (app *App) subscribeReadCache() {
+	c := app.readCache
+	metaPrefix := app.systemKey(fileMetaNamespace)
+	probe := app.systemKey(readCacheProbeKey)
+	if app.db.Opts().ReadOnly {
+		c.setLive()
+	} else {
+		go app.probeReadCache(probe)
+	}
+	err := app.db.Subscribe(context.Background(), func(kvs *badger.KVList) error {
+		keys := make([]string, 0, len(kvs.Kv))
+		for _, kv := range kvs.Kv {
+			if bytes.Equal(kv.Key, probe) {
+				c.setLive()
+				continue
+			}
+			keys = append(keys, string(bytes.TrimPrefix(kv.Key, metaPrefix)))
+		}
+		c.invalidate(keys)
+		return nil
+	}, []pb.Match{{Prefix: nil}})
+	if err != nil {
+		errorf("Read cache subscription failed, disabling the cache: %v", err)
+	}
+	c.mu.Lock()
+	c.maxSize = 0
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+	c.mu.Unlock()
+}
+
+// probeReadCache writes the probe until the subscription has seen it or
+// has ended.
+func (app *App) probeReadCache(probe []byte) {
+	c := app.readCache
+	for {
+		c.mu.Lock()
+		done := c.live || c.maxSize == 0
+		c.mu.Unlock()
+		if done {
+			return
+		}
+		err := app.update(func(txn *badger.Txn) error {
+			return txn.Set(probe, []byte(time.Now().UTC().Format(time.RFC3339)))
+		})
+		if err != nil {
+			errorf("Failed to start the read cache: %v", err)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (c *readCache) setLive() {
+	c.mu.Lock()
+	c.live = true
+	c.mu.Unlock()
+}
+
+type ReadCacheMetrics struct {
+	MaxSize       int64   `json:"max_size"`
+	Size          int64   `json:"size"`
+	Keys          int     `json:"keys"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	HitRatio      float64 `json:"hit_ratio"`
+	Evictions     int64   `json:"evictions"`
+	Invalidations int64   `json:"invalidations"`
+}
+
+func (c *readCache) metrics() *ReadCacheMetrics {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := &ReadCacheMetrics{
+		MaxSize:       c.maxSize,
+		Size:          c.size,
+		Keys:          len(c.entries),
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Evictions:     c.evictions,
+		Invalidations: c.invalidations,
+	}
+	if c.hits+c.misses > 0 {
+		m.HitRatio = float64(c.hits) / float64(c.hits+c.misses)
+	}
+	return m
+}
+
+// readCacheGet returns the cached entry of key for a read at readTs, nil when
+// it must be read from the database.
+func (app *App) readCacheGet(key string, readTs uint64) *readCacheEntry {
+	if readTs != 0 {
+		return nil
+	}
+	return app.readCache.get(key)
+}
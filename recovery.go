@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// When the database cannot be opened, the process does not exit but serves a
+// recovery page and API on RECOVERY_ADDR describing the failure. Admins can
+// then retry, open the database read-only, let Badger truncate a corrupt
+// write-ahead log or remove a stale LOCK file. Once the database opens, the
+// recovery server stops and normal startup continues.
+//
+// The recovery server only knows the AUTH_USERS and AUTH_TOKENS admins; if
+// none are configured it answers loopback clients only.
+
+const (
+	RecoveryRetry      = "retry"
+	RecoveryReadOnly   = "read-only"
+	RecoveryTruncate   = "truncate"
+	RecoveryRemoveLock = "remove-lock"
+)
+
+// OpenFailure describes why the database could not be opened.
+type OpenFailure struct {
+	Dir   string `json:"dir"`
+	Error string `json:"error"`
+	// Kind is locked, truncate, manifest or other.
+	Kind           string   `json:"kind"`
+	LockPID        int      `json:"lock_pid,omitempty"`
+	LockPIDRunning bool     `json:"lock_pid_running,omitempty"`
+	Actions        []string `json:"actions"`
+}
+
+// openDatabaseDir opens the live database; see truncate.go for truncate.
+func openDatabaseDir(opts badger.Options, managed, truncate bool) (*badger.DB, error) {
+	if err := checkTruncate(opts, truncate); err != nil {
+		return nil, err
+	}
+	if managed {
+		return badger.OpenManaged(opts)
+	}
+	return badger.Open(opts)
+}
+
+// lockPID reads the PID Badger wrote to the LOCK file, 0 if there is none.
+func lockPID(dir string) int {
+	data, err := os.ReadFile(filepath.Join(dir, "LOCK"))
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
+
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, os.ErrPermission)
+}
+
+func diagnoseOpenFailure(dir string, err error) OpenFailure {
+	f := OpenFailure{Dir: dir, Error: err.Error(), Kind: "other"}
+	msg := err.Error()
+	switch {
+	case errors.Is(err, badger.ErrTruncateNeeded) || strings.Contains(msg, badger.ErrTruncateNeeded.Error()):
+		f.Kind = "truncate"
+	case strings.Contains(msg, "Cannot acquire directory lock"):
+		f.Kind = "locked"
+	case strings.Contains(strings.ToLower(msg), "manifest"):
+		f.Kind = "manifest"
+	}
+	f.Actions = []string{RecoveryRetry, RecoveryReadOnly}
+	if f.Kind == "truncate" {
+		f.Actions = append(f.Actions, RecoveryTruncate)
+	}
+	if f.LockPID = lockPID(dir); f.LockPID > 0 {
+		f.LockPIDRunning = f.LockPID != os.Getpid() && processRunning(f.LockPID)
+		if !f.LockPIDRunning {
+			f.Actions = append(f.Actions, RecoveryRemoveLock)
+		}
+	}
+	return f
+}
+
+type recoveryServer struct {
+	opts        badger.Options
+	managed     bool
+	truncate    bool
+	credentials *credentials
+	templates   *template.Template
+
+	mu      sync.Mutex
+	failure OpenFailure
+	done    bool
+	opened  chan *badger.DB
+}
+
+// recoverDatabase serves the recovery page until an action opens the
+// database, and returns it.
+func recoverDatabase(opts badger.Options, managed, truncate bool, openErr error) *badger.DB {
+	if getEnv("RECOVERY_MODE", "true") != "true" {
+		log.Fatal("Failed to open database:", openErr)
+	}
+	creds, err := parseCredentials(getEnv("AUTH_USERS", ""), getEnv("AUTH_TOKENS", ""))
+	if err != nil {
+		log.Fatal("Invalid credentials:", err)
+	}
+	templates, err := template.ParseFiles("templates/recovery.html")
+	if err != nil {
+		log.Fatal("Failed to parse templates:", err)
+	}
+	rs := &recoveryServer{
+		opts:        opts,
+		managed:     managed,
+		truncate:    truncate,
+		credentials: creds,
+		templates:   templates,
+		failure:     diagnoseOpenFailure(opts.Dir, openErr),
+		opened:      make(chan *badger.DB, 1),
+	}
+
+	base, err := loadBasePath()
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", rs.pageHandler)
+	mux.HandleFunc("/api/recovery", rs.apiHandler)
+	server := &http.Server{
+		Addr:    getEnv("RECOVERY_ADDR", ":"+getEnv("PORT", "8080")),
+		Handler: mountBasePath(base, rs.guard(mux)),
+	}
+	errorf("Failed to open database: %v", openErr)
+	log.Printf("Recovery mode: diagnostics and recovery actions served on %s", server.Addr)
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	db := <-rs.opened
+	if err := server.Shutdown(context.Background()); err != nil {
+		log.Printf("Failed to stop recovery server: %v", err)
+	}
+	return db
+}
+
+// guard admits AUTH_USERS/AUTH_TOKENS admins, or loopback clients when there
+// are none.
+func (rs *recoveryServer) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rs.credentials.enabled() {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+				http.Error(w, "Recovery is only available from localhost without AUTH_USERS or AUTH_TOKENS", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		var p *principal
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			p, _ = rs.credentials.checkToken(token)
+		} else if user, password, ok := r.BasicAuth(); ok {
+			p, _ = rs.credentials.checkPassword(user, password)
+		}
+		if p == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="badger-web-ui recovery"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !roleAllows(p.Role, permAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rs *recoveryServer) currentFailure() OpenFailure {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.failure
+}
+
+func (rs *recoveryServer) pageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.Error(w, "Database unavailable, see /api/recovery", http.StatusServiceUnavailable)
+		return
+	}
+	if err := rs.templates.ExecuteTemplate(w, "recovery.html", rs.currentFailure()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (rs *recoveryServer) apiHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, rs.currentFailure())
+	case http.MethodPost:
+		rs.runAction(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runAction performs a recovery action. Actions that can lose data must be
+// confirmed with "confirm": true.
+func (rs *recoveryServer) runAction(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Action  string `json:"action"`
+		Confirm bool   `json:"confirm"`
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.done {
+		http.Error(w, "The database is already open", http.StatusConflict)
+		return
+	}
+	allowed := false
+	for _, action := range rs.failure.Actions {
+		allowed = allowed || action == req.Action
+	}
+	if !allowed {
+		http.Error(w, fmt.Sprintf("Action %q is not available, use one of: %s", req.Action, strings.Join(rs.failure.Actions, ", ")), http.StatusBadRequest)
+		return
+	}
+	if (req.Action == RecoveryTruncate || req.Action == RecoveryRemoveLock) && !req.Confirm {
+		http.Error(w, req.Action+" must be confirmed with \"confirm\": true", http.StatusBadRequest)
+		return
+	}
+
+	opts := rs.opts
+	truncate := rs.truncate
+	switch req.Action {
+	case RecoveryReadOnly:
+		opts.ReadOnly = true
+	case RecoveryTruncate:
+		// Read-write opens truncate the write-ahead log after the last valid
+		// entry.
+		opts.ReadOnly = false
+		truncate = true
+	case RecoveryRemoveLock:
+		if pid := lockPID(opts.Dir); pid > 0 && processRunning(pid) {
+			http.Error(w, fmt.Sprintf("Process %d holding the LOCK file is running", pid), http.StatusConflict)
+			return
+		}
+		if err := os.Remove(filepath.Join(opts.Dir, "LOCK")); err != nil && !os.IsNotExist(err) {
+			http.Error(w, "Failed to remove LOCK: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Printf("Recovery action %s on %s", req.Action, opts.Dir)
+
+	db, err := openDatabaseDir(opts, rs.managed, truncate)
+	if err != nil {
+		rs.failure = diagnoseOpenFailure(opts.Dir, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(rs.failure)
+		return
+	}
+	rs.done = true
+	writeJSON(w, map[string]interface{}{"opened": true, "read_only": opts.ReadOnly})
+	rs.opened <- db
+}
+
+// readOnly reports whether the database was opened read-only from recovery
+// mode.
+func (app *App) readOnly() bool {
+	return app.db.Opts().ReadOnly
+}
+
+// readOnlyMiddleware rejects API writes while the database is read-only.
+func (app *App) readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.readOnly() && strings.HasPrefix(r.URL.Path, "/api/") && r.Method != http.MethodGet && r.Method != http.MethodHead && !readOnlyRequest(r) {
+			http.Error(w, "The database is open read-only for recovery, restart to write", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
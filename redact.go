@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// redactedValue replaces the value of secret keys in responses.
+const redactedValue = "********"
+
+// redactor masks the values of keys that hold secrets, such as API tokens,
+// for callers below the reveal role.
+type redactor struct {
+	prefixes   []string
+	pattern    *regexp.Regexp
+	revealPerm int
+}
+
+func loadRedactor() (*redactor, error) {
+	rd := &redactor{prefixes: parseList(getEnv("REDACT_PREFIXES", ""))}
+	if expr := getEnv("REDACT_KEY_PATTERN", ""); expr != "" {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDACT_KEY_PATTERN: %w", err)
+		}
+		rd.pattern = pattern
+	}
+	if len(rd.prefixes) == 0 && rd.pattern == nil {
+		return nil, nil
+	}
+	role := getEnv("REDACT_REVEAL_ROLE", RoleAdmin)
+	level, ok := roleLevels[role]
+	if !ok {
+		return nil, fmt.Errorf("unknown REDACT_REVEAL_ROLE %q", role)
+	}
+	rd.revealPerm = level
+	return rd, nil
+}
+
+func (rd *redactor) matches(key string) bool {
+	for _, prefix := range rd.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return rd.pattern != nil && rd.pattern.MatchString(key)
+}
+
+// shouldRedact reports whether the value of key must be hidden from the
+// caller. Without authentication nobody holds the reveal role.
+func (app *App) shouldRedact(r *http.Request, key string) bool {
+	if app.redactor == nil || !app.redactor.matches(key) {
+		return false
+	}
+	p := currentPrincipal(r)
+	return p == nil || !roleAllows(p.Role, app.redactor.revealPerm)
+}
+
+// redact masks kv in place when the caller may not see its value.
+func (app *App) redact(r *http.Request, kv *KeyValue) {
+	if !kv.Archived && app.shouldRedact(r, kv.Key) {
+		kv.Value = redactedValue
+		kv.Redacted = true
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// A rekey job moves the keys under one prefix to another, renaming a
+// namespace: each key gets the new prefix, then the rewrite rules are applied
+// to it in order. The new key is written with the value, TTL, archival state
+// and file metadata of the old one, and the old key is deleted in the same
+// transaction, so every key is either moved or untouched. A job that failed,
+// was canceled or was interrupted by a restart is resumed by starting it
+// again with the same parameters, or with resume= naming it.
+
+const jobRekey = "rekey"
+
+// RewriteRule replaces the matches of a regular expression in a key; With
+// may refer to groups as $1 or ${name}.
+type RewriteRule struct {
+	Pattern string `json:"pattern"`
+	With    string `json:"with"`
+}
+
+type rekeyParams struct {
+	From     string        `json:"from"`
+	To       string        `json:"to"`
+	Rules    []RewriteRule `json:"rules,omitempty"`
+	Conflict string        `json:"conflict"`
+}
+
+type RekeyResult struct {
+	Moved int64 `json:"moved"`
+	// Skipped counts keys left in place because their new key exists, or
+	// the rules give them their old name.
+	Skipped int64 `json:"skipped"`
+}
+
+type compiledRule struct {
+	pattern *regexp.Regexp
+	with    string
+}
+
+// newKey returns the new name of key.
+func (p *rekeyParams) newKey(key string, rules []compiledRule) string {
+	key = p.To + strings.TrimPrefix(key, p.From)
+	for _, rule := range rules {
+		key = rule.pattern.ReplaceAllString(key, rule.with)
+	}
+	return key
+}
+
+func (p *rekeyParams) compile() ([]compiledRule, error) {
+	if p.From == "" {
+		return nil, errors.New("a non-empty 'from' prefix is required")
+	}
+	if p.From == p.To && len(p.Rules) == 0 {
+		return nil, errors.New("'from' and 'to' must differ, or rules must be given")
+	}
+	if p.Conflict == "" {
+		p.Conflict = ConflictSkip
+	}
+	if p.Conflict != ConflictSkip && p.Conflict != ConflictOverwrite && p.Conflict != ConflictFail {
+		return nil, errors.New("conflict must be 'skip', 'overwrite' or 'fail'")
+	}
+	rules := make([]compiledRule, 0, len(p.Rules))
+	for i, rule := range p.Rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		rules = append(rules, compiledRule{pattern: pattern, with: rule.With})
+	}
+	return rules, nil
+}
+
+// rekeyHandler starts a rekey job, with the parameters of the job named by
+// resume= if given.
+func (app *App) rekeyHandler(w http.ResponseWriter, r *http.Request) {
+	var params rekeyParams
+	if id := r.URL.Query().Get("resume"); id != "" {
+		var job *Job
+		err := app.view(func(txn *badger.Txn) error {
+			var err error
+			job, err = app.loadJob(txn, id)
+			return err
+		})
+		if err == badger.ErrKeyNotFound || err == nil && job.Type != jobRekey {
+			http.Error(w, "Rekey job not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if job.Status == JobRunning || job.Status == JobSucceeded {
+			http.Error(w, "Only failed or canceled jobs can be resumed", http.StatusConflict)
+			return
+		}
+		if err := json.Unmarshal(job.Params, &params); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if app.rejectSystemWrite(w, params.From) || app.rejectSystemWrite(w, params.To) {
+		return
+	}
+	rules, err := params.compile()
+	if err != nil {
+		http.Error(w, "Invalid rekey: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := app.startJob(r, jobRekey, params, func(job *runningJob) (interface{}, error) {
+		return app.rekeyKeys(job, params, rules)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJobCreated(w, job)
+}
+
+// rekeyKeys moves the keys in batches. With the fail policy, conflicts are
+// looked for before anything is moved.
+func (app *App) rekeyKeys(job *runningJob, params rekeyParams, rules []compiledRule) (RekeyResult, error) {
+	var result RekeyResult
+	var keys [][]byte
+	err := app.view(func(txn *badger.Txn) error {
+		job.holds(txn)
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(params.From)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := job.checkCanceled(); err != nil {
+				return err
+			}
+			key := it.Item().Key()
+			if app.isSystemKey(key) {
+				continue
+			}
+			if params.Conflict == ConflictFail {
+				newKey := params.newKey(string(key), rules)
+				if _, err := txn.Get([]byte(newKey)); err == nil && newKey != string(key) {
+					return fmt.Errorf("key %q already exists, would be the new key of %q", newKey, key)
+				} else if err != nil && err != badger.ErrKeyNotFound {
+					return err
+				}
+			}
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	txn := app.newTransaction()
+	defer func() { app.discard(txn) }()
+	var batch [][]byte // the keys moved or skipped in txn
+	var pending [][2]string
+	move := func(key []byte) (bool, error) {
+		newKey := params.newKey(string(key), rules)
+		moved, err := app.moveKey(txn, key, []byte(newKey), params.Conflict)
+		if err != nil {
+			return false, err
+		}
+		batch = append(batch, key)
+		if moved {
+			pending = append(pending, [2]string{string(key), newKey})
+		}
+		return moved, nil
+	}
+	// A move that does not fit in txn may have queued some of its writes.
+	// restart discards them with txn and moves the keys of the batch again in
+	// a new transaction, so that a move is never committed half-way.
+	restart := func() error {
+		keys := batch
+		app.discard(txn)
+		txn = app.newTransaction()
+		batch, pending = nil, pending[:0]
+		for _, key := range keys {
+			if _, err := move(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	flush := func() error {
+		if err := app.commit(txn, 0); err != nil {
+			return err
+		}
+		for _, moved := range pending {
+			app.events.publish(Event{Type: EventDelete, Key: moved[0]})
+			app.events.publish(Event{Type: EventSet, Key: moved[1]})
+		}
+		result.Moved += int64(len(pending))
+		batch, pending = nil, pending[:0]
+		txn = app.newTransaction()
+		return nil
+	}
+	for _, key := range keys {
+		if err := job.checkCanceled(); err != nil {
+			return result, err
+		}
+		job.advance(1)
+		moved, err := move(key)
+		if err == badger.ErrTxnTooBig {
+			if err = restart(); err == nil {
+				if err = flush(); err == nil {
+					moved, err = move(key)
+				}
+			}
+		}
+		if err != nil {
+			return result, fmt.Errorf("after moving %d keys: %w", result.Moved, err)
+		}
+		if !moved {
+			result.Skipped++
+		}
+	}
+	if err := flush(); err != nil {
+		return result, fmt.Errorf("after moving %d keys: %w", result.Moved, err)
+	}
+	return result, nil
+}
+
+// moveKey writes key as newKey and deletes it in txn, and reports whether it
+// did. Keys deleted since they were listed are ignored.
+func (app *App) moveKey(txn *badger.Txn, key, newKey []byte, conflict string) (bool, error) {
+	if string(key) == string(newKey) {
+		return false, nil
+	}
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := txn.Get(newKey); err == nil {
+		if conflict != ConflictOverwrite {
+			return false, nil
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return false, err
+	}
+	if verr := app.writeRules.validate(string(newKey), nil); verr != nil {
+		// Only the key is checked; the value was accepted when written.
+		for _, v := range verr.Violations {
+			if v.Field == "key" {
+				return false, verr
+			}
+		}
+	}
+
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return false, err
+	}
+	meta, err := app.loadFileMeta(txn, key)
+	if err != nil {
+		return false, err
+	}
+	e := badger.NewEntry(newKey, value).WithMeta(item.UserMeta())
+	e.ExpiresAt = item.ExpiresAt()
+	if err := app.setEntry(txn, e); err != nil {
+		return false, err
+	}
+	if meta != nil {
+		if err := app.setFileMeta(txn, newKey, meta); err != nil {
+			return false, err
+		}
+	}
+	return true, app.deleteEntry(txn, key)
+}
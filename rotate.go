@@ -0,0 +1,151 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rotation configures when a log file is rotated and what is kept.
+type rotation struct {
+	maxSize    int64         // rotate above this size, 0 for no limit
+	maxAge     time.Duration // rotate once the file is this old, 0 for no limit
+	maxBackups int
+	compress   bool
+}
+
+// loadRotation reads <prefix>_MAX_SIZE_MB, <prefix>_MAX_AGE,
+// <prefix>_MAX_BACKUPS and <prefix>_COMPRESS.
+func loadRotation(prefix string) (rotation, error) {
+	var rot rotation
+	maxSize, err := strconv.Atoi(getEnv(prefix+"_MAX_SIZE_MB", "100"))
+	if err != nil || maxSize < 0 {
+		return rot, fmt.Errorf("%s_MAX_SIZE_MB must be a non-negative number", prefix)
+	}
+	rot.maxSize = int64(maxSize) << 20
+	if age := getEnv(prefix+"_MAX_AGE", ""); age != "" {
+		if rot.maxAge, err = time.ParseDuration(age); err != nil || rot.maxAge < 0 {
+			return rot, fmt.Errorf("invalid %s_MAX_AGE", prefix)
+		}
+	}
+	rot.maxBackups, err = strconv.Atoi(getEnv(prefix+"_MAX_BACKUPS", "5"))
+	if err != nil || rot.maxBackups < 0 {
+		return rot, fmt.Errorf("%s_MAX_BACKUPS must be a non-negative number", prefix)
+	}
+	rot.compress = getEnv(prefix+"_COMPRESS", "false") == "true"
+	return rot, nil
+}
+
+// rotatingFile is an append-only log file that is renamed to path.1 (or
+// path.1.gz when compressed) when it grows too large or too old, shifting
+// older files to path.2 and so on and keeping at most maxBackups of them.
+type rotatingFile struct {
+	path string
+	rotation
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	started time.Time
+}
+
+func openRotatingFile(path string, rot rotation) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, rotation: rot}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.started = file, info.Size(), time.Now()
+	if f.size > 0 {
+		// The creation time is not portable; the last write is the best
+		// guess for a file kept from a previous run.
+		f.started = info.ModTime()
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size > 0 && (f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize ||
+		f.maxAge > 0 && time.Since(f.started) > f.maxAge) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) backupName(n int) string {
+	if f.compress {
+		return fmt.Sprintf("%s.%d.gz", f.path, n)
+	}
+	return fmt.Sprintf("%s.%d", f.path, n)
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(f.backupName(f.maxBackups))
+	for n := f.maxBackups - 1; n >= 1; n-- {
+		os.Rename(f.backupName(n), f.backupName(n+1))
+	}
+	var err error
+	switch {
+	case f.maxBackups == 0:
+		err = os.Remove(f.path)
+	case f.compress:
+		err = compressFile(f.path, f.backupName(1))
+	default:
+		err = os.Rename(f.path, f.backupName(1))
+	}
+	if err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// compressFile gzips src into dst and removes src.
+func compressFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// GET /api/stats/sample?n= profiles an unfamiliar database from a uniform
+// sample of its keys. The keyspace is walked once without reading values,
+// keeping a reservoir of n keys; only the values of the sampled keys are then
+// read to detect their format.
+
+const maxSampleSize = 100000
+
+type Distribution struct {
+	Min  int64   `json:"min"`
+	Max  int64   `json:"max"`
+	Mean float64 `json:"mean"`
+	P50  int64   `json:"p50"`
+	P90  int64   `json:"p90"`
+	P99  int64   `json:"p99"`
+}
+
+type PrefixCount struct {
+	Prefix string `json:"prefix"`
+	Count  int    `json:"count"`
+}
+
+type KeyspaceSample struct {
+	// Keys is the number of keys walked, Sampled how many were profiled.
+	Keys      int64          `json:"keys"`
+	Sampled   int            `json:"sampled"`
+	KeyLength Distribution   `json:"key_length"`
+	ValueSize Distribution   `json:"value_size"`
+	Prefixes  []PrefixCount  `json:"prefixes"`
+	Formats   map[string]int `json:"formats"`
+}
+
+// prefixSeparators end the first segment of a key when grouping by prefix.
+const prefixSeparators = ":/|#"
+
+// maxSamplePrefixes caps the number of prefixes reported.
+const maxSamplePrefixes = 20
+
+type sampledKey struct {
+	key       []byte
+	valueSize int64
+	archived  bool
+}
+
+func distribution(values []int64) Distribution {
+	if len(values) == 0 {
+		return Distribution{}
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	var sum int64
+	for _, v := range values {
+		sum += v
+	}
+	at := func(p float64) int64 { return values[int(p*float64(len(values)-1))] }
+	return Distribution{
+		Min:  values[0],
+		Max:  values[len(values)-1],
+		Mean: float64(sum) / float64(len(values)),
+		P50:  at(0.50),
+		P90:  at(0.90),
+		P99:  at(0.99),
+	}
+}
+
+// valueFormat names the format of a value: empty, json, text, or the
+// sniffed content type of binary data.
+func valueFormat(value []byte) string {
+	switch {
+	case len(value) == 0:
+		return "empty"
+	case json.Valid(value):
+		return "json"
+	case utf8.Valid(value):
+		return "text"
+	}
+	return http.DetectContentType(value)
+}
+
+func (app *App) sampleKeyspace(n int, showSystem bool) (KeyspaceSample, error) {
+	sample := KeyspaceSample{Prefixes: make([]PrefixCount, 0), Formats: make(map[string]int)}
+	reservoir := make([]sampledKey, 0, n)
+	err := app.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if !showSystem && app.isSystemKey(item.Key()) {
+				continue
+			}
+			sample.Keys++
+			slot := len(reservoir)
+			if slot >= n {
+				if slot = int(rand.Int63n(sample.Keys)); slot >= n {
+					continue
+				}
+			}
+			k := sampledKey{
+				key:       item.KeyCopy(nil),
+				valueSize: item.ValueSize(),
+				archived:  item.UserMeta()&archivedMeta != 0,
+			}
+			if slot == len(reservoir) {
+				reservoir = append(reservoir, k)
+			} else {
+				reservoir[slot] = k
+			}
+		}
+
+		for _, k := range reservoir {
+			if k.archived {
+				sample.Formats["archived"]++
+				continue
+			}
+			item, err := txn.Get(k.key)
+			if err != nil {
+				return err
+			}
+			err = item.Value(func(val []byte) error {
+				sample.Formats[valueFormat(val)]++
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return sample, err
+	}
+
+	sample.Sampled = len(reservoir)
+	keyLengths := make([]int64, 0, len(reservoir))
+	valueSizes := make([]int64, 0, len(reservoir))
+	prefixes := make(map[string]int)
+	for _, k := range reservoir {
+		keyLengths = append(keyLengths, int64(len(k.key)))
+		valueSizes = append(valueSizes, k.valueSize)
+		if i := strings.IndexAny(string(k.key), prefixSeparators); i >= 0 {
+			prefixes[string(k.key[:i+1])]++
+		}
+	}
+	sample.KeyLength = distribution(keyLengths)
+	sample.ValueSize = distribution(valueSizes)
+	for prefix, count := range prefixes {
+		sample.Prefixes = append(sample.Prefixes, PrefixCount{Prefix: prefix, Count: count})
+	}
+	sort.Slice(sample.Prefixes, func(i, j int) bool {
+		if sample.Prefixes[i].Count != sample.Prefixes[j].Count {
+			return sample.Prefixes[i].Count > sample.Prefixes[j].Count
+		}
+		return sample.Prefixes[i].Prefix < sample.Prefixes[j].Prefix
+	})
+	if len(sample.Prefixes) > maxSamplePrefixes {
+		sample.Prefixes = sample.Prefixes[:maxSamplePrefixes]
+	}
+	return sample, nil
+}
+
+func (app *App) sampleHandler(w http.ResponseWriter, r *http.Request) {
+	n := 1000
+	if value := r.URL.Query().Get("n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxSampleSize {
+			http.Error(w, "Parameter 'n' must be between 1 and "+strconv.Itoa(maxSampleSize), http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+	sample, err := app.sampleKeyspace(n, includeSystem(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, sample)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/gorilla/mux"
+)
+
+// A scan session keeps a Badger iterator open on the server so a client can
+// page through a large keyspace in order without seeking from the start for
+// every page: POST /api/scan creates it, GET /api/scan/{id}/next returns the
+// next batch. The session reads a snapshot taken when it was created.
+// Sessions idle for SCAN_TTL are closed; an open session pins the snapshot's
+// memtables and tables, so MAX_SCAN_SESSIONS bounds how many may be open.
+
+const maxScanBatch = 1000
+
+type scanParams struct {
+	Prefix        string `json:"prefix,omitempty"`
+	Start         string `json:"start,omitempty"`
+	KeysOnly      bool   `json:"keys_only,omitempty"`
+	IncludeSystem bool   `json:"include_system,omitempty"`
+	ReadTs        uint64 `json:"read_ts,omitempty"`
+}
+
+type scanSession struct {
+	mu sync.Mutex // serializes batches, Badger iterators are not thread-safe
+
+	ID        string     `json:"id"`
+	Params    scanParams `json:"params"`
+	Returned  int64      `json:"returned"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	txn       *badger.Txn
+	it        *badger.Iterator
+	closed    bool
+}
+
+// close releases the iterator and transaction; the caller holds mu.
+func (s *scanSession) close() {
+	if !s.closed {
+		s.it.Close()
+		s.txn.Discard()
+		operations.done(s.txn)
+		s.closed = true
+	}
+}
+
+type ScanBatch struct {
+	ID       string      `json:"id"`
+	Items    interface{} `json:"items"`
+	Returned int64       `json:"returned"`
+	// Done is set with the last batch; the session is then closed.
+	Done bool `json:"done"`
+}
+
+type scanStore struct {
+	ttl         time.Duration
+	maxSessions int
+
+	mu       sync.Mutex
+	sessions map[string]*scanSession
+}
+
+func loadScanStore() (*scanStore, error) {
+	ttl, err := time.ParseDuration(getEnv("SCAN_TTL", "5m"))
+	if err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("invalid SCAN_TTL")
+	}
+	maxSessions, err := strconv.Atoi(getEnv("MAX_SCAN_SESSIONS", "100"))
+	if err != nil || maxSessions < 1 {
+		return nil, fmt.Errorf("MAX_SCAN_SESSIONS must be a positive number")
+	}
+	s := &scanStore{ttl: ttl, maxSessions: maxSessions, sessions: make(map[string]*scanSession)}
+	go s.cleanup()
+	return s, nil
+}
+
+// add registers s unless the session limit is reached.
+func (store *scanStore) add(s *scanSession) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.sessions) >= store.maxSessions {
+		return false
+	}
+	store.sessions[s.ID] = s
+	return true
+}
+
+func (store *scanStore) get(id string) *scanSession {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.sessions[id]
+}
+
+// remove unregisters and closes s; the caller holds s.mu.
+func (store *scanStore) remove(s *scanSession) {
+	store.mu.Lock()
+	delete(store.sessions, s.ID)
+	store.mu.Unlock()
+	s.close()
+}
+
+// cleanup closes sessions that saw no batch within the TTL.
+func (store *scanStore) cleanup() {
+	for range time.Tick(time.Minute) {
+		store.mu.Lock()
+		var stale []*scanSession
+		for _, s := range store.sessions {
+			if s.mu.TryLock() {
+				if time.Now().After(s.ExpiresAt) {
+					stale = append(stale, s)
+				}
+				s.mu.Unlock()
+			}
+		}
+		store.mu.Unlock()
+		for _, s := range stale {
+			s.mu.Lock()
+			store.remove(s)
+			s.mu.Unlock()
+			debugf("Scan session %s expired", s.ID)
+		}
+	}
+}
+
+// closeAll closes every session before the database is closed.
+func (store *scanStore) closeAll() {
+	store.mu.Lock()
+	sessions := store.sessions
+	store.sessions = make(map[string]*scanSession)
+	store.mu.Unlock()
+	for _, s := range sessions {
+		s.mu.Lock()
+		s.close()
+		s.mu.Unlock()
+	}
+}
+
+func (app *App) createScanHandler(w http.ResponseWriter, r *http.Request) {
+	var params scanParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.ReadTs != 0 && !app.managed {
+		http.Error(w, "read_ts requires MANAGED_TXNS=true", http.StatusBadRequest)
+		return
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchSize = 10
+	opts, ok := app.iteratorOptions(w, r, opts)
+	if !ok {
+		return
+	}
+	if params.KeysOnly {
+		opts.PrefetchValues = false
+	}
+	opts.Prefix = []byte(params.Prefix)
+
+	now := time.Now().UTC()
+	s := &scanSession{
+		ID:        randomToken(),
+		Params:    params,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(app.scans.ttl),
+	}
+	s.txn = app.readTransaction(params.ReadTs)
+	s.it = s.txn.NewIterator(opts)
+	start := params.Start
+	if start < params.Prefix {
+		start = params.Prefix
+	}
+	s.it.Seek([]byte(start))
+	if !app.scans.add(s) {
+		s.close()
+		http.Error(w, "Too many open scan sessions, see MAX_SCAN_SESSIONS", http.StatusTooManyRequests)
+		return
+	}
+	operations.setCancel(s.txn, "scan session "+s.ID, func() {
+		s.mu.Lock()
+		app.scans.remove(s)
+		s.mu.Unlock()
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(s)
+}
+
+func (app *App) scanSession(w http.ResponseWriter, r *http.Request) *scanSession {
+	s := app.scans.get(mux.Vars(r)["id"])
+	if s == nil {
+		http.Error(w, "Scan session not found", http.StatusNotFound)
+	}
+	return s
+}
+
+// scanNextHandler returns up to limit= entries (100 by default) from where
+// the previous batch stopped.
+func (app *App) scanNextHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed < 1 || parsed > maxScanBatch {
+			http.Error(w, "Parameter 'limit' must be between 1 and "+strconv.Itoa(maxScanBatch), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	s := app.scanSession(w, r)
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		http.Error(w, "Scan session not found", http.StatusNotFound)
+		return
+	}
+
+	keys := make([]KeyValue, 0)
+	infos := make([]KeyInfo, 0)
+	count := 0
+	for ; s.it.Valid() && count < limit; s.it.Next() {
+		item := s.it.Item()
+		if !s.Params.IncludeSystem && app.isSystemKey(item.Key()) {
+			continue
+		}
+		count++
+		if s.Params.KeysOnly {
+			infos = append(infos, keyInfo(item))
+			continue
+		}
+		kv := KeyValue{
+			Key:       string(item.Key()),
+			CreatedAt: time.Unix(int64(item.Version()), 0),
+			Version:   item.Version(),
+			Archived:  item.UserMeta()&archivedMeta != 0,
+		}
+		if !kv.Archived {
+			meta, err := app.loadFileMeta(s.txn, item.Key())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			kv.File = meta
+			err = item.Value(func(val []byte) error {
+				val, err := app.scriptRead(kv.Key, val)
+				kv.Value = string(val)
+				return err
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		app.redact(r, &kv)
+		keys = append(keys, kv)
+	}
+
+	s.Returned += int64(count)
+	now := time.Now().UTC()
+	s.UpdatedAt, s.ExpiresAt = now, now.Add(app.scans.ttl)
+	batch := ScanBatch{ID: s.ID, Items: keys, Returned: s.Returned, Done: !s.it.Valid()}
+	if s.Params.KeysOnly {
+		batch.Items = infos
+	}
+	if batch.Done {
+		app.scans.remove(s)
+	}
+	writeJSON(w, batch)
+}
+
+func (app *App) deleteScanHandler(w http.ResponseWriter, r *http.Request) {
+	s := app.scanSession(w, r)
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	app.scans.remove(s)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
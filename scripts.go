@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// SCRIPT_HOOKS runs small Lua scripts on the values of configured prefixes,
+// as comma-separated read:prefix=path and write:prefix=path entries. A script
+// sees the globals key, value and hook ("read" or "write") and returns the
+// value to use instead, or nothing to keep it. Write hooks may also call
+// reject(message) to refuse the write and put(key, value) to write another
+// key in the same transaction, e.g. an index entry. json.decode and
+// json.encode convert between JSON text and Lua tables. When several hooks
+// match a key they run in the configured order, each on the output of the
+// previous one.
+//
+// Scripts run in a fresh interpreter with only the base, string, table and
+// math libraries, without file access or module loading, and are stopped
+// after SCRIPT_TIMEOUT. SCRIPT_MAX_STACK caps the interpreter's stack slots
+// and SCRIPT_MAX_CALL_DEPTH its call depth. SCRIPT_MAX_STRING caps the
+// strings built by string.rep, the value returned and the values put().
+
+const (
+	hookRead  = "read"
+	hookWrite = "write"
+)
+
+// scriptRejection is a write refused by a write hook.
+type scriptRejection struct {
+	Key     string
+	Message string
+}
+
+func (e *scriptRejection) Error() string {
+	return fmt.Sprintf("write to %s rejected by script: %s", e.Key, e.Message)
+}
+
+// scriptError is a script that failed or returned something else than a
+// string.
+type scriptError struct {
+	Path string
+	err  error
+}
+
+func (e *scriptError) Error() string { return fmt.Sprintf("script %s: %v", e.Path, e.err) }
+func (e *scriptError) Unwrap() error { return e.err }
+
+type scriptHook struct {
+	Hook   string `json:"hook"`
+	Prefix string `json:"prefix"`
+	Path   string `json:"path"`
+	proto  *lua.FunctionProto
+}
+
+type scriptHooks struct {
+	hooks        []*scriptHook
+	timeout      time.Duration
+	maxStack     int
+	maxCallDepth int
+	maxString    int
+}
+
+func loadScriptHooks() (*scriptHooks, error) {
+	entries := parseList(getEnv("SCRIPT_HOOKS", ""))
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	timeout, err := time.ParseDuration(getEnv("SCRIPT_TIMEOUT", "100ms"))
+	if err != nil || timeout <= 0 {
+		return nil, errors.New("invalid SCRIPT_TIMEOUT")
+	}
+	maxStack, err := strconv.Atoi(getEnv("SCRIPT_MAX_STACK", "65536"))
+	if err != nil || maxStack < 1024 {
+		return nil, errors.New("SCRIPT_MAX_STACK must be at least 1024")
+	}
+	maxCallDepth, err := strconv.Atoi(getEnv("SCRIPT_MAX_CALL_DEPTH", "200"))
+	if err != nil || maxCallDepth < 1 {
+		return nil, errors.New("SCRIPT_MAX_CALL_DEPTH must be a positive number")
+	}
+	maxString, err := strconv.Atoi(getEnv("SCRIPT_MAX_STRING", "16777216"))
+	if err != nil || maxString < 1 {
+		return nil, errors.New("SCRIPT_MAX_STRING must be a positive number of bytes")
+	}
+
+	s := &scriptHooks{timeout: timeout, maxStack: maxStack, maxCallDepth: maxCallDepth, maxString: maxString}
+	for _, entry := range entries {
+		hook, rest, _ := strings.Cut(entry, ":")
+		i := strings.LastIndex(rest, "=")
+		if hook != hookRead && hook != hookWrite || i < 0 || rest[i+1:] == "" {
+			return nil, fmt.Errorf("SCRIPT_HOOKS entry %q must be read:prefix=path or write:prefix=path", entry)
+		}
+		h := &scriptHook{Hook: hook, Prefix: rest[:i], Path: rest[i+1:]}
+		if h.proto, err = compileScript(h.Path); err != nil {
+			return nil, err
+		}
+		s.hooks = append(s.hooks, h)
+	}
+	return s, nil
+}
+
+func compileScript(path string) (*lua.FunctionProto, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(strings.NewReader(string(src)), path)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, path)
+}
+
+// matching returns the hooks of kind that apply to key.
+func (s *scriptHooks) matching(kind, key string) []*scriptHook {
+	var hooks []*scriptHook
+	for _, h := range s.hooks {
+		if h.Hook == kind && strings.HasPrefix(key, h.Prefix) {
+			hooks = append(hooks, h)
+		}
+	}
+	return hooks
+}
+
+// hasHooks reports whether hooks of kind run on key.
+func (s *scriptHooks) hasHooks(kind, key string) bool {
+	return s != nil && len(s.matching(kind, key)) > 0
+}
+
+// newState returns a sandboxed interpreter stopped when ctx is done.
+func (s *scriptHooks) newState(ctx context.Context) *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:        true,
+		CallStackSize:       s.maxCallDepth,
+		RegistrySize:        1024,
+		RegistryMaxSize:     s.maxStack,
+		MinimizeStackMemory: true,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "print", "collectgarbage"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetField(L.GetGlobal(lua.StringLibName), "rep", L.NewFunction(s.luaStringRep))
+	jsonLib := L.NewTable()
+	L.SetField(jsonLib, "decode", L.NewFunction(luaJSONDecode))
+	L.SetField(jsonLib, "encode", L.NewFunction(luaJSONEncode))
+	L.SetGlobal("json", jsonLib)
+	L.SetContext(ctx)
+	return L
+}
+
+// luaStringRep is string.rep refusing results longer than maxString.
+func (s *scriptHooks) luaStringRep(L *lua.LState) int {
+	str, n := L.CheckString(1), L.CheckInt(2)
+	if n <= 0 {
+		L.Push(lua.LString(""))
+		return 1
+	}
+	if len(str) > s.maxString/n {
+		L.RaiseError("string.rep result exceeds SCRIPT_MAX_STRING (%d bytes)", s.maxString)
+	}
+	L.Push(lua.LString(strings.Repeat(str, n)))
+	return 1
+}
+
+// run runs h on value and returns the value it produced. put, if not nil,
+// receives the entries the script writes with put().
+func (s *scriptHooks) run(h *scriptHook, key string, value []byte, put func(key string, value []byte)) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	L := s.newState(ctx)
+	defer L.Close()
+
+	L.SetGlobal("key", lua.LString(key))
+	L.SetGlobal("value", lua.LString(value))
+	L.SetGlobal("hook", lua.LString(h.Hook))
+	var rejection *scriptRejection
+	if h.Hook == hookWrite {
+		L.SetGlobal("reject", L.NewFunction(func(L *lua.LState) int {
+			rejection = &scriptRejection{Key: key, Message: L.OptString(1, "rejected")}
+			L.RaiseError("%s", rejection.Message)
+			return 0
+		}))
+		L.SetGlobal("put", L.NewFunction(func(L *lua.LState) int {
+			k, v := L.CheckString(1), L.CheckString(2)
+			if len(k)+len(v) > s.maxString {
+				L.RaiseError("put() entry exceeds SCRIPT_MAX_STRING (%d bytes)", s.maxString)
+			}
+			put(k, []byte(v))
+			return 0
+		}))
+	}
+
+	L.Push(L.NewFunctionFromProto(h.proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		if rejection != nil {
+			return nil, rejection
+		}
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out after %s", s.timeout)
+		}
+		return nil, &scriptError{Path: h.Path, err: err}
+	}
+	switch ret := L.Get(-1).(type) {
+	case *lua.LNilType:
+		return value, nil
+	case lua.LString:
+		if len(ret) > s.maxString {
+			return nil, &scriptError{Path: h.Path, err: fmt.Errorf("returned %d bytes, more than SCRIPT_MAX_STRING (%d bytes)", len(ret), s.maxString)}
+		}
+		return []byte(ret), nil
+	default:
+		return nil, &scriptError{Path: h.Path, err: fmt.Errorf("returned a %s instead of a string", ret.Type())}
+	}
+}
+
+// scriptRead runs the read hooks of key on value.
+func (app *App) scriptRead(key string, value []byte) ([]byte, error) {
+	if app.scripts == nil {
+		return value, nil
+	}
+	var err error
+	for _, h := range app.scripts.matching(hookRead, key) {
+		if value, err = app.scripts.run(h, key, value, nil); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+// scriptWrite runs the write hooks of key on value and returns the value to
+// store along with the extra entries the scripts put, by key. All of them are
+// checked against the write rules.
+func (app *App) scriptWrite(key string, value []byte) ([]byte, map[string][]byte, error) {
+	if app.scripts == nil {
+		return value, nil, nil
+	}
+	var extra map[string][]byte
+	put := func(k string, v []byte) {
+		if extra == nil {
+			extra = make(map[string][]byte)
+		}
+		extra[k] = v
+	}
+	hooks := app.scripts.matching(hookWrite, key)
+	if len(hooks) == 0 {
+		return value, nil, nil
+	}
+	var err error
+	for _, h := range hooks {
+		if value, err = app.scripts.run(h, key, value, put); err != nil {
+			return nil, nil, err
+		}
+	}
+	if e := app.writeRules.validate(key, value); e != nil {
+		return nil, nil, e
+	}
+	for k, v := range extra {
+		if k == key {
+			return nil, nil, &scriptRejection{Key: key, Message: "put() cannot write the key being written"}
+		}
+		if app.isSystemKey([]byte(k)) {
+			return nil, nil, &scriptRejection{Key: key, Message: "put() cannot write system key " + k}
+		}
+		if e := app.writeRules.validate(k, v); e != nil {
+			return nil, nil, e
+		}
+	}
+	return value, extra, nil
+}
+
+func luaJSONDecode(L *lua.LState) int {
+	var v interface{}
+	if err := json.Unmarshal([]byte(L.CheckString(1)), &v); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(toLua(L, v))
+	return 1
+}
+
+func luaJSONEncode(L *lua.LState) int {
+	v, err := fromLua(L.CheckAny(1), 0)
+	if err == nil {
+		var data []byte
+		if data, err = json.Marshal(v); err == nil {
+			L.Push(lua.LString(data))
+			return 1
+		}
+	}
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+func toLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		t := L.CreateTable(0, len(v))
+		for k, item := range v {
+			t.RawSetString(k, toLua(L, item))
+		}
+		return t
+	case []interface{}:
+		t := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			t.Append(toLua(L, item))
+		}
+		return t
+	case string:
+		return lua.LString(v)
+	case float64:
+		return lua.LNumber(v)
+	case bool:
+		return lua.LBool(v)
+	default:
+		return lua.LNil
+	}
+}
+
+// fromLua converts v for encoding as JSON: tables with only the keys 1..n
+// become arrays, other tables objects.
+func fromLua(v lua.LValue, depth int) (interface{}, error) {
+	if depth > 100 {
+		return nil, errors.New("nested too deeply")
+	}
+	switch v := v.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		entries := 0
+		v.ForEach(func(_, _ lua.LValue) { entries++ })
+		if n := v.MaxN(); n > 0 && n == entries {
+			array := make([]interface{}, n)
+			for i := range array {
+				item, err := fromLua(v.RawGetInt(i+1), depth+1)
+				if err != nil {
+					return nil, err
+				}
+				array[i] = item
+			}
+			return array, nil
+		}
+		object := make(map[string]interface{})
+		var err error
+		v.ForEach(func(k, item lua.LValue) {
+			if err == nil {
+				object[k.String()], err = fromLua(item, depth+1)
+			}
+		})
+		return object, err
+	default:
+		return nil, fmt.Errorf("cannot encode a %s", v.Type())
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The binary can install itself as a Windows service or a launchd daemon:
+//
+//	badger-web-ui install [config-file]
+//	badger-web-ui uninstall
+//	badger-web-ui run [config-file]
+//
+// and replays a request journal against another instance, see journal.go:
+//
+//	badger-web-ui replay journal-file url
+//
+// Services run from the directory of the executable, where templates/ is
+// expected, and take their settings from the config file since service
+// managers do not pass the user's environment. On Linux, use the systemd
+// units described in the README.
+
+const serviceName = "badger-web-ui"
+
+// shutdownRequests asks the server to shut down, as SIGTERM does.
+var shutdownRequests = make(chan struct{}, 1)
+
+func requestShutdown() {
+	select {
+	case shutdownRequests <- struct{}{}:
+	default:
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [run [config-file] | install [config-file] | uninstall | replay journal-file url]\n", filepath.Base(os.Args[0]))
+	os.Exit(2)
+}
+
+// serviceConfig returns the absolute path of the optional config file
+// argument.
+func serviceConfig(args []string) (string, error) {
+	switch len(args) {
+	case 0:
+		return "", nil
+	case 1:
+		return filepath.Abs(args[0])
+	}
+	usage()
+	return "", nil
+}
+
+// executableDir returns the directory of the running binary.
+func executableDir() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Dir(exe), nil
+}
+
+func main() {
+	command := "run"
+	var args []string
+	if len(os.Args) > 1 {
+		command, args = os.Args[1], os.Args[2:]
+	}
+	if command == "replay" {
+		if len(args) != 2 {
+			usage()
+		}
+		if err := replayJournal(args[0], args[1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	config, err := serviceConfig(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	switch command {
+	case "run":
+		if config != "" {
+			os.Setenv("CONFIG_FILE", config)
+		}
+		err = runService()
+	case "install":
+		err = installService(config)
+		if err == nil {
+			fmt.Printf("Installed service %s\n", serviceName)
+		}
+	case "uninstall":
+		err = uninstallService()
+		if err == nil {
+			fmt.Printf("Removed service %s\n", serviceName)
+		}
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
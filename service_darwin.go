@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+)
+
+const launchdLabel = "com.github.jesusnoseq." + serviceName
+
+var launchdPlistPath = "/Library/LaunchDaemons/" + launchdLabel + ".plist"
+
+// launchdPlist is rendered with text/template, escaping the strings for XML
+// explicitly: html/template escapes for HTML contexts instead.
+var launchdPlist = template.Must(template.New("plist").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{xml .Label}}</string>
+	<key>ProgramArguments</key>
+	<array>{{range .Args}}
+		<string>{{xml .}}</string>{{end}}
+	</array>
+	<key>WorkingDirectory</key>
+	<string>{{xml .Dir}}</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+</dict>
+</plist>
+`))
+
+func xmlEscape(s string) (string, error) {
+	var b strings.Builder
+	err := xml.EscapeText(&b, []byte(s))
+	return b.String(), err
+}
+
+// runService serves in the foreground; launchd stops the daemon with
+// SIGTERM, which shuts down cleanly.
+func runService() error {
+	serve()
+	return nil
+}
+
+func installService(config string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	dir, err := executableDir()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(launchdPlistPath); err == nil {
+		return fmt.Errorf("%s already exists", launchdPlistPath)
+	}
+	args := []string{exe, "run"}
+	if config != "" {
+		args = append(args, config)
+	}
+	f, err := os.OpenFile(launchdPlistPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = launchdPlist.Execute(f, map[string]interface{}{"Label": launchdLabel, "Args": args, "Dir": dir})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(launchdPlistPath)
+		return err
+	}
+	if out, err := exec.Command("launchctl", "load", "-w", launchdPlistPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl load: %v: %s", err, out)
+	}
+	return nil
+}
+
+func uninstallService() error {
+	if _, err := os.Stat(launchdPlistPath); err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	if out, err := exec.Command("launchctl", "unload", "-w", launchdPlistPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl unload: %v: %s", err, out)
+	}
+	return os.Remove(launchdPlistPath)
+}
@@ -0,0 +1,20 @@
+//go:build !windows && !darwin
+
+package main
+
+import "errors"
+
+var errNoServiceManager = errors.New("install and uninstall support Windows and macOS; on Linux use a systemd unit, see the README")
+
+func runService() error {
+	serve()
+	return nil
+}
+
+func installService(config string) error {
+	return errNoServiceManager
+}
+
+func uninstallService() error {
+	return errNoServiceManager
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie   = "bwui_session"
+	loginCSRFCookie = "bwui_login_csrf"
+)
+
+type session struct {
+	ID        string
+	User      string
+	Role      string
+	CSRFToken string
+	Created   time.Time
+	Expires   time.Time
+}
+
+// sessionStore keeps browser sessions in memory; a restart logs everyone out.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	ttl      time.Duration
+	secure   bool   // force the Secure cookie attribute
+	path     string // cookie path, the base path of the application
+}
+
+func newSessionStore(ttl time.Duration, secure bool, path string) *sessionStore {
+	store := &sessionStore{
+		sessions: make(map[string]*session),
+		ttl:      ttl,
+		secure:   secure,
+		path:     path,
+	}
+	go store.cleanup()
+	return store
+}
+
+func randomToken() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func (s *sessionStore) create(p *principal) *session {
+	now := time.Now()
+	sess := &session{
+		ID:        randomToken(),
+		User:      p.Name,
+		Role:      p.Role,
+		CSRFToken: randomToken(),
+		Created:   now,
+		Expires:   now.Add(s.ttl),
+	}
+	s.mu.Lock()
+	s.sessions[sess.ID] = sess
+	s.mu.Unlock()
+	return sess
+}
+
+func (s *sessionStore) get(id string) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(sess.Expires) {
+		delete(s.sessions, id)
+		return nil
+	}
+	return sess
+}
+
+func (s *sessionStore) fromRequest(r *http.Request) *session {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	return s.get(cookie.Value)
+}
+
+func (s *sessionStore) destroy(id string) {
+	s.mu.Lock()
+	delete(s.sessions, id)
+	s.mu.Unlock()
+}
+
+// destroyUser ends every session of a user, e.g. after it was disabled.
+func (s *sessionStore) destroyUser(name string) {
+	s.mu.Lock()
+	for id, sess := range s.sessions {
+		if sess.User == name {
+			delete(s.sessions, id)
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (s *sessionStore) updateRole(name, role string) {
+	s.mu.Lock()
+	for _, sess := range s.sessions {
+		if sess.User == name {
+			sess.Role = role
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (s *sessionStore) cleanup() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		s.mu.Lock()
+		for id, sess := range s.sessions {
+			if now.After(sess.Expires) {
+				delete(s.sessions, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *sessionStore) isSecure(r *http.Request) bool {
+	return s.secure || r.TLS != nil || r.URL.Scheme == "https"
+}
+
+func (s *sessionStore) setCookie(w http.ResponseWriter, r *http.Request, name, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     s.path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   s.isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// safeRedirect only allows local paths as post-login targets.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+type loginPage struct {
+	BasePath  string
+	Lang      string
+	CSRFToken string
+	Next      string
+	Error     string
+	SSO       bool
+}
+
+func (app *App) renderLogin(w http.ResponseWriter, r *http.Request, status int, next, message string) {
+	// The login form is protected with a double-submit token, since there is
+	// no session yet to bind it to.
+	token := randomToken()
+	app.sessions.setCookie(w, r, loginCSRFCookie, token, 600)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := app.templates.ExecuteTemplate(w, "login.html", loginPage{
+		BasePath:  app.basePath,
+		Lang:      app.requestLanguage(r),
+		CSRFToken: token,
+		Next:      next,
+		Error:     message,
+		SSO:       app.oidc != nil,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (app *App) loginPageHandler(w http.ResponseWriter, r *http.Request) {
+	if app.sessions.fromRequest(r) != nil {
+		http.Redirect(w, r, app.url(safeRedirect(r.URL.Query().Get("next"))), http.StatusSeeOther)
+		return
+	}
+	app.renderLogin(w, r, http.StatusOK, safeRedirect(r.URL.Query().Get("next")), "")
+}
+
+func (app *App) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	next := safeRedirect(r.PostForm.Get("next"))
+
+	cookie, err := r.Cookie(loginCSRFCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.PostForm.Get("csrf_token"))) != 1 {
+		app.renderLogin(w, r, http.StatusForbidden, next, "Your login form expired, please try again.")
+		return
+	}
+
+	user := r.PostForm.Get("username")
+	if app.throttle != nil && app.throttle.retryAfter(app.throttleKeys(r, user)) > 0 {
+		app.renderLogin(w, r, http.StatusTooManyRequests, next, "Too many failed attempts, please try again later.")
+		return
+	}
+
+	p, ok := app.checkPassword(user, r.PostForm.Get("password"))
+	if !ok {
+		app.authFailed(r, "password", user)
+		app.renderLogin(w, r, http.StatusUnauthorized, next, "Invalid username or password.")
+		return
+	}
+	app.authSucceeded(user)
+	app.audit(r, AuditEntry{Action: AuditLogin, Actor: p.Name, Detail: "password"})
+
+	sess := app.sessions.create(p)
+	app.sessions.setCookie(w, r, loginCSRFCookie, "", -1)
+	app.sessions.setCookie(w, r, sessionCookie, sess.ID, int(app.sessions.ttl.Seconds()))
+	http.Redirect(w, r, app.url(next), http.StatusSeeOther)
+}
+
+func (app *App) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	sess := app.sessions.fromRequest(r)
+	if sess != nil {
+		if subtle.ConstantTimeCompare([]byte(sess.CSRFToken), []byte(requestCSRFToken(r))) != 1 {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		app.sessions.destroy(sess.ID)
+		app.audit(r, AuditEntry{Action: AuditLogout, Actor: sess.User})
+	}
+	app.sessions.setCookie(w, r, sessionCookie, "", -1)
+	http.Redirect(w, r, app.url("/login"), http.StatusSeeOther)
+}
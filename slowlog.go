@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Requests taking longer than SLOW_REQUEST_THRESHOLD are kept in memory, the
+// last maxSlowRequests of them, and listed at /api/admin/slowlog and in the
+// diagnostics bundle. Query strings are left out since they may carry
+// tokens.
+
+const maxSlowRequests = 100
+
+type SlowRequest struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	// Duration is in milliseconds.
+	Duration int64 `json:"duration_ms"`
+}
+
+type slowLog struct {
+	threshold time.Duration
+
+	mu       sync.Mutex
+	requests []SlowRequest // oldest first
+}
+
+func loadSlowLog() (*slowLog, error) {
+	threshold, err := time.ParseDuration(getEnv("SLOW_REQUEST_THRESHOLD", "1s"))
+	if err != nil || threshold < 0 {
+		return nil, fmt.Errorf("invalid SLOW_REQUEST_THRESHOLD")
+	}
+	if threshold == 0 {
+		return nil, nil
+	}
+	return &slowLog{threshold: threshold}, nil
+}
+
+func (l *slowLog) add(req SlowRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.requests) == maxSlowRequests {
+		l.requests = l.requests[1:]
+	}
+	l.requests = append(l.requests, req)
+}
+
+// list returns the slow requests, the slowest first.
+func (l *slowLog) list() []SlowRequest {
+	requests := make([]SlowRequest, 0)
+	if l == nil {
+		return requests
+	}
+	l.mu.Lock()
+	requests = append(requests, l.requests...)
+	l.mu.Unlock()
+	sort.SliceStable(requests, func(i, j int) bool { return requests[i].Duration > requests[j].Duration })
+	return requests
+}
+
+func (app *App) slowLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.slowLog == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &responseRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		if elapsed := time.Since(start); elapsed >= app.slowLog.threshold {
+			app.slowLog.add(SlowRequest{
+				Time:      start.UTC(),
+				RequestID: requestID(r),
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Status:    rec.status,
+				Duration:  elapsed.Milliseconds(),
+			})
+		}
+	})
+}
+
+func (app *App) slowLogHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, app.slowLog.list())
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// A stale space job estimates how much of the database is held by versions
+// waiting for compaction or value log GC: versions past VERSIONS_TO_KEEP (or,
+// in managed mode, at or below the discard timestamp), deletion markers and
+// expired entries, with everything they shadow. It walks all versions of a
+// sample= fraction of the keys, and adds what Badger already knows: the stale
+// data recorded in each table and the discard statistics of the value log.
+// The result tells whether a discard-versions job is worth its IO.
+
+const jobStaleSpace = "stale-space"
+
+// Classes of versions in a stale space report.
+const (
+	VersionsLive       = "live"
+	VersionsRetained   = "retained"
+	VersionsSuperseded = "superseded"
+	VersionsDeleted    = "deleted"
+	VersionsExpired    = "expired"
+)
+
+type VersionSpace struct {
+	Versions int64 `json:"versions"`
+	// Bytes counts keys and values, VlogBytes the part stored in the value
+	// log.
+	Bytes     int64 `json:"bytes"`
+	VlogBytes int64 `json:"vlog_bytes"`
+}
+
+type VlogDiscard struct {
+	File string `json:"file"`
+	Size int64  `json:"size"`
+	// Discardable is what Badger has recorded as garbage in the file; value
+	// log GC rewrites files where it is a large share.
+	Discardable int64 `json:"discardable"`
+}
+
+type StaleSpaceReport struct {
+	Sample float64 `json:"sample"`
+	Keys   int64   `json:"keys"`
+	// Classes are extrapolated from the sampled keys to the whole database.
+	Classes map[string]*VersionSpace `json:"classes"`
+	// StaleBytes adds up the superseded, deleted and expired classes.
+	StaleBytes      int64         `json:"stale_bytes"`
+	LSMSize         int64         `json:"lsm_size"`
+	LSMStaleSize    int64         `json:"lsm_stale_size"`
+	VlogSize        int64         `json:"vlog_size"`
+	VlogDiscardable int64         `json:"vlog_discardable"`
+	ValueLog        []VlogDiscard `json:"value_log"`
+	Advice          []string      `json:"advice"`
+}
+
+// staleSpaceHandler starts a stale space job over a sample= fraction of the
+// keys, all of them by default.
+func (app *App) staleSpaceHandler(w http.ResponseWriter, r *http.Request) {
+	sample := 1.0
+	if s := r.URL.Query().Get("sample"); s != "" {
+		parsed, err := strconv.ParseFloat(s, 64)
+		if err != nil || parsed <= 0 || parsed > 1 {
+			http.Error(w, "Parameter 'sample' must be above 0 and at most 1", http.StatusBadRequest)
+			return
+		}
+		sample = parsed
+	}
+	params := map[string]float64{"sample": sample}
+	job, err := app.startJob(r, jobStaleSpace, params, func(job *runningJob) (interface{}, error) {
+		return app.staleSpace(job, sample)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJobCreated(w, job)
+}
+
+func (app *App) staleSpace(job *runningJob, sample float64) (*StaleSpaceReport, error) {
+	opts := app.db.Opts()
+	report := &StaleSpaceReport{Sample: sample, Classes: make(map[string]*VersionSpace), Advice: make([]string, 0)}
+	for _, class := range []string{VersionsLive, VersionsRetained, VersionsSuperseded, VersionsDeleted, VersionsExpired} {
+		report.Classes[class] = &VersionSpace{}
+	}
+	discardTs := uint64(0)
+	if app.managed {
+		var err error
+		if discardTs, err = app.storedDiscardTs(); err != nil {
+			return nil, err
+		}
+	}
+	// discardable reports whether compaction may drop an older version.
+	discardable := func(version uint64) bool {
+		return !app.managed || version <= discardTs
+	}
+	now := uint64(time.Now().Unix())
+
+	err := app.view(func(txn *badger.Txn) error {
+		job.holds(txn)
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.AllVersions = true
+		iterOpts.PrefetchValues = false
+		it := txn.NewIterator(iterOpts)
+		defer it.Close()
+
+		var (
+			key      []byte
+			sampled  bool
+			index    int
+			shadowed string // class of the versions under a deletion or expiry
+		)
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if !bytes.Equal(item.Key(), key) {
+				if err := job.checkCanceled(); err != nil {
+					return err
+				}
+				key = item.KeyCopy(key[:0])
+				report.Keys++
+				job.advance(1)
+				sampled = sample >= 1 || rand.Float64() < sample
+				index, shadowed = 0, ""
+			}
+			if !sampled {
+				continue
+			}
+
+			var class string
+			switch {
+			case shadowed != "":
+				class = shadowed
+			case item.IsDeletedOrExpired():
+				class = VersionsDeleted
+				if expires := item.ExpiresAt(); expires > 0 && expires <= now {
+					class = VersionsExpired
+				}
+				shadowed = class
+			case index == 0:
+				class = VersionsLive
+			case index < opts.NumVersionsToKeep || !discardable(item.Version()):
+				class = VersionsRetained
+			default:
+				class = VersionsSuperseded
+			}
+			index++
+
+			space := report.Classes[class]
+			space.Versions++
+			space.Bytes += int64(item.KeySize()) + item.ValueSize()
+			if item.ValueSize() >= opts.ValueThreshold {
+				space.VlogBytes += item.ValueSize()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for class, space := range report.Classes {
+		space.Versions = int64(float64(space.Versions) / sample)
+		space.Bytes = int64(float64(space.Bytes) / sample)
+		space.VlogBytes = int64(float64(space.VlogBytes) / sample)
+		if class == VersionsSuperseded || class == VersionsDeleted || class == VersionsExpired {
+			report.StaleBytes += space.Bytes
+		}
+	}
+
+	report.LSMSize, report.VlogSize = app.db.Size()
+	for _, t := range app.db.Tables() {
+		report.LSMStaleSize += int64(t.StaleDataSize)
+	}
+	if report.ValueLog, err = vlogDiscards(opts.ValueDir); err != nil {
+		return nil, err
+	}
+	for _, v := range report.ValueLog {
+		report.VlogDiscardable += v.Discardable
+	}
+	report.Advice = staleSpaceAdvice(report)
+	return report, nil
+}
+
+// vlogDiscards reads Badger's DISCARD file, a table of 16 byte slots holding
+// a value log file ID and its discardable bytes, both big endian, up to the
+// first empty slot.
+func vlogDiscards(valueDir string) ([]VlogDiscard, error) {
+	data, err := os.ReadFile(filepath.Join(valueDir, "DISCARD"))
+	if os.IsNotExist(err) {
+		return []VlogDiscard{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	discards := make([]VlogDiscard, 0)
+	for offset := 0; offset+16 <= len(data); offset += 16 {
+		fid := binary.BigEndian.Uint64(data[offset:])
+		if fid == 0 {
+			break
+		}
+		v := VlogDiscard{
+			File:        fmt.Sprintf("%06d.vlog", fid),
+			Discardable: int64(binary.BigEndian.Uint64(data[offset+8:])),
+		}
+		// Files already removed by GC keep their slot.
+		info, err := os.Stat(filepath.Join(valueDir, v.File))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		v.Size = info.Size()
+		discards = append(discards, v)
+	}
+	sort.Slice(discards, func(i, j int) bool { return discards[i].File < discards[j].File })
+	return discards, nil
+}
+
+func staleSpaceAdvice(report *StaleSpaceReport) []string {
+	advice := make([]string, 0)
+	total := report.StaleBytes
+	for _, class := range []string{VersionsLive, VersionsRetained} {
+		total += report.Classes[class].Bytes
+	}
+	switch {
+	case total == 0:
+	case report.StaleBytes*2 > total:
+		advice = append(advice, fmt.Sprintf("%d of %d bytes are stale versions, a discard-versions job would reclaim most of them", report.StaleBytes, total))
+	case report.StaleBytes*10 > total:
+		advice = append(advice, fmt.Sprintf("%d of %d bytes are stale versions, a discard-versions job may be worth it", report.StaleBytes, total))
+	default:
+		advice = append(advice, "Little space is held by stale versions, compaction is keeping up")
+	}
+	for _, v := range report.ValueLog {
+		if v.Size > 0 && v.Discardable*2 > v.Size {
+			advice = append(advice, fmt.Sprintf("Value log %s is more than half garbage, value log GC would rewrite it", v.File))
+		}
+	}
+	return advice
+}
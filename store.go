@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Besides the live database, STORES names other key-value directories to
+// inspect through /api/stores/{name}/keys: name=path for a Badger directory,
+// or name=backend:path for another backend. Only Badger is compiled in by
+// default; bbolt is added with the bbolt build tag, see store_bbolt.go.
+// Stores are opened at startup and kept open, so they must not be in use by
+// another process. The live database keeps its own, complete API under
+// /api/keys.
+
+// errStoreKeyNotFound is returned by Store.Get for missing keys.
+var errStoreKeyNotFound = errors.New("key not found")
+
+// Store is the subset of a key-value database the stores API needs.
+type Store interface {
+	// Get returns the value of key or errStoreKeyNotFound.
+	Get(key []byte) ([]byte, error)
+	Set(key, value []byte) error
+	Delete(key []byte) error
+	// Iterate calls fn for the keys under prefix in order until fn returns
+	// an error, errStopIteration ending it without one. fn must copy key
+	// and value to keep them.
+	Iterate(prefix []byte, fn func(key, value []byte) error) error
+	// Subscribe calls fn for each change under prefix made through this
+	// process until ctx is done.
+	Subscribe(ctx context.Context, prefix []byte, fn func(StoreChange)) error
+	Close() error
+}
+
+type StoreChange struct {
+	Key     []byte
+	Value   []byte
+	Deleted bool
+}
+
+// errStopIteration ends Store.Iterate early.
+var errStopIteration = errors.New("stop iteration")
+
+// storeBackendNames are the backends recognized in STORES, compiled in or
+// not.
+var storeBackendNames = map[string]bool{"badger": true, "bbolt": true}
+
+// storeBackends opens a Store of each compiled in backend on a path; build
+// tags add entries.
+var storeBackends = map[string]func(path string, readOnly bool) (Store, error){
+	"badger": openBadgerStore,
+}
+
+type namedStore struct {
+	Name    string `json:"name"`
+	Backend string `json:"backend"`
+	Path    string `json:"path"`
+	store   Store
+	cancel  context.CancelFunc
+}
+
+// loadStores opens the stores listed in STORES, read-only in READ_ONLY
+// mode.
+func (app *App) loadStores() (map[string]*namedStore, error) {
+	stores := make(map[string]*namedStore)
+	for _, entry := range parseList(getEnv("STORES", "")) {
+		name, location, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || location == "" {
+			return nil, fmt.Errorf("STORES entry %q must be name=path or name=backend:path", entry)
+		}
+		backend, path, ok := strings.Cut(location, ":")
+		if !ok || !storeBackendNames[backend] {
+			// A Badger directory, whose path may hold a colon itself.
+			backend, path = "badger", location
+		}
+		open, ok := storeBackends[backend]
+		if !ok {
+			return nil, fmt.Errorf("STORES: backend %s of %s is not compiled in, build with -tags %s", backend, name, backend)
+		}
+		if _, ok := stores[name]; ok {
+			return nil, fmt.Errorf("STORES: %s is listed twice", name)
+		}
+		store, err := open(path, app.readOnly())
+		if err != nil {
+			closeStores(stores)
+			return nil, fmt.Errorf("opening store %s: %w", name, err)
+		}
+		s := &namedStore{Name: name, Backend: backend, Path: path, store: store}
+		stores[name] = s
+		app.publishStoreChanges(s)
+	}
+	return stores, nil
+}
+
+// publishStoreChanges publishes the writes to s on the event bus.
+func (app *App) publishStoreChanges(s *namedStore) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go func() {
+		err := s.store.Subscribe(ctx, nil, func(change StoreChange) {
+			evt := Event{Type: EventSet, Key: string(change.Key), Store: s.Name}
+			if change.Deleted {
+				evt.Type = EventDelete
+			}
+			app.events.publish(evt)
+		})
+		if err != nil && ctx.Err() == nil {
+			warnf("Events of store %s stopped: %v", s.Name, err)
+		}
+	}()
+}
+
+func closeStores(stores map[string]*namedStore) {
+	for _, s := range stores {
+		if s.cancel != nil {
+			s.cancel()
+		}
+		if err := s.store.Close(); err != nil {
+			errorf("Failed to close store %s: %v", s.Name, err)
+		}
+	}
+}
+
+func (app *App) storeRoutes(r *mux.Router) {
+	// Keys may contain slashes, as the bucket/key addresses of bbolt do.
+	r.HandleFunc("/api/stores", app.listStoresHandler).Methods("GET")
+	r.HandleFunc("/api/stores/{store}/keys", app.listStoreKeysHandler).Methods("GET")
+	r.HandleFunc("/api/stores/{store}/keys/{key:.+}", app.getStoreKeyHandler).Methods("GET")
+	r.HandleFunc("/api/stores/{store}/keys/{key:.+}", app.putStoreKeyHandler).Methods("PUT")
+	r.HandleFunc("/api/stores/{store}/keys/{key:.+}", app.deleteStoreKeyHandler).Methods("DELETE")
+}
+
+func (app *App) listStoresHandler(w http.ResponseWriter, r *http.Request) {
+	stores := make([]*namedStore, 0, len(app.stores))
+	for _, s := range app.stores {
+		stores = append(stores, s)
+	}
+	sort.Slice(stores, func(i, j int) bool { return stores[i].Name < stores[j].Name })
+	writeJSON(w, stores)
+}
+
+func (app *App) routeStore(w http.ResponseWriter, r *http.Request) (*namedStore, bool) {
+	s, ok := app.stores[mux.Vars(r)["store"]]
+	if !ok {
+		http.Error(w, "Store not found", http.StatusNotFound)
+	}
+	return s, ok
+}
+
+type StoreKey struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Redacted bool   `json:"redacted,omitempty"`
+}
+
+func (app *App) storeKey(r *http.Request, key, value []byte) StoreKey {
+	kv := StoreKey{Key: string(key), Value: string(value)}
+	if app.shouldRedact(r, kv.Key) {
+		kv.Value, kv.Redacted = redactedValue, true
+	}
+	return kv
+}
+
+// listStoreKeysHandler returns up to limit= keys (100 by default) under
+// prefix=.
+func (app *App) listStoreKeysHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := app.routeStore(w, r)
+	if !ok {
+		return
+	}
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Parameter 'limit' must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	keys := make([]StoreKey, 0)
+	err := s.store.Iterate([]byte(r.URL.Query().Get("prefix")), func(key, value []byte) error {
+		if len(keys) == limit {
+			return errStopIteration
+		}
+		keys = append(keys, app.storeKey(r, key, value))
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, keys)
+}
+
+func (app *App) getStoreKeyHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := app.routeStore(w, r)
+	if !ok {
+		return
+	}
+	key, ok := routeKey(w, r)
+	if !ok {
+		return
+	}
+	value, err := s.store.Get([]byte(key))
+	if err == errStoreKeyNotFound {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, app.storeKey(r, []byte(key), value))
+}
+
+func (app *App) putStoreKeyHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := app.routeStore(w, r)
+	if !ok {
+		return
+	}
+	key, ok := routeKey(w, r)
+	if !ok {
+		return
+	}
+	var kv StoreKey
+	if err := json.NewDecoder(r.Body).Decode(&kv); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if app.rejectInvalidWrite(w, key, []byte(kv.Value)) {
+		return
+	}
+	if err := s.store.Set([]byte(key), []byte(kv.Value)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	kv.Key = key
+	writeJSON(w, kv)
+}
+
+func (app *App) deleteStoreKeyHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := app.routeStore(w, r)
+	if !ok {
+		return
+	}
+	key, ok := routeKey(w, r)
+	if !ok {
+		return
+	}
+	if err := s.store.Delete([]byte(key)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
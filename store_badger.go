@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/pb"
+)
+
+// badgerInternalPrefix marks keys Badger writes for itself, such as the
+// transaction markers its publisher passes on.
+var badgerInternalPrefix = []byte("!badger!")
+
+// badgerStore is the Store of a Badger directory listed in STORES.
+type badgerStore struct {
+	db *badger.DB
+}
+
+func openBadgerStore(path string, readOnly bool) (Store, error) {
+	db, err := badger.Open(badger.DefaultOptions(path).WithReadOnly(readOnly).WithLogger(nil))
+	if err != nil {
+		return nil, err
+	}
+	return &badgerStore{db: db}, nil
+}
+
+func (s *badgerStore) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, errStoreKeyNotFound
+	}
+	return value, err
+}
+
+func (s *badgerStore) Set(key, value []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, value)
+	})
+}
+
+func (s *badgerStore) Delete(key []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+func (s *badgerStore) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			err := item.Value(func(val []byte) error {
+				return fn(item.Key(), val)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == errStopIteration {
+		return nil
+	}
+	return err
+}
+
+// Subscribe reports writes through Badger's own publisher. It carries no
+// deletion marker, so an empty value is looked up to tell a delete from a
+// write of an empty value.
+func (s *badgerStore) Subscribe(ctx context.Context, prefix []byte, fn func(StoreChange)) error {
+	err := s.db.Subscribe(ctx, func(list *badger.KVList) error {
+		for _, kv := range list.Kv {
+			if bytes.HasPrefix(kv.Key, badgerInternalPrefix) {
+				continue
+			}
+			change := StoreChange{Key: kv.Key, Value: kv.Value}
+			if len(kv.Value) == 0 {
+				_, err := s.Get(kv.Key)
+				change.Deleted = err == errStoreKeyNotFound
+			}
+			fn(change)
+		}
+		return nil
+	}, []pb.Match{{Prefix: prefix}})
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+func (s *badgerStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,133 @@
+//go:build bbolt
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A bbolt file holds keys in buckets. Its keys are addressed as
+// bucket/key, the bucket being a top-level one; nested buckets are not
+// listed. Keys are iterated bucket by bucket.
+
+func init() {
+	storeBackends["bbolt"] = openBoltStore
+}
+
+type boltStore struct {
+	db   *bolt.DB
+	feed changeFeed
+}
+
+func openBoltStore(path string, readOnly bool) (Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{ReadOnly: readOnly, Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// splitBoltKey splits bucket/key.
+func splitBoltKey(key []byte) (bucket, name []byte, err error) {
+	bucket, name, ok := bytes.Cut(key, []byte("/"))
+	if !ok || len(bucket) == 0 || len(name) == 0 {
+		return nil, nil, errors.New("bbolt keys are addressed as bucket/key")
+	}
+	return bucket, name, nil
+}
+
+func (s *boltStore) Get(key []byte) ([]byte, error) {
+	bucket, name, err := splitBoltKey(key)
+	if err != nil {
+		return nil, errStoreKeyNotFound
+	}
+	var value []byte
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return errStoreKeyNotFound
+		}
+		v := b.Get(name)
+		if v == nil {
+			return errStoreKeyNotFound
+		}
+		value = bytes.Clone(v)
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStore) Set(key, value []byte) error {
+	bucket, name, err := splitBoltKey(key)
+	if err != nil {
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(name, value)
+	})
+	if err == nil {
+		s.feed.publish(StoreChange{Key: key, Value: value})
+	}
+	return err
+}
+
+func (s *boltStore) Delete(key []byte) error {
+	bucket, name, err := splitBoltKey(key)
+	if err != nil {
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucket); b != nil {
+			return b.Delete(name)
+		}
+		return nil
+	})
+	if err == nil {
+		s.feed.publish(StoreChange{Key: key, Deleted: true})
+	}
+	return err
+}
+
+func (s *boltStore) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	bucketPrefix, namePrefix, inBucket := bytes.Cut(prefix, []byte("/"))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(bucket []byte, b *bolt.Bucket) error {
+			if inBucket && !bytes.Equal(bucket, bucketPrefix) || !bytes.HasPrefix(bucket, bucketPrefix) {
+				return nil
+			}
+			c := b.Cursor()
+			for k, v := c.Seek(namePrefix); k != nil && bytes.HasPrefix(k, namePrefix); k, v = c.Next() {
+				if v == nil {
+					continue
+				}
+				key := append(append(append([]byte{}, bucket...), '/'), k...)
+				if err := fn(key, v); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err == errStopIteration {
+		return nil
+	}
+	return err
+}
+
+// Subscribe reports the writes made through this store.
+func (s *boltStore) Subscribe(ctx context.Context, prefix []byte, fn func(StoreChange)) error {
+	return s.feed.subscribe(ctx, prefix, fn)
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,47 @@
+//go:build bbolt
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// changeFeed delivers the writes of backends without a change feed of
+// their own to their subscribers.
+type changeFeed struct {
+	mu   sync.Mutex
+	subs map[*feedSubscriber]bool
+}
+
+type feedSubscriber struct {
+	prefix []byte
+	fn     func(StoreChange)
+}
+
+func (f *changeFeed) publish(change StoreChange) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subs {
+		if bytes.HasPrefix(change.Key, sub.prefix) {
+			sub.fn(change)
+		}
+	}
+}
+
+func (f *changeFeed) subscribe(ctx context.Context, prefix []byte, fn func(StoreChange)) error {
+	sub := &feedSubscriber{prefix: prefix, fn: fn}
+	f.mu.Lock()
+	if f.subs == nil {
+		f.subs = make(map[*feedSubscriber]bool)
+	}
+	f.subs[sub] = true
+	f.mu.Unlock()
+
+	<-ctx.Done()
+	f.mu.Lock()
+	delete(f.subs, sub)
+	f.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// All internal bookkeeping (access statistics, archive state, ...) lives under
+// a single reserved prefix so it can be hidden from user-facing views and
+// protected from accidental writes.
+
+func (app *App) systemKey(name string) []byte {
+	return []byte(app.systemPrefix + name)
+}
+
+func (app *App) isSystemKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(app.systemPrefix))
+}
+
+// includeSystem reports whether the request asked to see system keys with
+// include_system=true.
+func includeSystem(r *http.Request) bool {
+	return r.URL.Query().Get("include_system") == "true"
+}
+
+// rejectSystemWrite answers 403 if key is reserved for internal use.
+func (app *App) rejectSystemWrite(w http.ResponseWriter, key string) bool {
+	if app.isSystemKey([]byte(key)) {
+		http.Error(w, "Keys under the system prefix "+app.systemPrefix+" are reserved", http.StatusForbidden)
+		return true
+	}
+	return false
+}
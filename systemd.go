@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Under systemd the server can take its listening socket from socket
+// activation (LISTEN_FDS) and reports readiness, reloads and shutdown through
+// NOTIFY_SOCKET. With WatchdogSec= set, the watchdog is pinged only while a
+// read from Badger succeeds, so systemd restarts a wedged process.
+
+const listenFdsStart = 3
+
+// systemdListener returns the first socket passed by systemd, or nil when the
+// process was not socket activated.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	f := os.NewFile(uintptr(listenFdsStart), "LISTEN_FD_3")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// sdNotify sends state to the service manager; it does nothing outside
+// systemd.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often to ping the watchdog, 0 if disabled.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// healthCheck reads from the database to make sure it still answers.
+func (app *App) healthCheck() error {
+	if app.db.IsClosed() {
+		return badger.ErrDBClosed
+	}
+	return app.view(func(txn *badger.Txn) error {
+		_, err := txn.Get(app.systemKey("health"))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// notifyReady tells systemd the server is up and starts the watchdog.
+func (app *App) notifyReady() {
+	if err := sdNotify("READY=1\nSTATUS=Serving"); err != nil {
+		errorf("Failed to notify systemd: %v", err)
+	}
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := app.healthCheck(); err != nil {
+				errorf("Health check failed, skipping watchdog ping: %v", err)
+				sdNotify(fmt.Sprintf("STATUS=Health check failed: %v", err))
+				continue
+			}
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
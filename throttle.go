@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authThrottle slows down password and token guessing. Failures are counted
+// per client IP and per user name; after a few free attempts each further
+// failure blocks the IP and user for an exponentially growing delay, capped
+// at maxDelay.
+type authThrottle struct {
+	freeAttempts int
+	baseDelay    time.Duration
+	maxDelay     time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*failureRecord
+}
+
+type failureRecord struct {
+	count        int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+func loadAuthThrottle() (*authThrottle, error) {
+	t, err := parseAuthThrottle()
+	if t != nil {
+		go t.cleanup()
+	}
+	return t, err
+}
+
+// parseAuthThrottle reads the throttle settings; it returns nil when
+// throttling is disabled.
+func parseAuthThrottle() (*authThrottle, error) {
+	if getEnv("AUTH_THROTTLE", "true") != "true" {
+		return nil, nil
+	}
+	free, err := strconv.Atoi(getEnv("AUTH_THROTTLE_FREE_ATTEMPTS", "5"))
+	if err != nil || free < 0 {
+		return nil, fmt.Errorf("AUTH_THROTTLE_FREE_ATTEMPTS must be a non-negative number")
+	}
+	base, err := time.ParseDuration(getEnv("AUTH_THROTTLE_BASE_DELAY", "1s"))
+	if err != nil || base <= 0 {
+		return nil, fmt.Errorf("invalid AUTH_THROTTLE_BASE_DELAY")
+	}
+	max, err := time.ParseDuration(getEnv("AUTH_LOCKOUT_MAX", "15m"))
+	if err != nil || max < base {
+		return nil, fmt.Errorf("AUTH_LOCKOUT_MAX must be a duration of at least AUTH_THROTTLE_BASE_DELAY")
+	}
+	return &authThrottle{
+		freeAttempts: free,
+		baseDelay:    base,
+		maxDelay:     max,
+		failures:     make(map[string]*failureRecord),
+	}, nil
+}
+
+// configure takes over the delays of src, keeping the recorded failures.
+func (t *authThrottle) configure(src *authThrottle) {
+	t.mu.Lock()
+	t.freeAttempts = src.freeAttempts
+	t.baseDelay = src.baseDelay
+	t.maxDelay = src.maxDelay
+	t.mu.Unlock()
+}
+
+// throttleKeys identifies the client and, when known, the targeted user.
+func (app *App) throttleKeys(r *http.Request, user string) []string {
+	keys := []string{"ip:" + app.clientIP(r).String()}
+	if user != "" {
+		keys = append(keys, "user:"+strings.ToLower(user))
+	}
+	return keys
+}
+
+// retryAfter returns how long the given keys remain blocked.
+func (t *authThrottle) retryAfter(keys []string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if rec, ok := t.failures[key]; ok {
+			if d := time.Until(rec.blockedUntil); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt and returns the block it triggered, if any.
+func (t *authThrottle) fail(keys []string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	var block time.Duration
+	for _, key := range keys {
+		rec, ok := t.failures[key]
+		if !ok {
+			rec = &failureRecord{}
+			t.failures[key] = rec
+		}
+		rec.count++
+		rec.last = now
+		if excess := rec.count - t.freeAttempts; excess > 0 {
+			d := time.Duration(float64(t.baseDelay) * math.Pow(2, float64(excess-1)))
+			if d > t.maxDelay || d <= 0 {
+				d = t.maxDelay
+			}
+			rec.blockedUntil = now.Add(d)
+			if d > block {
+				block = d
+			}
+		}
+	}
+	return block
+}
+
+func (t *authThrottle) succeed(keys []string) {
+	t.mu.Lock()
+	for _, key := range keys {
+		delete(t.failures, key)
+	}
+	t.mu.Unlock()
+}
+
+// cleanup forgets failures once they are older than the longest lockout.
+func (t *authThrottle) cleanup() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		t.mu.Lock()
+		for key, rec := range t.failures {
+			if now.After(rec.blockedUntil) && now.Sub(rec.last) > t.maxDelay {
+				delete(t.failures, key)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// throttled rejects the request with 429 while its IP or user is blocked.
+func (app *App) throttled(w http.ResponseWriter, r *http.Request, user string) bool {
+	if app.throttle == nil {
+		return false
+	}
+	wait := app.throttle.retryAfter(app.throttleKeys(r, user))
+	if wait <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+	return true
+}
+
+// authFailed records a failed authentication in the throttle and audit log.
+func (app *App) authFailed(r *http.Request, method, user string) {
+	app.audit(r, AuditEntry{Action: AuditAuthFailure, Actor: user, Detail: method})
+	if app.throttle == nil {
+		return
+	}
+	if block := app.throttle.fail(app.throttleKeys(r, user)); block > 0 {
+		app.audit(r, AuditEntry{Action: AuditAuthLocked, Actor: user, Detail: fmt.Sprintf("%s, blocked for %s", method, block)})
+	}
+}
+
+// authSucceeded clears the failures of the user. The IP keeps its record, so
+// one valid account cannot be used to reset guessing against others.
+func (app *App) authSucceeded(user string) {
+	if app.throttle != nil && user != "" {
+		app.throttle.succeed([]string{"user:" + strings.ToLower(user)})
+	}
+}
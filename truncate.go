@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Badger deletes the memtable write-ahead logs (*.mem) when it closes
+// cleanly. Leftover ones mean the last shutdown was not clean: a read-write
+// open replays them and truncates each after its last valid entry, dropping
+// any partially written one. Badger v4 always does this and has no option to
+// refuse, so BADGER_TRUNCATE=false makes the application refuse instead,
+// which lands in recovery mode.
+
+func loadTruncate() bool {
+	return getEnv("BADGER_TRUNCATE", "true") == "true"
+}
+
+// walFiles lists the write-ahead logs left in dir.
+func walFiles(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.mem"))
+	return files
+}
+
+// checkTruncate returns an error if opening opts.Dir would truncate
+// write-ahead logs and truncation is not allowed.
+func checkTruncate(opts badger.Options, truncate bool) error {
+	if truncate || opts.ReadOnly || opts.InMemory {
+		return nil
+	}
+	if files := walFiles(opts.Dir); len(files) > 0 {
+		return fmt.Errorf("%w: %d write-ahead log(s) left by an unclean shutdown and BADGER_TRUNCATE=false", badger.ErrTruncateNeeded, len(files))
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Badger stores the expiry with each version of a key, so changing it means
+// writing the value again. These helpers do so inside the caller's
+// transaction, keeping the value, its user metadata and file metadata.
+
+// rewriteTTL gives key an expiry of ttl from now, or none if ttl is 0, and
+// returns the new expiry time (0 for none). It returns badger.ErrKeyNotFound
+// for missing keys.
+func (app *App) rewriteTTL(txn *badger.Txn, key []byte, ttl time.Duration) (uint64, error) {
+	return app.rewriteExpiry(txn, key, func(uint64) (uint64, error) {
+		if ttl == 0 {
+			return 0, nil
+		}
+		return uint64(time.Now().Add(ttl).Unix()), nil
+	})
+}
+
+// rewriteExpiry rewrites key with the expiry that expiry computes from the
+// current one, both Unix times or 0 for none, and returns it.
+func (app *App) rewriteExpiry(txn *badger.Txn, key []byte, expiry func(current uint64) (uint64, error)) (uint64, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	expiresAt, err := expiry(item.ExpiresAt())
+	if err != nil {
+		return 0, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, err
+	}
+	e := badger.NewEntry(key, value).WithMeta(item.UserMeta())
+	e.ExpiresAt = expiresAt
+	if err := txn.SetEntry(e); err != nil {
+		return 0, err
+	}
+	return expiresAt, app.setEntryIndex(txn, key, expiresAt)
+}
+
+// TTLRequest is the body of the TTL endpoints; an empty or "0" TTL removes
+// the expiry.
+type TTLRequest struct {
+	Prefix string `json:"prefix,omitempty"`
+	TTL    string `json:"ttl"`
+}
+
+type KeyTTL struct {
+	Key       string     `json:"key"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Version   uint64     `json:"version,omitempty"`
+}
+
+// expiryTime converts a Badger expiry to a time, nil for none.
+func expiryTime(expiresAt uint64) *time.Time {
+	if expiresAt == 0 {
+		return nil
+	}
+	t := time.Unix(int64(expiresAt), 0).UTC()
+	return &t
+}
+
+// decodeTTLRequest reads the request body, answering 400 and reporting false
+// when it is invalid.
+func decodeTTLRequest(w http.ResponseWriter, r *http.Request) (TTLRequest, time.Duration, bool) {
+	var req TTLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return req, 0, false
+	}
+	if req.TTL == "" {
+		return req, 0, true
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl < 0 {
+		http.Error(w, "Invalid 'ttl', expected a duration such as 30m", http.StatusBadRequest)
+		return req, 0, false
+	}
+	return req, ttl, true
+}
+
+// setTTLHandler changes the expiry of a key without resending its value.
+func (app *App) setTTLHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := routeKey(w, r)
+	if !ok {
+		return
+	}
+	if app.rejectSystemWrite(w, key) {
+		return
+	}
+	commitTs, ok := app.timestampParam(w, r, "commit_ts")
+	if !ok {
+		return
+	}
+	_, ttl, ok := decodeTTLRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var expiresAt uint64
+	info, err := app.writeKey(key, commitTs, func(txn *badger.Txn) error {
+		var err error
+		expiresAt, err = app.rewriteTTL(txn, []byte(key), ttl)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeTxnHeaders(w, info)
+	app.events.publish(Event{Type: EventSet, Key: key})
+	writeJSON(w, KeyTTL{Key: key, ExpiresAt: expiryTime(expiresAt), Version: info.CommitTs})
+}
+
+type PrefixTTLResult struct {
+	Prefix  string `json:"prefix"`
+	Updated int64  `json:"updated"`
+}
+
+// setPrefixTTLHandler changes the expiry of every user key under a prefix.
+// Keys are rewritten in batches of transactions as large as Badger allows;
+// keys written concurrently keep the TTL of that write.
+func (app *App) setPrefixTTLHandler(w http.ResponseWriter, r *http.Request) {
+	req, ttl, ok := decodeTTLRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Prefix == "" {
+		http.Error(w, "A non-empty 'prefix' is required", http.StatusBadRequest)
+		return
+	}
+	if app.rejectSystemWrite(w, req.Prefix) {
+		return
+	}
+
+	var keys [][]byte
+	err := app.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(req.Prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if !app.isSystemKey(it.Item().Key()) {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := PrefixTTLResult{Prefix: req.Prefix}
+	txn := app.newTransaction()
+	defer func() { app.discard(txn) }()
+	var pending []string
+	flush := func() error {
+		if err := app.commit(txn, 0); err != nil {
+			return err
+		}
+		for _, key := range pending {
+			app.events.publish(Event{Type: EventSet, Key: key})
+		}
+		result.Updated += int64(len(pending))
+		pending = pending[:0]
+		txn = app.newTransaction()
+		return nil
+	}
+	for _, key := range keys {
+		_, err = app.rewriteTTL(txn, key, ttl)
+		if err == badger.ErrTxnTooBig {
+			if err = flush(); err == nil {
+				_, err = app.rewriteTTL(txn, key, ttl)
+			}
+		}
+		if err == badger.ErrKeyNotFound {
+			// Deleted since the keys were listed.
+			err = nil
+			continue
+		}
+		if err != nil {
+			break
+		}
+		pending = append(pending, string(key))
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		writeStoreError(w, fmt.Errorf("after updating %d keys: %w", result.Updated, err))
+		return
+	}
+	writeJSON(w, result)
+}
+
+// errNoExpiry rejects touching a key that does not expire.
+var errNoExpiry = errors.New("key has no expiry")
+
+// touchHandler implements sliding expiration: the key's expiry is pushed back
+// by extend= from its current expiry, or from now if that has passed. With
+// max_ttl= the key never expires later than that from now.
+func (app *App) touchHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := routeKey(w, r)
+	if !ok {
+		return
+	}
+	if app.rejectSystemWrite(w, key) {
+		return
+	}
+	commitTs, ok := app.timestampParam(w, r, "commit_ts")
+	if !ok {
+		return
+	}
+	extend, err := time.ParseDuration(r.URL.Query().Get("extend"))
+	if err != nil || extend <= 0 {
+		http.Error(w, "Parameter 'extend' must be a positive duration such as 30m", http.StatusBadRequest)
+		return
+	}
+	var maxTTL time.Duration
+	if m := r.URL.Query().Get("max_ttl"); m != "" {
+		if maxTTL, err = time.ParseDuration(m); err != nil || maxTTL <= 0 {
+			http.Error(w, "Parameter 'max_ttl' must be a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var expiresAt uint64
+	info, err := app.writeKey(key, commitTs, func(txn *badger.Txn) error {
+		var err error
+		expiresAt, err = app.rewriteExpiry(txn, []byte(key), func(current uint64) (uint64, error) {
+			if current == 0 {
+				return 0, errNoExpiry
+			}
+			now := time.Now()
+			next := time.Unix(int64(max(current, uint64(now.Unix()))), 0).Add(extend)
+			if maxTTL > 0 && next.After(now.Add(maxTTL)) {
+				next = now.Add(maxTTL)
+			}
+			return uint64(next.Unix()), nil
+		})
+		return err
+	})
+	switch {
+	case err == badger.ErrKeyNotFound:
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	case err == errNoExpiry:
+		http.Error(w, "Key has no expiry to extend, set one with PATCH /api/keys/{key}/ttl", http.StatusConflict)
+		return
+	case err != nil:
+		writeStoreError(w, err)
+		return
+	}
+	writeTxnHeaders(w, info)
+	app.events.publish(Event{Type: EventSet, Key: key})
+	writeJSON(w, KeyTTL{Key: key, ExpiresAt: expiryTime(expiresAt), Version: info.CommitTs})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Writes report the timestamps of their transaction in the X-Read-Ts and
+// X-Commit-Ts headers, which helps applications sharing the database to
+// diagnose conflicts. With conflict detection on (DETECT_CONFLICTS, the
+// default), a transaction fails with ErrConflict if a key it read was
+// committed by another transaction after its read timestamp.
+
+// txnInfo holds the timestamps of a write. ReadTs is 0 in managed mode,
+// where writes read the latest data.
+type txnInfo struct {
+	ReadTs   uint64
+	CommitTs uint64
+}
+
+// TxnStats reports the transaction settings and conflicts seen since start.
+type TxnStats struct {
+	DetectConflicts bool   `json:"detect_conflicts"`
+	Managed         bool   `json:"managed"`
+	MaxVersion      uint64 `json:"max_version"`
+	Conflicts       int64  `json:"conflicts"`
+}
+
+// latestVersion returns the newest version of key, deletions included, or 0
+// if none is retained. Outside managed mode Badger does not report commit
+// timestamps, so this is read back right after a write; a concurrent write
+// to the same key can be reported instead.
+func (app *App) latestVersion(key string) uint64 {
+	var version uint64
+	_ = app.view(func(txn *badger.Txn) error {
+		return eachVersion(txn, []byte(key), func(item *badger.Item) (bool, error) {
+			version = item.Version()
+			return false, nil
+		})
+	})
+	return version
+}
+
+// writeKey runs fn in a write transaction on key like updateAt and reports
+// its timestamps.
+func (app *App) writeKey(key string, commitTs uint64, fn func(txn *badger.Txn) error) (txnInfo, error) {
+	if app.managed && commitTs == 0 {
+		commitTs = app.clock.Add(1)
+	}
+	var info txnInfo
+	err := app.updateAt(commitTs, func(txn *badger.Txn) error {
+		if !app.managed {
+			info.ReadTs = txn.ReadTs()
+		}
+		return fn(txn)
+	})
+	if err != nil {
+		return info, err
+	}
+	info.CommitTs = commitTs
+	if !app.managed {
+		info.CommitTs = app.latestVersion(key)
+	}
+	return info, nil
+}
+
+func writeTxnHeaders(w http.ResponseWriter, info txnInfo) {
+	if info.ReadTs > 0 {
+		w.Header().Set("X-Read-Ts", strconv.FormatUint(info.ReadTs, 10))
+	}
+	if info.CommitTs > 0 {
+		w.Header().Set("X-Commit-Ts", strconv.FormatUint(info.CommitTs, 10))
+	}
+}
+
+func (app *App) txnStatsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, TxnStats{
+		DetectConflicts: app.db.Opts().DetectConflicts,
+		Managed:         app.managed,
+		MaxVersion:      app.db.MaxVersion(),
+		Conflicts:       app.conflicts.Load(),
+	})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Large backups and exports can be uploaded in chunks: create an upload
+// session, append chunks at the current offset, then commit. A chunk cut off
+// by a dropped connection keeps what arrived, and the client resumes from the
+// offset reported by the server.
+type uploadSession struct {
+	mu sync.Mutex // serializes appends and commit
+
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Offset    int64     `json:"offset"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	path      string
+}
+
+type uploadStore struct {
+	dir string
+	ttl time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+func loadUploadStore() (*uploadStore, error) {
+	ttl, err := time.ParseDuration(getEnv("UPLOAD_TTL", "24h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid UPLOAD_TTL: %w", err)
+	}
+	dir := getEnv("UPLOAD_DIR", filepath.Join(os.TempDir(), "bwui-uploads"))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &uploadStore{dir: dir, ttl: ttl, sessions: make(map[string]*uploadSession)}
+	go s.cleanup()
+	return s, nil
+}
+
+func (s *uploadStore) create(kind string) (*uploadSession, error) {
+	now := time.Now().UTC()
+	u := &uploadSession{ID: randomToken(), Kind: kind, CreatedAt: now, UpdatedAt: now}
+	u.path = filepath.Join(s.dir, u.ID+".part")
+	file, err := os.OpenFile(u.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	s.mu.Lock()
+	s.sessions[u.ID] = u
+	s.mu.Unlock()
+	return u, nil
+}
+
+func (s *uploadStore) get(id string) *uploadSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[id]
+}
+
+func (s *uploadStore) remove(u *uploadSession) {
+	s.mu.Lock()
+	delete(s.sessions, u.ID)
+	s.mu.Unlock()
+	os.Remove(u.path)
+}
+
+// cleanup drops sessions that saw no chunk within the TTL.
+func (s *uploadStore) cleanup() {
+	for range time.Tick(time.Minute) {
+		s.mu.Lock()
+		var stale []*uploadSession
+		for _, u := range s.sessions {
+			if u.mu.TryLock() {
+				if time.Since(u.UpdatedAt) > s.ttl {
+					stale = append(stale, u)
+				}
+				u.mu.Unlock()
+			}
+		}
+		s.mu.Unlock()
+		for _, u := range stale {
+			s.remove(u)
+		}
+	}
+}
+
+func (app *App) uploadSession(w http.ResponseWriter, r *http.Request) *uploadSession {
+	u := app.uploads.get(mux.Vars(r)["id"])
+	if u == nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+	}
+	return u
+}
+
+func (app *App) createUploadHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Kind string `json:"kind"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Kind != manifestBackup && req.Kind != manifestExport {
+		http.Error(w, "Kind must be 'backup' or 'export'", http.StatusBadRequest)
+		return
+	}
+	u, err := app.uploads.create(req.Kind)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(u)
+}
+
+func (app *App) uploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	u := app.uploadSession(w, r)
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	writeJSON(w, u)
+}
+
+// appendUploadHandler appends the body at the offset given in the
+// Upload-Offset header, which must match the bytes received so far.
+func (app *App) appendUploadHandler(w http.ResponseWriter, r *http.Request) {
+	u := app.uploadSession(w, r)
+	if u == nil {
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Header 'Upload-Offset' is required", http.StatusBadRequest)
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if offset != u.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		http.Error(w, fmt.Sprintf("Upload is at offset %d", u.Offset), http.StatusConflict)
+		return
+	}
+
+	file, err := os.OpenFile(u.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	n, copyErr := io.Copy(file, r.Body)
+	closeErr := file.Close()
+	u.Offset += n
+	u.UpdatedAt = time.Now().UTC()
+	if copyErr == nil {
+		copyErr = closeErr
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	if copyErr != nil {
+		http.Error(w, fmt.Sprintf("Chunk interrupted at offset %d: %v", u.Offset, copyErr), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, u)
+}
+
+// commitUploadHandler verifies the upload against its manifest, if given,
+// and restores or imports it. The session is removed once applied.
+func (app *App) commitUploadHandler(w http.ResponseWriter, r *http.Request) {
+	u := app.uploadSession(w, r)
+	if u == nil {
+		return
+	}
+	m, err := app.requestManifest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if app.uploads.get(u.ID) == nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	file, err := os.Open(u.path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The verified reader removes the file when closed; the session goes
+	// with it, whether or not applying succeeds.
+	defer app.uploads.remove(u)
+	in, err := app.verifiedFile(file, m, u.Kind)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer in.Close()
+
+	if u.Kind == manifestBackup {
+		if err := app.restore(in); err != nil {
+			http.Error(w, "Restore failed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	result, err := app.importRecords(in, includeSystem(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Import failed after %d records: %v", result.Imported, err), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, result)
+}
+
+func (app *App) deleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	u := app.uploadSession(w, r)
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	app.uploads.remove(u)
+	u.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users managed through the API are stored under the system prefix with a
+// bcrypt password hash. They complement the AUTH_USERS environment users.
+const usersNamespace = "users:"
+
+const minPasswordLength = 8
+
+var errUserExists = errors.New("user already exists")
+
+type User struct {
+	Name         string    `json:"name"`
+	Role         string    `json:"role"`
+	Disabled     bool      `json:"disabled"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// public returns a copy safe to send to clients.
+func (u User) public() User {
+	u.PasswordHash = ""
+	return u
+}
+
+func (app *App) loadUser(txn *badger.Txn, name string) (*User, error) {
+	item, err := txn.Get(app.systemKey(usersNamespace + name))
+	if err != nil {
+		return nil, err
+	}
+	var u User
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &u)
+	})
+	return &u, err
+}
+
+func (app *App) storeUser(txn *badger.Txn, u *User) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return txn.Set(app.systemKey(usersNamespace+u.Name), data)
+}
+
+// checkStoredPassword validates credentials against the users stored in the
+// database; disabled users never authenticate.
+func (app *App) checkStoredPassword(name, password string) (*principal, bool) {
+	var u *User
+	err := app.view(func(txn *badger.Txn) error {
+		var err error
+		u, err = app.loadUser(txn, name)
+		return err
+	})
+	if err != nil || u.Disabled {
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return nil, false
+	}
+	return &principal{Name: u.Name, Role: u.Role}, true
+}
+
+// refreshStoredUsers records whether any stored user exists.
+func (app *App) refreshStoredUsers() error {
+	return app.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = app.systemKey(usersNamespace)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Rewind()
+		app.storedUsers.Store(it.Valid())
+		return nil
+	})
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func validateUserInput(w http.ResponseWriter, role, password string, passwordRequired bool) bool {
+	if role != "" {
+		if _, ok := roleLevels[role]; !ok {
+			http.Error(w, "Unknown role "+role, http.StatusBadRequest)
+			return false
+		}
+	}
+	if (passwordRequired || password != "") && len(password) < minPasswordLength {
+		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (app *App) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users := make([]User, 0)
+	err := app.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = app.systemKey(usersNamespace)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var u User
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &u)
+			})
+			if err != nil {
+				return err
+			}
+			users = append(users, u.public())
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	writeJSON(w, users)
+}
+
+func (app *App) createUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || strings.ContainsAny(req.Name, ":/") {
+		http.Error(w, "User name must be non-empty and must not contain ':' or '/'", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = RoleViewer
+	}
+	if !validateUserInput(w, req.Role, req.Password, true) {
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	u := &User{Name: req.Name, Role: req.Role, PasswordHash: hash, CreatedAt: now, UpdatedAt: now}
+
+	err = app.update(func(txn *badger.Txn) error {
+		if _, err := app.loadUser(txn, u.Name); err != badger.ErrKeyNotFound {
+			if err == nil {
+				return errUserExists
+			}
+			return err
+		}
+		return app.storeUser(txn, u)
+	})
+	if err == errUserExists {
+		http.Error(w, "User already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.storedUsers.Store(true)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(u.public())
+}
+
+func (app *App) getUserHandler(w http.ResponseWriter, r *http.Request) {
+	var u *User
+	err := app.view(func(txn *badger.Txn) error {
+		var err error
+		u, err = app.loadUser(txn, mux.Vars(r)["name"])
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, u.public())
+}
+
+// userChange holds the fields of a user to change; nil fields are kept.
+type userChange struct {
+	Role     *string `json:"role"`
+	Disabled *bool   `json:"disabled"`
+	Password *string `json:"password"`
+}
+
+// updateUserHandler changes the role, disabled flag and/or password of a user.
+func (app *App) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req userChange
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	app.changeUser(w, mux.Vars(r)["name"], req)
+}
+
+// resetPasswordHandler only sets the password; role and disabled changes go
+// through PUT.
+func (app *App) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Password == "" {
+		http.Error(w, "A non-empty 'password' is required", http.StatusBadRequest)
+		return
+	}
+	app.changeUser(w, mux.Vars(r)["name"], userChange{Password: &req.Password})
+}
+
+// changeUser validates and applies change to the user name and writes the
+// updated user.
+func (app *App) changeUser(w http.ResponseWriter, name string, change userChange) {
+	role, password := "", ""
+	if change.Role != nil {
+		role = *change.Role
+		if role == "" {
+			http.Error(w, "Role cannot be empty", http.StatusBadRequest)
+			return
+		}
+	}
+	if change.Password != nil {
+		password = *change.Password
+	}
+	if !validateUserInput(w, role, password, change.Password != nil) {
+		return
+	}
+
+	hash := ""
+	if change.Password != nil {
+		var err error
+		if hash, err = hashPassword(password); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var u *User
+	err := app.update(func(txn *badger.Txn) error {
+		var err error
+		if u, err = app.loadUser(txn, name); err != nil {
+			return err
+		}
+		if change.Role != nil {
+			u.Role = role
+		}
+		if change.Disabled != nil {
+			u.Disabled = *change.Disabled
+		}
+		if hash != "" {
+			u.PasswordHash = hash
+		}
+		u.UpdatedAt = time.Now()
+		return app.storeUser(txn, u)
+	})
+	if err == badger.ErrKeyNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Existing sessions must not outlive a disable or password reset, and
+	// must pick up role changes immediately.
+	if u.Disabled || hash != "" {
+		app.sessions.destroyUser(u.Name)
+	} else if change.Role != nil {
+		app.sessions.updateRole(u.Name, u.Role)
+	}
+	writeJSON(w, u.public())
+}
+
+func (app *App) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	err := app.update(func(txn *badger.Txn) error {
+		if _, err := app.loadUser(txn, name); err != nil {
+			return err
+		}
+		return txn.Delete(app.systemKey(usersNamespace + name))
+	})
+	if err == badger.ErrKeyNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.sessions.destroyUser(name)
+	if err := app.refreshStoredUsers(); err != nil {
+		errorf("Failed to refresh stored users: %v", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
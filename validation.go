@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Every API write of a user key goes through the same rules, whether it
+// comes from the key endpoints, a file upload or an import. Violations are
+// reported together as a JSON body:
+//
+//	{"error": "Validation failed", "key": "...", "violations": [{"field": "key", "code": "key_forbidden_prefix", "message": "..."}]}
+//
+// Restores of native backups, copies between databases and values cached in
+// proxy mode are written as they are.
+
+// Validation codes.
+const (
+	CodeKeyEmpty           = "key_empty"
+	CodeKeyTooLarge        = "key_too_large"
+	CodeKeyForbiddenPrefix = "key_forbidden_prefix"
+	CodeKeyControlChars    = "key_control_characters"
+	CodeKeyInvalidUTF8     = "key_invalid_utf8"
+	CodeValueEmpty         = "value_empty"
+	CodeValueTooLarge      = "value_too_large"
+	CodeValueInvalidUTF8   = "value_invalid_utf8"
+)
+
+// badgerMaxKeySize is the largest key Badger accepts.
+const badgerMaxKeySize = 65000
+
+type writeRules struct {
+	maxKeySize        int
+	forbiddenPrefixes []string
+	rejectControl     bool
+	keyUTF8           bool
+	valueUTF8         bool
+	allowEmptyValues  bool
+	// maxValueSize is MAX_VALUE_SIZE, see raw.go.
+	maxValueSize int64
+}
+
+func loadWriteRules(maxValueSize int64) (writeRules, error) {
+	rules := writeRules{
+		forbiddenPrefixes: parseList(getEnv("KEY_FORBIDDEN_PREFIXES", "")),
+		keyUTF8:           getEnv("KEY_REQUIRE_UTF8", "false") == "true",
+		valueUTF8:         getEnv("VALUE_REQUIRE_UTF8", "false") == "true",
+		allowEmptyValues:  getEnv("ALLOW_EMPTY_VALUES", "true") == "true",
+		maxValueSize:      maxValueSize,
+	}
+	size, err := strconv.Atoi(getEnv("MAX_KEY_SIZE", strconv.Itoa(badgerMaxKeySize)))
+	if err != nil || size < 1 || size > badgerMaxKeySize {
+		return rules, fmt.Errorf("MAX_KEY_SIZE must be between 1 and %d bytes", badgerMaxKeySize)
+	}
+	rules.maxKeySize = size
+	switch policy := getEnv("KEY_CONTROL_CHARS", "allow"); policy {
+	case "allow":
+	case "reject":
+		rules.rejectControl = true
+	default:
+		return rules, errors.New("KEY_CONTROL_CHARS must be allow or reject")
+	}
+	return rules, nil
+}
+
+type Violation struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ValidationError struct {
+	Key        string      `json:"key"`
+	Violations []Violation `json:"violations"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// hasControlChars reports bytes below 0x20 and DEL.
+func hasControlChars(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks a write of value to key, nil if it is allowed.
+func (rules writeRules) validate(key string, value []byte) *ValidationError {
+	e := &ValidationError{Key: key}
+	add := func(field, code, message string) {
+		e.Violations = append(e.Violations, Violation{Field: field, Code: code, Message: message})
+	}
+
+	switch {
+	case key == "":
+		add("key", CodeKeyEmpty, "Key cannot be empty")
+	case len(key) > rules.maxKeySize:
+		add("key", CodeKeyTooLarge, fmt.Sprintf("Key exceeds the maximum size of %d bytes", rules.maxKeySize))
+	}
+	for _, prefix := range rules.forbiddenPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			add("key", CodeKeyForbiddenPrefix, "Keys under "+prefix+" cannot be written")
+			break
+		}
+	}
+	if rules.rejectControl && hasControlChars(key) {
+		add("key", CodeKeyControlChars, "Key contains control characters")
+	}
+	if rules.keyUTF8 && !utf8.ValidString(key) {
+		add("key", CodeKeyInvalidUTF8, "Key is not valid UTF-8")
+	}
+
+	switch {
+	case len(value) == 0 && !rules.allowEmptyValues:
+		add("value", CodeValueEmpty, "Value cannot be empty")
+	case int64(len(value)) > rules.maxValueSize:
+		add("value", CodeValueTooLarge, fmt.Sprintf("Value exceeds the maximum size of %d bytes", rules.maxValueSize))
+	}
+	if rules.valueUTF8 && !utf8.Valid(value) {
+		add("value", CodeValueInvalidUTF8, "Value is not valid UTF-8")
+	}
+
+	if len(e.Violations) == 0 {
+		return nil
+	}
+	return e
+}
+
+// rejectInvalidWrite answers with the violations if writing value to key
+// breaks the write rules: 413 when the value is only too large, 400
+// otherwise.
+func (app *App) rejectInvalidWrite(w http.ResponseWriter, key string, value []byte) bool {
+	e := app.writeRules.validate(key, value)
+	if e == nil {
+		return false
+	}
+	writeValidationError(w, e)
+	return true
+}
+
+func writeValidationError(w http.ResponseWriter, e *ValidationError) {
+	status := http.StatusBadRequest
+	if len(e.Violations) == 1 && e.Violations[0].Code == CodeValueTooLarge {
+		status = http.StatusRequestEntityTooLarge
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		*ValidationError
+	}{"Validation failed", e})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sort"
+)
+
+// The version is set at build time, as the Makefile and Dockerfile do:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=2024-05-01T12:00:00Z"
+//
+// Without -ldflags the commit and its date are taken from the version control
+// information Go embeds when building from a checkout, if any.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	// Badger is the version of the Badger library the server is built with.
+	Badger string `json:"badger"`
+	// StoreBackends are the backends compiled in for STORES.
+	StoreBackends []string `json:"store_backends"`
+	// Features are those DISABLED_FEATURES can switch off, false when it
+	// does.
+	Features map[string]bool `json:"features"`
+}
+
+func (app *App) versionInfo() VersionInfo {
+	build := buildInfo()
+	info := VersionInfo{
+		Version:       version,
+		Commit:        commit,
+		BuildDate:     buildDate,
+		GoVersion:     runtime.Version(),
+		Badger:        build.Dependencies["github.com/dgraph-io/badger/v4"],
+		StoreBackends: make([]string, 0, len(storeBackends)),
+		Features:      make(map[string]bool, len(allFeatures)),
+	}
+	if info.Commit == "" {
+		info.Commit = build.Revision
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = build.RevisionTime
+	}
+	for name := range storeBackends {
+		info.StoreBackends = append(info.StoreBackends, name)
+	}
+	sort.Strings(info.StoreBackends)
+	for _, f := range allFeatures {
+		info.Features[f] = !app.disabledFeatures[f]
+	}
+	return info
+}
+
+func (app *App) versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, app.versionInfo())
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Badger keeps older versions of a key until compaction discards them.
+// VERSIONS_TO_KEEP raises NumVersionsToKeep so those versions survive and can
+// be listed and compared. Compaction only discards versions at or below the
+// discard timestamp, which Badger tracks itself except in managed mode, where
+// operators set it through /api/admin/versions.
+
+const (
+	discardTsKey       = "versions:discard_ts"
+	jobDiscardVersions = "discard-versions"
+)
+
+var errVersionNotFound = errors.New("version not found")
+
+// ValueVersion describes one stored version of a key.
+type ValueVersion struct {
+	Version   uint64 `json:"version"`
+	Size      int64  `json:"size"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	Archived  bool   `json:"archived,omitempty"`
+	ExpiresAt uint64 `json:"expires_at,omitempty"`
+}
+
+func loadVersionsToKeep() (int, error) {
+	n, err := strconv.Atoi(getEnv("VERSIONS_TO_KEEP", "1"))
+	if err != nil || n < 1 {
+		return 0, errors.New("VERSIONS_TO_KEEP must be a positive integer")
+	}
+	return n, nil
+}
+
+// eachVersion calls fn for every retained version of key, newest first.
+func eachVersion(txn *badger.Txn, key []byte, fn func(item *badger.Item) (bool, error)) error {
+	opts := badger.DefaultIteratorOptions
+	opts.AllVersions = true
+	opts.PrefetchValues = false
+	opts.Prefix = key
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(key); it.Valid(); it.Next() {
+		item := it.Item()
+		if !bytes.Equal(item.Key(), key) {
+			break
+		}
+		more, err := fn(item)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyVersions lists the retained versions of key, newest first.
+func (app *App) keyVersions(key string) ([]ValueVersion, error) {
+	versions := make([]ValueVersion, 0)
+	err := app.view(func(txn *badger.Txn) error {
+		return eachVersion(txn, []byte(key), func(item *badger.Item) (bool, error) {
+			versions = append(versions, ValueVersion{
+				Version:   item.Version(),
+				Size:      item.ValueSize(),
+				Deleted:   item.IsDeletedOrExpired(),
+				Archived:  item.UserMeta()&archivedMeta != 0,
+				ExpiresAt: item.ExpiresAt(),
+			})
+			return true, nil
+		})
+	})
+	return versions, err
+}
+
+// valueAt returns key's value as of the given version, rehydrating it if it
+// was archived. Deleted versions are reported as not found.
+func (app *App) valueAt(key string, version uint64) ([]byte, error) {
+	var (
+		value    []byte
+		archived bool
+	)
+	err := app.view(func(txn *badger.Txn) error {
+		err := errVersionNotFound
+		iterErr := eachVersion(txn, []byte(key), func(item *badger.Item) (bool, error) {
+			if item.Version() != version {
+				return item.Version() > version, nil
+			}
+			if item.IsDeletedOrExpired() {
+				return false, nil
+			}
+			archived = item.UserMeta()&archivedMeta != 0
+			value, err = item.ValueCopy(nil)
+			return false, nil
+		})
+		if iterErr != nil {
+			return iterErr
+		}
+		return err
+	})
+	if err == nil && archived {
+		value, _, err = app.fetchArchived(value)
+	}
+	return value, err
+}
+
+func (app *App) keyVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := routeKey(w, r)
+	if !ok {
+		return
+	}
+
+	if app.isSystemKey([]byte(key)) && !includeSystem(r) {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	versions, err := app.keyVersions(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(versions) == 0 {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, versions)
+}
+
+// VersionSettings reports how much MVCC history is retained.
+type VersionSettings struct {
+	NumVersionsToKeep int    `json:"num_versions_to_keep"`
+	Managed           bool   `json:"managed"`
+	DiscardTs         uint64 `json:"discard_ts,omitempty"`
+	MaxVersion        uint64 `json:"max_version"`
+}
+
+// storedDiscardTs returns the discard timestamp last set in managed mode.
+func (app *App) storedDiscardTs() (uint64, error) {
+	var ts uint64
+	err := app.view(func(txn *badger.Txn) error {
+		item, err := txn.Get(app.systemKey(discardTsKey))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) != 8 {
+				return errors.New("invalid stored discard timestamp")
+			}
+			ts = binary.BigEndian.Uint64(val)
+			return nil
+		})
+	})
+	return ts, err
+}
+
+// restoreDiscardTs applies the stored discard timestamp after a restart;
+// Badger does not persist it.
+func (app *App) restoreDiscardTs() error {
+	if !app.managed {
+		return nil
+	}
+	ts, err := app.storedDiscardTs()
+	if err == nil && ts > 0 {
+		app.db.SetDiscardTs(ts)
+	}
+	return err
+}
+
+func (app *App) versionSettings() (VersionSettings, error) {
+	settings := VersionSettings{
+		NumVersionsToKeep: app.db.Opts().NumVersionsToKeep,
+		Managed:           app.managed,
+		MaxVersion:        app.db.MaxVersion(),
+	}
+	if app.managed {
+		var err error
+		settings.DiscardTs, err = app.storedDiscardTs()
+		return settings, err
+	}
+	return settings, nil
+}
+
+func (app *App) versionSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	settings, err := app.versionSettings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, settings)
+}
+
+// updateVersionSettingsHandler sets the discard timestamp in managed mode.
+// The number of versions kept is fixed when the database is opened.
+func (app *App) updateVersionSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		NumVersionsToKeep *int    `json:"num_versions_to_keep"`
+		DiscardTs         *uint64 `json:"discard_ts"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.NumVersionsToKeep != nil && *req.NumVersionsToKeep != app.db.Opts().NumVersionsToKeep {
+		http.Error(w, "num_versions_to_keep is fixed when the database is opened, set VERSIONS_TO_KEEP and restart", http.StatusBadRequest)
+		return
+	}
+	if req.DiscardTs != nil {
+		if !app.managed {
+			http.Error(w, "discard_ts can only be set with MANAGED_TXNS=true", http.StatusBadRequest)
+			return
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, *req.DiscardTs)
+		err := app.update(func(txn *badger.Txn) error {
+			return txn.Set(app.systemKey(discardTsKey), value)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		app.db.SetDiscardTs(*req.DiscardTs)
+	}
+	app.versionSettingsHandler(w, r)
+}
+
+type DiscardResult struct {
+	LSMSizeBefore  int64 `json:"lsm_size_before"`
+	LSMSizeAfter   int64 `json:"lsm_size_after"`
+	VlogSizeBefore int64 `json:"vlog_size_before"`
+	VlogSizeAfter  int64 `json:"vlog_size_after"`
+	VlogRewrites   int   `json:"vlog_rewrites"`
+}
+
+// discardVersionsHandler starts a job that compacts the LSM tree into one
+// level, dropping versions that are no longer retained, and then rewrites
+// value log files whose space was freed.
+func (app *App) discardVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := app.startJob(r, jobDiscardVersions, nil, func(job *runningJob) (interface{}, error) {
+		lsmBefore, vlogBefore, err := app.filesSizes()
+		if err != nil {
+			return nil, err
+		}
+		if err := app.db.Flatten(1); err != nil {
+			return nil, err
+		}
+		rewrites := 0
+		for {
+			if err := job.checkCanceled(); err != nil {
+				return nil, err
+			}
+			err := app.db.RunValueLogGC(0.5)
+			if err == badger.ErrNoRewrite || err == badger.ErrRejected {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			rewrites++
+			job.advance(1)
+		}
+		lsmAfter, vlogAfter, err := app.filesSizes()
+		if err != nil {
+			return nil, err
+		}
+		return DiscardResult{
+			LSMSizeBefore:  lsmBefore,
+			LSMSizeAfter:   lsmAfter,
+			VlogSizeBefore: vlogBefore,
+			VlogSizeAfter:  vlogAfter,
+			VlogRewrites:   rewrites,
+		}, nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJobCreated(w, job)
+}
+
+// filesSizes measures the disk usage of the LSM tables and value log files.
+// db.Size() is only refreshed once a minute, so it would still report the
+// sizes from before the discard.
+func (app *App) filesSizes() (lsm, vlog int64, err error) {
+	opts := app.db.Opts()
+	if lsm, err = extSize(opts.Dir, ".sst"); err != nil {
+		return 0, 0, err
+	}
+	if vlog, err = extSize(opts.ValueDir, ".vlog"); err != nil {
+		return 0, 0, err
+	}
+	return lsm, vlog, nil
+}
+
+// extSize returns the disk usage of the files in dir with extension ext.
+func extSize(dir, ext string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ext {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += diskUsage(info)
+	}
+	return size, nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/gorilla/mux"
+)
+
+// Views are named, read-only slices of the keyspace: the keys under a prefix
+// that match a filter expression (see expr.go), optionally projected to a few
+// fields of their JSON values. Admins define them under /api/admin/views and
+// everybody who can read browses them at /api/views/{name}. Nothing is
+// materialized; each request evaluates the view over the current data.
+const viewsNamespace = "views:"
+
+type View struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Prefix      string    `json:"prefix"`
+	Filter      string    `json:"filter,omitempty"`
+	Fields      []string  `json:"fields,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// compiledView is a View ready to be evaluated.
+type compiledView struct {
+	*View
+	filter *filterExpr
+	paths  [][]interface{}
+}
+
+func (v *View) compile() (*compiledView, error) {
+	cv := &compiledView{View: v}
+	if v.Filter != "" {
+		filter, err := parseFilter(v.Filter)
+		if err != nil {
+			return nil, errors.New("filter: " + err.Error())
+		}
+		cv.filter = filter
+	}
+	for _, field := range v.Fields {
+		path, err := parseJSONPath(field)
+		if err != nil {
+			return nil, errors.New("fields: " + err.Error())
+		}
+		cv.paths = append(cv.paths, path)
+	}
+	return cv, nil
+}
+
+func (app *App) loadView(txn *badger.Txn, name string) (*View, error) {
+	item, err := txn.Get(app.systemKey(viewsNamespace + name))
+	if err != nil {
+		return nil, err
+	}
+	var v View
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &v)
+	})
+	return &v, err
+}
+
+func (app *App) listViewsHandler(w http.ResponseWriter, r *http.Request) {
+	views := make([]View, 0)
+	err := app.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = app.systemKey(viewsNamespace)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var v View
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &v)
+			})
+			if err != nil {
+				return err
+			}
+			views = append(views, v)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+	writeJSON(w, views)
+}
+
+// putViewHandler creates or replaces a view.
+func (app *App) putViewHandler(w http.ResponseWriter, r *http.Request) {
+	var v View
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	v.Name = mux.Vars(r)["name"]
+	if strings.ContainsAny(v.Name, ":/") {
+		http.Error(w, "View name must not contain ':' or '/'", http.StatusBadRequest)
+		return
+	}
+	if app.isSystemKey([]byte(v.Prefix)) {
+		http.Error(w, "Views cannot cover the system prefix "+app.systemPrefix, http.StatusBadRequest)
+		return
+	}
+	if _, err := v.compile(); err != nil {
+		http.Error(w, "Invalid view: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	created := false
+	err := app.update(func(txn *badger.Txn) error {
+		v.UpdatedAt = time.Now()
+		v.CreatedAt = v.UpdatedAt
+		old, err := app.loadView(txn, v.Name)
+		switch {
+		case err == badger.ErrKeyNotFound:
+			created = true
+		case err != nil:
+			return err
+		default:
+			v.CreatedAt = old.CreatedAt
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return txn.Set(app.systemKey(viewsNamespace+v.Name), data)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (app *App) deleteViewHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	err := app.update(func(txn *badger.Txn) error {
+		if _, err := app.loadView(txn, name); err != nil {
+			return err
+		}
+		return txn.Delete(app.systemKey(viewsNamespace + name))
+	})
+	if err == badger.ErrKeyNotFound {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ViewItem struct {
+	Key      string      `json:"key"`
+	Value    interface{} `json:"value"`
+	Version  uint64      `json:"version"`
+	Redacted bool        `json:"redacted,omitempty"`
+}
+
+type ViewPage struct {
+	View  string     `json:"view"`
+	Items []ViewItem `json:"items"`
+	// Next is the after= of the next page, empty on the last one.
+	Next string `json:"next,omitempty"`
+}
+
+// viewItemsHandler evaluates a view, returning up to limit= items (100 by
+// default, at most 1000) after the key given in after=.
+func (app *App) viewItemsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed < 1 || parsed > 1000 {
+			http.Error(w, "Parameter 'limit' must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	after := r.URL.Query().Get("after")
+
+	var cv *compiledView
+	page := ViewPage{View: mux.Vars(r)["name"], Items: make([]ViewItem, 0)}
+	err := app.view(func(txn *badger.Txn) error {
+		v, err := app.loadView(txn, page.View)
+		if err != nil {
+			return err
+		}
+		if cv, err = v.compile(); err != nil {
+			return err
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(v.Prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		start := opts.Prefix
+		if after > v.Prefix {
+			start = []byte(after)
+		}
+		for it.Seek(start); it.Valid(); it.Next() {
+			item := it.Item()
+			key := string(item.Key())
+			if key == after || app.isSystemKey(item.Key()) || item.UserMeta()&archivedMeta != 0 {
+				continue
+			}
+			if len(page.Items) == limit {
+				page.Next = page.Items[limit-1].Key
+				break
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if value, err = app.scriptRead(key, value); err != nil {
+				return err
+			}
+			if cv.filter != nil && !cv.filter.match(key, value) {
+				continue
+			}
+			page.Items = append(page.Items, app.viewItem(r, cv, key, value, item.Version()))
+		}
+		return nil
+	})
+	if err == badger.ErrKeyNotFound {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, page)
+}
+
+// viewItem projects value to the view's fields, an object keyed by field,
+// or returns it as text without fields.
+func (app *App) viewItem(r *http.Request, cv *compiledView, key string, value []byte, version uint64) ViewItem {
+	item := ViewItem{Key: key, Version: version}
+	if app.shouldRedact(r, key) {
+		item.Value, item.Redacted = redactedValue, true
+		return item
+	}
+	if len(cv.paths) == 0 {
+		item.Value = string(value)
+		return item
+	}
+	var doc interface{}
+	if json.Unmarshal(value, &doc) != nil {
+		doc = nil
+	}
+	projected := make(map[string]interface{}, len(cv.paths))
+	for i, path := range cv.paths {
+		projected[cv.Fields[i]] = lookupJSONPath(doc, path)
+	}
+	item.Value = projected
+	return item
+}
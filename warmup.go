@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// After a restart Badger's block cache is empty and the OS has not paged in
+// the tables yet, so the first requests on a large database read everything
+// from disk. WARM_PREFIXES lists hot prefixes, or * for all keys, that are
+// scanned on start to load their blocks, and with WARM_VALUES their values
+// from the value log, before users ask for them. Progress is logged every warmupLogInterval.
+
+const (
+	warmupLogInterval = 5 * time.Second
+	// warmupBatch keys are read per transaction, so a long warm-up does not
+	// keep one read transaction open throughout.
+	warmupBatch = 10000
+)
+
+type warmup struct {
+	prefixes []string
+	values   bool
+	// wait holds the server back until the warm-up is done.
+	wait bool
+}
+
+func loadWarmup() *warmup {
+	prefixes := parseList(getEnv("WARM_PREFIXES", ""))
+	if len(prefixes) == 0 {
+		return nil
+	}
+	return &warmup{
+		prefixes: prefixes,
+		values:   getEnv("WARM_VALUES", "false") == "true",
+		wait:     getEnv("WARM_BEFORE_SERVING", "false") == "true",
+	}
+}
+
+// warm scans the prefixes in turn; failures are logged and end the warm-up.
+func (app *App) warm(cfg *warmup) {
+	start := time.Now()
+	lastLog := start
+	var keys, size int64
+	for _, prefix := range cfg.prefixes {
+		infof("Warming up %s", prefix)
+		scanPrefix := []byte(prefix)
+		if prefix == "*" {
+			scanPrefix = nil
+		}
+		seek, done := scanPrefix, false
+		for !done {
+			err := app.view(func(txn *badger.Txn) error {
+				opts := badger.DefaultIteratorOptions
+				opts.PrefetchValues = cfg.values
+				opts.Prefix = scanPrefix
+				it := txn.NewIterator(opts)
+				defer it.Close()
+
+				n := 0
+				for it.Seek(seek); it.Valid(); it.Next() {
+					if n == warmupBatch {
+						seek = bytes.Clone(it.Item().Key())
+						return nil
+					}
+					item := it.Item()
+					if cfg.values && item.UserMeta()&archivedMeta == 0 {
+						if err := item.Value(func([]byte) error { return nil }); err != nil {
+							return err
+						}
+					}
+					n++
+					keys++
+					size += int64(len(item.Key())) + item.ValueSize()
+					if time.Since(lastLog) >= warmupLogInterval {
+						lastLog = time.Now()
+						infof("Warming up %s: %d keys, %d bytes so far", prefix, keys, size)
+					}
+				}
+				done = true
+				return nil
+			})
+			if err != nil {
+				errorf("Warm-up failed: %v", err)
+				return
+			}
+		}
+	}
+	infof("Warm-up of %s done in %s: %d keys, %d bytes", strings.Join(cfg.prefixes, ", "), time.Since(start).Round(time.Millisecond), keys, size)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// With WRITE_BATCHING=true, small writes of single values are handed to a
+// pool of workers instead of each committing its own transaction. A worker
+// takes the first queued write, collects the ones arriving within
+// WRITE_BATCH_INTERVAL and commits them together in a Badger WriteBatch,
+// which costs one sync instead of one per write: each write waits a few
+// milliseconds more, but the server sustains many more writes per second.
+// Once the queue is full, writers wait for room, so a write burst slows its
+// clients down rather than piling up in memory.
+//
+// Only blind sets are batched: creates with if_absent, file uploads, writes
+// with an explicit commit_ts and values above maxBatchedValueSize commit in
+// their own transaction as before. Batched writes skip conflict detection,
+// which they do not need since they read nothing.
+
+const maxBatchedValueSize = 64 << 10
+
+type writeResult struct {
+	// commitTs is the commit timestamp of the batch in managed mode, 0
+	// otherwise.
+	commitTs uint64
+	err      error
+}
+
+type writeRequest struct {
+	entries []*badger.Entry
+	done    chan writeResult
+}
+
+type writePool struct {
+	requests  chan *writeRequest
+	workers   int
+	interval  time.Duration
+	batchSize int
+}
+
+func loadWritePool() (*writePool, error) {
+	if getEnv("WRITE_BATCHING", "false") != "true" {
+		return nil, nil
+	}
+	workers, err := strconv.Atoi(getEnv("WRITE_WORKERS", "4"))
+	if err != nil || workers < 1 {
+		return nil, errors.New("WRITE_WORKERS must be a positive number")
+	}
+	queueSize, err := strconv.Atoi(getEnv("WRITE_QUEUE_SIZE", "1000"))
+	if err != nil || queueSize < 0 {
+		return nil, errors.New("WRITE_QUEUE_SIZE must be a number")
+	}
+	interval, err := time.ParseDuration(getEnv("WRITE_BATCH_INTERVAL", "2ms"))
+	if err != nil || interval < 0 {
+		return nil, errors.New("invalid WRITE_BATCH_INTERVAL")
+	}
+	batchSize, err := strconv.Atoi(getEnv("WRITE_BATCH_SIZE", "1000"))
+	if err != nil || batchSize < 1 {
+		return nil, errors.New("WRITE_BATCH_SIZE must be a positive number")
+	}
+	return &writePool{
+		requests:  make(chan *writeRequest, queueSize),
+		workers:   workers,
+		interval:  interval,
+		batchSize: batchSize,
+	}, nil
+}
+
+// batchable reports whether a write of value can go through the pool.
+func (p *writePool) batchable(value []byte, meta *FileMeta, commitTs uint64, ifAbsent bool) bool {
+	return p != nil && meta == nil && commitTs == 0 && !ifAbsent && len(value) <= maxBatchedValueSize
+}
+
+// batchWrite queues the entries of a write of key and waits for the batch
+// holding them to be committed.
+func (app *App) batchWrite(key string, entries []*badger.Entry) (txnInfo, error) {
+	req := &writeRequest{entries: entries, done: make(chan writeResult, 1)}
+	app.writes.requests <- req
+	result := <-req.done
+	if result.err != nil {
+		return txnInfo{}, result.err
+	}
+	info := txnInfo{CommitTs: result.commitTs}
+	if !app.managed {
+		info.CommitTs = app.latestVersion(key)
+	}
+	return info, nil
+}
+
+func (app *App) runWriteWorkers() {
+	for i := 0; i < app.writes.workers; i++ {
+		go app.runWriteWorker()
+	}
+}
+
+func (app *App) runWriteWorker() {
+	p := app.writes
+	for first := range p.requests {
+		batch := []*writeRequest{first}
+		size := len(first.entries)
+		timer := time.NewTimer(p.interval)
+	collect:
+		for size < p.batchSize {
+			select {
+			case req := <-p.requests:
+				batch = append(batch, req)
+				size += len(req.entries)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		results := app.commitBatch(batch)
+		for i, req := range batch {
+			req.done <- results[i]
+		}
+	}
+}
+
+// commitBatch commits batch in one write batch. If that fails, the requests
+// are committed one by one, so that each gets its own result and a bad
+// write does not fail the ones batched with it.
+func (app *App) commitBatch(batch []*writeRequest) []writeResult {
+	results := make([]writeResult, len(batch))
+	commitTs, err := app.writeBatch(batch)
+	if err == nil || len(batch) == 1 {
+		for i := range results {
+			results[i] = writeResult{commitTs: commitTs, err: err}
+		}
+		return results
+	}
+	for i := range batch {
+		commitTs, err := app.writeBatch(batch[i : i+1])
+		results[i] = writeResult{commitTs: commitTs, err: err}
+	}
+	return results
+}
+
+// writeBatch writes the entries of batch, with their expiry tracking and the
+// removal of stale file metadata as setEntry does, in one write batch.
+func (app *App) writeBatch(batch []*writeRequest) (uint64, error) {
+	wb, commitTs := app.newWriteBatch()
+	defer wb.Cancel()
+	for _, req := range batch {
+		for _, e := range req.entries {
+			if err := wb.SetEntry(e); err != nil {
+				return 0, fmt.Errorf("%s: %w", e.Key, err)
+			}
+			trackKey := app.systemKey(expiryNamespace + string(e.Key))
+			var err error
+			if e.ExpiresAt == 0 {
+				err = wb.Delete(trackKey)
+			} else {
+				err = wb.SetEntry(badger.NewEntry(trackKey, expiryIndexValue(e.ExpiresAt)))
+			}
+			if err != nil {
+				return 0, err
+			}
+			// Batched writes are never files, so file metadata left by an
+			// earlier upload is stale. A write batch cannot read, so it is
+			// deleted whether it exists or not.
+			if err := wb.Delete(app.systemKey(fileMetaNamespace + string(e.Key))); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return 0, err
+	}
+	return commitTs, nil
+}